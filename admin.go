@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// adminHandler routes everything under /admin/, all of which requires
+// authentication.
+func adminHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAuth(w, r) {
+		return
+	}
+
+	params := strings.Split(strings.TrimPrefix(r.URL.Path, "/admin/"), "/")
+	switch {
+	case params[0] == "jobs":
+		jobsHandler(w, r, params[1:])
+	case params[0] == "rejections" && len(params) == 1:
+		rejectionsHandler(w, r)
+	case params[0] == "shard-plan" && len(params) == 1:
+		shardPlanHandler(w, r)
+	case params[0] == "catalog":
+		catalogHandler(w, r, params[1:])
+	case params[0] == "fanout":
+		fanoutHandler(w, r, params[1:])
+	case params[0] == "faults" && len(params) == 1:
+		faultsHandler(w, r)
+	case params[0] == "shards" && len(params) == 3 && params[2] == "drain":
+		drainHandler(w, r, strings.ToLower(params[1]))
+	default:
+		http.Error(w, "No request handler for that", http.StatusNotFound)
+	}
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"time"
+)
+
+const archiveDigestHeader = "X-Archive-SHA256"
+
+// archiveEntry is a file as it appears in an archive, with the name it is
+// stored under and where to read it from, as it was when it was listed.
+type archiveEntry struct {
+	name string
+	src  string
+	size int64
+	stat os.FileInfo
+}
+
+// archiveEntries lists a holding's album art, front first, and then its music
+// in play order, so that the same holding always produces the same archive.
+// Sidecar files such as the lock and holding.json are left out.
+func archiveEntries(uuid string, dir string) ([]archiveEntry, error) {
+	entries := []archiveEntry{}
+	if stat, err := os.Stat(path.Join(dir, "albumart")); err == nil {
+		entries = append(entries, archiveEntry{path.Join(uuid, "albumart"), path.Join(dir, "albumart"), stat.Size(), stat})
+	}
+	for _, slot := range artworkSlots(dir) {
+		p := path.Join(dir, artworkDirName, slot)
+		if stat, err := os.Stat(p); err == nil {
+			entries = append(entries, archiveEntry{path.Join(uuid, artworkDirName, slot), p, stat.Size(), stat})
+		}
+	}
+	musicDir := path.Join(dir, "music")
+	files := []string{}
+	if err := walkFiles(musicDir, func(rel string) error {
+		files = append(files, rel)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	for _, rel := range playOrder(files) {
+		stat, err := os.Stat(path.Join(musicDir, rel))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, archiveEntry{path.Join(uuid, "music", rel), path.Join(musicDir, rel), stat.Size(), stat})
+	}
+	return entries, nil
+}
+
+// archiveModTime is the timestamp given to every entry: the lock time for
+// locked holdings and the Unix epoch otherwise, never the files' own mtimes.
+func archiveModTime(dir string) time.Time {
+	lockedAt := holdingLockedAt(dir)
+	if lockedAt.IsZero() {
+		return time.Unix(0, 0).UTC()
+	}
+	return lockedAt.Truncate(time.Second).UTC()
+}
+
+// An entry without a source is written as zeros, for measuring archives.
+func copyEntry(w io.Writer, entry archiveEntry) error {
+	if entry.src == "" {
+		_, err := io.CopyN(w, zeros{}, entry.size)
+		return err
+	}
+	f, err := os.Open(entry.src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// Unlocked holdings aren't held still while they're archived, so a file
+	// replaced since the entries were listed fails the archive rather than
+	// ending up in it mixed with the holding as it was.
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(fi, entry.stat) || fi.Size() != entry.size || !fi.ModTime().Equal(entry.stat.ModTime()) {
+		return &archiveChangedError{entry.name}
+	}
+	_, err = io.CopyN(w, f, entry.size)
+	return err
+}
+
+type archiveChangedError struct {
+	name string
+}
+
+func (e *archiveChangedError) Error() string {
+	return e.name + " changed while it was being archived"
+}
+
+func writeTar(w io.Writer, entries []archiveEntry, modTime time.Time) error {
+	tw := tar.NewWriter(w)
+	for _, entry := range entries {
+		hdr := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     entry.name,
+			Size:     entry.size,
+			Mode:     0644,
+			ModTime:  modTime,
+			Format:   tar.FormatPAX,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if err := copyEntry(tw, entry); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func writeZip(w io.Writer, entries []archiveEntry, modTime time.Time) error {
+	zw := zip.NewWriter(w)
+	for _, entry := range entries {
+		hdr := &zip.FileHeader{
+			Name:   entry.name,
+			Method: zip.Store,
+		}
+		// Only the MS-DOS time fields are set; a non-zero Modified would add
+		// an extended timestamp extra field.
+		hdr.ModifiedDate, hdr.ModifiedTime = msDosTime(modTime)
+		hdr.SetMode(0644)
+		fw, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if err := copyEntry(fw, entry); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func msDosTime(t time.Time) (uint16, uint16) {
+	if t.Year() < 1980 {
+		t = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	date := uint16((t.Year()-1980)<<9 | int(t.Month())<<5 | t.Day())
+	clock := uint16(t.Hour()<<11 | t.Minute()<<5 | t.Second()/2)
+	return date, clock
+}
+
+type zeros struct{}
+
+func (zeros) Read(b []byte) (int, error) {
+	clear(b)
+	return len(b), nil
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	c.n += int64(len(b))
+	return len(b), nil
+}
+
+// archiveSize works out how long an archive will be without reading any of
+// the files, as the sizes don't depend on what's in them.
+func archiveSize(write func(io.Writer, []archiveEntry, time.Time) error, entries []archiveEntry, modTime time.Time) (int64, error) {
+	empty := make([]archiveEntry, len(entries))
+	for i, entry := range entries {
+		empty[i] = archiveEntry{entry.name, "", entry.size, nil}
+	}
+	c := &countingWriter{}
+	err := write(c, empty, modTime)
+	return c.n, err
+}
+
+// skipWriter drops the first skip bytes written to it.
+type skipWriter struct {
+	w    io.Writer
+	skip int64
+}
+
+func (s *skipWriter) Write(b []byte) (int, error) {
+	if s.skip >= int64(len(b)) {
+		s.skip -= int64(len(b))
+		return len(b), nil
+	}
+	rest := b[s.skip:]
+	s.skip = 0
+	if _, err := s.w.Write(rest); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// archiveStream is an io.ReadSeeker over an archive that's generated as it's
+// read. Seeking is cheap; reading from anywhere but where the last read
+// stopped generates the archive again from the start, throwing away what
+// comes before the offset. That's only right for archives that come out the
+// same every time, those of locked holdings.
+type archiveStream struct {
+	generate func(io.Writer) error
+	size     int64
+	offset   int64
+	pos      int64
+	pr       *io.PipeReader
+}
+
+func (a *archiveStream) Read(b []byte) (int, error) {
+	if a.offset >= a.size {
+		return 0, io.EOF
+	}
+	if a.pr == nil || a.pos != a.offset {
+		a.Close()
+		pr, pw := io.Pipe()
+		skip := a.offset
+		go func() {
+			pw.CloseWithError(a.generate(&skipWriter{pw, skip}))
+		}()
+		a.pr, a.pos = pr, a.offset
+	}
+	n, err := a.pr.Read(b)
+	a.pos += int64(n)
+	a.offset += int64(n)
+	return n, err
+}
+
+func (a *archiveStream) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += a.offset
+	case io.SeekEnd:
+		offset += a.size
+	}
+	if offset < 0 {
+		return 0, &archiveSeekError{}
+	}
+	a.offset = offset
+	return offset, nil
+}
+
+// Close stops any generation in progress.
+func (a *archiveStream) Close() error {
+	if a.pr != nil {
+		a.pr.Close()
+		a.pr = nil
+	}
+	return nil
+}
+
+type archiveSeekError struct{}
+
+func (e *archiveSeekError) Error() string {
+	return "seek to before the start of the archive"
+}
+
+// archiveHandler streams a holding as a tar (the default) or, with
+// ?format=zip, a zip file. The output only depends on the holding's contents
+// and lock time, so repeated downloads are byte-identical. The digest is sent
+// as a trailer, and remembered for locked holdings so later downloads can
+// send it up front. Archives of locked holdings can be resumed with Range
+// requests; the others, which could change between attempts, can't.
+func archiveHandler(w http.ResponseWriter, r *http.Request, uuid string) {
+	if err := uuidSanityCheck(uuid); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "tar"
+	}
+	var write func(io.Writer, []archiveEntry, time.Time) error
+	var contentType string
+	switch format {
+	case "tar":
+		write, contentType = writeTar, "application/x-tar"
+	case "zip":
+		write, contentType = writeZip, "application/zip"
+	default:
+		http.Error(w, "format must be tar or zip", http.StatusBadRequest)
+		return
+	}
+
+	if knownMissing(uuid) {
+		http.Error(w, "holding not found on disk", http.StatusNotFound)
+		return
+	}
+	dir := holdingDir(uuid)
+	if !dirExists(dir) {
+		rememberMissing(uuid)
+		http.Error(w, "holding not found on disk", http.StatusNotFound)
+		return
+	}
+
+	if archivedAway(w, uuid, dir) {
+		return
+	}
+
+	// A read reference keeps the holding from being removed while it's sent.
+	// Like other readers the download doesn't hold the mutex, which anyone
+	// can reach and keep for as long as they care to read. An unlocked
+	// holding only has it while its entries are listed; a locked one's music
+	// can't change at all. Either way a file replaced after it was listed,
+	// such as the album art of a locked holding, fails the archive.
+	done := readHolding(uuid)
+	defer done()
+
+	_, lockErr := os.Stat(path.Join(dir, lockFileName))
+	locked := lockErr == nil
+	var entries []archiveEntry
+	var err error
+	if locked {
+		entries, err = archiveEntries(uuid, dir)
+	} else {
+		unlock := lockHolding(uuid)
+		entries, err = archiveEntries(uuid, dir)
+		unlock()
+	}
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	modTime := archiveModTime(dir)
+	version := archiveVersion(format, entries, modTime)
+
+	info, _ := readHoldingInfo(dir)
+	known := ""
+	if locked {
+		known = info.ArchiveSHA256[format]
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+uuid+"."+format+"\"")
+	if !locked {
+		w.Header().Set("Accept-Ranges", "none")
+	} else {
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Last-Modified", archiveLastModified(entries, modTime).Format(http.TimeFormat))
+		w.Header().Set("ETag", "\""+version+"\"")
+	}
+	if locked && r.Header.Get("Range") != "" {
+		serveArchiveRange(w, r, uuid, write, entries, modTime, known)
+		return
+	}
+	if known != "" {
+		w.Header().Set(archiveDigestHeader, known)
+	} else {
+		w.Header().Set("Trailer", archiveDigestHeader)
+	}
+	if r.Method == "HEAD" {
+		return
+	}
+
+	h := sha256.New()
+	if err := write(io.MultiWriter(w, h), entries, modTime); err != nil {
+		// Too late for an error status, the client sees a truncated archive
+		log.Printf("Archive of %s failed: %s\n", uuid, err.Error())
+		return
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if known != "" {
+		if sum != known {
+			log.Printf("Archive of locked holding %s no longer matches its recorded digest\n", uuid)
+		}
+		return
+	}
+	w.Header().Set(archiveDigestHeader, sum)
+
+	if locked {
+		release, err := beginWrite()
+		if err != nil {
+			// Frozen, just don't remember the digest this time
+			return
+		}
+		defer release()
+		unlock := lockHolding(uuid)
+		defer unlock()
+		// The art comes first, so it may have been replaced after it was
+		// sent; don't record a digest of what the holding no longer holds.
+		now, err := archiveEntries(uuid, dir)
+		if err != nil || archiveVersion(format, now, modTime) != version {
+			return
+		}
+		info, _ := readHoldingInfo(dir)
+		if info.CreatedAt.IsZero() {
+			info.CreatedAt = stamp(holdingCreatedAt(dir))
+		}
+		if info.ArchiveSHA256 == nil {
+			info.ArchiveSHA256 = map[string]string{}
+		}
+		info.ArchiveSHA256[format] = sum
+		if err := writeHoldingInfo(dir, info); err != nil {
+			log.Println(err.Error())
+		}
+	}
+}
+
+// serveArchiveRange answers a Range request for a locked holding's archive,
+// regenerating the archive up to the part asked for. http.ServeContent takes
+// care of If-Range, against the ETag or Last-Modified already set, and of
+// ranges that can't be satisfied.
+func serveArchiveRange(w http.ResponseWriter, r *http.Request, uuid string, write func(io.Writer, []archiveEntry, time.Time) error, entries []archiveEntry, modTime time.Time, known string) {
+	size, err := archiveSize(write, entries, modTime)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	if known != "" {
+		w.Header().Set(archiveDigestHeader, known)
+	}
+	stream := &archiveStream{
+		generate: func(w io.Writer) error {
+			return write(w, entries, modTime)
+		},
+		size: size,
+	}
+	defer stream.Close()
+	http.ServeContent(w, r, "", archiveLastModified(entries, modTime), stream)
+}
+
+// archiveVersion identifies the archive of entries in format: the name, size
+// and modification time of every entry, and the time given to them. A
+// locked holding's album art can still change, so downloads are validated
+// by this rather than by the lock time or a digest recorded before.
+func archiveVersion(format string, entries []archiveEntry, modTime time.Time) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %d\n", format, modTime.Unix())
+	for _, entry := range entries {
+		fmt.Fprintf(h, "%q %d %d\n", entry.name, entry.size, entry.stat.ModTime().UnixNano())
+	}
+	return hex.EncodeToString(h.Sum(nil))[:32]
+}
+
+// archiveLastModified is when the archive of entries last changed: the
+// holding's lock or the latest change to one of its files, such as album art
+// replaced since.
+func archiveLastModified(entries []archiveEntry, modTime time.Time) time.Time {
+	latest := modTime
+	for _, entry := range entries {
+		if t := entry.stat.ModTime(); t.After(latest) {
+			latest = t
+		}
+	}
+	return latest.UTC().Truncate(time.Second)
+}
+
+// Archive digests recorded before archives were in play order describe
+// archives moss no longer produces.
+func hasArchiveDigests(uuid string, dir string) (bool, error) {
+	info, err := readHoldingInfo(dir)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return len(info.ArchiveSHA256) > 0, err
+}
+
+// forgetArchiveDigests drops a holding's recorded archive digests, as when
+// its album art changes. The caller must hold the holding's mutex.
+func forgetArchiveDigests(uuid string, dir string) error {
+	info, err := readHoldingInfo(dir)
+	if os.IsNotExist(err) || err == nil && len(info.ArchiveSHA256) == 0 {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	info.ArchiveSHA256 = nil
+	return writeHoldingInfo(dir, info)
+}
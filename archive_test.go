@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/wuvt/moss/mosstest"
+)
+
+func archiveTestSpec(t testing.TB, locked bool) mosstest.Spec {
+	return mosstest.Spec{Holdings: []mosstest.Holding{{
+		UUID: "6f1e2d3c-4b5a-4978-8695-a4b3c2d1e0f9",
+		Tracks: []mosstest.Track{
+			{Name: "10 Ten.flac", Size: 3000},
+			{Name: "2 Two.flac", Size: 70000},
+			{Name: "1 One.flac", Size: 100},
+		},
+		AlbumArt: readTestdata(t, "front.png"),
+		Artwork:  map[string][]byte{"back": readTestdata(t, "back.png")},
+		Locked:   locked,
+	}}}
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// Archives only depend on a holding's contents, so the same holding built
+// twice, here or on any other platform, archives to the same bytes.
+func TestArchiveReproducible(t *testing.T) {
+	for format, want := range map[string]string{
+		"tar": "b96100d27fe84b5d8d0e2981ad5d531d928697e8887fae9fafc37bcdac89a2ad",
+		"zip": "426ca74bbda7530800b0b8998232842511ba624b78c22e3fb9813de654d7491c",
+	} {
+		for run := 0; run < 2; run++ {
+			s := newTestServer(t, archiveTestSpec(t, false))
+			resp := s.MustDo("GET", s.Path(0, "archive")+"?format="+format, nil)
+			if got := sha256Hex(resp.Body); got != want {
+				t.Errorf("%s archive of run %d is %s, want %s", format, run, got, want)
+			}
+			if got := resp.Trailer.Get(archiveDigestHeader); got != want {
+				t.Errorf("%s digest trailer is %q", format, got)
+			}
+		}
+	}
+}
+
+// An interrupted download of a locked holding's archive resumes into the
+// same bytes, and is refused a resume once the art has changed underneath.
+func TestArchiveResume(t *testing.T) {
+	s := newTestServer(t, archiveTestSpec(t, true))
+	archive := s.Path(0, "archive")
+
+	full := s.MustDo("GET", archive, nil)
+	digest := sha256Hex(full.Body)
+	etag := full.Header.Get("ETag")
+	if etag == "" || full.Header.Get("Accept-Ranges") != "bytes" {
+		t.Fatalf("locked archive sent ETag %q, Accept-Ranges %q", etag, full.Header.Get("Accept-Ranges"))
+	}
+	// Now recorded, it's sent up front
+	again := s.MustDo("GET", archive, nil)
+	if got := again.Header.Get(archiveDigestHeader); got != digest {
+		t.Fatalf("recorded digest is %q, want %s", got, digest)
+	}
+
+	cut := len(full.Body) / 3
+	head := s.Do("GET", archive, nil, "Range", "bytes=0-"+strconv.Itoa(cut-1))
+	if head.Status != http.StatusPartialContent || len(head.Body) != cut {
+		t.Fatalf("first part: %d, %d bytes", head.Status, len(head.Body))
+	}
+	tail := s.Do("GET", archive, nil, "Range", "bytes="+strconv.Itoa(cut)+"-", "If-Range", head.Header.Get("ETag"))
+	if tail.Status != http.StatusPartialContent {
+		t.Fatalf("resume: %d", tail.Status)
+	}
+	if got := sha256Hex(append(append([]byte{}, head.Body...), tail.Body...)); got != digest {
+		t.Errorf("resumed archive is %s, want %s", got, digest)
+	}
+	if got := tail.Header.Get(archiveDigestHeader); got != digest {
+		t.Errorf("resume sent digest %q", got)
+	}
+
+	for _, change := range []struct {
+		method string
+		path   string
+		body   []byte
+	}{
+		{"PUT", s.Path(0, "albumart"), mosstest.PNG(300, 0x21)},
+		{"PUT", s.Path(0, "albumart", "back"), mosstest.PNG(300, 0x61)},
+		{"DELETE", s.Path(0, "albumart", "back"), nil},
+		{"DELETE", s.Path(0, "albumart"), nil},
+	} {
+		s.MustDo(change.method, change.path, change.body)
+
+		stale := s.Do("GET", archive, nil, "Range", "bytes="+strconv.Itoa(cut)+"-", "If-Range", etag)
+		if stale.Status != http.StatusOK {
+			t.Errorf("after %s %s, a resume against the old ETag got %d", change.method, change.path, stale.Status)
+		}
+		if got := stale.Header.Get("ETag"); got == etag {
+			t.Errorf("after %s %s the ETag is unchanged", change.method, change.path)
+		}
+		if got := stale.Header.Get(archiveDigestHeader); got == digest {
+			t.Errorf("after %s %s the old digest is still sent", change.method, change.path)
+		}
+		if bytes.Equal(stale.Body, full.Body) {
+			t.Errorf("after %s %s the archive is unchanged", change.method, change.path)
+		}
+		// A failed If-Range gets the whole archive by way of Range handling,
+		// which only sends a digest that has been recorded
+		if got := stale.Header.Get(archiveDigestHeader); got != "" && got != sha256Hex(stale.Body) {
+			t.Errorf("after %s %s the digest doesn't match the archive", change.method, change.path)
+		}
+		etag, digest, full = stale.Header.Get("ETag"), sha256Hex(stale.Body), stale
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+type noEmbeddedArtError struct {
+	uuid string
+}
+
+func (e *noEmbeddedArtError) Error() string {
+	return fmt.Sprintf("%s - no usable embedded art found", e.uuid)
+}
+
+func wantArtExtraction(r *http.Request) bool {
+	return config.ExtractArtOnLock || r.URL.Query().Get("extractArt") == "1"
+}
+
+// extractArt stores the largest picture embedded in the holding's audio files
+// as its album art if it has none, and returns where the picture came from.
+// The caller must hold the holding's mutex.
+func extractArt(uuid string, dir string) (string, error) {
+	artPath := path.Join(dir, "albumart")
+	if _, err := os.Stat(artPath); err == nil {
+		return "", nil
+	}
+
+	musicDir := path.Join(dir, "music")
+	var best embeddedPicture
+	var source string
+	err := walkFiles(musicDir, func(rel string) error {
+		ext := strings.ToLower(path.Ext(rel))
+		if ext != ".flac" && ext != ".mp3" {
+			return nil
+		}
+		pictures, err := embeddedPictures(path.Join(musicDir, rel))
+		if err != nil {
+			// One unreadable track shouldn't stop us looking at the rest
+			return nil
+		}
+		for _, pic := range pictures {
+			if _, err := validateArt(pic.Data); err == nil && len(pic.Data) > len(best.Data) {
+				best = pic
+				source = rel
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if source == "" {
+		return "", &noEmbeddedArtError{uuid}
+	}
+
+	if err := ensureSafePath(config.LibraryPath, artPath); err != nil {
+		return "", err
+	}
+	if err := writeFileAtomic(artPath, best.Data); err != nil {
+		return "", err
+	}
+	ctype, _ := validateArt(best.Data)
+	if err := recordArtType(dir, ctype); err != nil {
+		return "", err
+	}
+	now := stamp(time.Now())
+	if err := recordProvenance(dir, "albumart", &Provenance{Source: provenanceExtracted, At: &now, From: path.Join("music", source)}); err != nil {
+		return "", err
+	}
+	if err := forgetArchiveDigests(uuid, dir); err != nil {
+		return "", err
+	}
+	emitChange(uuid, "albumart", "")
+	log.Printf("Extracted album art for %s from %s (%d bytes)\n", uuid, source, len(best.Data))
+	return "embedded:music/" + source, nil
+}
+
+// lockArtSource runs art extraction for a lock if it was asked for. Failing
+// to find art never fails the lock, it just gets logged.
+func lockArtSource(r *http.Request, uuid string) string {
+	if !wantArtExtraction(r) {
+		return ""
+	}
+	dir := uuidToPath(config.LibraryPath, uuid)
+	if _, err := os.Stat(path.Join(dir, lockFileName)); err == nil || !dirExists(dir) {
+		return ""
+	}
+	source, err := extractArt(uuid, dir)
+	if err != nil {
+		log.Println("Art extraction: " + err.Error())
+	}
+	return source
+}
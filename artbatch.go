@@ -0,0 +1,231 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// POST /albumart/batch stores album art for many holdings in one request, a
+// multipart/form-data body or a tar stream whose parts or entries are named
+// UUID4.EXT. Each image goes through the checks of PUT /UUID4/albumart, and
+// the result for each comes back as a line of NDJSON as soon as it is known,
+// followed by a final line with the totals. Holdings that already have art
+// are skipped unless ?overwrite=1 is given.
+const (
+	artBatchStored          = "stored"
+	artBatchNotFound        = "holding-not-found"
+	artBatchInvalidImage    = "invalid-image"
+	artBatchSkippedExisting = "skipped-existing"
+	artBatchInvalidUUID     = "invalid-uuid"
+	artBatchTooLarge        = "too-large"
+	artBatchNotWritable     = "not-writable"
+	artBatchFailed          = "failed"
+)
+
+type ArtBatchResult struct {
+	// The part or entry named it
+	Name    string
+	UUID    string `json:",omitempty"`
+	Status  string
+	SHA256  string `json:",omitempty"`
+	Message string `json:",omitempty"`
+}
+
+// The last line: done, or aborted with the Message saying why
+type ArtBatchSummary struct {
+	Status  string
+	Stored  int
+	Skipped int
+	Failed  int
+	Message string `json:",omitempty"`
+}
+
+type artBatchTooManyError struct {
+	limit int
+}
+
+func (e *artBatchTooManyError) Error() string {
+	return fmt.Sprintf("A batch can hold at most %d images", e.limit)
+}
+
+// artBatchEntries calls fn with the name and body of each part or entry of
+// a batch, stopping at the first error.
+func artBatchEntries(r *http.Request, fn func(name string, body io.Reader) error) error {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/x-tar" || mediaType == "application/tar" {
+		tr := tar.NewReader(r.Body)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if hdr.Typeflag != tar.TypeReg {
+				continue
+			}
+			if err := fn(hdr.Name, tr); err != nil {
+				return err
+			}
+		}
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return err
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		name := part.FileName()
+		if name == "" {
+			name = part.FormName()
+		}
+		err = fn(name, part)
+		part.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// storeBatchArt runs one image of a batch through the album art upload
+// checks and stores it. Errors are only returned for failures that end the
+// whole batch.
+func storeBatchArt(name string, body io.Reader, overwrite bool, prov Provenance) (ArtBatchResult, error) {
+	result := ArtBatchResult{Name: name, Status: artBatchFailed}
+	fail := func(status string, err error) (ArtBatchResult, error) {
+		result.Status = status
+		result.Message = err.Error()
+		return result, nil
+	}
+
+	base := path.Base(name)
+	uuid := strings.ToLower(strings.TrimSuffix(base, path.Ext(base)))
+	if err := uuidSanityCheck(uuid); err != nil {
+		return fail(artBatchInvalidUUID, err)
+	}
+	result.UUID = uuid
+
+	limit := config.Limits.MaxAlbumArtBytes
+	data, err := io.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		// The request body itself failed, e.g. over MaxArtBatchBytes
+		return result, err
+	}
+	if int64(len(data)) > limit {
+		if _, err := io.Copy(io.Discard, body); err != nil {
+			return result, err
+		}
+		return fail(artBatchTooLarge, &tooLargeError{limit})
+	}
+	if _, err := validateArt(data); err != nil {
+		return fail(artBatchInvalidImage, &planError{base + ": " + err.Error()})
+	}
+
+	if err := checkWritable(uuid); err != nil {
+		return fail(artBatchNotWritable, err)
+	}
+	if err := prepareWrite(uuid); err != nil {
+		return fail(artBatchNotWritable, err)
+	}
+	dir := uuidToPath(config.LibraryPath, uuid)
+	if !dirExists(dir) {
+		return fail(artBatchNotFound, &planError{"holding not found on disk"})
+	}
+	if _, err := os.Stat(path.Join(dir, "albumart")); err == nil && !overwrite {
+		return fail(artBatchSkippedExisting, &planError{uuid + " already has album art, pass ?overwrite=1 to replace it"})
+	}
+
+	sums := digestBytes(data, uploadAlgorithms(nil))
+	if err := storeAlbumArt(uuid, data, sums, prov); err != nil {
+		log.Println(err.Error())
+		if _, ok := err.(*pathTraversalError); !ok {
+			stats.storageErrors.add()
+		}
+		return fail(artBatchFailed, err)
+	}
+	result.Status = artBatchStored
+	result.SHA256 = sums["sha256"]
+	return result, nil
+}
+
+func artBatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkAuth(w, r) {
+		return
+	}
+	release, ok := guardWrite(w)
+	if !ok {
+		return
+	}
+	defer release()
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" && mediaType != "application/x-tar" && mediaType != "application/tar" {
+		http.Error(w, "Send the images as multipart/form-data or application/x-tar", http.StatusUnsupportedMediaType)
+		return
+	}
+	overwrite := r.URL.Query().Get("overwrite") == "1"
+
+	// Results go out while the rest of the body is still coming in
+	if err := http.NewResponseController(w).EnableFullDuplex(); err != nil {
+		log.Println("Album art batch: " + err.Error())
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	summary := ArtBatchSummary{Status: "done"}
+	count := 0
+	err := artBatchEntries(r, func(name string, body io.Reader) error {
+		if count++; count > config.Limits.MaxArtBatchItems {
+			return &artBatchTooManyError{config.Limits.MaxArtBatchItems}
+		}
+		prov := requestProvenance(r, provenanceBatchArt)
+		prov.RequestedName = name
+		result, err := storeBatchArt(name, body, overwrite, prov)
+		if err != nil {
+			return err
+		}
+		switch result.Status {
+		case artBatchStored:
+			summary.Stored++
+		case artBatchSkippedExisting:
+			summary.Skipped++
+		default:
+			summary.Failed++
+		}
+		enc.Encode(result)
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		summary.Status = "aborted"
+		if merr, ok := err.(*http.MaxBytesError); ok {
+			err = &tooLargeError{merr.Limit}
+		} else if err == multipart.ErrMessageTooLarge {
+			err = &tooLargeError{config.Limits.MaxArtBatchBytes}
+		}
+		summary.Message = err.Error()
+		log.Println("Album art batch aborted: " + err.Error())
+	}
+	user, _, _ := r.BasicAuth()
+	log.Printf("Album art batch for %s: %d stored, %d skipped, %d failed\n", user, summary.Stored, summary.Skipped, summary.Failed)
+	enc.Encode(summary)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Album art is stored as a bare "albumart" file, so its type is detected from
+// the bytes when it's stored and kept as AlbumArtType in holding.json, to be
+// served as its Content-Type. Art stored before that is sniffed when served.
+//
+// Before it's stored, art also has to have a header that decodes, with
+// dimensions of at least MinAlbumArtWidth by MinAlbumArtHeight and at most
+// MaxAlbumArtSide on a side, unless SkipArtDimensionChecks is set. Art that
+// fails is refused with 415 and a JSON body like the one for 413.
+var albumArtTypes = []string{"image/jpeg", "image/png", "image/gif", "image/webp"}
+
+const defaultMaxAlbumArtSide = 10000
+
+type artTypeError struct {
+	detected string
+}
+
+func (e *artTypeError) Error() string {
+	return "Album art must be a JPEG, PNG, GIF or WebP image, not " + e.detected
+}
+
+// detectArtType returns the type of an image moss accepts as album art.
+func detectArtType(data []byte) (string, error) {
+	detected := http.DetectContentType(data)
+	// "text/plain; charset=utf-8" and the like
+	if i := strings.Index(detected, ";"); i >= 0 {
+		detected = detected[:i]
+	}
+	for _, ctype := range albumArtTypes {
+		if detected == ctype {
+			return ctype, nil
+		}
+	}
+	return "", &artTypeError{detected}
+}
+
+type artDecodeError struct {
+	ctype  string
+	reason string
+}
+
+func (e *artDecodeError) Error() string {
+	return "Album art looks like " + e.ctype + " but can't be read as one: " + e.reason
+}
+
+type artDimensionsError struct {
+	width  int
+	height int
+}
+
+func (e *artDimensionsError) Error() string {
+	if e.width < config.MinAlbumArtWidth {
+		return fmt.Sprintf("Album art is %dx%d, narrower than MinAlbumArtWidth (%d)", e.width, e.height, config.MinAlbumArtWidth)
+	} else if e.height < config.MinAlbumArtHeight {
+		return fmt.Sprintf("Album art is %dx%d, shorter than MinAlbumArtHeight (%d)", e.width, e.height, config.MinAlbumArtHeight)
+	}
+	return fmt.Sprintf("Album art is %dx%d, more than MaxAlbumArtSide (%d) pixels on a side", e.width, e.height, config.MaxAlbumArtSide)
+}
+
+// detectArtDimensions reads the width and height from the image's header.
+// WebP has no decoder in the standard library, so its header is read here.
+func detectArtDimensions(data []byte, ctype string) (int, int, error) {
+	if ctype != "image/webp" {
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return 0, 0, &artDecodeError{ctype, err.Error()}
+		}
+		return cfg.Width, cfg.Height, nil
+	}
+	// RIFF, length, WEBP, then the first chunk's FourCC and length
+	if len(data) < 30 {
+		return 0, 0, &artDecodeError{ctype, "truncated header"}
+	}
+	le24 := func(b []byte) int {
+		return int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+	}
+	switch string(data[12:16]) {
+	case "VP8X":
+		return 1 + le24(data[24:27]), 1 + le24(data[27:30]), nil
+	case "VP8 ":
+		if !bytes.Equal(data[23:26], []byte{0x9d, 0x01, 0x2a}) {
+			return 0, 0, &artDecodeError{ctype, "bad VP8 start code"}
+		}
+		return int(binary.LittleEndian.Uint16(data[26:28]) & 0x3fff), int(binary.LittleEndian.Uint16(data[28:30]) & 0x3fff), nil
+	case "VP8L":
+		if data[20] != 0x2f {
+			return 0, 0, &artDecodeError{ctype, "bad VP8L signature"}
+		}
+		bits := binary.LittleEndian.Uint32(data[21:25])
+		return 1 + int(bits&0x3fff), 1 + int(bits>>14&0x3fff), nil
+	}
+	return 0, 0, &artDecodeError{ctype, "unknown WebP chunk " + string(data[12:16])}
+}
+
+// validateArt returns the type of album art that may be stored, checking
+// that its header decodes and, unless SkipArtDimensionChecks is set, its
+// dimensions.
+func validateArt(data []byte) (string, error) {
+	ctype, err := detectArtType(data)
+	if err != nil {
+		return "", err
+	}
+	width, height, err := detectArtDimensions(data, ctype)
+	if err != nil {
+		return "", err
+	}
+	if config.SkipArtDimensionChecks {
+		return ctype, nil
+	}
+	if width < config.MinAlbumArtWidth || height < config.MinAlbumArtHeight || width > config.MaxAlbumArtSide || height > config.MaxAlbumArtSide {
+		return "", &artDimensionsError{width, height}
+	}
+	return ctype, nil
+}
+
+type ArtRejectionResponse struct {
+	Error string
+	Code  string
+}
+
+// artRejected answers 415 for album art validateArt refused, with a JSON
+// body like tooLarge's.
+func artRejected(w http.ResponseWriter, err error) {
+	log.Println(err.Error())
+	code := "unsupported-art-type"
+	switch err.(type) {
+	case *artDecodeError:
+		code = "unreadable-art"
+	case *artDimensionsError:
+		code = "art-dimensions"
+	}
+	js, _ := json.Marshal(ArtRejectionResponse{err.Error(), code})
+	w.Header().Set(errorCodeHeader, code)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusUnsupportedMediaType)
+	w.Write(js)
+}
+
+// recordArtType keeps the type of the holding's album art, or forgets it
+// when ctype is "". The caller must hold the holding's mutex.
+func recordArtType(dir string, ctype string) error {
+	info, err := readHoldingInfo(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if info.AlbumArtType == ctype {
+		return nil
+	}
+	if info.CreatedAt.IsZero() {
+		info.CreatedAt = stamp(holdingCreatedAt(dir))
+	}
+	info.AlbumArtType = ctype
+	return writeHoldingInfo(dir, info)
+}
+
+// storedArtType returns the recorded type of the holding's album art, or ""
+// if it has to be sniffed.
+func storedArtType(dir string) string {
+	info, err := readHoldingInfo(dir)
+	if err != nil {
+		return ""
+	}
+	return info.AlbumArtType
+}
+
+// Extensions album art is named with when it's served
+var artExtensions = map[string]string{"image/jpeg": ".jpg", "image/png": ".png", "image/gif": ".gif", "image/webp": ".webp"}
+
+// artFileName names the album art at fp after its slot and type, sniffing
+// the type of art stored before types were recorded.
+func artFileName(slot string, ctype string, fp string) string {
+	if ctype == "" {
+		if f, err := os.Open(fp); err == nil {
+			head := make([]byte, 512)
+			n, _ := io.ReadFull(f, head)
+			f.Close()
+			ctype, _ = detectArtType(head[:n])
+		}
+	}
+	return slot + artExtensions[ctype]
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// Besides the front cover in albumart, a holding can keep scans of the rest
+// of its packaging, each in a named slot at /UUID4/albumart/SLOT and stored
+// under artwork/. "front" is the albumart file itself, which stays where it
+// was so that existing holdings, peers and archives keep working. Like the
+// front, the other slots may be changed after the holding is locked.
+const artworkDirName = "artwork"
+
+// Slots other than front
+var artSlotPattern = regexp.MustCompile(`^(back|spine|tray|inlay|disc[1-9][0-9]?|booklet-[0-9][0-9])$`)
+
+type artSlotError struct {
+	slot string
+}
+
+func (e *artSlotError) Error() string {
+	return "Unknown album art slot " + e.slot + "; use front, back, spine, tray, inlay, disc1 to disc99 or booklet-01 to booklet-99"
+}
+
+func checkArtSlot(slot string) error {
+	if slot != "front" && !artSlotPattern.MatchString(slot) {
+		return &artSlotError{slot}
+	}
+	return nil
+}
+
+// artworkSlots lists the slots a holding has art in, front first. A holding
+// with only a master has a front, derived from it.
+func artworkSlots(dir string) []string {
+	slots := []string{}
+	if _, err := os.Stat(path.Join(dir, "albumart")); err == nil {
+		slots = append(slots, "front")
+	} else if _, err := os.Stat(path.Join(dir, masterArtFileName)); err == nil {
+		slots = append(slots, "front")
+	}
+	dirEnts, _ := ioutil.ReadDir(path.Join(dir, artworkDirName))
+	others := []string{}
+	for _, dirEnt := range dirEnts {
+		if dirEnt.Mode().IsRegular() && artSlotPattern.MatchString(dirEnt.Name()) {
+			others = append(others, dirEnt.Name())
+		}
+	}
+	sort.Strings(others)
+	return append(slots, others...)
+}
+
+// recordArtworkType keeps the type of the art in a slot other than front, or
+// forgets it when ctype is "". The caller must hold the holding's mutex.
+func recordArtworkType(dir string, slot string, ctype string) error {
+	info, err := readHoldingInfo(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if info.ArtworkTypes[slot] == ctype {
+		return nil
+	}
+	if info.CreatedAt.IsZero() {
+		info.CreatedAt = stamp(holdingCreatedAt(dir))
+	}
+	if ctype == "" {
+		delete(info.ArtworkTypes, slot)
+	} else {
+		if info.ArtworkTypes == nil {
+			info.ArtworkTypes = map[string]string{}
+		}
+		info.ArtworkTypes[slot] = ctype
+	}
+	return writeHoldingInfo(dir, info)
+}
+
+// recordArtworkChecksums keeps or, for nil fileSums, forgets the digests of
+// the art in a slot other than front.
+func recordArtworkChecksums(dir string, slot string, fileSums map[string]string) error {
+	sums, err := readChecksums(dir)
+	if err != nil {
+		return err
+	}
+	if fileSums == nil {
+		delete(sums.Artwork, slot)
+	} else {
+		if sums.Artwork == nil {
+			sums.Artwork = map[string]map[string]string{}
+		}
+		sums.Artwork[slot] = fileSums
+	}
+	return writeChecksums(dir, sums)
+}
+
+// artworkUploadHandler handles PUT /UUID4/albumart/SLOT.
+func artworkUploadHandler(w http.ResponseWriter, r *http.Request, uuid string, slot string) {
+	if err := checkArtSlot(slot); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if slot == "front" {
+		albumArtUploadHandler(w, r, uuid)
+		return
+	}
+	if err := uuidSanityCheck(uuid); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkWritable(uuid); err != nil {
+		writeRefused(w, err)
+		return
+	}
+	if err := prepareWrite(uuid); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	body, ok := readUpload(w, r)
+	if !ok {
+		return
+	}
+	ctype, err := validateArt(body)
+	if err != nil {
+		artRejected(w, err)
+		return
+	}
+	sums, err := verifyUpload(r, body)
+	if err != nil {
+		checksumUploadError(w, err)
+		return
+	}
+
+	unlock := lockHolding(uuid)
+	defer unlock()
+
+	dir := uuidToPath(config.LibraryPath, uuid)
+	destPath := path.Join(dir, artworkDirName, slot)
+	if err := ensureSafePath(config.LibraryPath, destPath); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if !dirExists(dir) {
+		if err := makeDirs(dir); err != nil {
+			storageError(w, err)
+			return
+		}
+		if err := writeHoldingInfo(dir, HoldingInfo{CreatedAt: stamp(time.Now())}); err != nil {
+			storageError(w, err)
+			return
+		}
+	}
+	if err := makeDirs(path.Dir(destPath)); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := writeFileAtomic(destPath, body); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := recordArtworkType(dir, slot, ctype); err != nil {
+		storageError(w, err)
+		return
+	}
+	if err := recordArtworkChecksums(dir, slot, sums); err != nil {
+		storageError(w, err)
+		return
+	}
+	prov := requestProvenance(r, provenanceUpload)
+	if err := recordProvenance(dir, path.Join(artworkDirName, slot), &prov); err != nil {
+		storageError(w, err)
+		return
+	}
+	if err := forgetArchiveDigests(uuid, dir); err != nil {
+		storageError(w, err)
+		return
+	}
+	emitChange(uuid, "artwork", slot)
+
+	fmt.Fprintf(w, "uploaded: %d bytes\nsha256: %s\n", len(body), sums["sha256"])
+}
+
+// serveArtwork handles GET and HEAD of /UUID4/albumart/SLOT for slots other
+// than front.
+func serveArtwork(w http.ResponseWriter, r *http.Request, dir string, slot string) {
+	if err := checkArtSlot(slot); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fp := path.Join(dir, artworkDirName, slot)
+	if err := ensureSafePath(config.LibraryPath, fp); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if _, err := os.Stat(fp); os.IsNotExist(err) {
+		http.Error(w, "No album art in "+slot, http.StatusNotFound)
+		return
+	}
+	if sums, err := readChecksums(dir); err == nil {
+		setChecksumHeaders(w, sums.Artwork[slot])
+	}
+	var ctype string
+	if info, err := readHoldingInfo(dir); err == nil && info.ArtworkTypes[slot] != "" {
+		ctype = info.ArtworkTypes[slot]
+		w.Header().Set("Content-Type", ctype)
+	}
+	setCacheControl(w, dir, config.ArtCacheSeconds, false)
+	setContentDisposition(w, r, artFileName("albumart-"+slot, ctype, fp))
+	http.ServeFile(w, r, fp)
+}
+
+// artworkDeleteHandler handles DELETE /UUID4/albumart/SLOT.
+func artworkDeleteHandler(w http.ResponseWriter, r *http.Request, uuid string, slot string) {
+	if err := checkArtSlot(slot); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if slot == "front" {
+		albumArtDeleteHandler(w, r, uuid)
+		return
+	}
+	if err := uuidSanityCheck(uuid); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkWritable(uuid); err != nil {
+		writeRefused(w, err)
+		return
+	}
+	if err := prepareWrite(uuid); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	unlock := lockHolding(uuid)
+	defer unlock()
+
+	dir := uuidToPath(config.LibraryPath, uuid)
+	artPath := path.Join(dir, artworkDirName, slot)
+	if err := ensureSafePath(config.LibraryPath, artPath); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err := os.Remove(artPath); os.IsNotExist(err) {
+		http.Error(w, "No album art in "+slot, http.StatusNotFound)
+		return
+	} else if err != nil {
+		storageError(w, err)
+		return
+	}
+	if err := syncRemoved(artPath); err != nil {
+		storageError(w, err)
+		return
+	}
+	// Leave no empty artwork/ behind
+	if err := os.Remove(path.Dir(artPath)); err == nil {
+		syncRemoved(path.Dir(artPath))
+	}
+	if err := recordArtworkType(dir, slot, ""); err != nil {
+		storageError(w, err)
+		return
+	}
+	if err := recordArtworkChecksums(dir, slot, nil); err != nil {
+		storageError(w, err)
+		return
+	}
+	if err := recordProvenance(dir, path.Join(artworkDirName, slot), nil); err != nil {
+		storageError(w, err)
+		return
+	}
+	if err := forgetArchiveDigests(uuid, dir); err != nil {
+		storageError(w, err)
+		return
+	}
+	emitChange(uuid, "artwork-delete", slot)
+	fmt.Fprintln(w, "deleted: albumart/"+slot)
+}
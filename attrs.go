@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+const maxAttrsPerFile = 32
+const maxAttrKeyLength = 64
+const maxAttrValueLength = 1024
+
+type attrError struct {
+	problem string
+}
+
+func (e *attrError) Error() string {
+	return "Invalid attributes - " + e.problem
+}
+
+// Per-file attributes for a holding are kept together in attrs.json, keyed
+// by the file's path under music/.
+func readAttrs(dir string) (map[string]map[string]string, error) {
+	attrs := map[string]map[string]string{}
+	data, err := ioutil.ReadFile(path.Join(dir, attrsFileName))
+	if os.IsNotExist(err) {
+		return attrs, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &attrs)
+	return attrs, err
+}
+
+func writeAttrs(dir string, attrs map[string]map[string]string) error {
+	js, err := json.Marshal(attrs)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path.Join(dir, attrsFileName), js)
+}
+
+func validateAttrs(attrs map[string]string) error {
+	if len(attrs) > maxAttrsPerFile {
+		return &attrError{fmt.Sprintf("at most %d attributes are allowed per file", maxAttrsPerFile)}
+	}
+	for key, value := range attrs {
+		if key == "" || len(key) > maxAttrKeyLength || strings.ContainsAny(key, ":\x00") {
+			return &attrError{fmt.Sprintf("bad attribute name %q", key)}
+		}
+		if len(value) > maxAttrValueLength {
+			return &attrError{fmt.Sprintf("value of %s is longer than %d bytes", key, maxAttrValueLength)}
+		}
+	}
+	return nil
+}
+
+func attrsHandler(w http.ResponseWriter, r *http.Request, params []string) {
+	uuid := params[0]
+	if err := uuidSanityCheck(uuid); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rel := strings.TrimPrefix(path.Clean("/"+strings.Join(params[2:], "/")), "/")
+	if rel == "" {
+		http.Error(w, "Insufficient parameters", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "PUT" {
+		if err := checkWritable(uuid); err != nil {
+			writeRefused(w, err)
+			return
+		}
+		if err := prepareWrite(uuid); err != nil {
+			log.Println(err.Error())
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+	}
+
+	unlock := lockHolding(uuid)
+	defer unlock()
+
+	dir := holdingDir(uuid)
+	if stat, err := musicFileStat(dir, rel); err != nil || stat.IsDir() {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	attrs, err := readAttrs(dir)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+
+	if r.Method == "PUT" {
+		if _, err := os.Stat(path.Join(dir, lockFileName)); err == nil && !isAdmin(r) {
+			http.Error(w, "Attributes of locked holdings can only be changed by admins", http.StatusForbidden)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, maxAttrsPerFile*(maxAttrKeyLength+maxAttrValueLength+8))
+		body, ok := readUpload(w, r)
+		if !ok {
+			return
+		}
+		fileAttrs := map[string]string{}
+		if err := json.Unmarshal(body, &fileAttrs); err != nil {
+			http.Error(w, "Expected a flat JSON object of strings: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := validateAttrs(fileAttrs); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if len(fileAttrs) == 0 {
+			delete(attrs, rel)
+		} else {
+			attrs[rel] = fileAttrs
+		}
+		if err := writeAttrs(dir, attrs); err != nil {
+			storageError(w, err)
+			return
+		}
+		emitChange(uuid, "attrs", rel)
+	}
+
+	fileAttrs := attrs[rel]
+	if fileAttrs == nil {
+		fileAttrs = map[string]string{}
+	}
+	js, err := json.Marshal(fileAttrs)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+type SearchResult struct {
+	UUID       string
+	Path       string
+	Attributes map[string]string
+	Tags       *TrackTags `json:",omitempty"`
+}
+
+// searchHandler finds files whose attributes match every ?attr=name:value
+// given and, with ?artist= or ?albumartist=, whose tags name that artist.
+// artist matches either the track artist or the album artist, so tracks on
+// compilations are found by who performs them. Artists compare without
+// regard to case.
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	want := map[string]string{}
+	for _, attr := range query["attr"] {
+		kv := strings.SplitN(attr, ":", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			http.Error(w, "attr must be of the form name:value", http.StatusBadRequest)
+			return
+		}
+		want[kv[0]] = kv[1]
+	}
+	artist := query.Get("artist")
+	albumArtist := query.Get("albumartist")
+	byTags := artist != "" || albumArtist != ""
+	if len(want) == 0 && !byTags {
+		http.Error(w, "At least one attr, artist or albumartist filter is required", http.StatusBadRequest)
+		return
+	}
+
+	results := []SearchResult{}
+	err := walkHoldings(config.LibraryPath, func(uuid string, dir string, legacy bool) error {
+		attrs, err := readAttrs(dir)
+		if err != nil {
+			log.Println("Search: " + uuid + ": " + err.Error())
+			return nil
+		}
+		tags, err := readTags(dir)
+		if err != nil {
+			log.Println("Search: " + uuid + ": " + err.Error())
+			return nil
+		}
+		candidates := []string{}
+		if len(want) > 0 {
+			for rel := range attrs {
+				candidates = append(candidates, rel)
+			}
+		} else {
+			for rel := range tags {
+				candidates = append(candidates, rel)
+			}
+		}
+		for _, rel := range candidates {
+			fileAttrs := attrs[rel]
+			match := true
+			for key, value := range want {
+				if fileAttrs[key] != value {
+					match = false
+					break
+				}
+			}
+			t, tagged := tags[rel]
+			if byTags {
+				if !tagged ||
+					(artist != "" && !t.matchesArtist(artist)) ||
+					(albumArtist != "" && !strings.EqualFold(t.AlbumArtist, albumArtist)) {
+					match = false
+				}
+			}
+			if match {
+				if fileAttrs == nil {
+					fileAttrs = map[string]string{}
+				}
+				result := SearchResult{uuid, rel, fileAttrs, nil}
+				if tagged {
+					result.Tags = &t
+				}
+				results = append(results, result)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].UUID != results[j].UUID {
+			return results[i].UUID < results[j].UUID
+		}
+		return results[i].Path < results[j].Path
+	})
+
+	js, err := json.Marshal(results)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
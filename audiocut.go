@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+// Cutting clips without decoding: MP3 is cut on frame boundaries and Ogg
+// (Vorbis or Opus) on page boundaries, so clips start and end up to one frame
+// or page away from the requested times.
+
+var errUnsupportedCut = errors.New("format can't be cut without decoding")
+
+var mp3Bitrates = map[[2]int][]int{
+	{1, 1}: {0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+	{1, 2}: {0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+	{1, 3}: {0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+	{2, 1}: {0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+	{2, 2}: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+	{2, 3}: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+}
+
+var mp3SampleRates = map[int][]int{
+	1:  {44100, 48000, 32000},
+	2:  {22050, 24000, 16000},
+	25: {11025, 12000, 8000},
+}
+
+type mp3Frame struct {
+	size    int
+	seconds float64
+}
+
+// parseMP3Frame decodes a four byte MPEG audio frame header.
+func parseMP3Frame(h []byte) (mp3Frame, bool) {
+	if len(h) < 4 || h[0] != 0xff || h[1]&0xe0 != 0xe0 {
+		return mp3Frame{}, false
+	}
+	var version int
+	switch (h[1] >> 3) & 3 {
+	case 0:
+		version = 25
+	case 2:
+		version = 2
+	case 3:
+		version = 1
+	default:
+		return mp3Frame{}, false
+	}
+	layer := 4 - int((h[1]>>1)&3)
+	if layer == 4 {
+		return mp3Frame{}, false
+	}
+	bitrateIndex := int(h[2] >> 4)
+	rateIndex := int((h[2] >> 2) & 3)
+	if bitrateIndex == 0 || bitrateIndex == 15 || rateIndex == 3 {
+		return mp3Frame{}, false
+	}
+	tableVersion := version
+	if version == 25 {
+		tableVersion = 2
+	}
+	bitrate := mp3Bitrates[[2]int{tableVersion, layer}][bitrateIndex] * 1000
+	rate := mp3SampleRates[version][rateIndex]
+	padding := int((h[2] >> 1) & 1)
+
+	var size, samples int
+	switch {
+	case layer == 1:
+		size = (12*bitrate/rate + padding) * 4
+		samples = 384
+	case layer == 3 && version != 1:
+		size = 72*bitrate/rate + padding
+		samples = 576
+	default:
+		size = 144*bitrate/rate + padding
+		samples = 1152
+	}
+	return mp3Frame{size, float64(samples) / float64(rate)}, true
+}
+
+// cutMP3 returns the frames of an MP3 file covering [start, start+length)
+// seconds. Tags and any Xing/Info header frame are left out.
+func cutMP3(p string, start float64, length float64) ([]byte, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var offset int64
+	header := make([]byte, 10)
+	if _, err := f.ReadAt(header, 0); err == nil && bytes.HasPrefix(header, []byte("ID3")) {
+		offset = 10 + int64(syncsafe(header[6:10]))
+	}
+
+	clip := &bytes.Buffer{}
+	var t float64
+	first := true
+	frameHeader := make([]byte, 4)
+	for offset+4 <= stat.Size() && t < start+length {
+		if _, err := f.ReadAt(frameHeader, offset); err != nil {
+			return nil, err
+		}
+		frame, ok := parseMP3Frame(frameHeader)
+		if !ok {
+			// Lost sync, e.g. junk between frames; look further on
+			offset++
+			continue
+		}
+		if offset+int64(frame.size) > stat.Size() {
+			break
+		}
+		data := make([]byte, frame.size)
+		if _, err := f.ReadAt(data, offset); err != nil {
+			return nil, err
+		}
+		offset += int64(frame.size)
+
+		if first {
+			first = false
+			if bytes.Contains(data, []byte("Xing")) || bytes.Contains(data, []byte("Info")) || bytes.Contains(data, []byte("VBRI")) {
+				continue
+			}
+		}
+		if t+frame.seconds > start {
+			clip.Write(data)
+		}
+		t += frame.seconds
+	}
+	if clip.Len() == 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return clip.Bytes(), nil
+}
+
+type oggPage struct {
+	headerType byte
+	granule    int64
+	serial     uint32
+	segments   []byte
+	body       []byte
+}
+
+func readOggPage(r io.Reader) (*oggPage, error) {
+	header := make([]byte, 27)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:4], []byte("OggS")) {
+		return nil, errUnsupportedCut
+	}
+	page := &oggPage{
+		headerType: header[5],
+		granule:    int64(binary.LittleEndian.Uint64(header[6:14])),
+		serial:     binary.LittleEndian.Uint32(header[14:18]),
+		segments:   make([]byte, header[26]),
+	}
+	if _, err := io.ReadFull(r, page.segments); err != nil {
+		return nil, err
+	}
+	size := 0
+	for _, s := range page.segments {
+		size += int(s)
+	}
+	page.body = make([]byte, size)
+	if _, err := io.ReadFull(r, page.body); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+var oggCRCTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// encode serializes the page with a new sequence number and checksum.
+func (page *oggPage) encode(seq uint32) []byte {
+	b := make([]byte, 27, 27+len(page.segments)+len(page.body))
+	copy(b, "OggS")
+	b[5] = page.headerType
+	binary.LittleEndian.PutUint64(b[6:14], uint64(page.granule))
+	binary.LittleEndian.PutUint32(b[14:18], page.serial)
+	binary.LittleEndian.PutUint32(b[18:22], seq)
+	b[26] = byte(len(page.segments))
+	b = append(b, page.segments...)
+	b = append(b, page.body...)
+	var crc uint32
+	for _, c := range b {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^c]
+	}
+	binary.LittleEndian.PutUint32(b[22:26], crc)
+	return b
+}
+
+// oggGranuleRate works out how many granule positions make a second from the
+// stream's identification header.
+func oggGranuleRate(body []byte) (float64, bool) {
+	switch {
+	case len(body) >= 16 && bytes.Equal(body[:7], []byte("\x01vorbis")):
+		return float64(binary.LittleEndian.Uint32(body[12:16])), true
+	case bytes.HasPrefix(body, []byte("OpusHead")):
+		// Opus granule positions always count 48 kHz samples
+		return 48000, true
+	}
+	return 0, false
+}
+
+// cutOgg returns the header pages of the first logical stream of an Ogg
+// Vorbis or Opus file followed by the pages covering [start, start+length)
+// seconds, renumbered and with the last one marked end of stream.
+func cutOgg(p string, start float64, length float64) ([]byte, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	first, err := readOggPage(r)
+	if err != nil {
+		return nil, err
+	}
+	rate, ok := oggGranuleRate(first.body)
+	if !ok {
+		return nil, errUnsupportedCut
+	}
+
+	pages := []*oggPage{first}
+	prevGranule := int64(0)
+	inHeaders := true
+	inClip := false
+	for {
+		page, err := readOggPage(r)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if page.serial != first.serial {
+			// Chained or multiplexed streams aren't worth the trouble
+			break
+		}
+		if inHeaders && page.granule == 0 {
+			pages = append(pages, page)
+			continue
+		}
+		inHeaders = false
+		if page.granule < 0 {
+			// No packet ends on this page; keep it with its neighbours
+			if inClip {
+				pages = append(pages, page)
+			}
+			continue
+		}
+		pageStart := float64(prevGranule) / rate
+		pageEnd := float64(page.granule) / rate
+		prevGranule = page.granule
+		if pageEnd <= start {
+			continue
+		}
+		if pageStart >= start+length {
+			break
+		}
+		pages = append(pages, page)
+		inClip = true
+	}
+
+	clip := &bytes.Buffer{}
+	for i, page := range pages {
+		page.headerType &^= 0x04
+		if i == len(pages)-1 {
+			page.headerType |= 0x04
+		}
+		clip.Write(page.encode(uint32(i)))
+	}
+	return clip.Bytes(), nil
+}
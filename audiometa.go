@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+// Embedded pictures larger than this are ignored rather than read into memory.
+const maxEmbeddedPicture = 16 << 20
+
+var errNoMetadata = errors.New("no supported metadata")
+
+type embeddedPicture struct {
+	MIME string
+	Data []byte
+}
+
+// embeddedPictures returns the pictures embedded in a FLAC file's PICTURE
+// blocks or an MP3's ID3v2 APIC frames.
+func embeddedPictures(p string) ([]embeddedPicture, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	magic, err := r.Peek(4)
+	if err != nil {
+		return nil, errNoMetadata
+	}
+	if string(magic) == "fLaC" {
+		r.Discard(4)
+		return flacPictures(r)
+	} else if string(magic[:3]) == "ID3" {
+		return id3Pictures(r)
+	}
+	return nil, errNoMetadata
+}
+
+// flacBlocks calls fn for each metadata block, passing a reader limited to the
+// block. fn may leave the block partly read.
+func flacBlocks(r *bufio.Reader, fn func(blockType byte, length int, block io.Reader) error) error {
+	for {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return err
+		}
+		last := header[0]&0x80 != 0
+		length := int(header[1])<<16 | int(header[2])<<8 | int(header[3])
+		block := &io.LimitedReader{R: r, N: int64(length)}
+		if err := fn(header[0]&0x7f, length, block); err != nil {
+			return err
+		}
+		if _, err := io.Copy(io.Discard, block); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+func flacPictures(r *bufio.Reader) ([]embeddedPicture, error) {
+	pictures := []embeddedPicture{}
+	err := flacBlocks(r, func(blockType byte, length int, block io.Reader) error {
+		if blockType != 6 || length > maxEmbeddedPicture {
+			return nil
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(block, data); err != nil {
+			return err
+		}
+		if pic, ok := parseFlacPicture(data); ok {
+			pictures = append(pictures, pic)
+		}
+		return nil
+	})
+	return pictures, err
+}
+
+func parseFlacPicture(b []byte) (embeddedPicture, bool) {
+	field := func() ([]byte, bool) {
+		if len(b) < 4 {
+			return nil, false
+		}
+		n := binary.BigEndian.Uint32(b)
+		if uint32(len(b)-4) < n {
+			return nil, false
+		}
+		v := b[4 : 4+n]
+		b = b[4+n:]
+		return v, true
+	}
+	if len(b) < 4 {
+		return embeddedPicture{}, false
+	}
+	b = b[4:] // picture type
+	mime, ok := field()
+	if !ok {
+		return embeddedPicture{}, false
+	}
+	if _, ok := field(); !ok { // description
+		return embeddedPicture{}, false
+	}
+	if len(b) < 16 {
+		return embeddedPicture{}, false
+	}
+	b = b[16:] // width, height, depth, colors
+	data, ok := field()
+	if !ok {
+		return embeddedPicture{}, false
+	}
+	return embeddedPicture{string(mime), data}, true
+}
+
+func syncsafe(b []byte) int {
+	return int(b[0])<<21 | int(b[1])<<14 | int(b[2])<<7 | int(b[3])
+}
+
+// id3Frames calls fn with the ID and contents of each frame of an ID3v2.3 or
+// v2.4 tag.
+func id3Frames(r *bufio.Reader, fn func(id string, frame []byte)) error {
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	version := header[3]
+	if version != 3 && version != 4 {
+		return errNoMetadata
+	}
+	if header[5]&0x80 != 0 {
+		// Unsynchronised tags are rare enough not to bother with
+		return errNoMetadata
+	}
+	size := syncsafe(header[6:10])
+	tag := make([]byte, size)
+	if _, err := io.ReadFull(r, tag); err != nil {
+		return err
+	}
+	if header[5]&0x40 != 0 && len(tag) >= 4 {
+		extended := int(binary.BigEndian.Uint32(tag))
+		if version == 4 {
+			extended = syncsafe(tag)
+		} else {
+			extended += 4
+		}
+		if extended > len(tag) {
+			return errNoMetadata
+		}
+		tag = tag[extended:]
+	}
+
+	for len(tag) >= 10 && tag[0] != 0 {
+		id := string(tag[:4])
+		frameSize := int(binary.BigEndian.Uint32(tag[4:8]))
+		if version == 4 {
+			frameSize = syncsafe(tag[4:8])
+		}
+		if frameSize < 0 || frameSize > len(tag)-10 {
+			break
+		}
+		fn(id, tag[10:10+frameSize])
+		tag = tag[10+frameSize:]
+	}
+	return nil
+}
+
+func id3Pictures(r *bufio.Reader) ([]embeddedPicture, error) {
+	pictures := []embeddedPicture{}
+	err := id3Frames(r, func(id string, frame []byte) {
+		if id == "APIC" {
+			if pic, ok := parseAPIC(frame); ok {
+				pictures = append(pictures, pic)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pictures, nil
+}
+
+func parseAPIC(b []byte) (embeddedPicture, bool) {
+	if len(b) < 2 {
+		return embeddedPicture{}, false
+	}
+	encoding := b[0]
+	b = b[1:]
+	i := bytes.IndexByte(b, 0)
+	if i < 0 || i+2 > len(b) {
+		return embeddedPicture{}, false
+	}
+	mime := string(b[:i])
+	b = b[i+2:] // terminator and picture type
+
+	// The description is terminated by a single NUL, or a double NUL for the
+	// UTF-16 encodings
+	if encoding == 1 || encoding == 2 {
+		for j := 0; j+1 < len(b); j += 2 {
+			if b[j] == 0 && b[j+1] == 0 {
+				return embeddedPicture{normalizeImageMIME(mime), b[j+2:]}, true
+			}
+		}
+		return embeddedPicture{}, false
+	}
+	j := bytes.IndexByte(b, 0)
+	if j < 0 {
+		return embeddedPicture{}, false
+	}
+	return embeddedPicture{normalizeImageMIME(mime), b[j+1:]}, true
+}
+
+func normalizeImageMIME(mime string) string {
+	mime = strings.ToLower(mime)
+	if !strings.Contains(mime, "/") {
+		// ID3v2.2-style "JPG"/"PNG"
+		return "image/" + strings.Replace(mime, "jpg", "jpeg", 1)
+	}
+	return mime
+}
+
+// trackDuration returns the length in seconds of a FLAC file, from its
+// STREAMINFO block, or of an MP3, by adding up its frames.
+func trackDuration(p string) (float64, bool) {
+	f, err := os.Open(p)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	magic, err := r.Peek(4)
+	if err != nil {
+		return 0, false
+	}
+	if string(magic) == "fLaC" {
+		r.Discard(4)
+		var seconds float64
+		found := false
+		err := flacBlocks(r, func(blockType byte, length int, block io.Reader) error {
+			if blockType != 0 || length < 18 {
+				return nil
+			}
+			info := make([]byte, 18)
+			if _, err := io.ReadFull(block, info); err != nil {
+				return err
+			}
+			// 20 bits of sample rate, then channels and bits per sample, then
+			// 36 bits of total samples
+			rate := binary.BigEndian.Uint32(info[10:14]) >> 12
+			samples := uint64(info[13]&0x0f)<<32 | uint64(binary.BigEndian.Uint32(info[14:18]))
+			if rate > 0 && samples > 0 {
+				seconds = float64(samples) / float64(rate)
+				found = true
+			}
+			return nil
+		})
+		return seconds, err == nil && found
+	}
+	if string(magic[:3]) != "ID3" && !strings.HasSuffix(strings.ToLower(p), ".mp3") {
+		return 0, false
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, false
+	}
+	var offset int64
+	header := make([]byte, 10)
+	if _, err := f.ReadAt(header, 0); err == nil && bytes.HasPrefix(header, []byte("ID3")) {
+		offset = 10 + int64(syncsafe(header[6:10]))
+	}
+	var seconds float64
+	frameHeader := make([]byte, 4)
+	for frames := 0; offset+4 <= stat.Size(); {
+		if _, err := f.ReadAt(frameHeader, offset); err != nil {
+			break
+		}
+		frame, ok := parseMP3Frame(frameHeader)
+		if !ok {
+			if frames == 0 && offset > 1<<20 {
+				// Nothing like MP3 this far in
+				return 0, false
+			}
+			offset++
+			continue
+		}
+		frames++
+		seconds += frame.seconds
+		offset += int64(frame.size)
+	}
+	return seconds, seconds > 0
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// With ?autoname=1 a track upload is stored under a name made from its tags
+// by AutonameTemplate rather than the name it was sent under. The template
+// is text with fields in braces:
+//
+//	{title}               the tag's value, or nothing if it isn't set
+//	{albumartist|artist}  the first of several that is set
+//	{title|"Untitled"}    a quoted fallback for when none are
+//	{tracknumber:02}      a number zero-padded to two digits
+//	[{discnumber}-]       a section left out unless every field in it is set
+//
+// The fields are title, artist, albumartist, album, tracknumber,
+// discnumber, and name, the sent name without its extension. A '/' in the
+// template makes a subdirectory; one in a tag's value is replaced with '-'.
+// The sent name's extension is kept.
+const defaultAutonameTemplate = `[{discnumber}-][{tracknumber:02} ]{title|name}`
+
+var autonameFields = map[string]bool{
+	"title": true, "artist": true, "albumartist": true, "album": true,
+	"tracknumber": true, "discnumber": true, "name": true,
+}
+
+type autonameTemplateError struct {
+	template string
+	problem  string
+}
+
+func (e *autonameTemplateError) Error() string {
+	return fmt.Sprintf("AutonameTemplate %q: %s", e.template, e.problem)
+}
+
+type autonameEmptyError struct {
+	name string
+}
+
+func (e *autonameEmptyError) Error() string {
+	return e.name + " has nothing to name it by: its tags don't fill in AutonameTemplate"
+}
+
+func autonameTemplate() string {
+	if config.AutonameTemplate == "" {
+		return defaultAutonameTemplate
+	}
+	return config.AutonameTemplate
+}
+
+func validateAutonameTemplate(tmpl string) error {
+	_, err := renderAutoname(tmpl, map[string]string{})
+	return err
+}
+
+// autoname returns the name a track sent as requested is stored under when
+// it's autonamed, from the tags read from body.
+func autoname(requested string, body []byte) (string, error) {
+	ext := path.Ext(requested)
+	tags, _ := readTrackTags(bytes.NewReader(body))
+	fields := map[string]string{
+		"title":       tags.Title,
+		"artist":      tags.Artist,
+		"albumartist": tags.AlbumArtist,
+		"album":       tags.Album,
+		"tracknumber": tags.TrackNumber,
+		"discnumber":  tags.DiscNumber,
+		"name":        strings.TrimSuffix(path.Base(requested), ext),
+	}
+	for k, v := range fields {
+		fields[k] = strings.ReplaceAll(v, "/", "-")
+	}
+	name, err := renderAutoname(autonameTemplate(), fields)
+	if err != nil {
+		return "", err
+	}
+	elements := []string{}
+	for _, element := range strings.Split(name, "/") {
+		if element = strings.Join(strings.Fields(element), " "); element != "" {
+			elements = append(elements, element)
+		}
+	}
+	if len(elements) == 0 {
+		return "", &autonameEmptyError{requested}
+	}
+	return strings.Join(elements, "/") + ext, nil
+}
+
+// renderAutoname fills in a template with fields. An unknown field or a
+// malformed template is an error even when fields is empty, so templates
+// can be checked at startup.
+func renderAutoname(tmpl string, fields map[string]string) (string, error) {
+	p := &autonameParser{tmpl: tmpl, fields: fields}
+	out, _, err := p.section(false)
+	if err == nil && p.pos < len(tmpl) {
+		err = p.fail("unmatched ]")
+	}
+	return out, err
+}
+
+type autonameParser struct {
+	tmpl   string
+	pos    int
+	fields map[string]string
+}
+
+func (p *autonameParser) fail(problem string) error {
+	return &autonameTemplateError{p.tmpl, fmt.Sprintf("%s at offset %d", problem, p.pos)}
+}
+
+// section renders up to the end of the template or, inside brackets, the
+// closing ']', and reports whether every field in it was set.
+func (p *autonameParser) section(bracketed bool) (string, bool, error) {
+	var b strings.Builder
+	complete := true
+	for p.pos < len(p.tmpl) {
+		c := p.tmpl[p.pos]
+		switch c {
+		case ']':
+			if bracketed {
+				p.pos++
+			}
+			return b.String(), complete, nil
+		case '[':
+			p.pos++
+			inner, ok, err := p.section(true)
+			if err != nil {
+				return "", false, err
+			}
+			if ok {
+				b.WriteString(inner)
+			}
+		case '{':
+			p.pos++
+			value, err := p.field()
+			if err != nil {
+				return "", false, err
+			}
+			if value == "" {
+				complete = false
+			}
+			b.WriteString(value)
+		case '}':
+			return "", false, p.fail("unmatched }")
+		default:
+			b.WriteByte(c)
+			p.pos++
+		}
+	}
+	if bracketed {
+		return "", false, p.fail("unclosed [")
+	}
+	return b.String(), complete, nil
+}
+
+// field renders the alternatives of a {...} up to its closing brace.
+func (p *autonameParser) field() (string, error) {
+	end := strings.IndexByte(p.tmpl[p.pos:], '}')
+	if end < 0 {
+		return "", p.fail("unclosed {")
+	}
+	expr := p.tmpl[p.pos : p.pos+end]
+	p.pos += end + 1
+
+	value := ""
+	for _, alt := range strings.Split(expr, "|") {
+		alt = strings.TrimSpace(alt)
+		if len(alt) >= 2 && alt[0] == '"' && alt[len(alt)-1] == '"' {
+			if value == "" {
+				value = alt[1 : len(alt)-1]
+			}
+			continue
+		}
+		name, width := alt, 0
+		if i := strings.IndexByte(alt, ':'); i >= 0 {
+			w, err := strconv.Atoi(alt[i+1:])
+			if err != nil || w < 1 || w > 9 {
+				return "", p.fail("bad width in {" + expr + "}")
+			}
+			name, width = alt[:i], w
+		}
+		if !autonameFields[name] {
+			return "", p.fail("unknown field " + strconv.Quote(name))
+		}
+		if v := p.fields[name]; value == "" && v != "" {
+			if width > 0 {
+				if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+					v = fmt.Sprintf("%0*d", width, n)
+				}
+			}
+			value = v
+		}
+	}
+	return value, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/wuvt/moss/mosstest"
+)
+
+// taggedFLAC is a FLAC with the given "NAME=value" Vorbis comments.
+func taggedFLAC(comments ...string) []byte {
+	var block bytes.Buffer
+	field := func(s string) {
+		binary.Write(&block, binary.LittleEndian, uint32(len(s)))
+		block.WriteString(s)
+	}
+	field("mosstest")
+	binary.Write(&block, binary.LittleEndian, uint32(len(comments)))
+	for _, c := range comments {
+		field(c)
+	}
+
+	plain := mosstest.FLAC(0)
+	var b bytes.Buffer
+	b.WriteString("fLaC")
+	// STREAMINFO, no longer the last block
+	b.WriteByte(0)
+	b.Write(plain[5:42])
+	// VORBIS_COMMENT, the last
+	n := block.Len()
+	b.Write([]byte{0x84, byte(n >> 16), byte(n >> 8), byte(n)})
+	b.Write(block.Bytes())
+	b.Write(plain[42:])
+	return b.Bytes()
+}
+
+func TestRenderAutoname(t *testing.T) {
+	fields := map[string]string{
+		"title":       "Blue Monday",
+		"artist":      "New Order",
+		"tracknumber": "3",
+		"name":        "track03",
+	}
+	for _, c := range []struct {
+		tmpl string
+		want string
+	}{
+		{"{title}", "Blue Monday"},
+		{"{tracknumber:02} {title}", "03 Blue Monday"},
+		{"{albumartist|artist} - {title}", "New Order - Blue Monday"},
+		{`{albumartist|"Various Artists"}`, "Various Artists"},
+		{`{album|albumartist|"Unknown"}`, "Unknown"},
+		{"[{discnumber}-]{tracknumber}", "3"},
+		{"[{tracknumber}-]{title}", "3-Blue Monday"},
+		{"[{album}/][{artist} - ]{title}", "New Order - Blue Monday"},
+		{"{discnumber}", ""},
+		{"{title|name}", "Blue Monday"},
+		{"[[{discnumber}.]{tracknumber} ]{title}", "3 Blue Monday"},
+	} {
+		got, err := renderAutoname(c.tmpl, fields)
+		if err != nil {
+			t.Errorf("%s: %s", c.tmpl, err)
+		} else if got != c.want {
+			t.Errorf("%s rendered %q, want %q", c.tmpl, got, c.want)
+		}
+	}
+
+	for _, bad := range []string{"{title", "title}", "[{title}", "{title}]", "{genre}", "{tracknumber:x}", "{tracknumber:0}"} {
+		if err := validateAutonameTemplate(bad); err == nil {
+			t.Errorf("%s was accepted", bad)
+		}
+	}
+	if err := validateAutonameTemplate(defaultAutonameTemplate); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAutonameUpload(t *testing.T) {
+	s := newTestServer(t, mosstest.Spec{}, func(c *Config) {
+		c.AutonameTemplate = `[CD{discnumber}/][{tracknumber:02} ][{albumartist|artist} - ]{title|name}`
+	})
+	uuid := mosstest.NewUUID()
+
+	for _, c := range []struct {
+		sent string
+		body []byte
+		want string
+	}{
+		{"a.flac", taggedFLAC("TITLE=Intro", "TRACKNUMBER=1/12", "ARTIST=Someone"), "01 Someone - Intro.flac"},
+		// A compilation's album artist wins over the track artist
+		{"b.flac", taggedFLAC("TITLE=Hit", "TRACKNUMBER=2", "DISCNUMBER=2", "ARTIST=Someone", "ALBUMARTIST=Various Artists"), "CD2/02 Various Artists - Hit.flac"},
+		// Slashes in tags don't make directories
+		{"c.flac", taggedFLAC("TITLE=AC/DC", "TRACKNUMBER=3"), "03 AC-DC.flac"},
+		// Untagged, it falls back to the sent name
+		{"sub/untagged.flac", mosstest.FLAC(0), "untagged.flac"},
+	} {
+		resp := s.MustDo("PUT", "/"+uuid+"/music/"+c.sent+"?autoname=1", c.body)
+		if got := resp.Header.Get("X-Moss-Stored-Name"); got != c.want {
+			t.Errorf("%s was stored as %q, want %q", c.sent, got, c.want)
+		}
+	}
+	if resp := s.Do("GET", "/"+uuid+"/music/CD2/02 Various Artists - Hit.flac", nil); resp.Status != 200 {
+		t.Errorf("autonamed track got %d", resp.Status)
+	}
+
+	var prov map[string]Provenance
+	s.MustDo("GET", "/"+uuid+"/provenance", nil).JSON(t, &prov)
+	if got := prov["music/01 Someone - Intro.flac"].RequestedName; got != "a.flac" {
+		t.Errorf("requested name recorded as %q", got)
+	}
+
+	// Without ?autoname=1 the sent name stands
+	resp := s.MustDo("PUT", "/"+uuid+"/music/d.flac", taggedFLAC("TITLE=Outro"))
+	if got := resp.Header.Get("X-Moss-Stored-Name"); got != "d.flac" {
+		t.Errorf("plain upload stored as %q", got)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every response about a holding says which storage it came from in
+// X-Moss-Backend: the Backend of the shard covering it, else the shard's
+// Label, else "local". Holdings archived away report "archive:" and the
+// archive destination. Request latency is kept per backend so tiers can be
+// compared.
+const backendHeader = "X-Moss-Backend"
+
+const defaultBackend = "local"
+
+// Upper bounds in seconds of the latency histogram buckets
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+type latencyHistogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+type backendOp struct {
+	backend string
+	op      string
+}
+
+var backendLatency = struct {
+	sync.Mutex
+	m map[backendOp]*latencyHistogram
+}{m: map[backendOp]*latencyHistogram{}}
+
+func backendFor(uuid string) string {
+	i := shardIndex(uuid)
+	if i < 0 {
+		return defaultBackend
+	}
+	if config.Shards[i].Backend != "" {
+		return config.Shards[i].Backend
+	}
+	if config.Shards[i].Label != "" {
+		return config.Shards[i].Label
+	}
+	return defaultBackend
+}
+
+// backendOrNone is for log lines, where an empty field would be ambiguous.
+func backendOrNone(backend string) string {
+	if backend == "" {
+		return "-"
+	}
+	return backend
+}
+
+func archiveBackend(destination string) string {
+	return "archive:" + destination
+}
+
+func observeLatency(backend string, op string, d time.Duration) {
+	backendLatency.Lock()
+	defer backendLatency.Unlock()
+	key := backendOp{backend, op}
+	h, ok := backendLatency.m[key]
+	if !ok {
+		h = &latencyHistogram{counts: make([]uint64, len(latencyBuckets))}
+		backendLatency.m[key] = h
+	}
+	seconds := d.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// writeLatencyMetrics writes the moss_backend_request_duration_seconds
+// histograms for /metrics.
+func writeLatencyMetrics(w io.Writer) {
+	backendLatency.Lock()
+	defer backendLatency.Unlock()
+	if len(backendLatency.m) == 0 {
+		return
+	}
+	keys := []backendOp{}
+	for key := range backendLatency.m {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].backend != keys[j].backend {
+			return keys[i].backend < keys[j].backend
+		}
+		return keys[i].op < keys[j].op
+	})
+
+	name := "moss_backend_request_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Time taken to answer requests for holdings, by storage backend.\n# TYPE %s histogram\n", name, name)
+	for _, key := range keys {
+		h := backendLatency.m[key]
+		labels := fmt.Sprintf("backend=%q,op=%q", key.backend, key.op)
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels, bound, h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+		fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, h.sum)
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+	}
+}
+
+// measureBackends sets X-Moss-Backend on requests for a holding and times
+// them against that backend. Handlers that find the holding elsewhere, such
+// as in an archive, replace the header before answering.
+func measureBackends(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uuid := strings.ToLower(strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[0])
+		if uuidSanityCheck(uuid) != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set(backendHeader, backendFor(uuid))
+		start := time.Now()
+		next.ServeHTTP(w, r)
+		op := "write"
+		if r.Method == "GET" || r.Method == "HEAD" {
+			op = "read"
+		}
+		observeLatency(w.Header().Get(backendHeader), op, time.Since(start))
+	})
+}
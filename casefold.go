@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Set at startup by probing the library filesystem.
+var caseInsensitiveFS bool
+
+type caseCollisionError struct {
+	requested string
+	existing  string
+}
+
+func (e *caseCollisionError) Error() string {
+	return fmt.Sprintf("%s collides with existing name %s", e.requested, e.existing)
+}
+
+// probeCaseInsensitive creates a lowercase probe file in dir and checks
+// whether it can be found again under an uppercase name.
+func probeCaseInsensitive(dir string) (bool, error) {
+	probe := path.Join(dir, ".moss-case-probe")
+	if err := ioutil.WriteFile(probe, []byte{}, 0644); err != nil {
+		return false, err
+	}
+	defer os.Remove(probe)
+	_, err := os.Stat(path.Join(dir, ".MOSS-CASE-PROBE"))
+	return err == nil, nil
+}
+
+func enforceCaseUniqueness() bool {
+	return caseInsensitiveFS || config.StrictCaseNames
+}
+
+// checkCaseCollision walks from root down to target and fails if any path
+// element would land on an existing entry whose name differs only by case.
+func checkCaseCollision(root string, target string) error {
+	rel, err := filepath.Rel(root, target)
+	if err != nil {
+		return err
+	}
+	dir := root
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		dirEnts, err := ioutil.ReadDir(dir)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		for _, dirEnt := range dirEnts {
+			if dirEnt.Name() != name && strings.EqualFold(dirEnt.Name(), name) {
+				return &caseCollisionError{name, dirEnt.Name()}
+			}
+		}
+		dir = path.Join(dir, name)
+	}
+	return nil
+}
+
+// findCaseCollisions returns groups of names under root that share a
+// directory and differ only by case.
+func findCaseCollisions(root string) ([][]string, error) {
+	collisions := [][]string{}
+	err := filepath.Walk(root, func(p string, f os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !f.IsDir() {
+			return nil
+		}
+		dirEnts, err := ioutil.ReadDir(p)
+		if err != nil {
+			return err
+		}
+		folded := map[string][]string{}
+		for _, dirEnt := range dirEnts {
+			key := strings.ToLower(dirEnt.Name())
+			folded[key] = append(folded[key], strings.TrimPrefix(path.Join(p[len(root):], dirEnt.Name()), "/"))
+		}
+		for _, names := range folded {
+			if len(names) > 1 {
+				sort.Strings(names)
+				collisions = append(collisions, names)
+			}
+		}
+		return nil
+	})
+	return collisions, err
+}
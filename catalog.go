@@ -0,0 +1,605 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The station catalog is the system of record for what is in the library.
+// With a catalog configured, every lock sends the holding to the catalog's
+// ingest endpoint through an outbox kept in .moss-catalog/outbox.json, so a
+// restart or a catalog outage loses nothing, and every night the UUIDs the
+// catalog knows are compared with the holdings locked here. The catalog is
+// reached through CatalogClient; Catalog in the config sets up the HTTP one,
+// and a station with a different catalog can set catalogClient from an
+// init() of its own instead.
+const catalogDirName = ".moss-catalog"
+
+const defaultCatalogReconcileAt = "04:00"
+
+// Failed ingests are retried with backoff up to this long apart
+const catalogRetryCap = 30 * time.Minute
+
+const catalogIdleInterval = 5 * time.Second
+
+type CatalogConfig struct {
+	// Locked holdings are POSTed to IngestURL; ListURL answers GET with a
+	// JSON array of the UUIDs in the catalog
+	IngestURL string
+	ListURL   string
+
+	// Basic auth, or a bearer Token
+	User  string `json:",omitempty"`
+	Key   string `json:",omitempty"`
+	Token string `json:",omitempty"`
+
+	// Local time of day, as HH:MM, to reconcile at
+	ReconcileAt string `json:",omitempty"`
+}
+
+type CatalogClient interface {
+	// Ingest records a locked holding. Sending the same UUID again, as
+	// happens after a retry or from another replica, replaces the entry.
+	Ingest(entry CatalogEntry) error
+	// UUIDs lists the holdings in the catalog.
+	UUIDs() ([]string, error)
+}
+
+// Nil unless a catalog is configured
+var catalogClient CatalogClient
+
+type CatalogFile struct {
+	Path     string
+	Size     int64
+	SHA256   string            `json:",omitempty"`
+	Duration float64           `json:",omitempty"`
+	Tags     *TrackTags        `json:",omitempty"`
+	Attrs    map[string]string `json:",omitempty"`
+}
+
+type CatalogEntry struct {
+	UUID        string
+	Node        string `json:",omitempty"`
+	Digest      string
+	LockedAt    Timestamp
+	LockedBy    string
+	Reason      string `json:",omitempty"`
+	Duration    float64
+	HasAlbumArt bool
+	Files       []CatalogFile
+}
+
+type catalogError struct {
+	problem string
+}
+
+func (e *catalogError) Error() string {
+	return e.problem
+}
+
+type httpCatalog struct {
+	config CatalogConfig
+	client *http.Client
+}
+
+func (c *httpCatalog) request(method string, target string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.config.Token)
+	} else if c.config.User != "" {
+		req.SetBasicAuth(c.config.User, c.config.Key)
+	}
+	return c.client.Do(req)
+}
+
+func (c *httpCatalog) Ingest(entry CatalogEntry) error {
+	js, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	resp, err := c.request("POST", c.config.IngestURL, js)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &catalogError{"Catalog ingest returned " + resp.Status}
+	}
+	return nil
+}
+
+func (c *httpCatalog) UUIDs() ([]string, error) {
+	resp, err := c.request("GET", c.config.ListURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &catalogError{"Catalog listing returned " + resp.Status}
+	}
+	uuids := []string{}
+	if err := json.NewDecoder(resp.Body).Decode(&uuids); err != nil {
+		return nil, &catalogError{"Catalog listing isn't a JSON array of UUIDs: " + err.Error()}
+	}
+	return uuids, nil
+}
+
+// catalogEntry describes a locked holding for the catalog.
+func catalogEntry(uuid string, dir string) (CatalogEntry, error) {
+	entry := CatalogEntry{UUID: uuid, Node: config.NodeName, Files: []CatalogFile{}}
+	lock, err := readLockInfo(dir)
+	if err != nil {
+		return entry, err
+	}
+	entry.Digest = lock.Digest
+	entry.LockedAt = lock.LockedAt
+	entry.LockedBy = lock.LockedBy
+	entry.Reason = lock.Reason
+	_, err = os.Stat(path.Join(dir, "albumart"))
+	entry.HasAlbumArt = err == nil
+
+	sums, err := readChecksums(dir)
+	if err != nil {
+		return entry, err
+	}
+	tags, err := readTags(dir)
+	if err != nil {
+		return entry, err
+	}
+	attrs, err := readAttrs(dir)
+	if err != nil {
+		return entry, err
+	}
+	musicDir := path.Join(dir, "music")
+	err = walkFiles(musicDir, func(rel string) error {
+		stat, err := os.Stat(path.Join(musicDir, rel))
+		if err != nil {
+			return err
+		}
+		file := CatalogFile{Path: rel, Size: stat.Size(), SHA256: sums.Music[rel]["sha256"], Attrs: attrs[rel]}
+		if t, ok := tags[rel]; ok && !t.empty() {
+			file.Tags = &t
+		}
+		if d, ok := trackDuration(path.Join(musicDir, rel)); ok {
+			file.Duration = d
+			entry.Duration += d
+		}
+		entry.Files = append(entry.Files, file)
+		return nil
+	})
+	sort.Slice(entry.Files, func(i, j int) bool { return entry.Files[i].Path < entry.Files[j].Path })
+	return entry, err
+}
+
+type CatalogItem struct {
+	UUID     string
+	Enqueued Timestamp
+
+	Attempts    int        `json:",omitempty"`
+	LastError   string     `json:",omitempty"`
+	NextAttempt *Timestamp `json:",omitempty"`
+}
+
+var catalogOutbox = struct {
+	sync.Mutex
+	items map[string]*CatalogItem
+	wake  chan struct{}
+	// Set when the outbox changed but couldn't be saved, e.g. while frozen
+	dirty bool
+}{items: map[string]*CatalogItem{}, wake: make(chan struct{}, 1)}
+
+func catalogDir() string {
+	return path.Join(config.LibraryPath, catalogDirName)
+}
+
+// saveCatalogOutbox writes the outbox out. The caller holds catalogOutbox.
+func saveCatalogOutbox() {
+	release, err := beginWrite()
+	if err != nil {
+		catalogOutbox.dirty = true
+		return
+	}
+	defer release()
+	items := []*CatalogItem{}
+	for _, item := range catalogOutbox.items {
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Enqueued.Before(items[j].Enqueued.Time) })
+	js, err := json.Marshal(items)
+	if err == nil {
+		err = writeFileAtomic(path.Join(catalogDir(), "outbox.json"), js)
+	}
+	if err != nil {
+		log.Println("Cannot save catalog outbox: " + err.Error())
+		catalogOutbox.dirty = true
+		return
+	}
+	catalogOutbox.dirty = false
+}
+
+func loadCatalogOutbox() error {
+	data, err := ioutil.ReadFile(path.Join(catalogDir(), "outbox.json"))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	items := []*CatalogItem{}
+	if err := json.Unmarshal(data, &items); err != nil {
+		return err
+	}
+	for _, item := range items {
+		catalogOutbox.items[item.UUID] = item
+	}
+	return nil
+}
+
+// enqueueCatalog queues a newly locked holding for the catalog.
+func enqueueCatalog(uuid string) {
+	if catalogClient == nil {
+		return
+	}
+	catalogOutbox.Lock()
+	if item, ok := catalogOutbox.items[uuid]; ok {
+		item.NextAttempt = nil
+	} else {
+		catalogOutbox.items[uuid] = &CatalogItem{UUID: uuid, Enqueued: stamp(time.Now())}
+	}
+	saveCatalogOutbox()
+	catalogOutbox.Unlock()
+	select {
+	case catalogOutbox.wake <- struct{}{}:
+	default:
+	}
+}
+
+// nextCatalogItem returns a copy of the oldest item that is due, or nil.
+func nextCatalogItem() *CatalogItem {
+	catalogOutbox.Lock()
+	defer catalogOutbox.Unlock()
+	if catalogOutbox.dirty {
+		saveCatalogOutbox()
+	}
+	now := time.Now()
+	var oldest *CatalogItem
+	for _, item := range catalogOutbox.items {
+		if item.NextAttempt != nil && item.NextAttempt.After(now) {
+			continue
+		}
+		if oldest == nil || item.Enqueued.Before(oldest.Enqueued.Time) {
+			oldest = item
+		}
+	}
+	if oldest == nil {
+		return nil
+	}
+	item := *oldest
+	return &item
+}
+
+func catalogItemDone(item *CatalogItem, err error) {
+	catalogOutbox.Lock()
+	defer catalogOutbox.Unlock()
+	current, ok := catalogOutbox.items[item.UUID]
+	if !ok || !current.Enqueued.Equal(item.Enqueued.Time) {
+		return
+	}
+	if err == nil {
+		delete(catalogOutbox.items, item.UUID)
+	} else {
+		current.Attempts++
+		current.LastError = err.Error()
+		delay := peerRetryCap << uint(current.Attempts-1)
+		if delay <= 0 || delay > catalogRetryCap {
+			delay = catalogRetryCap
+		}
+		next := stamp(time.Now().Add(delay))
+		current.NextAttempt = &next
+	}
+	saveCatalogOutbox()
+}
+
+func sendToCatalog(item *CatalogItem) error {
+	dir := holdingDir(item.UUID)
+	if _, err := os.Stat(path.Join(dir, lockFileName)); os.IsNotExist(err) {
+		// Deleted or unlocked since; reconciliation will tell the catalog
+		// side about it
+		return nil
+	}
+	entry, err := catalogEntry(item.UUID, dir)
+	if err != nil {
+		return err
+	}
+	return catalogClient.Ingest(entry)
+}
+
+func runCatalogOutbox() {
+	for {
+		item := nextCatalogItem()
+		if item == nil {
+			select {
+			case <-catalogOutbox.wake:
+			case <-time.After(catalogIdleInterval):
+			}
+			continue
+		}
+		err := sendToCatalog(item)
+		if err != nil {
+			log.Printf("Sending %s to the catalog: %s\n", item.UUID, err.Error())
+		}
+		catalogItemDone(item, err)
+	}
+}
+
+type CatalogReport struct {
+	At                 Timestamp
+	LockedHoldings     int
+	CatalogHoldings    int
+	MissingFromCatalog []string
+	MissingFromMoss    []string
+	Error              string `json:",omitempty"`
+}
+
+var catalogReport = struct {
+	sync.Mutex
+	last    *CatalogReport
+	running bool
+}{}
+
+type reconcileRunningError struct{}
+
+func (e *reconcileRunningError) Error() string {
+	return "A catalog reconciliation is already running"
+}
+
+// reconcileCatalog compares the holdings locked here with the UUIDs in the
+// catalog that fall in this server's shards.
+func reconcileCatalog() (*CatalogReport, error) {
+	catalogReport.Lock()
+	if catalogReport.running {
+		catalogReport.Unlock()
+		return nil, &reconcileRunningError{}
+	}
+	catalogReport.running = true
+	catalogReport.Unlock()
+	defer func() {
+		catalogReport.Lock()
+		catalogReport.running = false
+		catalogReport.Unlock()
+	}()
+
+	report := &CatalogReport{At: stamp(time.Now()), MissingFromCatalog: []string{}, MissingFromMoss: []string{}}
+	local := map[string]bool{}
+	err := walkHoldings(config.LibraryPath, func(uuid string, dir string, legacy bool) error {
+		if _, err := os.Stat(path.Join(dir, lockFileName)); err == nil {
+			local[strings.ToLower(uuid)] = true
+		}
+		return nil
+	})
+	var remote []string
+	if err == nil {
+		remote, err = catalogClient.UUIDs()
+	}
+	if err != nil {
+		report.Error = err.Error()
+	} else {
+		report.LockedHoldings = len(local)
+		inCatalog := map[string]bool{}
+		for _, uuid := range remote {
+			uuid = strings.ToLower(uuid)
+			if len(config.Shards) > 0 && shardIndex(uuid) < 0 {
+				continue
+			}
+			inCatalog[uuid] = true
+			if !local[uuid] {
+				report.MissingFromMoss = append(report.MissingFromMoss, uuid)
+			}
+		}
+		report.CatalogHoldings = len(inCatalog)
+		for uuid := range local {
+			if !inCatalog[uuid] {
+				report.MissingFromCatalog = append(report.MissingFromCatalog, uuid)
+			}
+		}
+		sort.Strings(report.MissingFromCatalog)
+		sort.Strings(report.MissingFromMoss)
+	}
+
+	catalogReport.Lock()
+	catalogReport.last = report
+	catalogReport.Unlock()
+	if js, jerr := json.Marshal(report); jerr == nil {
+		if release, ferr := beginWrite(); ferr == nil {
+			if werr := writeFileAtomic(path.Join(catalogDir(), "report.json"), js); werr != nil {
+				log.Println("Cannot save catalog report: " + werr.Error())
+			}
+			release()
+		}
+	}
+	if err != nil {
+		log.Println("Catalog reconciliation failed: " + err.Error())
+	} else {
+		log.Printf("Catalog reconciliation: %d locked holdings missing from the catalog, %d catalog holdings missing here\n", len(report.MissingFromCatalog), len(report.MissingFromMoss))
+	}
+	return report, nil
+}
+
+// nextReconcile returns the next time after now at the local time of day at,
+// given as HH:MM.
+func nextReconcile(now time.Time, at string) time.Time {
+	t, _ := time.Parse("15:04", at)
+	next := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, now.Location())
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+func runCatalogReconciliation(at string) {
+	for {
+		time.Sleep(time.Until(nextReconcile(time.Now(), at)))
+		if _, err := reconcileCatalog(); err != nil {
+			log.Println(err.Error())
+		}
+	}
+}
+
+// initCatalog sets up the catalog client from the config, unless one was set
+// already, and starts the outbox and the nightly reconciliation.
+func initCatalog() error {
+	if catalogClient == nil && config.Catalog != nil {
+		if config.Catalog.IngestURL == "" || config.Catalog.ListURL == "" {
+			return &catalogError{"IngestURL and ListURL are both needed"}
+		}
+		catalogClient = &httpCatalog{*config.Catalog, &http.Client{Timeout: time.Minute}}
+	}
+	if catalogClient == nil {
+		return nil
+	}
+	at := defaultCatalogReconcileAt
+	if config.Catalog != nil && config.Catalog.ReconcileAt != "" {
+		at = config.Catalog.ReconcileAt
+	}
+	if _, err := time.Parse("15:04", at); err != nil {
+		return &catalogError{"ReconcileAt must be HH:MM"}
+	}
+	if err := os.MkdirAll(catalogDir(), 0755); err != nil {
+		return err
+	}
+	if err := loadCatalogOutbox(); err != nil {
+		return err
+	}
+	if data, err := ioutil.ReadFile(path.Join(catalogDir(), "report.json")); err == nil {
+		report := &CatalogReport{}
+		if json.Unmarshal(data, report) == nil {
+			catalogReport.last = report
+		}
+	}
+	if len(catalogOutbox.items) > 0 {
+		log.Printf("Resuming catalog outbox with %d holdings pending\n", len(catalogOutbox.items))
+	}
+	go runCatalogOutbox()
+	go runCatalogReconciliation(at)
+	return nil
+}
+
+type CatalogStats struct {
+	Outbox             int
+	OldestPending      *Timestamp `json:",omitempty"`
+	LastReconciled     *Timestamp `json:",omitempty"`
+	ReconcileError     string     `json:",omitempty"`
+	MissingFromCatalog int
+	MissingFromMoss    int
+}
+
+// catalogStats returns nil without a catalog.
+func catalogStats() *CatalogStats {
+	if catalogClient == nil {
+		return nil
+	}
+	s := &CatalogStats{}
+	catalogOutbox.Lock()
+	s.Outbox = len(catalogOutbox.items)
+	for _, item := range catalogOutbox.items {
+		if s.OldestPending == nil || item.Enqueued.Before(s.OldestPending.Time) {
+			enqueued := item.Enqueued
+			s.OldestPending = &enqueued
+		}
+	}
+	catalogOutbox.Unlock()
+	catalogReport.Lock()
+	if r := catalogReport.last; r != nil {
+		at := r.At
+		s.LastReconciled = &at
+		s.ReconcileError = r.Error
+		s.MissingFromCatalog = len(r.MissingFromCatalog)
+		s.MissingFromMoss = len(r.MissingFromMoss)
+	}
+	catalogReport.Unlock()
+	return s
+}
+
+type CatalogStatus struct {
+	Outbox []CatalogItem
+	Report *CatalogReport `json:",omitempty"`
+}
+
+// catalogHandler handles GET /admin/catalog, the outbox and the last
+// reconciliation, GET /admin/catalog/report and POST
+// /admin/catalog/reconcile.
+func catalogHandler(w http.ResponseWriter, r *http.Request, params []string) {
+	if catalogClient == nil {
+		http.Error(w, "No catalog is configured", http.StatusNotFound)
+		return
+	}
+	var result interface{}
+	switch {
+	case len(params) == 0 || (len(params) == 1 && params[0] == ""):
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		status := CatalogStatus{Outbox: []CatalogItem{}}
+		catalogOutbox.Lock()
+		for _, item := range catalogOutbox.items {
+			status.Outbox = append(status.Outbox, *item)
+		}
+		catalogOutbox.Unlock()
+		sort.Slice(status.Outbox, func(i, j int) bool { return status.Outbox[i].Enqueued.Before(status.Outbox[j].Enqueued.Time) })
+		catalogReport.Lock()
+		status.Report = catalogReport.last
+		catalogReport.Unlock()
+		result = status
+	case len(params) == 1 && params[0] == "report":
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		catalogReport.Lock()
+		report := catalogReport.last
+		catalogReport.Unlock()
+		if report == nil {
+			http.Error(w, "The catalog hasn't been reconciled yet", http.StatusNotFound)
+			return
+		}
+		result = report
+	case len(params) == 1 && params[0] == "reconcile":
+		if r.Method != "POST" {
+			http.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		report, err := reconcileCatalog()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		result = report
+	default:
+		http.Error(w, "No request handler for that", http.StatusNotFound)
+		return
+	}
+
+	js, err := json.Marshal(result)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
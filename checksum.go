@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const checksumHeaderPrefix = "X-Checksum-"
+
+// Ripping stations send these as well as, or instead of, X-Checksum-<ALG>.
+// Content-MD5 is base64 as in RFC 1864; X-Content-SHA256 is hex.
+const contentSHA256Header = "X-Content-SHA256"
+const contentMD5Header = "Content-MD5"
+
+// Backfill reads at most this many bytes per second so it doesn't starve
+// uploads and downloads on the same disks.
+const defaultChecksumBackfillRate = 20 << 20
+
+var defaultChecksumAlgorithms = []string{"sha256"}
+
+// checksumAlgorithms lists every digest the server knows how to compute.
+// BLAKE3 isn't in the standard library, so it can't be configured yet.
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+type unsupportedChecksumError struct {
+	algorithm string
+}
+
+func (e *unsupportedChecksumError) Error() string {
+	return fmt.Sprintf("Unsupported checksum algorithm %s", e.algorithm)
+}
+
+type malformedChecksumError struct {
+	header string
+	value  string
+}
+
+func (e *malformedChecksumError) Error() string {
+	return fmt.Sprintf("%s is not a valid digest: %q", e.header, e.value)
+}
+
+type conflictingChecksumError struct {
+	algorithm string
+}
+
+func (e *conflictingChecksumError) Error() string {
+	return fmt.Sprintf("The request carries different %s checksums in different headers", e.algorithm)
+}
+
+type checksumMismatchError struct {
+	algorithm string
+	expected  string
+	actual    string
+}
+
+func (e *checksumMismatchError) Error() string {
+	return fmt.Sprintf("%s checksum mismatch: expected %s, got %s", e.algorithm, e.expected, e.actual)
+}
+
+// Checksums holds the stored digests for a holding in checksums.json, keyed
+// by the file's path under music/ and then by algorithm.
+type Checksums struct {
+	Music    map[string]map[string]string
+	AlbumArt map[string]string `json:",omitempty"`
+	// Of albumart-master
+	MasterArt map[string]string `json:",omitempty"`
+	// Of the album art slots under artwork/, by slot
+	Artwork map[string]map[string]string `json:",omitempty"`
+}
+
+func validateChecksumAlgorithms(algs []string) error {
+	for _, alg := range algs {
+		if _, ok := checksumAlgorithms[alg]; !ok {
+			return &unsupportedChecksumError{alg}
+		}
+	}
+	return nil
+}
+
+func hashFile(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// digestReader computes every requested digest in a single pass over r.
+func digestReader(r io.Reader, algs []string) (map[string]string, int64, error) {
+	hashes := map[string]hash.Hash{}
+	writers := []io.Writer{}
+	for _, alg := range algs {
+		if _, ok := hashes[alg]; ok {
+			continue
+		}
+		h := checksumAlgorithms[alg]()
+		hashes[alg] = h
+		writers = append(writers, h)
+	}
+	n, err := io.Copy(io.MultiWriter(writers...), r)
+	if err != nil {
+		return nil, n, err
+	}
+	sums := map[string]string{}
+	for alg, h := range hashes {
+		sums[alg] = hex.EncodeToString(h.Sum(nil))
+	}
+	return sums, n, nil
+}
+
+func digestBytes(data []byte, algs []string) map[string]string {
+	sums, _, _ := digestReader(bytes.NewReader(data), algs)
+	return sums
+}
+
+func digestFile(p string, algs []string) (map[string]string, int64, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	return digestReader(f, algs)
+}
+
+// uploadChecksums returns the digests the client asked us to verify, keyed
+// by algorithm and in hex, from any X-Checksum-<ALG>, X-Content-SHA256 and
+// Content-MD5 request headers.
+func uploadChecksums(r *http.Request) (map[string]string, error) {
+	expected := map[string]string{}
+	add := func(header string, alg string, sum string) error {
+		if !validChecksum(alg, sum) {
+			return &malformedChecksumError{header, sum}
+		}
+		sum = strings.ToLower(sum)
+		if have, ok := expected[alg]; ok && have != sum {
+			return &conflictingChecksumError{alg}
+		}
+		expected[alg] = sum
+		return nil
+	}
+	for name, values := range r.Header {
+		if !strings.HasPrefix(name, checksumHeaderPrefix) || len(values) == 0 {
+			continue
+		}
+		alg := strings.ToLower(name[len(checksumHeaderPrefix):])
+		if _, ok := checksumAlgorithms[alg]; !ok {
+			return nil, &unsupportedChecksumError{alg}
+		}
+		if err := add(name, alg, strings.TrimSpace(values[0])); err != nil {
+			return nil, err
+		}
+	}
+	if sum := strings.TrimSpace(r.Header.Get(contentSHA256Header)); sum != "" {
+		if err := add(contentSHA256Header, "sha256", sum); err != nil {
+			return nil, err
+		}
+	}
+	if sum := strings.TrimSpace(r.Header.Get(contentMD5Header)); sum != "" {
+		raw, err := base64.StdEncoding.DecodeString(sum)
+		if err != nil || len(raw) != md5.Size {
+			return nil, &malformedChecksumError{contentMD5Header, sum}
+		}
+		if err := add(contentMD5Header, "md5", hex.EncodeToString(raw)); err != nil {
+			return nil, err
+		}
+	}
+	return expected, nil
+}
+
+// uploadAlgorithms lists the digests to take of an upload: the configured
+// ones, any the client sent, and always SHA-256, which the PUT response
+// reports.
+func uploadAlgorithms(expected map[string]string) []string {
+	algs := append([]string{"sha256"}, config.ChecksumAlgorithms...)
+	for alg := range expected {
+		algs = append(algs, alg)
+	}
+	return algs
+}
+
+// verifyUpload checks the body against any digests the client sent and
+// returns every digest that should be stored for it.
+func verifyUpload(r *http.Request, body []byte) (map[string]string, error) {
+	expected, err := uploadChecksums(r)
+	if err != nil {
+		return nil, err
+	}
+	sums := digestBytes(body, uploadAlgorithms(expected))
+	for alg, want := range expected {
+		if sums[alg] != want {
+			return nil, &checksumMismatchError{alg, want, sums[alg]}
+		}
+	}
+	return sums, nil
+}
+
+func checksumUploadError(w http.ResponseWriter, err error) {
+	log.Println(err.Error())
+	if _, ok := err.(*checksumMismatchError); ok {
+		w.Header().Set(errorCodeHeader, "checksum-mismatch")
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+func setChecksumHeaders(w http.ResponseWriter, sums map[string]string) {
+	for alg, sum := range sums {
+		// Bypass canonicalization so clients see X-Checksum-SHA256
+		w.Header()[checksumHeaderPrefix+strings.ToUpper(alg)] = []string{sum}
+	}
+}
+
+func readChecksums(dir string) (Checksums, error) {
+	sums := Checksums{Music: map[string]map[string]string{}}
+	data, err := ioutil.ReadFile(path.Join(dir, checksumsFileName))
+	if os.IsNotExist(err) {
+		return sums, nil
+	} else if err != nil {
+		return sums, err
+	}
+	err = json.Unmarshal(data, &sums)
+	if sums.Music == nil {
+		sums.Music = map[string]map[string]string{}
+	}
+	return sums, err
+}
+
+func writeChecksums(dir string, sums Checksums) error {
+	js, err := json.Marshal(sums)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path.Join(dir, checksumsFileName), js)
+}
+
+// recordChecksums replaces the stored digests for one file; rel is the path
+// under music/ or "" for the album art. The caller holds the holding mutex.
+func recordChecksums(dir string, rel string, fileSums map[string]string) error {
+	sums, err := readChecksums(dir)
+	if err != nil {
+		return err
+	}
+	if rel == "" {
+		sums.AlbumArt = fileSums
+	} else {
+		sums.Music[rel] = fileSums
+	}
+	return writeChecksums(dir, sums)
+}
+
+// checksumKey normalizes a requested path the same way uploads store it.
+func checksumKey(rel string) string {
+	return strings.TrimPrefix(path.Clean("/"+rel), "/")
+}
+
+func missingAlgorithms(have map[string]string) []string {
+	missing := []string{}
+	for _, alg := range config.ChecksumAlgorithms {
+		if _, ok := have[alg]; !ok {
+			missing = append(missing, alg)
+		}
+	}
+	return missing
+}
+
+func init() {
+	jobRunners["checksum-backfill"] = jobRunner{idempotent: true, run: runChecksumBackfill}
+}
+
+// runChecksumBackfill adds any configured digest that is missing from the
+// stored checksums of existing holdings, e.g. after a new algorithm has been
+// added to ChecksumAlgorithms. Reads are throttled to ChecksumBackfillRate.
+func runChecksumBackfill(job *Job) {
+	type pending struct {
+		uuid string
+		dir  string
+	}
+	holdings := []pending{}
+	err := walkHoldings(config.LibraryPath, func(uuid string, dir string, legacy bool) error {
+		holdings = append(holdings, pending{uuid, dir})
+		return nil
+	})
+	if err != nil {
+		job.fail("Checksum backfill: " + err.Error())
+		job.finish()
+		return
+	}
+
+	job.update(func(j *Job) {
+		j.HoldingsTotal = len(holdings)
+		j.HoldingsRemaining = len(holdings)
+	})
+	updated := 0
+	for _, h := range holdings {
+		n, err := backfillHoldingChecksums(h.uuid, h.dir)
+		if err != nil {
+			job.fail(h.uuid + ": " + err.Error())
+		} else if n > 0 {
+			updated++
+		}
+		job.update(func(j *Job) {
+			j.HoldingsRemaining--
+		})
+	}
+	job.finish()
+	if updated > 0 {
+		log.Printf("Backfilled checksums for %d holdings\n", updated)
+	}
+}
+
+func backfillHoldingChecksums(uuid string, dir string) (int, error) {
+	stored, err := readChecksums(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	files := []string{}
+	musicDir := path.Join(dir, "music")
+	err = walkFiles(musicDir, func(rel string) error {
+		if len(missingAlgorithms(stored.Music[rel])) > 0 {
+			files = append(files, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	sort.Strings(files)
+
+	computed := map[string]map[string]string{}
+	for _, rel := range files {
+		sums, n, err := digestFile(path.Join(musicDir, rel), missingAlgorithms(stored.Music[rel]))
+		if err != nil {
+			return 0, err
+		}
+		computed[rel] = sums
+		throttleBackfill(n)
+	}
+	var artSums map[string]string
+	if missing := missingAlgorithms(stored.AlbumArt); len(missing) > 0 {
+		sums, n, err := digestFile(path.Join(dir, "albumart"), missing)
+		if err != nil && !os.IsNotExist(err) {
+			return 0, err
+		} else if err == nil {
+			artSums = sums
+			throttleBackfill(n)
+		}
+	}
+	if len(computed) == 0 && artSums == nil {
+		return 0, nil
+	}
+
+	release, err := beginWrite()
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	// Hashing ran without the mutex, so merge into whatever is stored now
+	// and skip any file that changed in the meantime.
+	unlock := lockHolding(uuid)
+	defer unlock()
+	current, err := readChecksums(dir)
+	if err != nil {
+		return 0, err
+	}
+	for rel, sums := range computed {
+		if !sameDigests(stored.Music[rel], current.Music[rel]) {
+			continue
+		}
+		if current.Music[rel] == nil {
+			current.Music[rel] = map[string]string{}
+		}
+		for alg, sum := range sums {
+			current.Music[rel][alg] = sum
+		}
+	}
+	if artSums != nil && sameDigests(stored.AlbumArt, current.AlbumArt) {
+		if current.AlbumArt == nil {
+			current.AlbumArt = map[string]string{}
+		}
+		for alg, sum := range artSums {
+			current.AlbumArt[alg] = sum
+		}
+	}
+	return len(computed), writeChecksums(dir, current)
+}
+
+func sameDigests(a map[string]string, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for alg, sum := range a {
+		if b[alg] != sum {
+			return false
+		}
+	}
+	return true
+}
+
+func throttleBackfill(n int64) {
+	if config.ChecksumBackfillRate > 0 {
+		time.Sleep(time.Duration(float64(n) / float64(config.ChecksumBackfillRate) * float64(time.Second)))
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/wuvt/moss/mosstest"
+)
+
+// Uploads are checked against the digests their client sends, and nothing
+// is kept of one that doesn't match or whose digest can't be read.
+func TestUploadDigests(t *testing.T) {
+	s := newTestServer(t, mosstest.Spec{Holdings: []mosstest.Holding{{Tracks: []mosstest.Track{{Name: "01.flac"}}}}})
+	dir := holdingDir(s.Holdings[0].UUID)
+
+	for _, upload := range []struct {
+		name string
+		body []byte
+		path string
+		file string
+	}{
+		{"track", mosstest.FLAC(4096), s.Path(0, "music", "02.flac"), path.Join("music", "02.flac")},
+		{"album art", mosstest.PNG(8, 0x40), s.Path(0, "albumart"), "albumart"},
+	} {
+		sha := sha256.Sum256(upload.body)
+		md := md5.Sum(upload.body)
+		goodSHA := hex.EncodeToString(sha[:])
+		goodMD5 := base64.StdEncoding.EncodeToString(md[:])
+		wrongSHA := strings.Repeat("0", 64)
+		wrongMD5 := base64.StdEncoding.EncodeToString(make([]byte, md5.Size))
+
+		for _, c := range []struct {
+			name   string
+			header []string
+			status int
+			// Both digests are named on a mismatch
+			mentions []string
+		}{
+			{"wrong sha256", []string{contentSHA256Header, wrongSHA}, http.StatusUnprocessableEntity, []string{wrongSHA, goodSHA}},
+			{"wrong md5", []string{contentMD5Header, wrongMD5}, http.StatusUnprocessableEntity, []string{hex.EncodeToString(make([]byte, md5.Size)), hex.EncodeToString(md[:])}},
+			{"wrong md5 with a right sha256", []string{contentSHA256Header, goodSHA, contentMD5Header, wrongMD5}, http.StatusUnprocessableEntity, nil},
+			{"sha256 not hex", []string{contentSHA256Header, "not-a-digest"}, http.StatusBadRequest, []string{contentSHA256Header}},
+			{"sha256 too short", []string{contentSHA256Header, goodSHA[:62]}, http.StatusBadRequest, nil},
+			{"md5 not base64", []string{contentMD5Header, "%%%"}, http.StatusBadRequest, []string{contentMD5Header}},
+			{"md5 in hex", []string{contentMD5Header, hex.EncodeToString(md[:])}, http.StatusBadRequest, nil},
+			{"two different sha256", []string{contentSHA256Header, goodSHA, checksumHeaderPrefix + "SHA256", wrongSHA}, http.StatusBadRequest, nil},
+			{"unknown algorithm", []string{checksumHeaderPrefix + "CRC32", "00000000"}, http.StatusBadRequest, nil},
+		} {
+			resp := s.Do("PUT", upload.path, upload.body, c.header...)
+			if resp.Status != c.status {
+				t.Errorf("%s with %s got %d %s", upload.name, c.name, resp.Status, resp.Body)
+			}
+			if c.status == http.StatusUnprocessableEntity && resp.Header.Get(errorCodeHeader) != "checksum-mismatch" {
+				t.Errorf("%s with %s has error code %q", upload.name, c.name, resp.Header.Get(errorCodeHeader))
+			}
+			for _, m := range c.mentions {
+				if !strings.Contains(string(resp.Body), m) {
+					t.Errorf("%s with %s doesn't mention %s: %s", upload.name, c.name, m, resp.Body)
+				}
+			}
+			if _, err := os.Stat(path.Join(dir, upload.file)); !os.IsNotExist(err) {
+				t.Fatalf("%s with %s was kept: %v", upload.name, c.name, err)
+			}
+		}
+		if ents, err := os.ReadDir(tmpDir()); err != nil || len(ents) > 0 {
+			t.Errorf("refused uploads left %d files in tmp/: %v", len(ents), err)
+		}
+
+		for _, header := range [][]string{
+			{contentSHA256Header, goodSHA},
+			{contentSHA256Header, strings.ToUpper(goodSHA)},
+			{contentMD5Header, goodMD5},
+			{contentSHA256Header, goodSHA, contentMD5Header, goodMD5, checksumHeaderPrefix + "SHA256", goodSHA},
+			nil,
+		} {
+			s.MustDo("PUT", upload.path, upload.body, header...)
+			data, err := os.ReadFile(path.Join(dir, upload.file))
+			if err != nil || sha256.Sum256(data) != sha {
+				t.Errorf("%s with %v wasn't stored: %v", upload.name, header, err)
+			}
+		}
+	}
+
+	var holding Holding
+	s.MustDo("GET", s.Path(0), nil).JSON(t, &holding)
+	want := sha256.Sum256(mosstest.FLAC(4096))
+	if sum := holding.Checksums.Music["02.flac"]["sha256"]; sum != hex.EncodeToString(want[:]) {
+		t.Errorf("02.flac's stored sha256 is %q", sum)
+	}
+}
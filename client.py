@@ -46,7 +46,7 @@ if __name__ == "__main__":
 
         endpoint = urljoin(args['--server'], '/{}/lock'.format(album_uuid))
         r = requests.put(endpoint)
-        if r.status_code != 200:
+        if r.status_code != 201:
             print("ERROR: {}".format(r.body))
 
         endpoint = urljoin(args['--server'], '/{}'.format(album_uuid))
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Behind a load balancer every connection comes from the balancer, so moss
+// works out the client's address itself. With ProxyProtocol set, the TCP
+// listeners accept a PROXY protocol v1 or v2 header at the start of each
+// connection and take the connection's address from it. And for requests
+// from an address in TrustedProxies, X-Forwarded-For is followed back from
+// the right through trusted proxies, up to TrustedProxyHops of them if set,
+// with X-Real-IP used when there's no X-Forwarded-For. Forwarding headers
+// from anybody else are ignored. clientIP gives the result, for logs, the
+// rejection log and rate limits.
+
+// How long a new connection has to send its PROXY header
+const proxyHeaderTimeout = 5 * time.Second
+
+// The signature a PROXY protocol v2 header starts with
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var trustedProxies []*net.IPNet
+
+// Set while serving as a tenant, when every request comes from the parent
+var servingTenant bool
+
+type trustedProxyError struct {
+	entry string
+}
+
+func (e *trustedProxyError) Error() string {
+	return "TrustedProxies: " + e.entry + " is not an IP address or CIDR block"
+}
+
+type proxyHeaderError struct {
+	problem string
+}
+
+func (e *proxyHeaderError) Error() string {
+	return "PROXY header: " + e.problem
+}
+
+// initTrustedProxies parses TrustedProxies, where a bare address stands for
+// itself alone.
+func initTrustedProxies() error {
+	trustedProxies = nil
+	for _, entry := range config.TrustedProxies {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return &trustedProxyError{entry}
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			trustedProxies = append(trustedProxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, block, err := net.ParseCIDR(entry)
+		if err != nil {
+			return &trustedProxyError{entry}
+		}
+		trustedProxies = append(trustedProxies, block)
+	}
+	return nil
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, block := range trustedProxies {
+		if block.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client that made r.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer := net.ParseIP(host)
+	if !servingTenant && (peer == nil || !isTrustedProxy(peer)) {
+		return host
+	}
+
+	var forwarded []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(value, ",") {
+			forwarded = append(forwarded, strings.TrimSpace(hop))
+		}
+	}
+	if len(forwarded) == 0 {
+		if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+			return ip.String()
+		}
+		return host
+	}
+	for i, hops := len(forwarded)-1, 0; i >= 0; i-- {
+		ip := net.ParseIP(forwarded[i])
+		if ip == nil {
+			// Whoever added that can't be trusted to have done the rest
+			break
+		}
+		host = ip.String()
+		hops++
+		if !isTrustedProxy(ip) || (config.TrustedProxyHops > 0 && hops >= config.TrustedProxyHops) {
+			break
+		}
+	}
+	return host
+}
+
+// proxyListener reads a PROXY header from the start of each connection.
+type proxyListener struct {
+	net.Listener
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: c}, nil
+}
+
+// proxyConn reads its PROXY header on first use, so a slow client holds up
+// its own connection and not the accept loop.
+type proxyConn struct {
+	net.Conn
+	once   sync.Once
+	r      *bufio.Reader
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.r = bufio.NewReader(c.Conn)
+		c.remote = c.Conn.RemoteAddr()
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		remote, err := readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			log.Printf("Dropping connection from %s: %s\n", c.remote, err.Error())
+			c.err = err
+			c.Conn.Close()
+			return
+		}
+		// Only a proxy we trust gets to say where the connection is from
+		if remote != nil && (len(trustedProxies) == 0 || isTrustedProxy(addrIP(c.remote))) {
+			c.remote = remote
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remote
+}
+
+func addrIP(addr net.Addr) net.IP {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP
+	}
+	return nil
+}
+
+// readProxyHeader consumes a PROXY header if the connection starts with one.
+// It returns the source address it gives, or nil for a connection without a
+// header or one the proxy made for itself, such as a health check.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	start, err := r.Peek(len(proxyV2Signature))
+	if bytes.HasPrefix(start, []byte("PROXY ")) {
+		return readProxyV1(r)
+	} else if bytes.Equal(start, proxyV2Signature) {
+		return readProxyV2(r)
+	} else if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// readProxyV1 reads "PROXY TCP4 SRC DST SRCPORT DSTPORT\r\n".
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	// The longest valid line is 107 bytes
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, &proxyHeaderError{"v1 header is too long"}
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, &proxyHeaderError{"malformed v1 header"}
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, &proxyHeaderError{"malformed v1 source address"}
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyV2 reads the binary header: the signature, version and command,
+// address family, length and then the addresses followed by any TLVs.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, &proxyHeaderError{fmt.Sprintf("unknown version %d", header[12]>>4)}
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	if command := header[12] & 0xf; command == 0 {
+		// LOCAL: the proxy's own connection
+		return nil, nil
+	} else if command != 1 {
+		return nil, &proxyHeaderError{fmt.Sprintf("unknown command %d", command)}
+	}
+	switch header[13] >> 4 {
+	case 1:
+		if len(body) < 12 {
+			return nil, &proxyHeaderError{"short IPv4 addresses"}
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 2:
+		if len(body) < 36 {
+			return nil, &proxyHeaderError{"short IPv6 addresses"}
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	// Unix sockets and unspecified families carry nothing useful
+	return nil, nil
+}
+
+// serveTCP serves handler on addr, over TLS if useTLS, reading PROXY headers
+// when ProxyProtocol is set.
+func serveTCP(addr string, handler http.Handler, useTLS bool) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if config.ProxyProtocol {
+		l = &proxyListener{l}
+	}
+	srv := &http.Server{Addr: addr, Handler: handler}
+	if useTLS {
+		return srv.ServeTLS(l, config.TLSCert, config.TLSKey)
+	}
+	return srv.Serve(l)
+}
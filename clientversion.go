@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// features is advertised in /version so clients can detect what this server
+// supports instead of guessing from its version.
+var features = []string{"bulk-lock", "changes-feed", "checksums", "client-version", "lock-proposals", "shard-drain"}
+
+type clientVersionError struct {
+	client  string
+	minimum string
+}
+
+func (e *clientVersionError) Error() string {
+	return fmt.Sprintf("Client version %s is older than the minimum supported version %s, see /version for the supported features", e.client, e.minimum)
+}
+
+// parseVersion accepts "1.2.3" or "name/1.2.3" and returns the numeric parts.
+func parseVersion(v string) ([]int, error) {
+	if i := strings.LastIndex(v, "/"); i >= 0 {
+		v = v[i+1:]
+	}
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+	parts := []int{}
+	for _, s := range strings.Split(v, ".") {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("Invalid version %q", v)
+		}
+		parts = append(parts, n)
+	}
+	return parts, nil
+}
+
+func versionLess(a []int, b []int) bool {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			return x < y
+		}
+	}
+	return false
+}
+
+// checkClientVersion rejects requests from clients that report a version
+// older than MinClientVersion. Clients that don't send X-Moss-Client are let
+// through, as is /version so old clients can still find out what changed.
+func checkClientVersion(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := r.Header.Get("X-Moss-Client")
+		if config.MinClientVersion == "" || client == "" || r.URL.Path == "/version" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		minimum, err := parseVersion(config.MinClientVersion)
+		if err != nil {
+			// Rejected by config validation, but don't lock everyone out
+			next.ServeHTTP(w, r)
+			return
+		}
+		v, err := parseVersion(client)
+		if err != nil {
+			http.Error(w, "X-Moss-Client: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if versionLess(v, minimum) {
+			verr := &clientVersionError{client, config.MinClientVersion}
+			w.Header().Set("Link", "</version>; rel=\"help\"")
+			http.Error(w, verr.Error(), http.StatusUpgradeRequired)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultMaxClipLength = 30
+const defaultClipCacheSize = 20
+
+// Clips are cached per holding in clips/, keyed by source file, start and
+// length, and evicted least recently used first.
+const clipDirName = "clips"
+
+const maxTranscodedClip = 64 << 20
+const transcodeTimeout = time.Minute
+
+var clipTypes = map[string]string{
+	".mp3": "audio/mpeg",
+	".ogg": "audio/ogg",
+}
+
+type clipLengthError struct {
+	length float64
+	limit  float64
+}
+
+func (e *clipLengthError) Error() string {
+	return fmt.Sprintf("Clip length %g exceeds the limit of %g seconds", e.length, e.limit)
+}
+
+func parseClipParams(r *http.Request) (float64, float64, error) {
+	start, length := 0.0, config.MaxClipLength
+	var err error
+	if s := r.URL.Query().Get("start"); s != "" {
+		if start, err = strconv.ParseFloat(s, 64); err != nil || start < 0 {
+			return 0, 0, fmt.Errorf("start must be a number of seconds")
+		}
+	}
+	if s := r.URL.Query().Get("length"); s != "" {
+		if length, err = strconv.ParseFloat(s, 64); err != nil || length <= 0 {
+			return 0, 0, fmt.Errorf("length must be a positive number of seconds")
+		}
+	}
+	if length > config.MaxClipLength {
+		return 0, 0, &clipLengthError{length, config.MaxClipLength}
+	}
+	return start, length, nil
+}
+
+// cutClip cuts the slice out directly where the container allows it and
+// otherwise hands it to the configured transcoder. It returns the clip and
+// the file extension it should be cached under.
+func cutClip(ctx context.Context, src string, start float64, length float64) ([]byte, string, error) {
+	var data []byte
+	var err error
+	switch strings.ToLower(path.Ext(src)) {
+	case ".mp3":
+		data, err = cutMP3(src, start, length)
+		if err == nil {
+			return data, ".mp3", nil
+		}
+	case ".ogg", ".oga", ".opus":
+		data, err = cutOgg(src, start, length)
+		if err == nil {
+			return data, ".ogg", nil
+		}
+	default:
+		err = errUnsupportedCut
+	}
+	if err != errUnsupportedCut || len(config.ClipTranscoder) == 0 {
+		return nil, "", err
+	}
+	data, err = transcodeClip(ctx, src, start, length)
+	return data, ".clip", err
+}
+
+// transcodeClip runs ClipTranscoder, e.g.
+// ["ffmpeg", "-ss", "{start}", "-t", "{length}", "-i", "{input}", "-f", "mp3", "-"],
+// and returns what it writes to stdout.
+func transcodeClip(ctx context.Context, src string, start float64, length float64) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, transcodeTimeout)
+	defer cancel()
+
+	replacer := strings.NewReplacer(
+		"{input}", src,
+		"{start}", strconv.FormatFloat(start, 'f', -1, 64),
+		"{length}", strconv.FormatFloat(length, 'f', -1, 64),
+	)
+	args := []string{}
+	for _, arg := range config.ClipTranscoder[1:] {
+		args = append(args, replacer.Replace(arg))
+	}
+	cmd := exec.CommandContext(ctx, config.ClipTranscoder[0], args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(stdout, maxTranscodedClip))
+	if werr := cmd.Wait(); err == nil {
+		err = werr
+	}
+	return data, err
+}
+
+func clipContentType(ext string) string {
+	if ext == ".clip" {
+		return config.ClipTranscoderType
+	}
+	return clipTypes[ext]
+}
+
+// cachedClip finds a cached clip for key, whatever its extension.
+func cachedClip(cacheDir string, key string) (string, string) {
+	for _, ext := range []string{".mp3", ".ogg", ".clip"} {
+		p := path.Join(cacheDir, key+ext)
+		if _, err := os.Stat(p); err == nil {
+			return p, ext
+		}
+	}
+	return "", ""
+}
+
+// evictClips removes the least recently used clips beyond ClipCacheSize.
+// Cache hits bump a clip's mtime, so mtime order is use order.
+func evictClips(cacheDir string) {
+	dirEnts, err := ioutil.ReadDir(cacheDir)
+	if err != nil {
+		return
+	}
+	if len(dirEnts) <= config.ClipCacheSize {
+		return
+	}
+	sort.Slice(dirEnts, func(i, j int) bool {
+		return dirEnts[i].ModTime().Before(dirEnts[j].ModTime())
+	})
+	for _, dirEnt := range dirEnts[:len(dirEnts)-config.ClipCacheSize] {
+		os.Remove(path.Join(cacheDir, dirEnt.Name()))
+	}
+}
+
+// clipHandler handles GET /UUID4/clip/path/to/file?start=30&length=30.
+func clipHandler(w http.ResponseWriter, r *http.Request, params []string) {
+	uuid := params[0]
+	if err := uuidSanityCheck(uuid); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rel := strings.TrimPrefix(path.Clean("/"+strings.Join(params[2:], "/")), "/")
+	if rel == "" {
+		http.Error(w, "Insufficient parameters", http.StatusBadRequest)
+		return
+	}
+	start, length, err := parseClipParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if knownMissing(uuid) {
+		http.Error(w, "holding not found on disk", http.StatusNotFound)
+		return
+	}
+	dir := holdingDir(uuid)
+	if !dirExists(dir) {
+		rememberMissing(uuid)
+		http.Error(w, "holding not found on disk", http.StatusNotFound)
+		return
+	}
+	if archivedAway(w, uuid, dir) {
+		return
+	}
+
+	// The read reference keeps the holding from being removed while the
+	// clip is cut and cached, as for an archive
+	done := readHolding(uuid)
+	defer done()
+
+	stat, err := musicFileStat(dir, rel)
+	if err != nil || stat.IsDir() {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	if err := ensureSafePath(config.LibraryPath, path.Join(dir, "music", rel)); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if stat.Size() == 0 {
+		eerr := &emptyFileError{rel}
+		http.Error(w, eerr.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	// The source's ETag is part of the key so a re-uploaded file never gets
+	// a stale clip
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%g\x00%g", rel, fileETag(stat), start, length)))
+	key := hex.EncodeToString(sum[:16])
+	cacheDir := path.Join(dir, clipDirName)
+	w.Header().Set("ETag", "\"clip-"+key+"\"")
+
+	if p, ext := cachedClip(cacheDir, key); p != "" {
+		if release, err := beginWrite(); err == nil {
+			now := time.Now()
+			os.Chtimes(p, now, now)
+			release()
+		}
+		w.Header().Set("Content-Type", clipContentType(ext))
+		http.ServeFile(w, r, p)
+		return
+	}
+
+	data, ext, err := cutClip(r.Context(), path.Join(dir, "music", rel), start, length)
+	if err == errUnsupportedCut {
+		http.Error(w, "Clips of this format need a transcoder and none is configured", http.StatusNotImplemented)
+		return
+	} else if err != nil {
+		log.Printf("Clip of %s/%s failed: %s\n", uuid, rel, err.Error())
+		http.Error(w, "Could not cut clip: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	// A frozen library just doesn't get the clip cached. Mkdir rather than
+	// MkdirAll, so a holding that went away anyway isn't brought back as an
+	// empty directory with only clips in it.
+	if release, err := beginWrite(); err == nil {
+		if err := os.Mkdir(cacheDir, 0755); err == nil || os.IsExist(err) {
+			if err := writeFileAtomic(path.Join(cacheDir, key+ext), data); err != nil {
+				log.Println(err.Error())
+			}
+			evictClips(cacheDir)
+		}
+		release()
+	}
+
+	w.Header().Set("Content-Type", clipContentType(ext))
+	http.ServeContent(w, r, "", time.Now(), bytes.NewReader(data))
+}
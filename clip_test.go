@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/wuvt/moss/mosstest"
+)
+
+// A holding deleted while a clip of it is being cut is deleted once the clip
+// is done, and caching the clip doesn't bring its directory back.
+func TestClipDuringDelete(t *testing.T) {
+	started := path.Join(t.TempDir(), "started")
+	s := newTestServer(t, mosstest.Spec{Holdings: []mosstest.Holding{{
+		Tracks: []mosstest.Track{{Name: "01.flac"}},
+	}}}, func(c *Config) {
+		c.ClipTranscoder = []string{"sh", "-c", `touch "$0"; sleep 0.5; printf clip`, started}
+	})
+
+	clipped := make(chan *mosstest.Response)
+	go func() {
+		clipped <- s.Do("GET", s.Path(0, "clip", "01.flac")+"?start=0&length=5", nil)
+	}()
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(started); err == nil {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("the transcoder never started")
+		}
+	}
+
+	deleted := s.Do("DELETE", s.Path(0), nil)
+	if resp := <-clipped; resp.Status != http.StatusOK || string(resp.Body) != "clip" {
+		t.Errorf("clip got %d %q", resp.Status, resp.Body)
+	}
+	if deleted.Status != http.StatusOK {
+		t.Errorf("delete got %d %s", deleted.Status, deleted.Body)
+	}
+	if _, err := os.Stat(holdingDir(s.Holdings[0].UUID)); !os.IsNotExist(err) {
+		t.Errorf("the holding directory is still there: %v", err)
+	}
+}
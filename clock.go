@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Expiring transactions, temp files and lock proposals all trust the local
+// clock, which a dead CMOS battery can leave days out. So at startup and every
+// clockCheckInterval moss compares it with the Date header of every peer's
+// /version and of each of ClockCheckURLs. When the median skew is more than
+// MaxClockSkew seconds it logs an alert, and /readyz fails its clock check
+// until the skew is back within it. /stats reports the last check. With
+// SuspendExpiryOnClockSkew set, nothing is expired and no lock proposal can
+// be approved while the clock is off.
+const defaultMaxClockSkew = 60
+const clockCheckInterval = 10 * time.Minute
+const clockProbeTimeout = 10 * time.Second
+
+type ClockSource struct {
+	Name string
+	// Seconds the source is ahead of us; unset if it couldn't be asked
+	Skew  *float64 `json:",omitempty"`
+	Error string   `json:",omitempty"`
+}
+
+type ClockStatus struct {
+	CheckedAt Timestamp
+	// Median of the sources' skews, in seconds
+	Skew    float64
+	Skewed  bool
+	Sources []ClockSource
+}
+
+type clockSkewError struct {
+	skew float64
+}
+
+func (e *clockSkewError) Error() string {
+	way := "behind"
+	if e.skew < 0 {
+		way = "ahead of"
+	}
+	return fmt.Sprintf("The clock is %.0f seconds %s its peers and ClockCheckURLs, more than MaxClockSkew (%d)", math.Abs(e.skew), way, config.MaxClockSkew)
+}
+
+type clockProbeError struct {
+	status string
+}
+
+func (e *clockProbeError) Error() string {
+	return "Answered " + e.status + " with no usable Date header"
+}
+
+var clockStatus struct {
+	sync.Mutex
+	status *ClockStatus
+}
+
+// probeClock asks url for the time. The Date header only has whole seconds,
+// so it's taken to be half a second later than it says, and compared with
+// the middle of the round trip.
+func probeClock(url string, peer *Peer) (float64, error) {
+	req, err := http.NewRequest("HEAD", url, nil)
+	if err != nil {
+		return 0, err
+	}
+	if peer != nil {
+		req.SetBasicAuth(peer.ApiUser, peer.ApiKey)
+	}
+	client := &http.Client{Timeout: clockProbeTimeout}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	end := time.Now()
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return 0, &clockProbeError{resp.Status}
+	}
+	middle := start.Add(end.Sub(start) / 2)
+	return date.Add(500 * time.Millisecond).Sub(middle).Seconds(), nil
+}
+
+// checkClock asks every source at once and records what they said. It
+// returns nil when there's nobody to ask.
+func checkClock() *ClockStatus {
+	type source struct {
+		name string
+		url  string
+		peer *Peer
+	}
+	sources := []source{}
+	for i := range config.Peers {
+		sources = append(sources, source{config.Peers[i].Name, peerURL(config.Peers[i], "version"), &config.Peers[i]})
+	}
+	for _, url := range config.ClockCheckURLs {
+		sources = append(sources, source{url, url, nil})
+	}
+	if len(sources) == 0 {
+		return nil
+	}
+
+	status := &ClockStatus{Sources: make([]ClockSource, len(sources))}
+	var wg sync.WaitGroup
+	for i, s := range sources {
+		wg.Add(1)
+		go func(i int, s source) {
+			defer wg.Done()
+			status.Sources[i].Name = s.name
+			skew, err := probeClock(s.url, s.peer)
+			if err != nil {
+				status.Sources[i].Error = err.Error()
+				return
+			}
+			status.Sources[i].Skew = &skew
+		}(i, s)
+	}
+	wg.Wait()
+	status.CheckedAt = stamp(time.Now())
+
+	skews := []float64{}
+	for _, s := range status.Sources {
+		if s.Skew != nil {
+			skews = append(skews, *s.Skew)
+		}
+	}
+	if len(skews) > 0 {
+		sort.Float64s(skews)
+		status.Skew = skews[len(skews)/2]
+		if len(skews)%2 == 0 {
+			status.Skew = (skews[len(skews)/2-1] + skews[len(skews)/2]) / 2
+		}
+		status.Skewed = math.Abs(status.Skew) > float64(config.MaxClockSkew)
+	}
+
+	clockStatus.Lock()
+	was := clockStatus.status
+	clockStatus.status = status
+	clockStatus.Unlock()
+	if status.Skewed {
+		log.Printf("ALERT: %s\n", (&clockSkewError{status.Skew}).Error())
+		if config.SuspendExpiryOnClockSkew {
+			log.Println("ALERT: expiry is suspended until the clock is right")
+		}
+	} else if was != nil && was.Skewed {
+		log.Printf("The clock is right again, %.0f seconds off\n", status.Skew)
+	}
+	return status
+}
+
+func runClockChecks() {
+	for {
+		time.Sleep(clockCheckInterval)
+		checkClock()
+	}
+}
+
+func currentClockStatus() *ClockStatus {
+	clockStatus.Lock()
+	defer clockStatus.Unlock()
+	return clockStatus.status
+}
+
+// checkClockSkew is the readiness check on the clock.
+func checkClockSkew() error {
+	if status := currentClockStatus(); status != nil && status.Skewed {
+		return &clockSkewError{status.Skew}
+	}
+	return nil
+}
+
+// expirySuspended reports whether things that expire should be left alone
+// for now.
+func expirySuspended() bool {
+	return config.SuspendExpiryOnClockSkew && checkClockSkew() != nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// GET /cluster gathers every configured peer's /version and /stats, fetched
+// at once with a short timeout, alongside this node's own, so the state of
+// the cluster can be seen in one place. The view is cached for a few seconds
+// so dashboards polling it don't multiply requests across the cluster. A
+// peer that doesn't answer is marked unreachable, with the last data it gave
+// marked stale.
+const clusterCacheTTL = 10 * time.Second
+const clusterPeerTimeout = 5 * time.Second
+
+// Holdings are counted, and their disk usage measured, at startup and then
+// every so often, since doing so on each request would walk the whole library
+const holdingCountInterval = 10 * time.Minute
+
+type HoldingCount struct {
+	Count     int
+	CountedAt Timestamp
+}
+
+var holdingCount = struct {
+	sync.Mutex
+	count *HoldingCount
+}{}
+
+func setHoldingCount(n int) {
+	holdingCount.Lock()
+	defer holdingCount.Unlock()
+	holdingCount.count = &HoldingCount{n, stamp(time.Now())}
+}
+
+func currentHoldingCount() *HoldingCount {
+	holdingCount.Lock()
+	defer holdingCount.Unlock()
+	return holdingCount.count
+}
+
+func runHoldingCounts() {
+	for {
+		if err := refreshUsage(); err != nil {
+			log.Println("Disk usage: " + err.Error())
+		}
+		time.Sleep(holdingCountInterval)
+		scan, err := scanLibrary(config.LibraryPath)
+		if err != nil {
+			log.Println("Holding count: " + err.Error())
+			continue
+		}
+		setHoldingCount(scan.Holdings)
+	}
+}
+
+type ClusterNode struct {
+	// The peer's name in Peers, or "self"
+	Name string
+	URL  string `json:",omitempty"`
+	Self bool
+
+	Reachable bool
+	// Set when the data below is from an earlier contact
+	Stale       bool
+	LastContact *Timestamp `json:",omitempty"`
+	Error       string     `json:",omitempty"`
+
+	Version   string        `json:",omitempty"`
+	NodeName  string        `json:",omitempty"`
+	Location  string        `json:",omitempty"`
+	FreeSpace uint64        `json:",omitempty"`
+	Writable  bool          `json:",omitempty"`
+	Shards    []ShardStatus `json:",omitempty"`
+	Holdings  *HoldingCount `json:",omitempty"`
+}
+
+type ClusterView struct {
+	GeneratedAt Timestamp
+	Nodes       []ClusterNode
+}
+
+var clusterCache = struct {
+	sync.Mutex
+	view *ClusterView
+	// The last successful contact with each peer, by name
+	lastGood map[string]ClusterNode
+}{lastGood: map[string]ClusterNode{}}
+
+var clusterClient = &http.Client{Timeout: clusterPeerTimeout, CheckRedirect: checkPeerRedirect}
+
+func anyWritable(shards []ShardStatus) bool {
+	for _, shard := range shards {
+		if shard.Writable {
+			return true
+		}
+	}
+	return false
+}
+
+func localClusterNode() ClusterNode {
+	free, _ := libraryFreeSpace()
+	now := stamp(time.Now())
+	shards := shardStatuses()
+	return ClusterNode{
+		Name:        "self",
+		Self:        true,
+		Reachable:   true,
+		LastContact: &now,
+		Version:     "git",
+		NodeName:    config.NodeName,
+		Location:    config.Location,
+		FreeSpace:   free,
+		Writable:    anyWritable(shards),
+		Shards:      shards,
+		Holdings:    currentHoldingCount(),
+	}
+}
+
+// fetchPeerJSON GETs one of a peer's endpoints without the retries of
+// peerRequest, which would hold up the whole view for one slow peer.
+func fetchPeerJSON(ctx context.Context, peer Peer, endpoint string, v interface{}) error {
+	req, err := newPeerRequest(peer, "GET", peerURL(peer, endpoint), nil, 0)
+	if err != nil {
+		return err
+	}
+	resp, err := clusterClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &peerError{peer.Name, fmt.Sprintf("GET /%s returned %s", endpoint, resp.Status)}
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+type peerStatsSummary struct {
+	Holdings *HoldingCount
+}
+
+func peerClusterNode(peer Peer) (ClusterNode, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), clusterPeerTimeout)
+	defer cancel()
+	node := ClusterNode{Name: peer.Name, URL: peer.URL}
+	info := ServerInfo{}
+	if err := fetchPeerJSON(ctx, peer, "version", &info); err != nil {
+		return node, err
+	}
+	summary := peerStatsSummary{}
+	if err := fetchPeerJSON(ctx, peer, "stats", &summary); err != nil {
+		return node, err
+	}
+	now := stamp(time.Now())
+	node.Reachable = true
+	node.LastContact = &now
+	node.Version = info.Version
+	node.NodeName = info.NodeName
+	node.Location = info.Location
+	node.FreeSpace = info.FreeSpace
+	node.Writable = anyWritable(info.Shards)
+	node.Shards = info.Shards
+	node.Holdings = summary.Holdings
+	return node, nil
+}
+
+// clusterView returns the cached view, or gathers a new one once it is
+// older than clusterCacheTTL. Callers arriving meanwhile wait for it rather
+// than asking the peers again.
+func clusterView() ClusterView {
+	clusterCache.Lock()
+	defer clusterCache.Unlock()
+	if clusterCache.view != nil && time.Since(clusterCache.view.GeneratedAt.Time) < clusterCacheTTL {
+		return *clusterCache.view
+	}
+
+	peers := make([]ClusterNode, len(config.Peers))
+	errs := make([]error, len(config.Peers))
+	var wg sync.WaitGroup
+	for i, peer := range config.Peers {
+		wg.Add(1)
+		go func(i int, peer Peer) {
+			defer wg.Done()
+			peers[i], errs[i] = peerClusterNode(peer)
+		}(i, peer)
+	}
+	wg.Wait()
+
+	view := ClusterView{stamp(time.Now()), []ClusterNode{localClusterNode()}}
+	for i, node := range peers {
+		if errs[i] == nil {
+			clusterCache.lastGood[node.Name] = node
+			view.Nodes = append(view.Nodes, node)
+			continue
+		}
+		if last, ok := clusterCache.lastGood[node.Name]; ok {
+			node = last
+			node.Stale = true
+		}
+		node.Reachable = false
+		node.Error = errs[i].Error()
+		view.Nodes = append(view.Nodes, node)
+	}
+	clusterCache.view = &view
+	return view
+}
+
+func clusterHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	js, err := json.Marshal(clusterView())
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
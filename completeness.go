@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+)
+
+// A holding can say what it should contain, typically from the release an
+// importer found on MusicBrainz: how many tracks and, optionally, their
+// paths under music/ and lengths. PUT /UUID4/expected stores that in
+// expected.json, and GET /UUID4/completeness compares it with the tracks on
+// disk. With RequireComplete set, locking an incomplete holding is refused
+// unless ?force=1 is given; otherwise the lock goes ahead with a warning.
+const expectedFileName = "expected.json"
+
+// A track counts as short when it is this much shorter than expected, in
+// seconds or as a fraction of the expected length, whichever is more
+const shortTrackSlack = 2.0
+const shortTrackFraction = 0.02
+
+type ExpectedTrack struct {
+	Path string
+	// Seconds; 0 if unknown
+	Duration float64 `json:",omitempty"`
+}
+
+type Expectation struct {
+	// Where the expectation came from, such as a MusicBrainz release ID
+	Source     string `json:",omitempty"`
+	TrackCount int
+	Tracks     []ExpectedTrack `json:",omitempty"`
+}
+
+type ShortTrack struct {
+	Path     string
+	Expected float64
+	Actual   float64
+}
+
+type Completeness struct {
+	UUID string
+	// Unset when the holding declares no expectation, in which case nothing
+	// else is filled in
+	Declared       bool
+	Complete       bool
+	ExpectedTracks int
+	ActualTracks   int
+	Missing        []string
+	Extra          []string
+	Short          []ShortTrack
+}
+
+type expectationError struct {
+	problem string
+}
+
+func (e *expectationError) Error() string {
+	return e.problem
+}
+
+type incompleteError struct {
+	uuid string
+	c    Completeness
+}
+
+func (e *incompleteError) Error() string {
+	return fmt.Sprintf("%s is incomplete: %d of %d tracks, %d missing, %d extra, %d short", e.uuid, e.c.ActualTracks, e.c.ExpectedTracks, len(e.c.Missing), len(e.c.Extra), len(e.c.Short))
+}
+
+func (x *Expectation) validate() error {
+	if x.TrackCount < 0 {
+		return &expectationError{"TrackCount can't be negative"}
+	}
+	if len(x.Tracks) > 0 && x.TrackCount == 0 {
+		x.TrackCount = len(x.Tracks)
+	} else if len(x.Tracks) > 0 && x.TrackCount != len(x.Tracks) {
+		return &expectationError{fmt.Sprintf("TrackCount is %d but %d Tracks are listed", x.TrackCount, len(x.Tracks))}
+	}
+	if x.TrackCount == 0 {
+		return &expectationError{"Give a TrackCount or the Tracks"}
+	}
+	seen := map[string]bool{}
+	for _, t := range x.Tracks {
+		if t.Path == "" {
+			return &expectationError{"Every track needs a Path"}
+		}
+		if err := checkDotSegments(t.Path); err != nil {
+			return err
+		}
+		if seen[t.Path] {
+			return &expectationError{t.Path + " is listed twice"}
+		}
+		seen[t.Path] = true
+		if t.Duration < 0 || math.IsNaN(t.Duration) || math.IsInf(t.Duration, 0) {
+			return &expectationError{"A Duration must be a number of seconds"}
+		}
+	}
+	return nil
+}
+
+// readExpectation returns the holding's expectation, or nil if it has none.
+func readExpectation(dir string) (*Expectation, error) {
+	data, err := ioutil.ReadFile(path.Join(dir, expectedFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	x := &Expectation{}
+	err = json.Unmarshal(data, x)
+	return x, err
+}
+
+// checkCompleteness compares a holding's tracks with its expectation.
+func checkCompleteness(uuid string, dir string) (Completeness, error) {
+	c := Completeness{UUID: uuid, Missing: []string{}, Extra: []string{}, Short: []ShortTrack{}}
+	x, err := readExpectation(dir)
+	if err != nil || x == nil {
+		return c, err
+	}
+	c.Declared = true
+	c.ExpectedTracks = x.TrackCount
+
+	musicDir := path.Join(dir, "music")
+	tracks := map[string]bool{}
+	if err := walkFiles(musicDir, func(rel string) error {
+		if isTrack(rel) {
+			tracks[rel] = true
+		}
+		return nil
+	}); err != nil {
+		return c, err
+	}
+	c.ActualTracks = len(tracks)
+
+	if len(x.Tracks) > 0 {
+		expected := map[string]bool{}
+		for _, t := range x.Tracks {
+			expected[t.Path] = true
+			if !tracks[t.Path] {
+				c.Missing = append(c.Missing, t.Path)
+				continue
+			}
+			if t.Duration <= 0 {
+				continue
+			}
+			actual, ok := trackDuration(path.Join(musicDir, t.Path))
+			if ok && actual < t.Duration-math.Max(shortTrackSlack, t.Duration*shortTrackFraction) {
+				c.Short = append(c.Short, ShortTrack{t.Path, t.Duration, actual})
+			}
+		}
+		for rel := range tracks {
+			if !expected[rel] {
+				c.Extra = append(c.Extra, rel)
+			}
+		}
+		sort.Strings(c.Extra)
+	}
+	c.Complete = c.ActualTracks == c.ExpectedTracks && len(c.Missing) == 0 && len(c.Extra) == 0 && len(c.Short) == 0
+	return c, nil
+}
+
+// checkLockCompleteness is run before a lock. For a holding that doesn't
+// match its expectation it returns an incompleteError when RequireComplete
+// refuses the lock, or logs and returns the warning to give when it doesn't.
+func checkLockCompleteness(r *http.Request, uuid string) (string, error) {
+	c, err := checkCompleteness(uuid, uuidToPath(config.LibraryPath, uuid))
+	if err != nil {
+		return "", err
+	}
+	if !c.Declared || c.Complete {
+		return "", nil
+	}
+	ierr := &incompleteError{uuid, c}
+	if config.RequireComplete && r.URL.Query().Get("force") != "1" {
+		return "", ierr
+	}
+	log.Println("Locking anyway: " + ierr.Error())
+	return ierr.Error(), nil
+}
+
+// expectationHandler handles GET, PUT and DELETE /UUID4/expected.
+func expectationHandler(w http.ResponseWriter, r *http.Request, uuid string) {
+	if err := uuidSanityCheck(uuid); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		if err := checkWritable(uuid); err != nil {
+			writeRefused(w, err)
+			return
+		}
+		if err := prepareWrite(uuid); err != nil {
+			log.Println(err.Error())
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+	}
+
+	unlock := lockHolding(uuid)
+	defer unlock()
+
+	dir, _ := lookupHoldingDir(uuid)
+	if !dirExists(dir) {
+		http.Error(w, "holding not found on disk", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case "GET", "HEAD":
+		x, err := readExpectation(dir)
+		if err != nil {
+			storageError(w, err)
+			return
+		} else if x == nil {
+			http.Error(w, "No expectation declared", http.StatusNotFound)
+			return
+		}
+		js, _ := json.Marshal(x)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+	case "PUT":
+		body, ok := readUpload(w, r)
+		if !ok {
+			return
+		}
+		x := Expectation{}
+		if err := json.Unmarshal(body, &x); err != nil {
+			http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := x.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		js, _ := json.Marshal(x)
+		if err := writeFileAtomic(path.Join(dir, expectedFileName), js); err != nil {
+			storageError(w, err)
+			return
+		}
+		emitChange(uuid, "expected", "")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+	case "DELETE":
+		if err := os.Remove(path.Join(dir, expectedFileName)); os.IsNotExist(err) {
+			http.Error(w, "No expectation declared", http.StatusNotFound)
+			return
+		} else if err != nil {
+			storageError(w, err)
+			return
+		}
+		if err := syncDir(dir); err != nil {
+			storageError(w, err)
+			return
+		}
+		emitChange(uuid, "expected-delete", "")
+		fmt.Fprintf(w, "Expectation removed\n")
+	}
+}
+
+// completenessHandler handles GET /UUID4/completeness.
+func completenessHandler(w http.ResponseWriter, r *http.Request, uuid string) {
+	if err := uuidSanityCheck(uuid); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dir, _ := lookupHoldingDir(uuid)
+	if !dirExists(dir) {
+		http.Error(w, "holding not found on disk", http.StatusNotFound)
+		return
+	}
+	c, err := checkCompleteness(uuid, dir)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	js, err := json.Marshal(c)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+type DeleteResult struct {
+	UUID  string
+	Files int
+	Bytes int64
+}
+
+// countTree returns the number of regular files under dir and their size.
+func countTree(dir string) (int, int64, error) {
+	files := 0
+	var bytes int64
+	err := filepath.Walk(dir, func(p string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if f.Mode().IsRegular() {
+			files++
+			bytes += f.Size()
+		}
+		return nil
+	})
+	return files, bytes, err
+}
+
+// deleteHoldingHandler handles DELETE /UUID4, removing the holding's
+// directory with everything in it. Locked holdings are refused with 423
+// unless ?force=1 is given.
+func deleteHoldingHandler(w http.ResponseWriter, r *http.Request, uuid string) {
+	if err := uuidSanityCheck(uuid); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkWritable(uuid); err != nil {
+		writeRefused(w, err)
+		return
+	}
+
+	admit, err := excludeReaders(uuid)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	defer admit()
+	unlock := lockHolding(uuid)
+	defer unlock()
+
+	dir := holdingDir(uuid)
+	if err := ensureSafePath(config.LibraryPath, dir); err != nil || path.Clean(dir) == path.Clean(config.LibraryPath) {
+		log.Printf("Refusing to delete %s for %s\n", dir, uuid)
+		http.Error(w, "Refusing to delete outside of the library", http.StatusUnauthorized)
+		return
+	}
+	if !dirExists(dir) {
+		http.Error(w, "holding not found on disk", http.StatusNotFound)
+		return
+	}
+	if _, err := os.Stat(path.Join(dir, lockFileName)); err == nil && r.URL.Query().Get("force") != "1" {
+		http.Error(w, uuid+" is locked, pass ?force=1 to delete it anyway", http.StatusLocked)
+		return
+	}
+
+	result := DeleteResult{UUID: uuid}
+	result.Files, result.Bytes, err = countTree(dir)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		storageError(w, err)
+		return
+	}
+	if err := syncRemoved(dir); err != nil {
+		storageError(w, err)
+		return
+	}
+	emitChange(uuid, "delete", "")
+	forgetHoldingUsage(uuid)
+	user, _, _ := r.BasicAuth()
+	log.Printf("Deleted %s (%d files, %d bytes) for %s\n", uuid, result.Files, result.Bytes, user)
+
+	js, err := json.Marshal(result)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// forgetTrack drops a deleted track's checksums, tags, provenance and
+// attributes. The caller holds the holding mutex.
+func forgetTrack(dir string, rel string) error {
+	sums, err := readChecksums(dir)
+	if err != nil {
+		return err
+	}
+	if _, ok := sums.Music[rel]; ok {
+		delete(sums.Music, rel)
+		if err := writeChecksums(dir, sums); err != nil {
+			return err
+		}
+	}
+	if err := recordTags(dir, rel, TrackTags{}); err != nil {
+		return err
+	}
+	if err := recordProvenance(dir, path.Join("music", rel), nil); err != nil {
+		return err
+	}
+	attrs, err := readAttrs(dir)
+	if err != nil {
+		return err
+	}
+	if _, ok := attrs[rel]; ok {
+		delete(attrs, rel)
+		return writeAttrs(dir, attrs)
+	}
+	return nil
+}
+
+// removeEmptyParents removes the directories between p and root that the
+// removal of p left empty, stopping at the first that isn't.
+func removeEmptyParents(root string, p string) {
+	for dir := path.Dir(p); strings.HasPrefix(dir, root+"/"); dir = path.Dir(dir) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+	}
+}
+
+// trackDeleteHandler handles DELETE /UUID4/music/path/to/file, which only
+// unlocked holdings allow.
+func trackDeleteHandler(w http.ResponseWriter, r *http.Request, params []string) {
+	uuid := params[0]
+	if err := uuidSanityCheck(uuid); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkWritable(uuid); err != nil {
+		writeRefused(w, err)
+		return
+	}
+	if err := prepareWrite(uuid); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	unlock := lockHolding(uuid)
+	defer unlock()
+
+	dir := uuidToPath(config.LibraryPath, uuid)
+	if !dirExists(dir) {
+		http.Error(w, "holding not found on disk", http.StatusNotFound)
+		return
+	}
+	if _, err := os.Stat(path.Join(dir, lockFileName)); err == nil {
+		lerr := &lockExistsError{uuid}
+		stats.lockConflicts.add()
+		log.Println(lerr.Error())
+		http.Error(w, lerr.Error(), http.StatusLocked)
+		return
+	}
+	if err := checkLockProposal(uuid, dir); err != nil {
+		if _, ok := err.(*lockProposedError); !ok {
+			storageError(w, err)
+			return
+		}
+		stats.lockConflicts.add()
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if err := checkDotSegments(strings.Join(params[2:], "/")); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	storedName, err := applyPortableNames(strings.Join(params[2:], "/"))
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	musicDir := path.Join(dir, "music")
+	destPath := path.Join(musicDir, storedName)
+	if err := ensureInMusic(musicDir, destPath); err != nil {
+		log.Printf("Refusing to delete %s from %s\n", destPath, uuid)
+		http.Error(w, "Refusing to delete outside of the holding's music", http.StatusUnauthorized)
+		return
+	}
+	if stat, err := os.Stat(destPath); err != nil || stat.IsDir() {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+
+	if err := os.Remove(destPath); err != nil {
+		storageError(w, err)
+		return
+	}
+	removeEmptyParents(musicDir, destPath)
+	if err := syncRemoved(destPath); err != nil {
+		storageError(w, err)
+		return
+	}
+	rel := strings.TrimPrefix(destPath, musicDir+"/")
+	if err := forgetTrack(dir, rel); err != nil {
+		storageError(w, err)
+		return
+	}
+	emitChange(uuid, "delete", rel)
+	fmt.Fprintf(w, "deleted: %s\n", rel)
+}
+
+// albumArtDeleteHandler handles DELETE /UUID4/albumart. Like uploading art,
+// it is allowed after the holding is locked.
+func albumArtDeleteHandler(w http.ResponseWriter, r *http.Request, uuid string) {
+	if err := uuidSanityCheck(uuid); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkWritable(uuid); err != nil {
+		writeRefused(w, err)
+		return
+	}
+	if err := prepareWrite(uuid); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	unlock := lockHolding(uuid)
+	defer unlock()
+
+	dir := uuidToPath(config.LibraryPath, uuid)
+	artPath := path.Join(dir, "albumart")
+	if err := ensureSafePath(config.LibraryPath, artPath); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err := os.Remove(artPath); os.IsNotExist(err) {
+		http.Error(w, "No album art", http.StatusNotFound)
+		return
+	} else if err != nil {
+		storageError(w, err)
+		return
+	}
+	if err := syncRemoved(artPath); err != nil {
+		storageError(w, err)
+		return
+	}
+	if err := recordArtType(dir, ""); err != nil {
+		storageError(w, err)
+		return
+	}
+	// Otherwise repairs would bring the art back from a peer
+	if err := recordChecksums(dir, "", nil); err != nil {
+		storageError(w, err)
+		return
+	}
+	if err := recordProvenance(dir, "albumart", nil); err != nil {
+		storageError(w, err)
+		return
+	}
+	if err := forgetArchiveDigests(uuid, dir); err != nil {
+		storageError(w, err)
+		return
+	}
+	emitChange(uuid, "albumart-delete", "")
+	fmt.Fprintln(w, "deleted: albumart")
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/wuvt/moss/mosstest"
+)
+
+func TestTrackDelete(t *testing.T) {
+	s := newTestServer(t, mosstest.Spec{Holdings: []mosstest.Holding{{
+		Tracks: []mosstest.Track{
+			{Name: "01 Keep.flac", Contents: taggedFLAC("TITLE=Keep")},
+			{Name: "CD2/01 Typo.flac", Contents: taggedFLAC("TITLE=Typo")},
+		},
+	}}})
+	dir := holdingDir(s.Holdings[0].UUID)
+
+	s.MustDo("DELETE", s.Path(0, "music", "CD2", "01%20Typo.flac"), nil)
+
+	var holding Holding
+	s.MustDo("GET", s.Path(0), nil).JSON(t, &holding)
+	if len(holding.FileList) != 1 || holding.FileList[0] != "01 Keep.flac" {
+		t.Errorf("the holding lists %v", holding.FileList)
+	}
+	if holding.Checksums == nil || len(holding.Checksums.Music) != 1 || holding.Checksums.Music["CD2/01 Typo.flac"] != nil {
+		t.Errorf("the holding's checksums are %+v", holding.Checksums)
+	}
+	if _, ok := holding.Provenance["music/CD2/01 Typo.flac"]; ok {
+		t.Error("the deleted track's provenance is still there")
+	}
+	if tags, err := readTags(dir); err != nil || len(tags) != 1 || tags["CD2/01 Typo.flac"].Title != "" {
+		t.Errorf("the holding's tags are %+v, %v", tags, err)
+	}
+	// Emptied directories under music/ go, music/ itself stays
+	if _, err := os.Stat(path.Join(dir, "music", "CD2")); !os.IsNotExist(err) {
+		t.Errorf("CD2/ is still there: %v", err)
+	}
+	if resp := s.Do("GET", s.Path(0, "music", "CD2", "01%20Typo.flac"), nil); resp.Status != http.StatusNotFound {
+		t.Errorf("the deleted track got %d", resp.Status)
+	}
+
+	for _, c := range []struct {
+		path   string
+		status int
+	}{
+		{s.Path(0, "music", "CD2", "01%20Typo.flac"), http.StatusNotFound},
+		{s.Path(0, "music", "nothing.flac"), http.StatusNotFound},
+		{"/" + mosstest.NewUUID() + "/music/01.flac", http.StatusNotFound},
+	} {
+		if resp := s.Do("DELETE", c.path, nil); resp.Status != c.status {
+			t.Errorf("DELETE %s got %d %s", c.path, resp.Status, resp.Body)
+		}
+	}
+
+	s.MustDo("PUT", s.Path(0, "lock"), nil)
+	if resp := s.Do("DELETE", s.Path(0, "music", "01%20Keep.flac"), nil); resp.Status != http.StatusLocked {
+		t.Errorf("deleting from a locked holding got %d %s", resp.Status, resp.Body)
+	}
+	if _, err := os.Stat(path.Join(dir, "music", "01 Keep.flac")); err != nil {
+		t.Error(err)
+	}
+}
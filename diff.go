@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+type DiffFile struct {
+	Path  string
+	SizeA int64 `json:",omitempty"`
+	SizeB int64 `json:",omitempty"`
+}
+
+type DiffPair struct {
+	A interface{}
+	B interface{}
+}
+
+type HoldingDiff struct {
+	A         string
+	B         string
+	OnlyInA   []DiffFile
+	OnlyInB   []DiffFile
+	Different []DiffFile
+	Identical int
+	Artwork   string
+	Metadata  map[string]DiffPair
+}
+
+func fileSizes(root string) (map[string]int64, error) {
+	sizes := map[string]int64{}
+	err := walkFiles(root, func(rel string) error {
+		stat, err := os.Stat(path.Join(root, rel))
+		if err != nil {
+			return err
+		}
+		sizes[rel] = stat.Size()
+		return nil
+	})
+	return sizes, err
+}
+
+// sameContent compares two files by size and then by SHA-256.
+func sameContent(a string, b string) (bool, error) {
+	statA, err := os.Stat(a)
+	if err != nil {
+		return false, err
+	}
+	statB, err := os.Stat(b)
+	if err != nil {
+		return false, err
+	}
+	if statA.Size() != statB.Size() {
+		return false, nil
+	}
+	sumA, err := hashFile(a)
+	if err != nil {
+		return false, err
+	}
+	sumB, err := hashFile(b)
+	if err != nil {
+		return false, err
+	}
+	return sumA == sumB, nil
+}
+
+func compareArtwork(dirA string, dirB string) (string, error) {
+	artA := path.Join(dirA, "albumart")
+	artB := path.Join(dirB, "albumart")
+	_, errA := os.Stat(artA)
+	_, errB := os.Stat(artB)
+	switch {
+	case errA != nil && errB != nil:
+		return "none", nil
+	case errB != nil:
+		return "only-in-a", nil
+	case errA != nil:
+		return "only-in-b", nil
+	}
+	same, err := sameContent(artA, artB)
+	if err != nil {
+		return "", err
+	}
+	if same {
+		return "identical", nil
+	}
+	return "different", nil
+}
+
+func diffHoldings(a string, dirA string, b string, dirB string) (*HoldingDiff, error) {
+	diff := &HoldingDiff{A: a, B: b, OnlyInA: []DiffFile{}, OnlyInB: []DiffFile{}, Different: []DiffFile{}}
+
+	sizesA, err := fileSizes(path.Join(dirA, "music"))
+	if err != nil {
+		return nil, err
+	}
+	sizesB, err := fileSizes(path.Join(dirB, "music"))
+	if err != nil {
+		return nil, err
+	}
+
+	for name, sizeA := range sizesA {
+		sizeB, ok := sizesB[name]
+		if !ok {
+			diff.OnlyInA = append(diff.OnlyInA, DiffFile{name, sizeA, 0})
+			continue
+		}
+		same, err := sameContent(path.Join(dirA, "music", name), path.Join(dirB, "music", name))
+		if err != nil {
+			return nil, err
+		}
+		if same {
+			diff.Identical++
+		} else {
+			diff.Different = append(diff.Different, DiffFile{name, sizeA, sizeB})
+		}
+	}
+	for name, sizeB := range sizesB {
+		if _, ok := sizesA[name]; !ok {
+			diff.OnlyInB = append(diff.OnlyInB, DiffFile{name, 0, sizeB})
+		}
+	}
+	for _, list := range [][]DiffFile{diff.OnlyInA, diff.OnlyInB, diff.Different} {
+		sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	}
+
+	diff.Artwork, err = compareArtwork(dirA, dirB)
+	if err != nil {
+		return nil, err
+	}
+
+	diff.Metadata = map[string]DiffPair{}
+	_, lockA := os.Stat(path.Join(dirA, lockFileName))
+	_, lockB := os.Stat(path.Join(dirB, lockFileName))
+	if (lockA == nil) != (lockB == nil) {
+		diff.Metadata["Locked"] = DiffPair{lockA == nil, lockB == nil}
+	}
+	createdA, createdB := holdingCreatedAt(dirA), holdingCreatedAt(dirB)
+	if !createdA.Equal(createdB) {
+		diff.Metadata["CreatedAt"] = DiffPair{createdA, createdB}
+	}
+	return diff, nil
+}
+
+func diffHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	a := strings.ToLower(r.URL.Query().Get("a"))
+	b := strings.ToLower(r.URL.Query().Get("b"))
+	dirs := []string{}
+	for _, uuid := range []string{a, b} {
+		if err := uuidSanityCheck(uuid); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		dir := holdingDir(uuid)
+		if !dirExists(dir) {
+			http.Error(w, "holding not found on disk: "+uuid, http.StatusNotFound)
+			return
+		}
+		dirs = append(dirs, dir)
+	}
+
+	diff, err := diffHoldings(a, dirs[0], b, dirs[1])
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+
+	js, err := json.Marshal(diff)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// A holding digest identifies a locked holding's complete content with one
+// string. It is the SHA-256 of the music files' manifest, one
+// "path\nsize\nsha256\n" record per file in byte order of path, so any node
+// holding the same files computes the same digest.
+const digestHeader = "X-Moss-Digest"
+
+type LookupResult struct {
+	UUID     string
+	LockedAt Timestamp
+}
+
+func holdingDigest(dir string) (string, error) {
+	manifest, err := lockManifest(dir)
+	if err != nil {
+		return "", err
+	}
+	musicDir := path.Join(dir, "music")
+	h := sha256.New()
+	for _, file := range manifest {
+		sum := file.Checksums["sha256"]
+		if sum == "" {
+			// Libraries configured without sha256 still need it here
+			if sum, err = hashFile(path.Join(musicDir, file.Path)); err != nil {
+				return "", err
+			}
+		}
+		fmt.Fprintf(h, "%s\n%d\n%s\n", file.Path, file.Size, sum)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func isDigest(s string) bool {
+	if len(s) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// lookupHandler handles GET /lookup?digest=..., finding the locked holdings
+// with that content.
+func lookupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	digest := strings.ToLower(r.URL.Query().Get("digest"))
+	if !isDigest(digest) {
+		http.Error(w, "digest must be a hex SHA-256", http.StatusBadRequest)
+		return
+	}
+
+	results := []LookupResult{}
+	err := walkHoldings(config.LibraryPath, func(uuid string, dir string, legacy bool) error {
+		info, err := readLockInfo(dir)
+		if err == nil && info.Digest == digest {
+			results = append(results, LookupResult{strings.ToLower(uuid), info.LockedAt})
+		}
+		return nil
+	})
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	if len(results) == 0 {
+		http.Error(w, "No holding has that digest", http.StatusNotFound)
+		return
+	}
+
+	js, err := json.Marshal(results)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
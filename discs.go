@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Multi-disc releases keep each disc in its own top-level directory under
+// music/. Directories whose name matches DiscPattern are discs, numbered by
+// the pattern's first group. Any holding without such directories is one
+// implicit disc.
+const defaultDiscPattern = `(?i)^(?:cd|dis[ck]|volume|vol\.?)[\s_.-]*(\d+)\b`
+
+var discPattern = regexp.MustCompile(defaultDiscPattern)
+
+type Disc struct {
+	// 0 for the files that aren't on any numbered disc
+	Number    int
+	Directory string `json:",omitempty"`
+	Tracks    []string
+}
+
+type discPatternError struct {
+	pattern string
+}
+
+func (e *discPatternError) Error() string {
+	return "DiscPattern " + e.pattern + " must capture the disc number in a group"
+}
+
+func initDiscPattern() error {
+	if config.DiscPattern == "" {
+		return nil
+	}
+	re, err := regexp.Compile(config.DiscPattern)
+	if err != nil {
+		return err
+	}
+	if re.NumSubexp() < 1 {
+		return &discPatternError{config.DiscPattern}
+	}
+	discPattern = re
+	return nil
+}
+
+func isTrack(name string) bool {
+	return strings.HasPrefix(contentTypeByName(name), "audio/")
+}
+
+// naturalLess orders names the way people number tracks, so "2 Intro"
+// precedes "10 Outro". Runs of digits compare by value and the rest of
+// the name without regard to case.
+func naturalLess(a string, b string) bool {
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		ca, cb := a[i], b[j]
+		if isDigit(ca) && isDigit(cb) {
+			si := i
+			for i < len(a) && isDigit(a[i]) {
+				i++
+			}
+			sj := j
+			for j < len(b) && isDigit(b[j]) {
+				j++
+			}
+			na := strings.TrimLeft(a[si:i], "0")
+			nb := strings.TrimLeft(b[sj:j], "0")
+			if len(na) != len(nb) {
+				return len(na) < len(nb)
+			}
+			if na != nb {
+				return na < nb
+			}
+			continue
+		}
+		la, lb := lowerASCII(ca), lowerASCII(cb)
+		if la != lb {
+			return la < lb
+		}
+		i++
+		j++
+	}
+	if len(a)-i != len(b)-j {
+		return len(a)-i < len(b)-j
+	}
+	// Equal apart from case or leading zeros; fall back to byte order
+	return a < b
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func lowerASCII(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// detectDiscs groups a holding's tracks into discs, in disc order with the
+// tracks of each in natural order. Tracks outside any disc directory make up
+// a final disc 0, or the implicit disc 1 if nothing matched the pattern.
+func detectDiscs(files []string) []Disc {
+	discs := map[string]*Disc{}
+	loose := &Disc{Number: 0, Tracks: []string{}}
+	for _, rel := range files {
+		if !isTrack(rel) {
+			continue
+		}
+		parts := strings.SplitN(rel, "/", 2)
+		if len(parts) == 2 {
+			if m := discPattern.FindStringSubmatch(parts[0]); m != nil {
+				n, err := strconv.Atoi(m[1])
+				if err == nil {
+					disc, ok := discs[parts[0]]
+					if !ok {
+						disc = &Disc{Number: n, Directory: parts[0], Tracks: []string{}}
+						discs[parts[0]] = disc
+					}
+					disc.Tracks = append(disc.Tracks, rel)
+					continue
+				}
+			}
+		}
+		loose.Tracks = append(loose.Tracks, rel)
+	}
+
+	result := []Disc{}
+	for _, disc := range discs {
+		result = append(result, *disc)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Number != result[j].Number {
+			return result[i].Number < result[j].Number
+		}
+		return naturalLess(result[i].Directory, result[j].Directory)
+	})
+	if len(result) == 0 && len(loose.Tracks) > 0 {
+		loose.Number = 1
+	}
+	if len(loose.Tracks) > 0 {
+		result = append(result, *loose)
+	}
+	for _, disc := range result {
+		sort.Slice(disc.Tracks, func(i, j int) bool { return naturalLess(disc.Tracks[i], disc.Tracks[j]) })
+	}
+	return result
+}
+
+// playOrder returns files with the tracks first, disc by disc, followed by
+// everything else in byte order.
+func playOrder(files []string) []string {
+	ordered := []string{}
+	seen := map[string]bool{}
+	for _, disc := range detectDiscs(files) {
+		for _, rel := range disc.Tracks {
+			ordered = append(ordered, rel)
+			seen[rel] = true
+		}
+	}
+	rest := []string{}
+	for _, rel := range files {
+		if !seen[rel] {
+			rest = append(rest, rel)
+		}
+	}
+	sort.Strings(rest)
+	return append(ordered, rest...)
+}
+
+// playlistHandler handles GET /UUID4/playlist.m3u, the holding's tracks in play
+// order with paths relative to the playlist.
+func playlistHandler(w http.ResponseWriter, r *http.Request, uuid string) {
+	if err := uuidSanityCheck(uuid); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dir := holdingDir(uuid)
+	if !dirExists(dir) {
+		http.Error(w, "holding not found on disk", http.StatusNotFound)
+		return
+	}
+	done := readHolding(uuid)
+	defer done()
+	files := []string{}
+	if err := walkFiles(path.Join(dir, "music"), func(rel string) error {
+		files = append(files, rel)
+		return nil
+	}); err != nil {
+		storageError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "audio/x-mpegurl")
+	fmt.Fprint(w, "#EXTM3U\n")
+	// Zero-byte placeholders aren't anything a player could play
+	for _, disc := range detectDiscs(nonEmptyFiles(dir, files)) {
+		for _, rel := range disc.Tracks {
+			fmt.Fprintf(w, "music/%s\n", escapePath(rel))
+		}
+	}
+}
+
+func escapePath(rel string) string {
+	parts := strings.Split(rel, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
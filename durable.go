@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"path"
+)
+
+// With Durable set, uploads and locks are fsynced, along with the directory
+// entries that make them reachable, before the request is answered, so a 200
+// survives a power cut. Without it moss leaves flushing to the kernel, which
+// is much faster but can lose the last few seconds of writes.
+
+// syncFile flushes f to disk when Durable is set.
+func syncFile(f *os.File) error {
+	if !config.Durable {
+		return nil
+	}
+	return f.Sync()
+}
+
+// syncDir flushes the entries of dir to disk when Durable is set, making a
+// file renamed or created in it permanent.
+func syncDir(dir string) error {
+	if !config.Durable {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// makeDirs is os.MkdirAll that, when Durable is set, also syncs the parent of
+// each directory it had to create.
+func makeDirs(dir string) error {
+	dir = path.Clean(dir)
+	existing := dir
+	for !dirExists(existing) && existing != path.Dir(existing) {
+		existing = path.Dir(existing)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for p := dir; p != existing && p != path.Dir(p); p = path.Dir(p) {
+		if err := syncDir(path.Dir(p)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncRemoved makes the removal of p permanent when Durable is set, by
+// syncing the closest directory above it that's still there.
+func syncRemoved(p string) error {
+	dir := path.Dir(path.Clean(p))
+	for !dirExists(dir) && dir != path.Dir(dir) {
+		dir = path.Dir(dir)
+	}
+	return syncDir(dir)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"syscall"
+)
+
+// Some legacy holdings contain zero-byte placeholder files on purpose, and a
+// few have sparse WAVs from a broken ripper. Zero-byte files are kept and
+// listed like any other, with the checksums of empty content, but are left
+// out of playlists and can't be previewed. fsck warns about them, and about
+// sparse files, without failing unless StrictEmptyFiles is set. Sizes are
+// always the logical size; POST /UUID4/sizes also reports what is allocated.
+
+type emptyFileError struct {
+	rel string
+}
+
+func (e *emptyFileError) Error() string {
+	return fmt.Sprintf("%s is a zero-byte file and has nothing to preview", e.rel)
+}
+
+// physicalSize returns the bytes allocated on disk for a file, which is less
+// than its size if it's sparse.
+func physicalSize(stat os.FileInfo) int64 {
+	if sys, ok := stat.Sys().(*syscall.Stat_t); ok {
+		return sys.Blocks * 512
+	}
+	return stat.Size()
+}
+
+func isSparse(stat os.FileInfo) bool {
+	return stat.Mode().IsRegular() && physicalSize(stat) < stat.Size()
+}
+
+// emptyChecksums are the digests of zero bytes in every configured
+// algorithm, for zero-byte files that were never hashed.
+func emptyChecksums() map[string]string {
+	return digestBytes(nil, config.ChecksumAlgorithms)
+}
+
+// emptyFiles returns the zero-byte files among paths under a holding's music
+// directory.
+func emptyFiles(dir string, files []string) []string {
+	empty := []string{}
+	for _, rel := range files {
+		if stat, err := os.Stat(path.Join(dir, "music", rel)); err == nil && stat.Size() == 0 {
+			empty = append(empty, rel)
+		}
+	}
+	return empty
+}
+
+// nonEmptyFiles drops the zero-byte files from a list of paths under a
+// holding's music directory.
+func nonEmptyFiles(dir string, files []string) []string {
+	kept := []string{}
+	for _, rel := range files {
+		if stat, err := os.Stat(path.Join(dir, "music", rel)); err == nil && stat.Size() == 0 {
+			continue
+		}
+		kept = append(kept, rel)
+	}
+	return kept
+}
+
+// emptyAndSparseFiles finds a holding's zero-byte and sparse music files for
+// fsck.
+func emptyAndSparseFiles(dir string) ([]string, []string, error) {
+	musicDir := path.Join(dir, "music")
+	empty := []string{}
+	sparse := []string{}
+	err := walkFiles(musicDir, func(rel string) error {
+		stat, err := os.Stat(path.Join(musicDir, rel))
+		if err != nil {
+			return err
+		}
+		if stat.Size() == 0 {
+			empty = append(empty, rel)
+		} else if isSparse(stat) {
+			sparse = append(sparse, rel)
+		}
+		return nil
+	})
+	return empty, sparse, err
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With EventBus set, every change event is also published to a message
+// broker, as JSON with the holding's lock digest, to SUBJECT.TYPE such as
+// moss.changes.lock. Only NATS is supported so far, spoken directly over
+// TCP so that no client library is needed. Events wait in a bounded outbox
+// while the broker is unreachable, the oldest dropped once it's full, and
+// are sent in sequence order once it's back, reconnecting with backoff. A
+// batch only leaves the outbox once the server has answered the PING that
+// follows it, so an event may be delivered twice but isn't lost to a
+// dropped connection.
+const defaultEventBusSubject = "moss.changes"
+const defaultEventBusOutbox = 10000
+
+const eventBusTimeout = 10 * time.Second
+const eventBusBatch = 100
+
+type EventBus struct {
+	// "nats"
+	Type string
+	// nats://[user:password@]host[:port]
+	URL     string
+	Subject string
+	// Instead of credentials in the URL
+	User     string
+	Password string
+	Token    string
+	// Events kept while the broker is unreachable
+	OutboxSize int
+}
+
+type EventBusStats struct {
+	Type       string
+	Connected  bool
+	Published  uint64
+	Queued     int
+	Dropped    uint64
+	Reconnects uint64
+	LastError  string `json:",omitempty"`
+}
+
+type eventBusError struct {
+	problem string
+}
+
+func (e *eventBusError) Error() string {
+	return "EventBus: " + e.problem
+}
+
+type natsSink struct {
+	bus  EventBus
+	addr string
+	user string
+	pass string
+
+	mu       sync.Mutex
+	outbox   []SinkEvent
+	dropping bool
+	stats    EventBusStats
+	// Signalled when the outbox gains events
+	wake chan struct{}
+}
+
+var eventBus *natsSink
+
+// initEventBus checks EventBus and starts publishing to it.
+func initEventBus() error {
+	if config.EventBus == nil {
+		return nil
+	}
+	bus := *config.EventBus
+	if bus.Type != "nats" {
+		return &eventBusError{"Type must be nats, not " + bus.Type}
+	}
+	u, err := url.Parse(bus.URL)
+	if err != nil || u.Scheme != "nats" || u.Hostname() == "" {
+		return &eventBusError{"URL must look like nats://host:4222"}
+	}
+	if bus.Subject == "" {
+		bus.Subject = defaultEventBusSubject
+	}
+	if bus.OutboxSize == 0 {
+		bus.OutboxSize = defaultEventBusOutbox
+	}
+	s := &natsSink{bus: bus, addr: u.Host, user: bus.User, pass: bus.Password, wake: make(chan struct{}, 1)}
+	if u.Port() == "" {
+		s.addr = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	if u.User != nil {
+		s.user = u.User.Username()
+		s.pass, _ = u.User.Password()
+	}
+	s.stats.Type = bus.Type
+	eventBus = s
+	eventSinks = append(eventSinks, s)
+	go s.run()
+	return nil
+}
+
+func (s *natsSink) publish(event SinkEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.outbox) >= s.bus.OutboxSize {
+		if !s.dropping {
+			log.Printf("ALERT: event bus outbox is full at %d events, dropping the oldest\n", s.bus.OutboxSize)
+			s.dropping = true
+		}
+		s.outbox = s.outbox[1:]
+		s.stats.Dropped++
+	}
+	s.outbox = append(s.outbox, event)
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *natsSink) currentStats() EventBusStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := s.stats
+	stats.Queued = len(s.outbox)
+	return stats
+}
+
+func (s *natsSink) setError(err error, connected bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.LastError = err.Error()
+	s.stats.Connected = connected
+}
+
+func (s *natsSink) run() {
+	for attempt := 0; ; attempt++ {
+		conn, r, err := s.connect()
+		if err != nil {
+			s.setError(err, false)
+			if attempt == 0 {
+				log.Println("Event bus: " + err.Error())
+			}
+			time.Sleep(retryDelay(attempt))
+			continue
+		}
+		log.Println("Event bus: connected to " + s.addr)
+		s.mu.Lock()
+		s.stats.Connected = true
+		s.stats.LastError = ""
+		s.mu.Unlock()
+
+		err = s.deliver(conn, r)
+		conn.Close()
+		log.Println("Event bus: " + err.Error())
+		s.setError(err, false)
+		s.mu.Lock()
+		s.stats.Reconnects++
+		s.mu.Unlock()
+		// Start the backoff over
+		time.Sleep(retryDelay(0))
+		attempt = -1
+	}
+}
+
+// connect reads the server's INFO, sends CONNECT and waits for the PONG to
+// a PING, which comes after any error about the credentials.
+func (s *natsSink) connect() (net.Conn, *bufio.Reader, error) {
+	conn, err := net.DialTimeout("tcp", s.addr, eventBusTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Now().Add(eventBusTimeout))
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	} else if !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return nil, nil, &eventBusError{"expected INFO from the server, got " + strings.TrimSpace(line)}
+	}
+	options := map[string]interface{}{"verbose": false, "pedantic": false, "name": "moss", "lang": "go", "version": "git", "protocol": 0}
+	if s.user != "" {
+		options["user"] = s.user
+		options["pass"] = s.pass
+	}
+	if s.bus.Token != "" {
+		options["auth_token"] = s.bus.Token
+	}
+	js, _ := json.Marshal(options)
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", js); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "PONG" {
+			break
+		} else if strings.HasPrefix(line, "-ERR") {
+			conn.Close()
+			return nil, nil, &eventBusError{"server said " + line}
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, r, nil
+}
+
+// deliver sends the outbox in batches until the connection fails.
+func (s *natsSink) deliver(conn net.Conn, r *bufio.Reader) error {
+	var writeMu sync.Mutex
+	pongs := make(chan struct{}, 1)
+	failed := make(chan error, 1)
+	go func() {
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				failed <- err
+				return
+			}
+			switch line = strings.TrimSpace(line); {
+			case line == "PING":
+				writeMu.Lock()
+				_, err := conn.Write([]byte("PONG\r\n"))
+				writeMu.Unlock()
+				if err != nil {
+					failed <- err
+					return
+				}
+			case line == "PONG":
+				select {
+				case pongs <- struct{}{}:
+				default:
+				}
+			case strings.HasPrefix(line, "-ERR"):
+				failed <- &eventBusError{"server said " + line}
+				return
+			}
+		}
+	}()
+
+	for {
+		s.mu.Lock()
+		n := len(s.outbox)
+		if n > eventBusBatch {
+			n = eventBusBatch
+		}
+		batch := append([]SinkEvent{}, s.outbox[:n]...)
+		s.mu.Unlock()
+		if n == 0 {
+			select {
+			case <-s.wake:
+				continue
+			case err := <-failed:
+				return err
+			}
+		}
+
+		var buf strings.Builder
+		for _, event := range batch {
+			js, _ := json.Marshal(event)
+			fmt.Fprintf(&buf, "PUB %s.%s %d\r\n%s\r\n", s.bus.Subject, event.Type, len(js), js)
+		}
+		buf.WriteString("PING\r\n")
+		writeMu.Lock()
+		conn.SetWriteDeadline(time.Now().Add(eventBusTimeout))
+		_, err := conn.Write([]byte(buf.String()))
+		writeMu.Unlock()
+		if err != nil {
+			return err
+		}
+		select {
+		case <-pongs:
+		case err := <-failed:
+			return err
+		case <-time.After(eventBusTimeout):
+			return &eventBusError{"no PONG from the server"}
+		}
+
+		// Overflow may have dropped some of the batch meanwhile
+		last := batch[len(batch)-1].Seq
+		s.mu.Lock()
+		i := 0
+		for i < len(s.outbox) && s.outbox[i].Seq <= last {
+			i++
+		}
+		s.outbox = s.outbox[i:]
+		s.stats.Published += uint64(n)
+		if len(s.outbox) < s.bus.OutboxSize {
+			s.dropping = false
+		}
+		s.mu.Unlock()
+	}
+}
+
+// eventBusStats returns the publisher's figures, or nil without EventBus.
+func eventBusStats() *EventBusStats {
+	if eventBus == nil {
+		return nil
+	}
+	stats := eventBus.currentStats()
+	return &stats
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const maxChangeEvents = 10000
+
+type ChangeEvent struct {
+	Seq  uint64
+	Time Timestamp
+	UUID string
+	Type string
+	Path string `json:",omitempty"`
+}
+
+// SinkEvent is a change event as handed to the event sinks.
+type SinkEvent struct {
+	ChangeEvent
+	// Of the holding's lock, once it's locked
+	Digest string `json:",omitempty"`
+}
+
+// An eventSink is handed every change event as it's emitted, in sequence
+// order. publish is called with the changes mutex held, so it mustn't block;
+// the /changes feed keeps its own copy regardless.
+type eventSink interface {
+	publish(event SinkEvent)
+}
+
+// Set up at startup and not changed after
+var eventSinks []eventSink
+
+// changes keeps the most recent events in memory so followers can poll
+// /changes?since=N and pick up where they left off.
+var changes = struct {
+	sync.Mutex
+	seq    uint64
+	events []ChangeEvent
+}{}
+
+// emitChange records an event. Call it only once the change is complete and
+// visible on disk, after the last rename and, with Durable set, the fsyncs:
+// the event's sequence number is taken here, so a follower that sees the
+// event can always find what it describes, unless a later event has undone
+// it. Sequence numbers and times go up together in the order events are
+// emitted.
+func emitChange(uuid string, eventType string, p string) {
+	forgetMissing(uuid)
+	enqueueReplication(uuid)
+	if eventType == "lock" {
+		enqueueCatalog(uuid)
+	}
+	var digest string
+	if len(eventSinks) > 0 {
+		dir, _ := lookupHoldingDir(uuid)
+		if info, err := readLockInfo(dir); err == nil {
+			digest = info.Digest
+		}
+	}
+
+	changes.Lock()
+	defer changes.Unlock()
+	changes.seq++
+	now := stamp(time.Now())
+	// Even when the clock is stepped back, so sinceTime doesn't skip events
+	if n := len(changes.events); n > 0 && now.Before(changes.events[n-1].Time.Time) {
+		now = changes.events[n-1].Time
+	}
+	event := ChangeEvent{changes.seq, now, uuid, eventType, p}
+	changes.events = append(changes.events, event)
+	if len(changes.events) > maxChangeEvents {
+		changes.events = changes.events[len(changes.events)-maxChangeEvents:]
+	}
+	for _, sink := range eventSinks {
+		sink.publish(SinkEvent{event, digest})
+	}
+}
+
+// changesSeq returns the sequence number of the latest event.
+func changesSeq() uint64 {
+	changes.Lock()
+	defer changes.Unlock()
+	return changes.seq
+}
+
+func changesSince(seq uint64) []ChangeEvent {
+	changes.Lock()
+	defer changes.Unlock()
+	result := []ChangeEvent{}
+	for _, event := range changes.events {
+		if event.Seq > seq {
+			result = append(result, event)
+		}
+	}
+	return result
+}
+
+func changesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var since uint64
+	if s := r.URL.Query().Get("since"); s != "" {
+		var err error
+		since, err = strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			http.Error(w, "since must be a sequence number", http.StatusBadRequest)
+			return
+		}
+	}
+
+	events := changesSince(since)
+	if s := r.URL.Query().Get("sinceTime"); s != "" {
+		t, err := parseTimeParam("sinceTime", s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		later := []ChangeEvent{}
+		for _, event := range events {
+			if event.Time.After(t) {
+				later = append(later, event)
+			}
+		}
+		events = later
+	}
+
+	js, err := json.Marshal(events)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
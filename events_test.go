@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/wuvt/moss/mosstest"
+)
+
+// TestChangesHappenBefore hammers moss with uploads and locks while a
+// follower replays /changes, as a mirror would. Whatever event the follower
+// sees must describe something it can already find on disk, in sequence
+// order, and every mutation must have its event by the time it's answered.
+// It's most useful run with -race.
+func TestChangesHappenBefore(t *testing.T) {
+	s := newTestServer(t, mosstest.Spec{})
+	const (
+		writers = 8
+		tracks  = 12
+	)
+
+	shared := mosstest.NewUUID()
+	start := changesSeq()
+	stop := make(chan struct{})
+	followed := make(chan error, 1)
+	go func() {
+		since := start
+		var last Timestamp
+		check := func() error {
+			var events []ChangeEvent
+			resp := s.Do("GET", fmt.Sprintf("/changes?since=%d", since), nil)
+			if err := json.Unmarshal(resp.Body, &events); err != nil {
+				return fmt.Errorf("/changes: %d %s", resp.Status, resp.Body)
+			}
+			for _, event := range events {
+				if event.Seq != since+1 {
+					return fmt.Errorf("event %d came after %d", event.Seq, since)
+				}
+				if event.Time.Before(last.Time) {
+					return fmt.Errorf("event %d went back in time", event.Seq)
+				}
+				since, last = event.Seq, event.Time
+				dir := holdingDir(event.UUID)
+				var p string
+				switch event.Type {
+				case "music":
+					p = path.Join(dir, "music", event.Path)
+				case "lock":
+					p = path.Join(dir, lockFileName)
+				default:
+					continue
+				}
+				if _, err := os.Stat(p); err != nil {
+					return fmt.Errorf("event %d %s %s was seen before its file: %s", event.Seq, event.Type, event.Path, err)
+				}
+			}
+			return nil
+		}
+		for {
+			select {
+			case <-stop:
+				// Everything has been answered, so one last look sees it all
+				followed <- check()
+				return
+			default:
+			}
+			if err := check(); err != nil {
+				followed <- err
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Half the writers share a holding, so some uploads contend for
+			// its mutex and some don't
+			uuid := mosstest.NewUUID()
+			if i%2 == 1 {
+				uuid = shared
+			}
+			for j := 0; j < tracks; j++ {
+				name := fmt.Sprintf("w%d-%02d.flac", i, j)
+				resp := s.Do("PUT", "/"+uuid+"/music/"+name, mosstest.FLAC(0))
+				if resp.Status/100 != 2 {
+					errs <- fmt.Errorf("PUT %s: %d %s", name, resp.Status, resp.Body)
+					return
+				}
+				if !hasChange(uuid, "music", name) {
+					errs <- fmt.Errorf("PUT %s was answered before its event", name)
+					return
+				}
+			}
+			if i%2 == 0 {
+				if resp := s.Do("PUT", "/"+uuid+"/lock", nil); resp.Status/100 != 2 {
+					errs <- fmt.Errorf("lock %s: %d %s", uuid, resp.Status, resp.Body)
+				} else if !hasChange(uuid, "lock", "") {
+					errs <- fmt.Errorf("lock %s was answered before its event", uuid)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(stop)
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if err := <-followed; err != nil {
+		t.Error(err)
+	}
+	if want := uint64(writers*tracks + writers/2); changesSeq()-start != want {
+		t.Errorf("%d events for %d changes", changesSeq()-start, want)
+	}
+}
+
+func hasChange(uuid string, eventType string, p string) bool {
+	for _, event := range changesSince(0) {
+		if event.UUID == uuid && event.Type == eventType && event.Path == p {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ArchiveRecord is kept in holding.json once a holding has been exported to
+// an archive destination.
+type ArchiveRecord struct {
+	Destination  string
+	Location     string
+	Manifest     string
+	SHA256       string
+	ArchivedAt   Timestamp
+	LocalRemoved bool `json:",omitempty"`
+}
+
+// ExportManifest is uploaded next to the archive so the export can be
+// checked without the library that produced it.
+type ExportManifest struct {
+	UUID          string
+	Lock          LockInfo
+	Files         []ExportFile
+	AlbumArt      *ExportFile `json:",omitempty"`
+	ArchiveSHA256 string
+}
+
+type ExportFile struct {
+	Path      string
+	Size      int64
+	Checksums map[string]string
+}
+
+type ExportRequest struct {
+	Destination string
+	DeleteLocal bool
+}
+
+type archivedError struct {
+	uuid     string
+	location string
+}
+
+func (e *archivedError) Error() string {
+	return fmt.Sprintf("%s has been moved to cold storage at %s", e.uuid, e.location)
+}
+
+// One export or restore at a time per holding
+var exports = struct {
+	sync.Mutex
+	m map[string]*Job
+}{m: map[string]*Job{}}
+
+// archivedAway answers 410 for holdings whose music only exists in cold
+// storage, pointing at where it went.
+func archivedAway(w http.ResponseWriter, uuid string, dir string) bool {
+	info, err := readHoldingInfo(dir)
+	if err != nil || info.Archive == nil || !info.Archive.LocalRemoved {
+		return false
+	}
+	aerr := &archivedError{uuid, info.Archive.Location}
+	w.Header().Set("X-Moss-Archive-Location", info.Archive.Location)
+	w.Header().Set(backendHeader, archiveBackend(info.Archive.Destination))
+	http.Error(w, aerr.Error(), http.StatusGone)
+	return true
+}
+
+// ExportJobParams are saved with archive-to and restore-from-archive jobs.
+type ExportJobParams struct {
+	UUID string
+	ExportRequest
+}
+
+func init() {
+	for _, jobType := range []string{"archive-to", "restore-from-archive"} {
+		// Both delete local files, so a restart leaves them for an admin
+		jobRunners[jobType] = jobRunner{
+			run:         runExportJob,
+			interrupted: trackExportJob,
+		}
+	}
+}
+
+func trackExportJob(job *Job) {
+	params := ExportJobParams{}
+	if err := job.decodeParams(&params); err != nil {
+		log.Printf("Job %s: %s\n", job.ID, err.Error())
+		return
+	}
+	exports.Lock()
+	exports.m[params.UUID] = job
+	exports.Unlock()
+}
+
+func startExportJob(w http.ResponseWriter, uuid string, jobType string, req ExportRequest) {
+	exports.Lock()
+	if job, ok := exports.m[uuid]; ok && job.active() {
+		exports.Unlock()
+		writeJob(w, job, http.StatusConflict)
+		return
+	}
+	job := newJob(jobType, ExportJobParams{uuid, req})
+	exports.m[uuid] = job
+	exports.Unlock()
+
+	go runExportJob(job)
+	writeJob(w, job, http.StatusAccepted)
+}
+
+func runExportJob(job *Job) {
+	job.update(func(j *Job) {
+		j.HoldingsTotal = 1
+		j.HoldingsRemaining = 1
+	})
+	params := ExportJobParams{}
+	err := job.decodeParams(&params)
+	if err == nil {
+		trackExportJob(job)
+		dir := uuidToPath(config.LibraryPath, params.UUID)
+		if job.Type == "restore-from-archive" {
+			err = restoreFromRecord(job, params.UUID, dir)
+		} else if dest, ok := findDestination(params.Destination); !ok {
+			err = &unknownDestinationError{params.Destination}
+		} else {
+			err = exportHolding(job, params.UUID, dir, dest, params.DeleteLocal)
+		}
+	}
+	if err != nil {
+		job.fail(params.UUID + ": " + err.Error())
+	}
+	job.update(func(j *Job) {
+		if len(j.Failures) == 0 {
+			j.HoldingsRemaining = 0
+		}
+	})
+	job.finish()
+}
+
+type unknownDestinationError struct {
+	name string
+}
+
+func (e *unknownDestinationError) Error() string {
+	return "Unknown archive destination " + e.name
+}
+
+// restoreFromRecord restores a holding from wherever its archive record says
+// it went.
+func restoreFromRecord(job *Job, uuid string, dir string) error {
+	info, err := readHoldingInfo(dir)
+	if err != nil {
+		return err
+	}
+	if info.Archive == nil || !info.Archive.LocalRemoved {
+		// Finished before the restart
+		return nil
+	}
+	dest, ok := findDestination(info.Archive.Destination)
+	if !ok {
+		return &unknownDestinationError{info.Archive.Destination}
+	}
+	return restoreHolding(job, uuid, dir, dest, *info.Archive)
+}
+
+// exportHandler handles POST /UUID4/archive-to and /UUID4/restore-from-archive.
+func exportHandler(w http.ResponseWriter, r *http.Request, uuid string, restore bool) {
+	if err := uuidSanityCheck(uuid); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !checkAuth(w, r) {
+		return
+	}
+	release, ok := guardWrite(w)
+	if !ok {
+		return
+	}
+	defer release()
+	if err := checkWritable(uuid); err != nil {
+		writeRefused(w, err)
+		return
+	}
+	if err := prepareWrite(uuid); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	dir := uuidToPath(config.LibraryPath, uuid)
+	if !dirExists(dir) {
+		http.Error(w, "holding not found on disk", http.StatusNotFound)
+		return
+	}
+	if _, err := os.Stat(path.Join(dir, lockFileName)); err != nil {
+		http.Error(w, "Only locked holdings can be archived", http.StatusConflict)
+		return
+	}
+	info, err := readHoldingInfo(dir)
+	if err != nil && !os.IsNotExist(err) {
+		storageError(w, err)
+		return
+	}
+	user, _, _ := r.BasicAuth()
+
+	if restore {
+		if info.Archive == nil || !info.Archive.LocalRemoved {
+			http.Error(w, "Holding has not been removed to cold storage", http.StatusConflict)
+			return
+		}
+		if _, ok := findDestination(info.Archive.Destination); !ok {
+			http.Error(w, "Unknown archive destination "+info.Archive.Destination, http.StatusConflict)
+			return
+		}
+		log.Printf("Restore of %s from %s started by %s\n", uuid, info.Archive.Location, user)
+		startExportJob(w, uuid, "restore-from-archive", ExportRequest{Destination: info.Archive.Destination})
+		return
+	}
+
+	req := ExportRequest{}
+	body, ok := readUpload(w, r)
+	if !ok {
+		return
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	dest, ok := findDestination(req.Destination)
+	if !ok {
+		http.Error(w, "Unknown archive destination "+req.Destination, http.StatusBadRequest)
+		return
+	}
+	if info.Archive != nil && info.Archive.LocalRemoved {
+		http.Error(w, "Holding is already in cold storage at "+info.Archive.Location, http.StatusConflict)
+		return
+	}
+	log.Printf("Export of %s to %s started by %s\n", uuid, dest.Name, user)
+	startExportJob(w, uuid, "archive-to", req)
+}
+
+func exportHolding(job *Job, uuid string, dir string, dest ArchiveDestination, deleteLocal bool) error {
+	done := readHolding(uuid)
+	defer done()
+	entries, err := archiveEntries(uuid, dir)
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, entry := range entries {
+		total += entry.size
+	}
+	job.update(func(j *Job) {
+		j.BytesTotal = total
+		j.BytesRemaining = total
+	})
+
+	// Build the same tarball GET /UUID4/archive serves, in tmp/ so it can be
+	// uploaded with a known length and digest
+	f, err := ioutil.TempFile(tmpDir(), "export-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	h := sha256.New()
+	err = writeTar(io.MultiWriter(f, h), entries, archiveModTime(dir))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	archiveSum := hex.EncodeToString(h.Sum(nil))
+
+	manifest, err := exportManifest(uuid, dir, archiveSum)
+	if err != nil {
+		return err
+	}
+	js, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	mf, err := ioutil.TempFile(tmpDir(), "export-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(mf.Name())
+	_, err = mf.Write(js)
+	if cerr := mf.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	manifestSum := sha256.Sum256(js)
+	done()
+
+	archiveKey := dest.objectKey(uuid + ".tar")
+	manifestKey := dest.objectKey(uuid + ".manifest.json")
+	if err := s3PutFile(dest, archiveKey, f.Name(), archiveSum, "application/x-tar", dest.StorageClass); err != nil {
+		return err
+	}
+	job.update(func(j *Job) { j.BytesRemaining = 0 })
+	// The manifest stays in the default storage class so it can be read
+	// without a Glacier restore
+	if err := s3PutFile(dest, manifestKey, mf.Name(), hex.EncodeToString(manifestSum[:]), "application/json", ""); err != nil {
+		return err
+	}
+
+	record := ArchiveRecord{
+		Destination: dest.Name,
+		Location:    dest.location(archiveKey),
+		Manifest:    dest.location(manifestKey),
+		SHA256:      archiveSum,
+		ArchivedAt:  stamp(time.Now()),
+	}
+	release, err := beginWrite()
+	if err != nil {
+		return err
+	}
+	defer release()
+	if deleteLocal {
+		admit, err := excludeReaders(uuid)
+		if err != nil {
+			return err
+		}
+		defer admit()
+	}
+	unlock := lockHolding(uuid)
+	defer unlock()
+
+	if err := updateArchiveRecord(dir, &record); err != nil {
+		return err
+	}
+	log.Printf("Exported %s to %s\n", uuid, record.Location)
+	emitChange(uuid, "archive", "")
+	if !deleteLocal {
+		return nil
+	}
+
+	// Drop the music but keep the sidecars, so the holding still lists and
+	// answers 410 with the archive location
+	if err := os.RemoveAll(path.Join(dir, "music")); err != nil {
+		return err
+	}
+	for _, name := range []string{"albumart", masterArtFileName, derivedArtFileName} {
+		if err := os.Remove(path.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := syncRemoved(path.Join(dir, "music")); err != nil {
+		return err
+	}
+	record.LocalRemoved = true
+	if err := updateArchiveRecord(dir, &record); err != nil {
+		return err
+	}
+	log.Printf("Removed local music of %s after export\n", uuid)
+	emitChange(uuid, "delete", "")
+	return nil
+}
+
+func updateArchiveRecord(dir string, record *ArchiveRecord) error {
+	info, err := readHoldingInfo(dir)
+	if os.IsNotExist(err) {
+		info = HoldingInfo{CreatedAt: stamp(inferCreatedAt(dir))}
+	} else if err != nil {
+		return err
+	}
+	info.Archive = record
+	return writeHoldingInfo(dir, info)
+}
+
+func exportManifest(uuid string, dir string, archiveSum string) (ExportManifest, error) {
+	manifest := ExportManifest{UUID: uuid, Files: []ExportFile{}, ArchiveSHA256: archiveSum}
+	lock, err := readLockInfo(dir)
+	if err != nil {
+		return manifest, err
+	}
+	manifest.Lock = lock
+	sums, err := localChecksums(dir)
+	if err != nil {
+		return manifest, err
+	}
+	musicDir := path.Join(dir, "music")
+	err = walkFiles(musicDir, func(rel string) error {
+		stat, err := os.Stat(path.Join(musicDir, rel))
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, ExportFile{rel, stat.Size(), sums.Music[rel]})
+		return nil
+	})
+	if err != nil {
+		return manifest, err
+	}
+	if stat, err := os.Stat(path.Join(dir, "albumart")); err == nil {
+		manifest.AlbumArt = &ExportFile{"albumart", stat.Size(), sums.AlbumArt}
+	}
+	return manifest, nil
+}
+
+// restoreHolding unpacks an exported archive into tmp/, checks it against
+// the recorded digests and only then moves the music back into place.
+func restoreHolding(job *Job, uuid string, dir string, dest ArchiveDestination, record ArchiveRecord) error {
+	key := strings.TrimPrefix(record.Location, "s3://"+dest.Bucket+"/")
+	body, err := s3Get(dest, key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	staging, err := ioutil.TempDir(tmpDir(), "restore-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	h := sha256.New()
+	tr := tar.NewReader(io.TeeReader(body, h))
+	prefix := uuid + "/"
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		name := path.Clean(hdr.Name)
+		if hdr.Typeflag != tar.TypeReg || !strings.HasPrefix(name, prefix) {
+			return &s3Error{dest.Name, "unexpected archive entry " + hdr.Name}
+		}
+		rel := name[len(prefix):]
+		if rel != "albumart" && !strings.HasPrefix(rel, "music/") {
+			return &s3Error{dest.Name, "unexpected archive entry " + hdr.Name}
+		}
+		target := path.Join(staging, rel)
+		if err := os.MkdirAll(path.Dir(target), 0755); err != nil {
+			return err
+		}
+		out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, tr)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// Read any padding so the digest covers the whole object
+	io.Copy(h, body)
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != record.SHA256 {
+		return &checksumMismatchError{"sha256", record.SHA256, sum}
+	}
+
+	sums, err := readChecksums(dir)
+	if err != nil {
+		return err
+	}
+	err = walkFiles(path.Join(staging, "music"), func(rel string) error {
+		want, ok := sums.Music[rel]["sha256"]
+		if !ok {
+			return nil
+		}
+		got, err := hashFile(path.Join(staging, "music", rel))
+		if err != nil {
+			return err
+		}
+		if got != want {
+			return &checksumMismatchError{"sha256", want, got}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	release, err := beginWrite()
+	if err != nil {
+		return err
+	}
+	defer release()
+	unlock := lockHolding(uuid)
+	defer unlock()
+
+	if err := os.Rename(path.Join(staging, "music"), path.Join(dir, "music")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(path.Join(staging, "albumart"), path.Join(dir, "albumart")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := restoredProvenance(dir, record.Location); err != nil {
+		return err
+	}
+	record.LocalRemoved = false
+	if err := updateArchiveRecord(dir, &record); err != nil {
+		return err
+	}
+	log.Printf("Restored %s from %s\n", uuid, record.Location)
+	emitChange(uuid, "restore", "")
+	return nil
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// With ExportTree set, moss keeps export-tree/ under the library root as an
+// Artist/Album tree of hardlinks to the music of every holding, for playout
+// systems that can only read a mounted filesystem. Being under the library
+// root keeps the links on the same filesystem. The tree is derived data: it
+// is rebuilt at startup, followed from the changes feed while running and
+// fully reconciled every holdingCountInterval, fsck never looks at it and
+// deleting it is always safe. Holdings that are private or whose tags don't
+// say what they are stay out of it and are listed by GET /export-tree.
+const exportTreeDirName = "export-tree"
+
+// Inside the tree: where each holding was placed, and where a holding's
+// directory is assembled before being renamed into place
+const exportTreeStateFileName = ".moss-export-tree.json"
+const exportTreeStagingDirName = ".staging"
+
+const exportTreeIdleInterval = 5 * time.Second
+
+// Path elements are cut to this many bytes, leaving room for a collision
+// suffix under the usual 255-byte limit
+const maxExportTreeName = 200
+
+const variousArtists = "Various Artists"
+
+type ExportTreeUnplaced struct {
+	UUID   string
+	Reason string
+}
+
+type ExportTreeReport struct {
+	Enabled  bool
+	Path     string     `json:",omitempty"`
+	LastSync *Timestamp `json:",omitempty"`
+	// How many holdings are in the tree
+	Placed   int
+	Unplaced []ExportTreeUnplaced
+}
+
+type exportTree struct {
+	sync.Mutex
+	// Relative directory of each placed holding
+	placed   map[string]string
+	unplaced map[string]string
+	lastSync time.Time
+	seq      uint64
+}
+
+var tree = &exportTree{placed: map[string]string{}, unplaced: map[string]string{}}
+
+type unplaceableError struct {
+	reason string
+}
+
+func (e *unplaceableError) Error() string {
+	return e.reason
+}
+
+func exportTreeDir() string {
+	return path.Join(config.LibraryPath, exportTreeDirName)
+}
+
+// exportTreeName makes a tag value safe to use as one path element.
+func exportTreeName(name string) string {
+	name = sanitizeName(strings.ReplaceAll(strings.TrimSpace(name), "/", "_"))
+	// No hidden entries, so nothing can be mistaken for the tree's own
+	name = strings.TrimLeft(name, ".")
+	for len(name) > maxExportTreeName {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	if name == "" {
+		return "_"
+	}
+	return name
+}
+
+// exportTreePlacement reads a holding's tags and returns the Artist and Album
+// directory names it belongs under.
+func exportTreePlacement(dir string, files []string) (string, string, error) {
+	info, err := readHoldingInfo(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return "", "", err
+	}
+	if info.Private {
+		return "", "", &unplaceableError{"private"}
+	}
+	tags, err := readTags(dir)
+	if err != nil {
+		return "", "", err
+	}
+	summary := summarizeTags(detectDiscs(files), tags)
+	if summary == nil {
+		return "", "", &unplaceableError{"no tagged tracks"}
+	}
+	artist := summary.AlbumArtist
+	if artist == "" && (summary.Compilation || len(summary.Artists) > 1) {
+		artist = variousArtists
+	} else if artist == "" && len(summary.Artists) == 1 {
+		artist = summary.Artists[0]
+	}
+	switch {
+	case strings.TrimSpace(artist) == "":
+		return "", "", &unplaceableError{"no artist or album artist tag"}
+	case strings.TrimSpace(summary.Album) == "":
+		return "", "", &unplaceableError{"no album tag"}
+	}
+	return exportTreeName(artist), exportTreeName(summary.Album), nil
+}
+
+// claim picks the directory for uuid under artist/album, keeping the one it
+// already has if that is still right, and adding part of the UUID to the
+// album when another holding has the name. Called with the tree locked.
+func (t *exportTree) claim(uuid string, artist string, album string) string {
+	candidates := []string{
+		path.Join(artist, album),
+		path.Join(artist, album+" ["+uuid[:8]+"]"),
+		path.Join(artist, album+" ["+uuid+"]"),
+	}
+	taken := map[string]bool{}
+	for other, rel := range t.placed {
+		if other != uuid {
+			// Case-insensitive, in case the tree is served from such a filesystem
+			taken[strings.ToLower(rel)] = true
+		}
+	}
+	free := []string{}
+	for _, rel := range candidates {
+		if !taken[strings.ToLower(rel)] {
+			free = append(free, rel)
+		}
+	}
+	for _, rel := range free {
+		if rel == t.placed[uuid] {
+			return rel
+		}
+	}
+	if len(free) == 0 {
+		// Only another holding with the same UUID could have taken them all
+		return candidates[2]
+	}
+	return free[0]
+}
+
+// current reports whether the tree directory rel already links to exactly
+// the given files of a holding.
+func (t *exportTree) current(rel string, musicDir string, files []string) bool {
+	dest := path.Join(exportTreeDir(), rel)
+	linked := []string{}
+	if err := walkFiles(dest, func(rel string) error {
+		linked = append(linked, rel)
+		return nil
+	}); err != nil || !dirExists(dest) {
+		return false
+	}
+	sort.Strings(linked)
+	if len(linked) != len(files) {
+		return false
+	}
+	for i, file := range files {
+		if linked[i] != file {
+			return false
+		}
+		a, err := os.Stat(path.Join(musicDir, file))
+		if err != nil {
+			return false
+		}
+		b, err := os.Stat(path.Join(dest, file))
+		if err != nil || !os.SameFile(a, b) {
+			return false
+		}
+	}
+	return true
+}
+
+// remove takes a holding out of the tree. Called with the tree locked.
+func (t *exportTree) remove(uuid string) error {
+	rel, ok := t.placed[uuid]
+	if !ok {
+		return nil
+	}
+	if err := os.RemoveAll(path.Join(exportTreeDir(), rel)); err != nil {
+		return err
+	}
+	delete(t.placed, uuid)
+	// The artist directory goes with its last album
+	os.Remove(path.Join(exportTreeDir(), path.Dir(rel)))
+	return nil
+}
+
+// update brings one holding's place in the tree up to date with the library.
+func (t *exportTree) update(uuid string) error {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.unplaced, uuid)
+	dir := uuidToPath(config.LibraryPath, uuid)
+	if !dirExists(dir) {
+		return t.remove(uuid)
+	}
+	musicDir := path.Join(dir, "music")
+	files := []string{}
+	if err := walkFiles(musicDir, func(rel string) error {
+		files = append(files, rel)
+		return nil
+	}); err != nil {
+		return err
+	}
+	sort.Strings(files)
+	artist, album, err := exportTreePlacement(dir, files)
+	if uerr, ok := err.(*unplaceableError); ok {
+		t.unplaced[uuid] = uerr.reason
+		return t.remove(uuid)
+	} else if err != nil {
+		return err
+	}
+	rel := t.claim(uuid, artist, album)
+	if rel == t.placed[uuid] && t.current(rel, musicDir, files) {
+		return nil
+	}
+
+	staging := path.Join(exportTreeDir(), exportTreeStagingDirName, uuid)
+	if err := os.RemoveAll(staging); err != nil {
+		return err
+	}
+	for _, file := range files {
+		target := path.Join(staging, file)
+		if err := os.MkdirAll(path.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := os.Link(path.Join(musicDir, file), target); err != nil {
+			os.RemoveAll(staging)
+			return err
+		}
+	}
+	if err := t.remove(uuid); err != nil {
+		os.RemoveAll(staging)
+		return err
+	}
+	dest := path.Join(exportTreeDir(), rel)
+	if err := os.MkdirAll(path.Dir(dest), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(staging, dest); err != nil {
+		os.RemoveAll(staging)
+		return err
+	}
+	t.placed[uuid] = rel
+	return nil
+}
+
+func (t *exportTree) save() error {
+	t.Lock()
+	js, err := json.Marshal(t.placed)
+	t.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path.Join(exportTreeDir(), exportTreeStateFileName), js)
+}
+
+// load reads back where holdings were placed. A tree without a readable
+// record is thrown away, since nothing in it can be matched to a holding.
+func (t *exportTree) load() error {
+	if err := os.MkdirAll(exportTreeDir(), 0755); err != nil {
+		return err
+	}
+	placed := map[string]string{}
+	data, err := ioutil.ReadFile(path.Join(exportTreeDir(), exportTreeStateFileName))
+	if err == nil {
+		err = json.Unmarshal(data, &placed)
+	}
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("Export tree: discarding the tree, its record is unreadable: " + err.Error())
+		}
+		dirEnts, err := ioutil.ReadDir(exportTreeDir())
+		if err != nil {
+			return err
+		}
+		for _, dirEnt := range dirEnts {
+			if err := os.RemoveAll(path.Join(exportTreeDir(), dirEnt.Name())); err != nil {
+				return err
+			}
+		}
+		placed = map[string]string{}
+	}
+	t.Lock()
+	t.placed = placed
+	t.Unlock()
+	return os.RemoveAll(path.Join(exportTreeDir(), exportTreeStagingDirName))
+}
+
+// reconcile updates every holding in the library and drops those that are
+// gone from it.
+func (t *exportTree) reconcile() error {
+	t.Lock()
+	t.seq = changesSeq()
+	seen := map[string]bool{}
+	t.Unlock()
+	err := walkHoldings(config.LibraryPath, func(uuid string, dir string, legacy bool) error {
+		uuid = strings.ToLower(uuid)
+		seen[uuid] = true
+		if err := t.update(uuid); err != nil {
+			log.Printf("Export tree: %s: %s\n", uuid, err.Error())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	t.Lock()
+	for uuid := range t.placed {
+		if !seen[uuid] {
+			if err := t.remove(uuid); err != nil {
+				log.Printf("Export tree: %s: %s\n", uuid, err.Error())
+			}
+		}
+	}
+	for uuid := range t.unplaced {
+		if !seen[uuid] {
+			delete(t.unplaced, uuid)
+		}
+	}
+	t.lastSync = time.Now()
+	t.Unlock()
+	return t.save()
+}
+
+// follow updates the holdings in the changes feed since the last look, and
+// reports false if events were missed so a full reconcile is needed.
+func (t *exportTree) follow() bool {
+	t.Lock()
+	since := t.seq
+	t.Unlock()
+	events := changesSince(since)
+	if len(events) == 0 {
+		return true
+	}
+	if events[0].Seq > since+1 {
+		return false
+	}
+	updated := map[string]bool{}
+	for _, event := range events {
+		if !updated[event.UUID] {
+			updated[event.UUID] = true
+			if err := t.update(event.UUID); err != nil {
+				log.Printf("Export tree: %s: %s\n", event.UUID, err.Error())
+			}
+		}
+	}
+	t.Lock()
+	t.seq = events[len(events)-1].Seq
+	t.lastSync = time.Now()
+	t.Unlock()
+	if err := t.save(); err != nil {
+		log.Println("Export tree: " + err.Error())
+	}
+	return true
+}
+
+func runExportTree() {
+	if err := tree.load(); err != nil {
+		log.Println("Export tree: " + err.Error())
+		return
+	}
+	lastReconcile := time.Time{}
+	needed := true
+	for {
+		if needed || time.Since(lastReconcile) > holdingCountInterval {
+			if err := tree.reconcile(); err != nil {
+				log.Println("Export tree: " + err.Error())
+			}
+			lastReconcile = time.Now()
+		}
+		time.Sleep(exportTreeIdleInterval)
+		needed = !tree.follow()
+	}
+}
+
+func (t *exportTree) report() ExportTreeReport {
+	t.Lock()
+	defer t.Unlock()
+	report := ExportTreeReport{Enabled: config.ExportTree, Unplaced: []ExportTreeUnplaced{}}
+	if !config.ExportTree {
+		return report
+	}
+	report.Path = exportTreeDir()
+	if !t.lastSync.IsZero() {
+		lastSync := stamp(t.lastSync)
+		report.LastSync = &lastSync
+	}
+	report.Placed = len(t.placed)
+	for uuid, reason := range t.unplaced {
+		report.Unplaced = append(report.Unplaced, ExportTreeUnplaced{uuid, reason})
+	}
+	sort.Slice(report.Unplaced, func(i, j int) bool {
+		return report.Unplaced[i].UUID < report.Unplaced[j].UUID
+	})
+	return report
+}
+
+// runExportTreeCommand brings the tree up to date once, for "moss
+// export-tree", and lists the holdings left out of it.
+func runExportTreeCommand() int {
+	config.ExportTree = true
+	if err := initTmpDir(); err != nil {
+		fmt.Println("export-tree: " + err.Error())
+		return 1
+	}
+	if err := tree.load(); err != nil {
+		fmt.Println("export-tree: " + err.Error())
+		return 1
+	}
+	if err := tree.reconcile(); err != nil {
+		fmt.Println("export-tree: " + err.Error())
+		return 1
+	}
+	report := tree.report()
+	for _, u := range report.Unplaced {
+		fmt.Printf("%s: not placed: %s\n", u.UUID, u.Reason)
+	}
+	fmt.Printf("placed %d holdings in %s\n", report.Placed, report.Path)
+	return 0
+}
+
+func exportTreeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkAuth(w, r) {
+		return
+	}
+	js, err := json.Marshal(tree.report())
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// With AutoFanoutThreshold set, a prefix directory that grows past that many
+// entries is fanned out: new holdings under it are created one level deeper,
+// in 3f/a2/UUID4, and lookups try the old depth first and then the new one.
+// Which prefixes are fanned out is kept in .moss-fanout.json at the library
+// root. POST /admin/fanout/migrate starts a job that moves the holdings still
+// at the old depth down.
+const fanoutFileName = ".moss-fanout.json"
+const fanoutCheckInterval = 10 * time.Minute
+
+var fanout = struct {
+	sync.RWMutex
+	prefixes map[string]time.Time
+	// The job moving holdings down, if one has been started
+	job *Job
+}{prefixes: map[string]time.Time{}}
+
+type FanoutPrefix struct {
+	Prefix      string
+	FannedOutAt Timestamp
+}
+
+func fanoutFile() string {
+	return path.Join(config.LibraryPath, fanoutFileName)
+}
+
+func loadFanout() error {
+	data, err := os.ReadFile(fanoutFile())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	fanout.Lock()
+	defer fanout.Unlock()
+	return json.Unmarshal(data, &fanout.prefixes)
+}
+
+// saveFanout writes the fan-out state. The caller holds the fanout lock.
+func saveFanout() error {
+	js, err := json.MarshalIndent(fanout.prefixes, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fanoutFile(), js)
+}
+
+func isFannedOut(prefix string) bool {
+	fanout.RLock()
+	defer fanout.RUnlock()
+	_, ok := fanout.prefixes[prefix]
+	return ok
+}
+
+func fanoutPrefixes() []FanoutPrefix {
+	fanout.RLock()
+	defer fanout.RUnlock()
+	result := []FanoutPrefix{}
+	for prefix, at := range fanout.prefixes {
+		result = append(result, FanoutPrefix{prefix, stamp(at)})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Prefix < result[j].Prefix })
+	return result
+}
+
+func shallowPath(basepath string, uuid string) string {
+	return path.Join(basepath, uuid[0:2], uuid)
+}
+
+func deepPath(basepath string, uuid string) string {
+	return path.Join(basepath, uuid[0:2], uuid[2:4], uuid)
+}
+
+// isSubPrefix reports whether an entry of a prefix directory is a second
+// level of fan-out rather than a holding.
+func isSubPrefix(name string) bool {
+	return shardDirPattern.MatchString(name)
+}
+
+// walkPrefix calls fn for each holding directory in a prefix directory,
+// including those one level down in a fanned-out one.
+func walkPrefix(prefixPath string, fn func(uuid string, dir string) error) error {
+	dirEnts, err := os.ReadDir(prefixPath)
+	if err != nil {
+		return err
+	}
+	for _, dirEnt := range dirEnts {
+		if !dirEnt.IsDir() {
+			continue
+		}
+		dir := path.Join(prefixPath, dirEnt.Name())
+		if !isSubPrefix(dirEnt.Name()) {
+			if err := fn(dirEnt.Name(), dir); err != nil {
+				return err
+			}
+			continue
+		}
+		subEnts, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, subEnt := range subEnts {
+			if subEnt.IsDir() {
+				if err := fn(subEnt.Name(), path.Join(dir, subEnt.Name())); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// countPrefixEntries counts the names directly in a prefix directory without
+// building a FileInfo for each.
+func countPrefixEntries(prefixPath string) (int, error) {
+	dir, err := os.Open(prefixPath)
+	if err != nil {
+		return 0, err
+	}
+	defer dir.Close()
+	count := 0
+	for {
+		names, err := dir.Readdirnames(readdirBatch)
+		count += len(names)
+		if err == io.EOF {
+			return count, nil
+		} else if err != nil {
+			return count, err
+		}
+	}
+}
+
+// prefixDepths counts the holdings in a prefix directory at each depth.
+func prefixDepths(prefix string) (int, int, error) {
+	prefixPath := path.Join(config.LibraryPath, prefix)
+	shallow, deep := 0, 0
+	err := walkPrefix(prefixPath, func(uuid string, dir string) error {
+		if path.Dir(dir) == prefixPath {
+			shallow++
+		} else {
+			deep++
+		}
+		return nil
+	})
+	return shallow, deep, err
+}
+
+// checkFanout fans out every prefix directory with more than
+// AutoFanoutThreshold entries.
+func checkFanout() error {
+	dirEnts, err := os.ReadDir(config.LibraryPath)
+	if err != nil {
+		return err
+	}
+	for _, dirEnt := range dirEnts {
+		prefix := dirEnt.Name()
+		if !dirEnt.IsDir() || !shardDirPattern.MatchString(prefix) || isFannedOut(prefix) {
+			continue
+		}
+		n, err := countPrefixEntries(path.Join(config.LibraryPath, prefix))
+		if err != nil {
+			return err
+		}
+		if n <= config.AutoFanoutThreshold {
+			continue
+		}
+		fanout.Lock()
+		fanout.prefixes[prefix] = time.Now().UTC()
+		err = saveFanout()
+		fanout.Unlock()
+		if err != nil {
+			return err
+		}
+		log.Printf("Prefix directory %s has %d entries, new holdings under it go one level deeper\n", prefix, n)
+	}
+	return nil
+}
+
+func runFanoutChecks() {
+	for {
+		release, err := beginWrite()
+		if err == nil {
+			if err := checkFanout(); err != nil {
+				log.Println("Fan-out check: " + err.Error())
+			}
+			release()
+		}
+		time.Sleep(fanoutCheckInterval)
+	}
+}
+
+type fanoutVerifyError struct {
+	uuid string
+}
+
+func (e *fanoutVerifyError) Error() string {
+	return fmt.Sprintf("%s does not have the same files after moving it down", e.uuid)
+}
+
+// fanDown moves one holding from the old depth of its fanned-out prefix to
+// the new one, comparing the files' sizes before and after.
+func fanDown(uuid string) error {
+	admit, err := excludeReaders(uuid)
+	if err != nil {
+		return err
+	}
+	defer admit()
+	unlock := lockHolding(uuid)
+	defer unlock()
+
+	src := shallowPath(config.LibraryPath, uuid)
+	dest := deepPath(config.LibraryPath, uuid)
+	if err := ensureSafePath(config.LibraryPath, dest); err != nil {
+		return err
+	}
+	if dirExists(dest) {
+		return &misplacedConflictError{uuid, []string{src, dest}}
+	}
+	before, err := treeSizes(src)
+	if err != nil {
+		return err
+	}
+	if _, err := moveHolding(src, dest); err != nil {
+		return err
+	}
+	after, err := treeSizes(dest)
+	if err != nil {
+		return err
+	}
+	if len(after) != len(before) {
+		return &fanoutVerifyError{uuid}
+	}
+	for name, size := range before {
+		if after[name] != size {
+			return &fanoutVerifyError{uuid}
+		}
+	}
+	return nil
+}
+
+func init() {
+	jobRunners["fanout-migrate"] = jobRunner{idempotent: true, run: runFanoutMigration}
+}
+
+// runFanoutMigration moves every holding at the old depth of a fanned-out
+// prefix down a level. Holdings that are busy are reported as failures and
+// left for the next run.
+func runFanoutMigration(job *Job) {
+	defer job.finish()
+	fanout.Lock()
+	fanout.job = job
+	fanout.Unlock()
+	pending := []string{}
+	for _, p := range fanoutPrefixes() {
+		dirEnts, err := os.ReadDir(path.Join(config.LibraryPath, p.Prefix))
+		if err != nil {
+			job.fail(p.Prefix + ": " + err.Error())
+			continue
+		}
+		for _, dirEnt := range dirEnts {
+			if dirEnt.IsDir() && uuidSanityCheck(dirEnt.Name()) == nil {
+				pending = append(pending, dirEnt.Name())
+			}
+		}
+	}
+	job.update(func(j *Job) {
+		j.HoldingsTotal = len(pending)
+		j.HoldingsRemaining = len(pending)
+	})
+	for _, uuid := range pending {
+		release, err := beginWrite()
+		if err != nil {
+			job.fail(uuid + ": " + err.Error())
+		} else {
+			if err := fanDown(uuid); err != nil {
+				job.fail(uuid + ": " + err.Error())
+			} else {
+				emitChange(uuid, "relocate", path.Join(uuid[0:2], uuid[2:4], uuid))
+			}
+			release()
+		}
+		job.update(func(j *Job) {
+			j.HoldingsRemaining--
+		})
+	}
+}
+
+// fanoutHandler handles GET /admin/fanout, the fanned-out prefixes, and
+// POST /admin/fanout/migrate.
+func fanoutHandler(w http.ResponseWriter, r *http.Request, params []string) {
+	if len(params) == 0 {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		js, err := json.Marshal(fanoutPrefixes())
+		if err != nil {
+			log.Println(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+		return
+	}
+	if len(params) != 1 || params[0] != "migrate" {
+		http.Error(w, "No request handler for that", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		fanout.RLock()
+		job := fanout.job
+		fanout.RUnlock()
+		if job == nil {
+			http.Error(w, "No fan-out migration has been started", http.StatusNotFound)
+			return
+		}
+		writeJob(w, job, http.StatusOK)
+		return
+	case "POST":
+	default:
+		http.Error(w, "Only GET and POST are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fanout.Lock()
+	if fanout.job != nil && fanout.job.active() {
+		job := fanout.job
+		fanout.Unlock()
+		writeJob(w, job, http.StatusConflict)
+		return
+	}
+	job := newJob("fanout-migrate", nil)
+	fanout.job = job
+	fanout.Unlock()
+
+	user, _, _ := r.BasicAuth()
+	log.Printf("Fan-out migration started by %s (job %s)\n", user, job.ID)
+	go runFanoutMigration(job)
+	writeJob(w, job, http.StatusAccepted)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"syscall"
+)
+
+// Fault injection lets a staging node rehearse a full disk, a slow disk or
+// torn writes without breaking hardware. It only exists in binaries built
+// with "-tags faults"; there, PUT /admin/faults sets the faults below and
+// /version lists "fault-injection" in its features and the active faults.
+// Normal builds compile the hooks down to nothing and answer 404.
+type Faults struct {
+	// The next FailWrites writes fail with ENOSPC, and TruncatePercent of
+	// writes are silently cut short, counting writes to files under
+	// WritePrefix, relative to the library root, or to any file without one
+	FailWrites      int    `json:",omitempty"`
+	TruncatePercent int    `json:",omitempty"`
+	WritePrefix     string `json:",omitempty"`
+	// Reads of files under ReadDelayPrefix, relative to the library root,
+	// wait this long first
+	ReadDelayMillis int    `json:",omitempty"`
+	ReadDelayPrefix string `json:",omitempty"`
+	// Reported by statfs instead of the real free space
+	FreeSpace *uint64 `json:",omitempty"`
+}
+
+type faultsError struct {
+	problem string
+}
+
+func (e *faultsError) Error() string {
+	return e.problem
+}
+
+func (f Faults) validate() error {
+	switch {
+	case f.FailWrites < 0 || f.ReadDelayMillis < 0:
+		return &faultsError{"FailWrites and ReadDelayMillis can't be negative"}
+	case f.TruncatePercent < 0 || f.TruncatePercent > 100:
+		return &faultsError{"TruncatePercent must be from 0 to 100"}
+	}
+	return nil
+}
+
+func (f Faults) active() bool {
+	return f.FailWrites > 0 || f.TruncatePercent > 0 || f.ReadDelayMillis > 0 || f.FreeSpace != nil
+}
+
+type lowSpaceError struct {
+	free uint64
+	min  int64
+}
+
+func (e *lowSpaceError) Error() string {
+	return fmt.Sprintf("Only %d bytes are free on the library filesystem, below ReadyMinFreeBytes (%d)", e.free, e.min)
+}
+
+// libraryFreeSpace returns the bytes available to moss on the library
+// filesystem.
+func libraryFreeSpace() (uint64, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(config.LibraryPath, &fs); err != nil {
+		return 0, err
+	}
+	return faultFreeSpace(fs.Bavail * uint64(fs.Bsize)), nil
+}
+
+// checkFreeSpace is the readiness check on free space, which fails once the
+// library filesystem is full or below ReadyMinFreeBytes. With
+// ReclaimOnLowSpace set, space that can be reclaimed counts as free, and
+// finding free space low starts reclaiming it.
+func checkFreeSpace() error {
+	free, err := libraryFreeSpace()
+	if err != nil {
+		return err
+	}
+	if free >= uint64(config.ReadyMinFreeBytes) && free > 0 {
+		return nil
+	}
+	if config.ReclaimOnLowSpace {
+		go reclaimSpace("free space is low")
+		if free+uint64(reclaimable().Total) >= uint64(config.ReadyMinFreeBytes) && free > 0 {
+			return nil
+		}
+	}
+	return &lowSpaceError{free, config.ReadyMinFreeBytes}
+}
+
+func isNoSpace(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT)
+}
+
+func noSpace(w http.ResponseWriter, err error) {
+	log.Println(err.Error())
+	w.Header().Set(errorCodeHeader, "insufficient-storage")
+	w.Header().Set("Retry-After", "300")
+	http.Error(w, err.Error(), http.StatusInsufficientStorage)
+}
@@ -0,0 +1,26 @@
+//go:build !faults
+
+package main
+
+import (
+	"io"
+	"net/http"
+)
+
+func activeFaults() *Faults {
+	return nil
+}
+
+func faultyWriter(name string, w io.Writer) io.Writer {
+	return w
+}
+
+func faultRead(p string) {}
+
+func faultFreeSpace(free uint64) uint64 {
+	return free
+}
+
+func faultsHandler(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "This moss was built without fault injection", http.StatusNotFound)
+}
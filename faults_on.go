@@ -0,0 +1,151 @@
+//go:build faults
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var injected = struct {
+	sync.Mutex
+	faults Faults
+}{}
+
+func init() {
+	features = append(features, "fault-injection")
+	log.Println("WARNING: built with fault injection, do not use in production")
+}
+
+func activeFaults() *Faults {
+	injected.Lock()
+	defer injected.Unlock()
+	if !injected.faults.active() {
+		return nil
+	}
+	f := injected.faults
+	return &f
+}
+
+// faultyWriter wraps the writer of a file that is being written to name.
+func faultyWriter(name string, w io.Writer) io.Writer {
+	injected.Lock()
+	defer injected.Unlock()
+	if !underPrefix(name, injected.faults.WritePrefix) {
+		return w
+	}
+	if injected.faults.FailWrites > 0 {
+		injected.faults.FailWrites--
+		log.Println("Fault injection: failing write of " + name)
+		return &failingWriter{&os.PathError{Op: "write", Path: name, Err: syscall.ENOSPC}}
+	}
+	if injected.faults.TruncatePercent > 0 && rand.Intn(100) < injected.faults.TruncatePercent {
+		log.Println("Fault injection: truncating write of " + name)
+		return &truncatingWriter{w: w}
+	}
+	return w
+}
+
+type failingWriter struct {
+	err error
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	return 0, w.err
+}
+
+// truncatingWriter keeps half of the first write and claims to have written
+// everything.
+type truncatingWriter struct {
+	w    io.Writer
+	done bool
+}
+
+func (w *truncatingWriter) Write(p []byte) (int, error) {
+	if !w.done {
+		w.done = true
+		if _, err := w.w.Write(p[:len(p)/2]); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// underPrefix reports whether p is at or under prefix, taken relative to the
+// library root.
+func underPrefix(p string, prefix string) bool {
+	prefix = path.Join(config.LibraryPath, prefix)
+	return p == prefix || strings.HasPrefix(p, strings.TrimSuffix(prefix, "/")+"/")
+}
+
+func faultRead(p string) {
+	injected.Lock()
+	delay := time.Duration(injected.faults.ReadDelayMillis) * time.Millisecond
+	prefix := injected.faults.ReadDelayPrefix
+	injected.Unlock()
+	if delay > 0 && underPrefix(p, prefix) {
+		time.Sleep(delay)
+	}
+}
+
+func faultFreeSpace(free uint64) uint64 {
+	injected.Lock()
+	defer injected.Unlock()
+	if injected.faults.FreeSpace != nil {
+		return *injected.faults.FreeSpace
+	}
+	return free
+}
+
+// faultsHandler handles GET, PUT and DELETE /admin/faults.
+func faultsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+	case "PUT":
+		body, ok := readUpload(w, r)
+		if !ok {
+			return
+		}
+		f := Faults{}
+		if err := json.Unmarshal(body, &f); err != nil {
+			http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := f.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		injected.Lock()
+		injected.faults = f
+		injected.Unlock()
+		js, _ := json.Marshal(f)
+		log.Println("Fault injection set: " + string(js))
+	case "DELETE":
+		injected.Lock()
+		injected.faults = Faults{}
+		injected.Unlock()
+		log.Println("Fault injection cleared")
+	default:
+		http.Error(w, "Only GET, PUT and DELETE are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	injected.Lock()
+	js, err := json.Marshal(injected.faults)
+	injected.Unlock()
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
@@ -0,0 +1,186 @@
+//go:build faults
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/wuvt/moss/mosstest"
+)
+
+// setFaults injects f, and clears it again at the end of the test.
+func setFaults(t *testing.T, s *mosstest.Server, f Faults) {
+	t.Helper()
+	js, err := json.Marshal(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.MustDo("PUT", "/admin/faults", js)
+	t.Cleanup(func() { s.MustDo("DELETE", "/admin/faults", nil) })
+}
+
+// holdingPrefix is the WritePrefix or ReadDelayPrefix for one holding, so
+// other writes, such as the quota counts, don't use a fault up.
+func holdingPrefix(uuid string) string {
+	return libraryRel(uuidToPath(config.LibraryPath, uuid))
+}
+
+func TestFaultsVersion(t *testing.T) {
+	s := newTestServer(t, mosstest.Spec{})
+	var info ServerInfo
+	s.MustDo("GET", "/version", nil).JSON(t, &info)
+	found := false
+	for _, f := range info.Features {
+		found = found || f == "fault-injection"
+	}
+	if !found || info.Faults != nil {
+		t.Errorf("/version has features %v and faults %+v", info.Features, info.Faults)
+	}
+
+	setFaults(t, s, Faults{ReadDelayMillis: 10})
+	s.MustDo("GET", "/version", nil).JSON(t, &info)
+	if info.Faults == nil || info.Faults.ReadDelayMillis != 10 {
+		t.Errorf("/version shows faults %+v", info.Faults)
+	}
+	for _, bad := range []string{`{"FailWrites": -1}`, `{"TruncatePercent": 101}`, `{`} {
+		if resp := s.Do("PUT", "/admin/faults", []byte(bad)); resp.Status != http.StatusBadRequest {
+			t.Errorf("%s got %d", bad, resp.Status)
+		}
+	}
+	s.MustDo("DELETE", "/admin/faults", nil)
+	info = ServerInfo{}
+	s.MustDo("GET", "/version", nil).JSON(t, &info)
+	if info.Faults != nil {
+		t.Errorf("cleared faults still show as %+v", info.Faults)
+	}
+}
+
+// A full disk is answered 507 with a Retry-After, leaves nothing in tmp/ and
+// nothing half-made in the holding.
+func TestFaultsFailWrites(t *testing.T) {
+	s := newTestServer(t, mosstest.Spec{Holdings: []mosstest.Holding{{Tracks: []mosstest.Track{{Name: "01.flac"}}}}})
+	uuid := s.Holdings[0].UUID
+	dir := holdingDir(uuid)
+	noSpace := func(what string, resp *mosstest.Response) {
+		t.Helper()
+		if resp.Status != http.StatusInsufficientStorage || resp.Header.Get(errorCodeHeader) != "insufficient-storage" || resp.Header.Get("Retry-After") == "" {
+			t.Errorf("%s got %d %v %s", what, resp.Status, resp.Header, resp.Body)
+		}
+		if ents, err := os.ReadDir(tmpDir()); err != nil || len(ents) > 0 {
+			t.Errorf("%s left %d files in tmp/: %v", what, len(ents), err)
+		}
+	}
+
+	setFaults(t, s, Faults{FailWrites: 1, WritePrefix: holdingPrefix(uuid)})
+	noSpace("upload", s.Do("PUT", s.Path(0, "music", "02.flac"), mosstest.FLAC(4096)))
+	if _, err := os.Stat(path.Join(dir, "music", "02.flac")); !os.IsNotExist(err) {
+		t.Errorf("the failed upload is there: %v", err)
+	}
+	// Only the one write failed
+	s.MustDo("PUT", s.Path(0, "music", "02.flac"), mosstest.FLAC(4096))
+
+	setFaults(t, s, Faults{FailWrites: 1, WritePrefix: holdingPrefix(uuid)})
+	noSpace("album art", s.Do("PUT", s.Path(0, "albumart"), mosstest.PNG(8, 0)))
+	if _, err := os.Stat(path.Join(dir, "albumart")); !os.IsNotExist(err) {
+		t.Errorf("the failed album art is there: %v", err)
+	}
+
+	setFaults(t, s, Faults{FailWrites: 1, WritePrefix: holdingPrefix(uuid)})
+	noSpace("lock", s.Do("PUT", s.Path(0, "lock"), nil))
+	if _, err := os.Stat(path.Join(dir, lockFileName)); !os.IsNotExist(err) {
+		t.Errorf("the failed lock is there: %v", err)
+	}
+	s.MustDo("PUT", s.Path(0, "lock"), nil)
+}
+
+// A torn write the disk doesn't report can't be caught when it's made, but
+// moss keeps the digest of what was sent, so a download shows the damage.
+func TestFaultsTruncatedWrite(t *testing.T) {
+	s := newTestServer(t, mosstest.Spec{Holdings: []mosstest.Holding{{Tracks: []mosstest.Track{{Name: "01.flac"}}}}})
+	uuid := s.Holdings[0].UUID
+	body := mosstest.FLAC(4096)
+	sent := sha256.Sum256(body)
+
+	setFaults(t, s, Faults{TruncatePercent: 100, WritePrefix: libraryRel(path.Join(holdingDir(uuid), "music", "02.flac"))})
+	s.MustDo("PUT", s.Path(0, "music", "02.flac"), body)
+	resp := s.MustDo("GET", s.Path(0, "music", "02.flac"), nil)
+	got := sha256.Sum256(resp.Body)
+	if len(resp.Body) != len(body)/2 || got == sent {
+		t.Fatalf("the write wasn't torn: %d bytes", len(resp.Body))
+	}
+	if recorded := resp.Header.Get("X-Checksum-SHA256"); recorded != hex.EncodeToString(sent[:]) {
+		t.Errorf("the download says its SHA-256 is %s, not what was sent", recorded)
+	}
+	// Nothing else was hit
+	s.MustDo("GET", s.Path(0), nil)
+	s.MustDo("GET", s.Path(0, "music", "01.flac"), nil)
+}
+
+func TestFaultsReadDelay(t *testing.T) {
+	const delay = 300 * time.Millisecond
+	s := newTestServer(t, mosstest.Spec{Holdings: []mosstest.Holding{
+		{Tracks: []mosstest.Track{{Name: "01.flac"}}},
+		{Tracks: []mosstest.Track{{Name: "01.flac"}}},
+	}})
+	setFaults(t, s, Faults{ReadDelayMillis: int(delay / time.Millisecond), ReadDelayPrefix: holdingPrefix(s.Holdings[0].UUID)})
+
+	start := time.Now()
+	s.MustDo("GET", s.Path(0, "music", "01.flac"), nil)
+	if took := time.Since(start); took < delay {
+		t.Errorf("the slow holding's read took %s", took)
+	}
+	start = time.Now()
+	s.MustDo("GET", s.Path(1, "music", "01.flac"), nil)
+	if took := time.Since(start); took >= delay {
+		t.Errorf("the other holding's read took %s", took)
+	}
+}
+
+// Readiness follows the free space statfs reports, reclaimable space aside.
+func TestFaultsFreeSpace(t *testing.T) {
+	s := newTestServer(t, mosstest.Spec{}, func(c *Config) { c.ReadyMinFreeBytes = 1 << 30 })
+	ready := func(want bool) {
+		t.Helper()
+		var readiness Readiness
+		resp := s.Do("GET", "/readyz", nil)
+		resp.JSON(t, &readiness)
+		if readiness.Ready != want || (resp.Status == http.StatusOK) != want {
+			t.Errorf("/readyz got %d %s, want ready %t", resp.Status, resp.Body, want)
+		}
+		for _, c := range readiness.Checks {
+			if c.Name == "free-space" && c.OK != want {
+				t.Errorf("the free-space check is %+v", c)
+			}
+		}
+	}
+
+	for _, c := range []struct {
+		free  uint64
+		ready bool
+	}{
+		{0, false},
+		{1 << 20, false},
+		{1<<30 - 1, false},
+		{1 << 30, true},
+		{1 << 40, true},
+	} {
+		free := c.free
+		setFaults(t, s, Faults{FreeSpace: &free})
+		ready(c.ready)
+		var info ServerInfo
+		s.MustDo("GET", "/version", nil).JSON(t, &info)
+		if info.FreeSpace != free {
+			t.Errorf("/version reports %d bytes free, not %d", info.FreeSpace, free)
+		}
+	}
+	s.MustDo("DELETE", "/admin/faults", nil)
+	config.ReadyMinFreeBytes = 0
+	ready(true)
+}
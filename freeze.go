@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// External tools coordinate with moss through an advisory flock on this file
+// in the library root. Every write takes a shared lock for its duration, so
+// "moss freeze" taking the exclusive lock waits for in-flight writes and then
+// keeps new ones out until "moss thaw".
+const freezeFileName = ".moss-freeze"
+const freezePidFileName = ".moss-freeze.pid"
+
+const thawTimeout = 10 * time.Second
+
+type frozenError struct{}
+
+func (e *frozenError) Error() string {
+	return "Library is frozen for maintenance, try again later"
+}
+
+func freezeFile() string {
+	return path.Join(config.LibraryPath, freezeFileName)
+}
+
+// beginWrite takes a shared lock on the freeze file, failing straight away
+// if the library is frozen. The returned func releases it.
+func beginWrite() (func(), error) {
+	f, err := os.OpenFile(freezeFile(), os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, &frozenError{}
+		}
+		return nil, err
+	}
+	return func() { f.Close() }, nil
+}
+
+func libraryFrozen() bool {
+	release, err := beginWrite()
+	if err != nil {
+		return true
+	}
+	release()
+	return false
+}
+
+// guardWrite is beginWrite for request handlers, answering 503 itself.
+func guardWrite(w http.ResponseWriter) (func(), bool) {
+	release, err := beginWrite()
+	if _, ok := err.(*frozenError); ok {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return nil, false
+	} else if err != nil {
+		storageError(w, err)
+		return nil, false
+	}
+	return release, true
+}
+
+func freezeArgs(subcommand string) []string {
+	args := append([]string{}, os.Args[1:len(os.Args)-flag.NArg()]...)
+	return append(args, subcommand)
+}
+
+// runFreeze starts a detached "freeze-hold" process that takes the exclusive
+// lock and keeps it, and returns once the lock is held, so a shell script can
+// run "moss freeze && rsync ... ; moss thaw".
+func runFreeze() int {
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	cmd := exec.Command(exe, freezeArgs("freeze-hold")...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	line, _ := bufio.NewReader(stdout).ReadString('\n')
+	if strings.TrimSpace(line) != "frozen" {
+		fmt.Fprintln(os.Stderr, "Could not freeze the library")
+		cmd.Wait()
+		return 1
+	}
+	fmt.Printf("Library frozen (pid %d)\n", cmd.Process.Pid)
+	return 0
+}
+
+func holdFreeze() int {
+	f, err := os.OpenFile(freezeFile(), os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	// Blocks until in-flight writes have released their shared locks
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	pidFile := path.Join(config.LibraryPath, freezePidFileName)
+	if err := ioutil.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	fmt.Println("frozen")
+	os.Stdout.Close()
+	os.Stderr.Close()
+	<-sig
+	os.Remove(pidFile)
+	f.Close()
+	return 0
+}
+
+func runThaw() int {
+	pidFile := path.Join(config.LibraryPath, freezePidFileName)
+	data, err := ioutil.ReadFile(pidFile)
+	if os.IsNotExist(err) {
+		fmt.Println("Library is not frozen")
+		return 0
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid pid file "+pidFile)
+		return 1
+	}
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil && err != syscall.ESRCH {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	deadline := time.Now().Add(thawTimeout)
+	for {
+		release, err := beginWrite()
+		if err == nil {
+			release()
+			os.Remove(pidFile)
+			fmt.Println("Library thawed")
+			return 0
+		}
+		if time.Now().After(deadline) {
+			fmt.Fprintln(os.Stderr, "Library is still frozen: "+err.Error())
+			return 1
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
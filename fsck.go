@@ -0,0 +1,170 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+var shardDirPattern = regexp.MustCompile("^[a-f0-9]{2}$")
+
+type LibraryScan struct {
+	Holdings       int
+	LegacyHoldings int
+}
+
+// walkHoldings calls fn for every holding directory in the library, including
+// any left behind in the legacy flat layout.
+func walkHoldings(basepath string, fn func(uuid string, dir string, legacy bool) error) error {
+	dirEnts, err := ioutil.ReadDir(basepath)
+	if err != nil {
+		return err
+	}
+	for _, dirEnt := range dirEnts {
+		if !dirEnt.IsDir() {
+			continue
+		}
+		if shardDirPattern.MatchString(dirEnt.Name()) {
+			err := walkPrefix(path.Join(basepath, dirEnt.Name()), func(uuid string, dir string) error {
+				return fn(uuid, dir, false)
+			})
+			if err != nil {
+				return err
+			}
+		} else if uuidSanityCheck(dirEnt.Name()) == nil {
+			if err := fn(dirEnt.Name(), path.Join(basepath, dirEnt.Name()), true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func scanLibrary(basepath string) (LibraryScan, error) {
+	scan := LibraryScan{}
+	err := walkHoldings(basepath, func(uuid string, dir string, legacy bool) error {
+		if legacy {
+			scan.LegacyHoldings++
+		} else {
+			scan.Holdings++
+		}
+		return nil
+	})
+	return scan, err
+}
+
+func logLibraryScan() {
+	scan, err := scanLibrary(config.LibraryPath)
+	if err != nil {
+		log.Println("Library scan failed: " + err.Error())
+		return
+	}
+	log.Printf("Library has %d holdings\n", scan.Holdings)
+	setHoldingCount(scan.Holdings)
+	if scan.LegacyHoldings > 0 {
+		log.Printf("%d holdings are still in the legacy flat layout\n", scan.LegacyHoldings)
+	}
+}
+
+// runFsck implements "moss fsck [-quarantine]" and returns the process exit
+// status.
+func runFsck() int {
+	flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	quarantine := flags.Bool("quarantine", false, "Move files found where a directory should be into "+quarantineDirName)
+	if err := flags.Parse(flag.Args()[1:]); err != nil {
+		return 2
+	}
+
+	status := 0
+	stray, err := findStrayFiles(config.LibraryPath)
+	if err != nil {
+		fmt.Println("fsck: " + err.Error())
+		return 1
+	}
+	for _, rel := range stray {
+		fmt.Printf("%s: file where a directory should be\n", rel)
+		status = 1
+	}
+	if *quarantine && len(stray) > 0 {
+		dest, err := quarantineStrayFiles(stray)
+		if err != nil {
+			fmt.Println("fsck: " + err.Error())
+			return 1
+		}
+		fmt.Printf("moved %d files to %s\n", len(stray), dest)
+		status = 0
+	}
+
+	scan, err := scanLibrary(config.LibraryPath)
+	if err != nil {
+		fmt.Println("fsck: " + err.Error())
+		return 1
+	}
+	fmt.Printf("holdings: %d\n", scan.Holdings)
+	fmt.Printf("legacy-layout holdings: %d\n", scan.LegacyHoldings)
+	for _, p := range fanoutPrefixes() {
+		shallow, deep, err := prefixDepths(p.Prefix)
+		if err != nil {
+			fmt.Println("fsck: " + err.Error())
+			return 1
+		}
+		fmt.Printf("prefix %s: fanned out since %s, %d holdings at the old depth, %d one level down\n", p.Prefix, p.FannedOutAt.Format(time.RFC3339), shallow, deep)
+	}
+
+	err = walkHoldings(config.LibraryPath, func(uuid string, dir string, legacy bool) error {
+		if isMisplaced(uuid, dir, legacy) {
+			fmt.Printf("%s: stored under the wrong prefix directory %s (fix with POST /%s/relocate)\n", uuid, path.Base(path.Dir(dir)), strings.ToLower(uuid))
+			status = 1
+		}
+		empty, sparse, err := emptyAndSparseFiles(dir)
+		if err != nil {
+			return err
+		}
+		for _, rel := range empty {
+			if config.StrictEmptyFiles {
+				fmt.Printf("%s: zero-byte file: %s\n", uuid, rel)
+				status = 1
+			} else {
+				fmt.Printf("%s: warning: zero-byte file: %s\n", uuid, rel)
+			}
+		}
+		for _, rel := range sparse {
+			fmt.Printf("%s: warning: sparse file: %s\n", uuid, rel)
+		}
+		collisions, err := findCaseCollisions(path.Join(dir, "music"))
+		if err != nil {
+			return err
+		}
+		for _, c := range collisions {
+			fmt.Printf("%s: case-only name collision: %s\n", uuid, strings.Join(c, ", "))
+			status = 1
+		}
+		if config.PortableNames != portableNamesOff {
+			renames, err := findNonPortableNames(path.Join(dir, "music"))
+			if err != nil {
+				return err
+			}
+			names := []string{}
+			for name := range renames {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				fmt.Printf("%s: non-portable name: %s (suggested rename: %s)\n", uuid, name, renames[name])
+				status = 1
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Println("fsck: " + err.Error())
+		return 1
+	}
+	return status
+}
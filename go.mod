@@ -0,0 +1,3 @@
+module github.com/wuvt/moss
+
+go 1.21
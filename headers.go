@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const defaultHSTSMaxAge = 365 * 24 * 60 * 60
+const defaultArtCacheSeconds = 24 * 60 * 60
+const defaultMusicCacheSeconds = 365 * 24 * 60 * 60
+
+// RouteHeaders overrides response headers for every path starting with
+// Path. An empty value removes the header, including one set by the handler.
+type RouteHeaders struct {
+	Path    string
+	Headers map[string]string
+}
+
+// headerWriter applies the per-route overrides just before the response
+// header goes out, so they win over whatever the handler set. Before them,
+// JSON responses that don't say how to cache themselves and all errors get
+// Cache-Control: no-store, so that no cache keeps a listing, a status or a
+// 404 for the max-age of the file it was about, and errors lose the
+// Content-Disposition of the file so browsers don't save them as it.
+type headerWriter struct {
+	http.ResponseWriter
+	overrides []map[string]string
+	applied   bool
+}
+
+func (w *headerWriter) apply(status int) {
+	if w.applied {
+		return
+	}
+	w.applied = true
+	h := w.Header()
+	ctype := h.Get("Content-Type")
+	if status >= 400 || (h.Get("Cache-Control") == "" && (strings.HasPrefix(ctype, "application/json") || strings.HasPrefix(ctype, "application/x-ndjson"))) {
+		h.Set("Cache-Control", "no-store")
+	}
+	if status >= 400 {
+		h.Del("Content-Disposition")
+	}
+	for _, headers := range w.overrides {
+		for name, value := range headers {
+			if value == "" {
+				w.Header().Del(name)
+			} else {
+				w.Header().Set(name, value)
+			}
+		}
+	}
+}
+
+func (w *headerWriter) WriteHeader(status int) {
+	w.apply(status)
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *headerWriter) Write(b []byte) (int, error) {
+	w.apply(http.StatusOK)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *headerWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *headerWriter) Flush() {
+	w.apply(http.StatusOK)
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// setPolicyHeaders wraps a handler with the configured response header
+// policy: nosniff always, the node's identity, HSTS over TLS, static headers,
+// the default caching and per-route overrides, in that order.
+func setPolicyHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("X-Content-Type-Options", "nosniff")
+		if config.ServerHeader != "" {
+			h.Set("Server", config.ServerHeader)
+		}
+		if config.NodeName != "" {
+			h.Set("X-Moss-Node", config.NodeName)
+		}
+		if r.TLS != nil && config.HSTSMaxAge > 0 {
+			h.Set("Strict-Transport-Security", "max-age="+strconv.Itoa(config.HSTSMaxAge))
+		}
+		for name, value := range config.ResponseHeaders {
+			h.Set(name, value)
+		}
+
+		overrides := []map[string]string{}
+		for _, route := range config.RouteHeaders {
+			if strings.HasPrefix(r.URL.Path, route.Path) {
+				overrides = append(overrides, route.Headers)
+			}
+		}
+		next.ServeHTTP(&headerWriter{w, overrides, false}, r)
+	})
+}
+
+// setCacheControl says how long a file served from the holding at dir may be
+// cached: seconds once the holding is locked and its files can't change, or
+// not without asking again before then. Private holdings are only cached by
+// the client. immutable marks files that never change once locked, which
+// with LockedImmutable tells browsers not to revalidate them even on reload;
+// album art can still be replaced after the lock, so it's never immutable.
+func setCacheControl(w http.ResponseWriter, dir string, seconds int, immutable bool) {
+	if _, err := os.Stat(path.Join(dir, lockFileName)); err != nil || seconds <= 0 {
+		w.Header().Set("Cache-Control", "no-cache")
+		return
+	}
+	scope := "public"
+	if info, err := readHoldingInfo(dir); err == nil && info.Private {
+		scope = "private"
+	}
+	value := scope + ", max-age=" + strconv.Itoa(seconds)
+	if immutable && config.LockedImmutable {
+		value += ", immutable"
+	}
+	w.Header().Set("Cache-Control", value)
+}
+
+// contentDisposition makes a Content-Disposition value naming a file name:
+// as filename, in ASCII with anything else and anything some clients would
+// unescape replaced by _, for clients that know nothing better, and exactly
+// as filename*, percent-encoded UTF-8 as in RFC 5987.
+func contentDisposition(disposition string, name string) string {
+	var fallback, encoded strings.Builder
+	for _, c := range name {
+		if c < 0x20 || c >= 0x7f || c == '"' || c == '\\' || c == '%' {
+			fallback.WriteByte('_')
+		} else {
+			fallback.WriteRune(c)
+		}
+	}
+	for i := 0; i < len(name); i++ {
+		if b := name[i]; isAttrChar(b) {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return disposition + `; filename="` + fallback.String() + `"; filename*=UTF-8''` + encoded.String()
+}
+
+// isAttrChar reports whether b may appear unencoded in an RFC 5987 value.
+func isAttrChar(b byte) bool {
+	return b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' || strings.IndexByte("!#$&+-.^_`|~", b) >= 0
+}
+
+// setContentDisposition names a served file: inline, so players can show
+// the name, or attachment with ?download=1, so browsers save it as that.
+func setContentDisposition(w http.ResponseWriter, r *http.Request, name string) {
+	disposition := "inline"
+	if r.URL.Query().Get("download") == "1" {
+		disposition = "attachment"
+	}
+	w.Header().Set("Content-Disposition", contentDisposition(disposition, name))
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"mime"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/wuvt/moss/mosstest"
+)
+
+func TestContentDisposition(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		fallback string
+		encoded  string
+	}{
+		{"01 Track.flac", "01 Track.flac", "01%20Track.flac"},
+		{"01 Björk – Jóga.flac", "01 Bj_rk _ J_ga.flac", "01%20Bj%C3%B6rk%20%E2%80%93%20J%C3%B3ga.flac"},
+		{`02 "Heroes".flac`, "02 _Heroes_.flac", "02%20%22Heroes%22.flac"},
+		{"03 “Curly” ‘quotes’.flac", "03 _Curly_ _quotes_.flac", "03%20%E2%80%9CCurly%E2%80%9D%20%E2%80%98quotes%E2%80%99.flac"},
+		{`04 It's 100% \ back.flac`, "04 It's 100_ _ back.flac", "04%20It%27s%20100%25%20%5C%20back.flac"},
+		{"05 a;b=c.flac", "05 a;b=c.flac", "05%20a%3Bb%3Dc.flac"},
+		{"06 東京.flac", "06 __.flac", "06%20%E6%9D%B1%E4%BA%AC.flac"},
+		{"07 tab\there.flac", "07 tab_here.flac", "07%20tab%09here.flac"},
+	} {
+		got := contentDisposition("attachment", c.name)
+		want := `attachment; filename="` + c.fallback + `"; filename*=UTF-8''` + c.encoded
+		if got != want {
+			t.Errorf("contentDisposition(%q)\n  = %s\nwant %s", c.name, got, want)
+		}
+		// A client going by filename* gets the name back exactly
+		disposition, params, err := mime.ParseMediaType(got)
+		if err != nil || disposition != "attachment" || params["filename"] != c.name {
+			t.Errorf("%q parses as %s %q, %v", c.name, disposition, params, err)
+		}
+	}
+}
+
+// Tracks are named as they're stored, however unusual, and art by its type.
+func TestDownloadNames(t *testing.T) {
+	const track = `CD1/01 Sigur Rós – "Svefn-g-englar".flac`
+	s := newTestServer(t, mosstest.Spec{Holdings: []mosstest.Holding{{
+		Tracks:   []mosstest.Track{{Name: "CD1/" + url.PathEscape(track[4:])}},
+		AlbumArt: mosstest.PNG(8, 0x40),
+		Artwork:  map[string][]byte{"back": mosstest.PNG(8, 0x80)},
+	}}})
+
+	for _, c := range []struct {
+		path     string
+		filename string
+	}{
+		{s.Path(0, "music", "CD1", url.PathEscape(track[4:])), track[4:]},
+		{s.Path(0, "albumart"), "albumart.png"},
+		{s.Path(0, "albumart", "back"), "albumart-back.png"},
+	} {
+		for query, want := range map[string]string{"": "inline", "?download=1": "attachment", "?download=0": "inline"} {
+			resp := s.MustDo("GET", c.path+query, nil)
+			header := resp.Header.Get("Content-Disposition")
+			disposition, params, err := mime.ParseMediaType(header)
+			if err != nil || disposition != want || params["filename"] != c.filename {
+				t.Errorf("GET %s%s has Content-Disposition %s", c.path, query, header)
+			}
+			if strings.ContainsAny(header, "\r\n") || strings.Count(header, `"`) != 2 {
+				t.Errorf("GET %s%s has a header that could be misread: %s", c.path, query, header)
+			}
+		}
+	}
+}
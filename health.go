@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+type ReadyCheck struct {
+	Name  string
+	OK    bool
+	Error string `json:",omitempty"`
+}
+
+type Readiness struct {
+	Ready  bool
+	Frozen bool
+	Checks []ReadyCheck
+}
+
+// healthzHandler only says the process is up and serving HTTP.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+func readiness() Readiness {
+	checks := []ReadyCheck{}
+	check := func(name string, err error) {
+		c := ReadyCheck{Name: name, OK: err == nil}
+		if err != nil {
+			c.Error = err.Error()
+		}
+		checks = append(checks, c)
+	}
+
+	_, err := ioutil.ReadDir(config.LibraryPath)
+	check("library", err)
+
+	// Don't actually write, the library may be frozen
+	check("tmp", syscall.Access(tmpDir(), 2))
+	check("free-space", checkFreeSpace())
+	check("clock", checkClockSkew())
+
+	ready := true
+	for _, c := range checks {
+		ready = ready && c.OK
+	}
+	// Reads keep working while frozen, so that alone doesn't make us unready
+	return Readiness{ready, libraryFrozen(), checks}
+}
+
+// readyzHandler answers 503 unless the library can be read and written.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	result := readiness()
+	js, err := json.Marshal(result)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !result.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(js)
+}
+
+func boolGauge(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// metricsHandler exposes the counters from /stats in the Prometheus text
+// format. Unlike /stats these are totals since startup and DELETE /stats
+// doesn't reset them.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	fmt.Fprintln(w, "# HELP moss_requests_total Requests handled, by status class.")
+	fmt.Fprintln(w, "# TYPE moss_requests_total counter")
+	classes := []struct {
+		name string
+		c    *rollingCounter
+	}{{"2xx", &stats.status2xx}, {"3xx", &stats.status3xx}, {"4xx", &stats.status4xx}, {"5xx", &stats.status5xx}}
+	for _, class := range classes {
+		fmt.Fprintf(w, "moss_requests_total{class=%q} %d\n", class.name, class.c.total.Load())
+	}
+
+	counters := []struct {
+		name string
+		help string
+		c    *rollingCounter
+	}{
+		{"moss_auth_failures_total", "Requests refused for bad credentials.", &stats.authFailures},
+		{"moss_lock_conflicts_total", "Writes refused because the holding is locked.", &stats.lockConflicts},
+		{"moss_traversal_rejections_total", "Requests refused for escaping the library.", &stats.traversalRejections},
+		{"moss_storage_errors_total", "Failed filesystem operations.", &stats.storageErrors},
+		{"moss_repairs_total", "Corrupt files repaired from a peer.", &stats.repairs},
+		{"moss_repair_failures_total", "Corrupt files that couldn't be repaired.", &stats.repairFailures},
+		{"moss_reader_conflicts_total", "Removals given up on while a holding was being streamed.", &stats.readerConflicts},
+		{"moss_verify_mismatches_total", "Files read back with a different SHA-256 than stored.", &stats.verifyMismatches},
+	}
+	for _, counter := range counters {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", counter.name, counter.help, counter.name, counter.name, counter.c.total.Load())
+	}
+
+	free, _ := libraryFreeSpace()
+	fmt.Fprintf(w, "# HELP moss_free_space_bytes Free space on the library filesystem.\n# TYPE moss_free_space_bytes gauge\nmoss_free_space_bytes %d\n", free)
+
+	temp := tempUsage()
+	fmt.Fprintf(w, "# HELP moss_temp_files Files in the library's tmp directory.\n# TYPE moss_temp_files gauge\nmoss_temp_files %d\n", temp.Files)
+	fmt.Fprintf(w, "# HELP moss_temp_bytes Bytes in the library's tmp directory.\n# TYPE moss_temp_bytes gauge\nmoss_temp_bytes %d\n", temp.Bytes)
+
+	neg := negativeCacheStats()
+	fmt.Fprintf(w, "# HELP moss_negative_cache_entries UUIDs remembered as missing.\n# TYPE moss_negative_cache_entries gauge\nmoss_negative_cache_entries %d\n", neg.Entries)
+	fmt.Fprintf(w, "# HELP moss_negative_cache_hits_total Lookups answered by the negative cache.\n# TYPE moss_negative_cache_hits_total counter\nmoss_negative_cache_hits_total %d\n", neg.Hits)
+	fmt.Fprintf(w, "# HELP moss_negative_cache_misses_total Lookups that missed the negative cache.\n# TYPE moss_negative_cache_misses_total counter\nmoss_negative_cache_misses_total %d\n", neg.Misses)
+
+	if bus := eventBusStats(); bus != nil {
+		fmt.Fprintf(w, "# HELP moss_event_bus_connected Whether the event bus publisher is connected.\n# TYPE moss_event_bus_connected gauge\nmoss_event_bus_connected %d\n", boolGauge(bus.Connected))
+		fmt.Fprintf(w, "# HELP moss_event_bus_published_total Change events the broker has acknowledged.\n# TYPE moss_event_bus_published_total counter\nmoss_event_bus_published_total %d\n", bus.Published)
+		fmt.Fprintf(w, "# HELP moss_event_bus_queued Change events waiting in the outbox.\n# TYPE moss_event_bus_queued gauge\nmoss_event_bus_queued %d\n", bus.Queued)
+		fmt.Fprintf(w, "# HELP moss_event_bus_dropped_total Change events dropped from a full outbox.\n# TYPE moss_event_bus_dropped_total counter\nmoss_event_bus_dropped_total %d\n", bus.Dropped)
+		fmt.Fprintf(w, "# HELP moss_event_bus_reconnects_total Connections to the broker that were lost.\n# TYPE moss_event_bus_reconnects_total counter\nmoss_event_bus_reconnects_total %d\n", bus.Reconnects)
+	}
+
+	peers := peerStats()
+	if len(peers) > 0 {
+		fmt.Fprintln(w, "# HELP moss_peer_healthy Whether a peer is currently considered healthy.")
+		fmt.Fprintln(w, "# TYPE moss_peer_healthy gauge")
+		for _, p := range peers {
+			fmt.Fprintf(w, "moss_peer_healthy{peer=%q} %d\n", p.Name, boolGauge(p.Healthy))
+		}
+		fmt.Fprintln(w, "# HELP moss_peer_requests_total Requests sent to a peer.")
+		fmt.Fprintln(w, "# TYPE moss_peer_requests_total counter")
+		for _, p := range peers {
+			fmt.Fprintf(w, "moss_peer_requests_total{peer=%q} %d\n", p.Name, p.Requests)
+		}
+		fmt.Fprintln(w, "# HELP moss_peer_retries_total Retried requests to a peer.")
+		fmt.Fprintln(w, "# TYPE moss_peer_retries_total counter")
+		for _, p := range peers {
+			fmt.Fprintf(w, "moss_peer_retries_total{peer=%q} %d\n", p.Name, p.Retries)
+		}
+		fmt.Fprintln(w, "# HELP moss_peer_failures_total Requests to a peer that failed after retries.")
+		fmt.Fprintln(w, "# TYPE moss_peer_failures_total counter")
+		for _, p := range peers {
+			fmt.Fprintf(w, "moss_peer_failures_total{peer=%q} %d\n", p.Name, p.Failures)
+		}
+	}
+
+	writeLatencyMetrics(w)
+	writeReaderMetrics(w)
+
+	queues := replicationStats(time.Now())
+	if len(queues) > 0 {
+		fmt.Fprintln(w, "# HELP moss_replication_queue_depth Holdings waiting to be replicated to a peer.")
+		fmt.Fprintln(w, "# TYPE moss_replication_queue_depth gauge")
+		for _, q := range queues {
+			fmt.Fprintf(w, "moss_replication_queue_depth{peer=%q} %d\n", q.Peer, q.Depth)
+		}
+		fmt.Fprintln(w, "# HELP moss_replication_oldest_pending_seconds Age of the oldest holding waiting for a peer.")
+		fmt.Fprintln(w, "# TYPE moss_replication_oldest_pending_seconds gauge")
+		for _, q := range queues {
+			fmt.Fprintf(w, "moss_replication_oldest_pending_seconds{peer=%q} %g\n", q.Peer, q.OldestAge)
+		}
+		fmt.Fprintln(w, "# HELP moss_replication_holdings_total Holdings replicated to a peer.")
+		fmt.Fprintln(w, "# TYPE moss_replication_holdings_total counter")
+		for _, q := range queues {
+			fmt.Fprintf(w, "moss_replication_holdings_total{peer=%q} %d\n", q.Peer, replicationQueues[q.Peer].holdings.total.Load())
+		}
+		fmt.Fprintln(w, "# HELP moss_replication_bytes_total Bytes replicated to a peer.")
+		fmt.Fprintln(w, "# TYPE moss_replication_bytes_total counter")
+		for _, q := range queues {
+			fmt.Fprintf(w, "moss_replication_bytes_total{peer=%q} %d\n", q.Peer, replicationQueues[q.Peer].bytes.total.Load())
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP moss_frozen Whether the library is frozen for maintenance.\n# TYPE moss_frozen gauge\nmoss_frozen %d\n", boolGauge(libraryFrozen()))
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Job tracks a long-running background operation so its progress can be
+// polled over the API. Jobs are saved under .moss-jobs/ in the library as
+// they start, fail, finish and, at most once a second, as they progress, so
+// a restart doesn't lose them. A job that was running when moss stopped is
+// resumed at startup if it is safe to run again; otherwise it is left
+// "interrupted" until an admin resumes or aborts it.
+type Job struct {
+	mu    sync.Mutex
+	saved time.Time
+
+	ID                string
+	Type              string
+	State             string
+	Started           Timestamp
+	Finished          *Timestamp `json:",omitempty"`
+	HoldingsTotal     int
+	HoldingsRemaining int
+	BytesTotal        int64
+	BytesRemaining    int64
+	Failures          []string
+
+	// What the job was started with, so it can be run again
+	Params json.RawMessage `json:",omitempty"`
+	// Times the job was resumed after a restart
+	Resumed int `json:",omitempty"`
+}
+
+const jobsDirName = ".moss-jobs"
+const jobSaveInterval = time.Second
+
+// Finished jobs are forgotten at startup after this long
+const jobHistoryTTL = 7 * 24 * time.Hour
+
+// jobRunner runs a type of job from its Params. run finishes the job.
+type jobRunner struct {
+	// Safe to run again from the start, so resumed without asking
+	idempotent bool
+	run        func(job *Job)
+	// Called at startup for a job left interrupted, and when it's aborted
+	interrupted func(job *Job)
+	abort       func(job *Job)
+}
+
+// Registered by each file's init
+var jobRunners = map[string]jobRunner{}
+
+var jobs = struct {
+	sync.Mutex
+	m map[string]*Job
+}{m: map[string]*Job{}}
+
+func jobsDir() string {
+	return path.Join(config.LibraryPath, jobsDirName)
+}
+
+func newJob(jobType string, params interface{}) *Job {
+	b := make([]byte, 8)
+	rand.Read(b)
+	job := &Job{
+		ID:       hex.EncodeToString(b),
+		Type:     jobType,
+		State:    "running",
+		Started:  stamp(time.Now()),
+		Failures: []string{},
+	}
+	if params != nil {
+		js, err := json.Marshal(params)
+		if err != nil {
+			log.Println(err.Error())
+		}
+		job.Params = js
+	}
+	jobs.Lock()
+	jobs.m[job.ID] = job
+	jobs.Unlock()
+	job.save()
+	return job
+}
+
+// save writes the job to .moss-jobs/. Failing to is logged and otherwise
+// ignored, since the job itself can carry on.
+func (j *Job) save() {
+	j.mu.Lock()
+	j.saved = time.Now()
+	j.mu.Unlock()
+	js, err := json.MarshalIndent(j.snapshot(), "", "  ")
+	if err == nil {
+		err = writeFileAtomic(path.Join(jobsDir(), j.ID+".json"), js)
+	}
+	if err != nil {
+		log.Printf("Cannot save job %s: %s\n", j.ID, err.Error())
+	}
+}
+
+func (j *Job) update(fn func(j *Job)) {
+	j.mu.Lock()
+	fn(j)
+	due := time.Since(j.saved) >= jobSaveInterval
+	j.mu.Unlock()
+	if due {
+		j.save()
+	}
+}
+
+func (j *Job) fail(problem string) {
+	log.Printf("Job %s: %s\n", j.ID, problem)
+	j.update(func(j *Job) {
+		j.Failures = append(j.Failures, problem)
+	})
+	j.save()
+}
+
+func (j *Job) finish() {
+	j.update(func(j *Job) {
+		now := stamp(time.Now())
+		j.Finished = &now
+		if len(j.Failures) > 0 {
+			j.State = "failed"
+		} else {
+			j.State = "done"
+		}
+	})
+	j.save()
+	log.Printf("Job %s (%s) finished\n", j.ID, j.Type)
+}
+
+// active reports whether the job is running or waiting to be resumed, which
+// keeps another of its kind from starting.
+func (j *Job) active() bool {
+	state := j.snapshot().State
+	return state == "running" || state == "interrupted"
+}
+
+// decodeParams unmarshals the job's Params into v.
+func (j *Job) decodeParams(v interface{}) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return json.Unmarshal(j.Params, v)
+}
+
+// snapshot returns a copy that is safe to marshal while the job runs.
+func (j *Job) snapshot() *Job {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return &Job{
+		ID:                j.ID,
+		Type:              j.Type,
+		State:             j.State,
+		Started:           j.Started,
+		Finished:          j.Finished,
+		HoldingsTotal:     j.HoldingsTotal,
+		HoldingsRemaining: j.HoldingsRemaining,
+		BytesTotal:        j.BytesTotal,
+		BytesRemaining:    j.BytesRemaining,
+		Failures:          append([]string{}, j.Failures...),
+		Params:            j.Params,
+		Resumed:           j.Resumed,
+	}
+}
+
+// resume runs an interrupted job again under the same ID.
+func (j *Job) resume(runner jobRunner) {
+	j.update(func(j *Job) {
+		j.State = "running"
+		j.Resumed++
+	})
+	j.save()
+	log.Printf("Job %s (%s) resumed\n", j.ID, j.Type)
+	go runner.run(j)
+}
+
+// loadJobs reads the saved jobs at startup. Jobs that were running are
+// resumed if their type is idempotent and otherwise marked interrupted.
+func loadJobs() error {
+	if err := os.MkdirAll(jobsDir(), 0755); err != nil {
+		return err
+	}
+	dirEnts, err := os.ReadDir(jobsDir())
+	if err != nil {
+		return err
+	}
+	for _, dirEnt := range dirEnts {
+		if !strings.HasSuffix(dirEnt.Name(), ".json") {
+			continue
+		}
+		p := path.Join(jobsDir(), dirEnt.Name())
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		job := &Job{}
+		if err := json.Unmarshal(data, job); err != nil {
+			log.Printf("Ignoring unreadable job %s: %s\n", dirEnt.Name(), err.Error())
+			continue
+		}
+		if job.Finished != nil && time.Since(job.Finished.Time) > jobHistoryTTL {
+			os.Remove(p)
+			continue
+		}
+		jobs.Lock()
+		jobs.m[job.ID] = job
+		jobs.Unlock()
+
+		if job.State != "running" && job.State != "interrupted" {
+			continue
+		}
+		runner, ok := jobRunners[job.Type]
+		if ok && runner.idempotent {
+			job.resume(runner)
+			continue
+		}
+		if job.State == "running" {
+			log.Printf("Job %s (%s) was interrupted by a restart, resume or abort it at /admin/jobs/%s\n", job.ID, job.Type, job.ID)
+			job.State = "interrupted"
+			job.save()
+		}
+		if ok && runner.interrupted != nil {
+			runner.interrupted(job)
+		}
+	}
+	return nil
+}
+
+// resumedJob reports whether a job of the given type was resumed at startup.
+func resumedJob(jobType string) bool {
+	for _, job := range allJobs() {
+		if job.Type == jobType && job.State == "running" && job.Resumed > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func findJob(id string) *Job {
+	jobs.Lock()
+	defer jobs.Unlock()
+	return jobs.m[id]
+}
+
+func allJobs() []*Job {
+	jobs.Lock()
+	list := []*Job{}
+	for _, job := range jobs.m {
+		list = append(list, job)
+	}
+	jobs.Unlock()
+
+	snapshots := []*Job{}
+	for _, job := range list {
+		snapshots = append(snapshots, job.snapshot())
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Started.Before(snapshots[j].Started.Time)
+	})
+	return snapshots
+}
+
+func jobsHandler(w http.ResponseWriter, r *http.Request, params []string) {
+	if len(params) == 2 && (params[1] == "resume" || params[1] == "abort") {
+		jobActionHandler(w, r, params[0], params[1])
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var result interface{}
+	if len(params) == 0 || params[0] == "" {
+		result = allJobs()
+	} else {
+		job := findJob(params[0])
+		if job == nil {
+			http.Error(w, "job not found", http.StatusNotFound)
+			return
+		}
+		result = job.snapshot()
+	}
+
+	js, err := json.Marshal(result)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// jobActionHandler handles POST /admin/jobs/ID/resume and /admin/jobs/ID/abort
+// for jobs interrupted by a restart.
+func jobActionHandler(w http.ResponseWriter, r *http.Request, id string, action string) {
+	if r.Method != "POST" {
+		http.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	job := findJob(id)
+	if job == nil {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+	if job.snapshot().State != "interrupted" {
+		writeJob(w, job, http.StatusConflict)
+		return
+	}
+	runner, ok := jobRunners[job.Type]
+	user, _, _ := r.BasicAuth()
+
+	if action == "abort" {
+		job.update(func(j *Job) {
+			now := stamp(time.Now())
+			j.Finished = &now
+			j.State = "aborted"
+		})
+		job.save()
+		if ok && runner.abort != nil {
+			runner.abort(job)
+		}
+		log.Printf("Job %s (%s) aborted by %s\n", job.ID, job.Type, user)
+		writeJob(w, job, http.StatusOK)
+		return
+	}
+
+	if !ok {
+		http.Error(w, "Jobs of type "+job.Type+" can't be resumed", http.StatusConflict)
+		return
+	}
+	log.Printf("Job %s (%s) resume requested by %s\n", job.ID, job.Type, user)
+	job.resume(runner)
+	writeJob(w, job, http.StatusAccepted)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/wuvt/moss/mosstest"
+)
+
+// savedJob reads a job the way the next start will, from .moss-jobs/.
+func savedJob(t *testing.T, library string, id string) *Job {
+	t.Helper()
+	data, err := os.ReadFile(path.Join(library, jobsDirName, id+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := &Job{}
+	if err := json.Unmarshal(data, job); err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+func jobsOfType(t *testing.T, s *mosstest.Server, jobType string) []*Job {
+	t.Helper()
+	var list []*Job
+	s.MustDo("GET", "/admin/jobs", nil).JSON(t, &list)
+	found := []*Job{}
+	for _, job := range list {
+		if job.Type == jobType {
+			found = append(found, job)
+		}
+	}
+	return found
+}
+
+// A checksum backfill killed partway through is picked up by the next start
+// under the same ID, rather than vanishing or starting a second one, and
+// gets through every holding.
+func TestJobResumedAfterKill(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds moss")
+	}
+	bin := filepath.Join(t.TempDir(), "moss")
+	if out, err := exec.Command("go", "build", "-o", bin, ".").CombinedOutput(); err != nil {
+		t.Fatalf("building moss: %s\n%s", err, out)
+	}
+
+	holdings := []mosstest.Holding{}
+	for i := 0; i < 6; i++ {
+		holdings = append(holdings, mosstest.Holding{Tracks: []mosstest.Track{{Name: "01.flac", Size: 64 << 10}}})
+	}
+	first := mosstest.Start(t, bin, nil, mosstest.Spec{Holdings: holdings})
+	first.Kill()
+	library := first.Library
+
+	// Adding md5 starts a backfill, slowed to about half a second a holding
+	slow := mosstest.Start(t, bin, map[string]interface{}{
+		"LibraryPath":          library,
+		"ChecksumAlgorithms":   []string{"sha256", "md5"},
+		"ChecksumBackfillRate": 128 << 10,
+	}, mosstest.Spec{})
+	var id string
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		if time.Now().After(deadline) {
+			t.Fatal("the backfill never saved any progress")
+		}
+		for _, job := range jobsOfType(t, slow, "checksum-backfill") {
+			if job.State == "running" {
+				id = job.ID
+			}
+		}
+		if id != "" {
+			saved := savedJob(t, library, id)
+			if saved.HoldingsRemaining > 0 && saved.HoldingsRemaining < saved.HoldingsTotal {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	slow.Kill()
+	if saved := savedJob(t, library, id); saved.State != "running" || saved.Finished != nil {
+		t.Fatalf("the killed backfill was saved as %+v", saved)
+	}
+
+	s := mosstest.Start(t, bin, map[string]interface{}{
+		"LibraryPath":        library,
+		"ChecksumAlgorithms": []string{"sha256", "md5"},
+	}, mosstest.Spec{})
+	var resumed *Job
+	deadline = time.Now().Add(30 * time.Second)
+	for resumed == nil || resumed.State == "running" {
+		if time.Now().After(deadline) {
+			t.Fatalf("the resumed backfill never finished: %+v", resumed)
+		}
+		time.Sleep(50 * time.Millisecond)
+		resumed = nil
+		for _, job := range jobsOfType(t, s, "checksum-backfill") {
+			if job.ID == id {
+				resumed = job
+			} else if job.State == "running" {
+				t.Fatalf("a second backfill %s started instead of resuming %s", job.ID, id)
+			}
+		}
+	}
+	if resumed.State != "done" || resumed.Resumed != 1 || resumed.HoldingsRemaining != 0 || len(resumed.Failures) > 0 {
+		t.Errorf("the resumed backfill ended as %+v", resumed)
+	}
+
+	for _, h := range first.Holdings {
+		var holding Holding
+		s.MustDo("GET", "/"+h.UUID+"/", nil).JSON(t, &holding)
+		if holding.Checksums == nil || holding.Checksums.Music["01.flac"]["md5"] == "" {
+			t.Errorf("%s has no md5: %+v", h.UUID, holding.Checksums)
+		}
+	}
+}
+
+// A drain can delete local copies, so one cut off by a restart waits for an
+// admin, with its shard still refusing writes, rather than running again.
+func TestDrainInterruptedByRestart(t *testing.T) {
+	s := newTestServer(t, mosstest.Spec{}, func(c *Config) {
+		c.Peers = []Peer{{Name: "elsewhere", URL: "http://127.0.0.1:1"}}
+	})
+	shard := config.Shards[0]
+	// What a drain running when moss was killed leaves in .moss-jobs/
+	job := newJob("drain", DrainJobParams{shard.MinUUID, "elsewhere", true})
+
+	jobs.Lock()
+	jobs.m = map[string]*Job{}
+	jobs.Unlock()
+	startTestLibrary(t)
+
+	var got Job
+	s.MustDo("GET", "/admin/jobs/"+job.ID, nil).JSON(t, &got)
+	if got.State != "interrupted" || got.Resumed != 0 {
+		t.Errorf("after the restart the drain is %+v", &got)
+	}
+	if saved := savedJob(t, config.LibraryPath, job.ID); saved.State != "interrupted" {
+		t.Errorf("the drain was saved as %s", saved.State)
+	}
+	uuid := mosstest.NewUUID()
+	if resp := s.Do("PUT", "/"+uuid+"/music/01.flac", mosstest.FLAC(0)); resp.Status != http.StatusMisdirectedRequest {
+		t.Errorf("an upload to the interrupted drain's shard got %d %s", resp.Status, resp.Body)
+	}
+
+	s.MustDo("POST", "/admin/jobs/"+job.ID+"/abort", nil).JSON(t, &got)
+	if got.State != "aborted" || got.Finished == nil {
+		t.Errorf("the aborted drain is %+v", &got)
+	}
+	s.MustDo("PUT", "/"+uuid+"/music/01.flac", mosstest.FLAC(0))
+	for _, action := range []string{"abort", "resume"} {
+		if resp := s.Do("POST", "/admin/jobs/"+job.ID+"/"+action, nil); resp.Status != http.StatusConflict {
+			t.Errorf("%s of an aborted drain got %d %s", action, resp.Status, resp.Body)
+		}
+	}
+}
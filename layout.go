@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"path"
+)
+
+// GET /layout describes where things are on disk, for backup scripts,
+// restore runbooks and other tools that would otherwise hardcode it. The
+// descriptor is built from the same constants the storage code uses, and
+// LayoutVersion goes up whenever its shape changes incompatibly.
+const layoutVersion = 1
+
+// Files kept in each holding directory next to music/
+const (
+	lockFileName        = "lock"
+	checksumsFileName   = "checksums.json"
+	holdingInfoFileName = "holding.json"
+	tagsFileName        = "tags.json"
+	attrsFileName       = "attrs.json"
+	provenanceFileName  = "provenance.json"
+)
+
+type LayoutSharding struct {
+	// Holdings live in PREFIX/UUID4, where PREFIX is the first PrefixLength
+	// characters of the lowercase UUID, or PREFIX/SUB/UUID4 under a
+	// fanned-out prefix, SUB being the next SubPrefixLength characters
+	Pattern          string
+	FannedOutPattern string
+	PrefixLength     int
+	SubPrefixLength  int
+	// Lookups try Pattern before FannedOutPattern under these
+	FannedOut []FanoutPrefix
+	// Set when holdings may also be directly under the root
+	LegacyFlat    bool
+	LegacyPattern string `json:",omitempty"`
+}
+
+type LayoutSidecar struct {
+	Name        string
+	Description string
+}
+
+type LayoutHolding struct {
+	Music      string
+	AlbumArt   string
+	MasterArt  string
+	DerivedArt string
+	Clips      string
+	Sidecars   []LayoutSidecar
+}
+
+type LayoutArchive struct {
+	Name         string
+	Bucket       string
+	Prefix       string `json:",omitempty"`
+	StorageClass string `json:",omitempty"`
+	// Object keys, with UUID4 replaced by the holding
+	ArchiveKey  string
+	ManifestKey string
+}
+
+type LayoutShard struct {
+	MinUUID  string
+	MaxUUID  string
+	Backend  string
+	Writable bool
+}
+
+type Layout struct {
+	LayoutVersion int
+	// The format the library is in and the newest this binary writes
+	FormatVersion        int
+	CurrentFormatVersion int
+	LibraryPath          string
+
+	Sharding LayoutSharding
+	Holding  LayoutHolding
+	// Directories and files at the library root that aren't holdings, by
+	// what they are for
+	Reserved map[string]string
+	Shards   []LayoutShard
+	Archives []LayoutArchive
+}
+
+func currentLayout() (Layout, error) {
+	version, err := readFormatVersion()
+	if err != nil {
+		return Layout{}, err
+	}
+	layout := Layout{
+		LayoutVersion:        layoutVersion,
+		FormatVersion:        version,
+		CurrentFormatVersion: currentFormatVersion,
+		LibraryPath:          config.LibraryPath,
+		Sharding: LayoutSharding{
+			Pattern:          path.Join("PREFIX", "UUID4"),
+			FannedOutPattern: path.Join("PREFIX", "SUB", "UUID4"),
+			PrefixLength:     2,
+			SubPrefixLength:  2,
+			FannedOut:        fanoutPrefixes(),
+			LegacyFlat:       config.LegacyLayout,
+		},
+		Holding: LayoutHolding{
+			Music:      "music",
+			AlbumArt:   "albumart",
+			MasterArt:  masterArtFileName,
+			DerivedArt: derivedArtFileName,
+			Clips:      clipDirName,
+			Sidecars: []LayoutSidecar{
+				{lockFileName, "present once the holding is locked; JSON lock metadata, or empty for old locks"},
+				{lockProposalFileName, "a lock waiting for approval"},
+				{checksumsFileName, "stored digests of the music and art"},
+				{holdingInfoFileName, "creation time, privacy and archive record"},
+				{tagsFileName, "tags read from the tracks"},
+				{attrsFileName, "per-file attributes"},
+				{provenanceFileName, "where each file came from"},
+				{expectedFileName, "the tracks the holding should have"},
+				{repairHistoryFileName, "repairs made from peers"},
+			},
+		},
+		Reserved: map[string]string{
+			tmpDirName:               "upload spool and transaction staging",
+			exportTreeDirName:        "Artist/Album hardlink tree, derived and safe to delete",
+			quarantineDirName:        "files moved out of the way by fsck -quarantine",
+			jobsDirName:              "background job state",
+			replicationDirName:       "replication queue",
+			catalogDirName:           "catalog ingest outbox and last reconciliation",
+			fanoutFileName:           "fanned-out prefixes",
+			formatFileName:           "on-disk format version",
+			migrationJournalFileName: "progress of a migration",
+			usageFileName:            "upload quota usage",
+			freezeFileName:           "present while writes are frozen",
+			freezePidFileName:        "the process holding the freeze",
+		},
+		Shards:   []LayoutShard{},
+		Archives: []LayoutArchive{},
+	}
+	if config.LegacyLayout {
+		layout.Sharding.LegacyPattern = "UUID4"
+	}
+	for _, shard := range config.Shards {
+		layout.Shards = append(layout.Shards, LayoutShard{shard.MinUUID, shard.MaxUUID, backendFor(shard.MinUUID), shard.Writable})
+	}
+	for _, dest := range config.ArchiveDestinations {
+		layout.Archives = append(layout.Archives, LayoutArchive{
+			Name:         dest.Name,
+			Bucket:       dest.Bucket,
+			Prefix:       dest.Prefix,
+			StorageClass: dest.StorageClass,
+			ArchiveKey:   dest.objectKey("UUID4.tar"),
+			ManifestKey:  dest.objectKey("UUID4.manifest.json"),
+		})
+	}
+	return layout, nil
+}
+
+func layoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkAuth(w, r) {
+		return
+	}
+	layout, err := currentLayout()
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	js, err := json.Marshal(layout)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
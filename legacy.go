@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+)
+
+// Migrations are rare and touch whole holdings, so they are simply run one at
+// a time.
+var migrateMu sync.Mutex
+
+type legacyHoldingError struct {
+	uuid string
+}
+
+func (e *legacyHoldingError) Error() string {
+	return fmt.Sprintf("%s is stored in the legacy flat layout and has not been migrated", e.uuid)
+}
+
+type migrationError struct {
+	uuid    string
+	problem string
+}
+
+func (e *migrationError) Error() string {
+	return fmt.Sprintf("Migration of %s failed - %s", e.uuid, e.problem)
+}
+
+func legacyPath(basepath string, uuid string) string {
+	return path.Join(basepath, uuid)
+}
+
+// lookupHoldingDir returns the directory a holding is stored in, preferring
+// its shard directory and falling back to the flat layout in legacy mode.
+func lookupHoldingDir(uuid string) (string, bool) {
+	dir := uuidToPath(config.LibraryPath, uuid)
+	if !config.LegacyLayout || dirExists(dir) {
+		return dir, false
+	}
+	legacy := legacyPath(config.LibraryPath, uuid)
+	if !dirExists(legacy) {
+		return dir, false
+	}
+	return legacy, true
+}
+
+// holdingDir returns the directory a holding should be read from. In legacy
+// mode a holding that is missing from its shard directory is served from the
+// flat layout instead, and optionally moved into place in the background.
+func holdingDir(uuid string) string {
+	dir, legacy := lookupHoldingDir(uuid)
+	if legacy && config.MigrateOnAccess {
+		go func() {
+			release, err := beginWrite()
+			if err != nil {
+				return
+			}
+			defer release()
+			if err := migrateLegacyHolding(uuid); err != nil {
+				log.Println(err.Error())
+			}
+		}()
+	}
+	return dir
+}
+
+// prepareWrite makes sure a write to a holding lands next to its existing
+// contents. Writing into the sharded location while the holding still lives
+// in the flat layout would split it in two, so the holding is either migrated
+// first or the write is refused.
+func prepareWrite(uuid string) error {
+	if !config.LegacyLayout || dirExists(uuidToPath(config.LibraryPath, uuid)) {
+		return nil
+	}
+	if !dirExists(legacyPath(config.LibraryPath, uuid)) {
+		return nil
+	}
+	if !config.MigrateOnAccess {
+		return &legacyHoldingError{uuid}
+	}
+	return migrateLegacyHolding(uuid)
+}
+
+// migrateLegacyHolding moves a holding from the flat layout into its shard.
+// Like any other move it waits for the holding's readers and takes its
+// mutex, so nothing is streamed from or written to the old directory as it
+// goes. The move is a rename within the library, which either happens or
+// doesn't, so unlike a relocation there's nothing to verify afterwards.
+func migrateLegacyHolding(uuid string) error {
+	admit, err := excludeReaders(uuid)
+	if err != nil {
+		return &migrationError{uuid, err.Error()}
+	}
+	defer admit()
+	unlock := lockHolding(uuid)
+	defer unlock()
+	migrateMu.Lock()
+	defer migrateMu.Unlock()
+
+	src := legacyPath(config.LibraryPath, uuid)
+	dest := uuidToPath(config.LibraryPath, uuid)
+	if dirExists(dest) || !dirExists(src) {
+		// Someone else got here first
+		return nil
+	}
+
+	if err := os.MkdirAll(path.Dir(dest), 0755); err != nil {
+		return &migrationError{uuid, err.Error()}
+	}
+	if err := os.Rename(src, dest); err != nil {
+		return &migrationError{uuid, err.Error()}
+	}
+
+	log.Printf("Migrated %s from legacy layout\n", uuid)
+	return nil
+}
+
+func treeSizes(root string) (map[string]int64, error) {
+	sizes := map[string]int64{}
+	err := filepath.Walk(root, func(p string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !f.IsDir() {
+			sizes[p[len(root):]] = f.Size()
+		}
+		return nil
+	})
+	return sizes, err
+}
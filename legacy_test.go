@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/wuvt/moss/mosstest"
+)
+
+func TestMigrateLegacyHolding(t *testing.T) {
+	s := newTestServer(t, mosstest.Spec{}, func(c *Config) {
+		c.LegacyLayout = true
+		c.MigrateOnAccess = true
+		c.MaxReaderWait = -1
+	})
+	uuid := mosstest.NewUUID()
+	flat := legacyPath(config.LibraryPath, uuid)
+	writeTestFile(t, path.Join(flat, "music", "01.flac"), mosstest.FLAC(0))
+
+	// Someone streaming from the flat directory keeps it where it is
+	done := readHolding(uuid)
+	if err := migrateLegacyHolding(uuid); err == nil {
+		t.Error("migrated with a reader")
+	}
+	done()
+	if !dirExists(flat) {
+		t.Fatal("the flat directory moved with a reader")
+	}
+
+	// A write moves it into its shard first
+	s.MustDo("PUT", "/"+uuid+"/music/02.flac", mosstest.FLAC(0))
+	if dirExists(flat) {
+		t.Error("the flat directory is still there")
+	}
+	for _, name := range []string{"01.flac", "02.flac"} {
+		if _, err := os.Stat(path.Join(uuidToPath(config.LibraryPath, uuid), "music", name)); err != nil {
+			t.Error(err)
+		}
+	}
+	if resp := s.Do("GET", "/"+uuid+"/music/01.flac", nil); resp.Status != http.StatusOK {
+		t.Errorf("migrated track got %d", resp.Status)
+	}
+}
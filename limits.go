@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limits gathers the request limits. Zero fields get the defaults below, and
+// -1 turns off a timeout or concurrency limit. The effective values are
+// reported in /version.
+type Limits struct {
+	// Request body bytes, by what is being uploaded. MaxRequestBytes covers
+	// every other PUT and POST.
+	MaxMusicBytes     int64
+	MaxAlbumArtBytes  int64
+	MaxMasterArtBytes int64
+	MaxRequestBytes   int64
+	// The whole of a POST /albumart/batch, each image in it being held to
+	// MaxAlbumArtBytes
+	MaxArtBatchBytes int64
+
+	// Seconds a request can take before its connection is closed, for
+	// uploads, for downloads of files, archives, playlists and clips, and
+	// for everything else
+	UploadTimeout int
+	StreamTimeout int
+	APITimeout    int
+
+	// Uploads and downloads handled at once; more are refused with 503
+	MaxConcurrentUploads int
+	MaxConcurrentStreams int
+
+	// Items per page of paged listings, holdings per POST /locks and files
+	// per holding
+	MaxPageSize     int
+	MaxLockBatch    int
+	MaxHoldingFiles int
+	// Images per POST /albumart/batch
+	MaxArtBatchItems int
+}
+
+var defaultLimits = Limits{
+	MaxMusicBytes:        2 << 30,
+	MaxAlbumArtBytes:     10 << 20,
+	MaxMasterArtBytes:    1 << 30,
+	MaxRequestBytes:      1 << 20,
+	MaxArtBatchBytes:     2 << 30,
+	UploadTimeout:        60 * 60,
+	StreamTimeout:        6 * 60 * 60,
+	APITimeout:           5 * 60,
+	MaxConcurrentUploads: 64,
+	MaxConcurrentStreams: 256,
+	MaxPageSize:          1000,
+	MaxLockBatch:         500,
+	MaxHoldingFiles:      10000,
+	MaxArtBatchItems:     5000,
+}
+
+type limitsError struct {
+	problem string
+}
+
+func (e *limitsError) Error() string {
+	return e.problem
+}
+
+// initLimits fills in defaults, taking MaxLockBatch and MaxHoldingFiles from
+// where they used to be configured, and checks the limits fit together.
+func initLimits() error {
+	l := &config.Limits
+	if l.MaxLockBatch == 0 {
+		l.MaxLockBatch = config.MaxLockBatch
+	}
+	if l.MaxHoldingFiles == 0 {
+		l.MaxHoldingFiles = config.MaxHoldingFiles
+	}
+	fill64 := func(v *int64, d int64) {
+		if *v == 0 {
+			*v = d
+		}
+	}
+	fill := func(v *int, d int) {
+		if *v == 0 {
+			*v = d
+		}
+	}
+	fill64(&l.MaxMusicBytes, defaultLimits.MaxMusicBytes)
+	fill64(&l.MaxAlbumArtBytes, defaultLimits.MaxAlbumArtBytes)
+	fill64(&l.MaxMasterArtBytes, defaultLimits.MaxMasterArtBytes)
+	fill64(&l.MaxRequestBytes, defaultLimits.MaxRequestBytes)
+	fill64(&l.MaxArtBatchBytes, defaultLimits.MaxArtBatchBytes)
+	fill(&l.UploadTimeout, defaultLimits.UploadTimeout)
+	fill(&l.StreamTimeout, defaultLimits.StreamTimeout)
+	fill(&l.APITimeout, defaultLimits.APITimeout)
+	fill(&l.MaxConcurrentUploads, defaultLimits.MaxConcurrentUploads)
+	fill(&l.MaxConcurrentStreams, defaultLimits.MaxConcurrentStreams)
+	fill(&l.MaxPageSize, defaultLimits.MaxPageSize)
+	fill(&l.MaxLockBatch, defaultLimits.MaxLockBatch)
+	fill(&l.MaxHoldingFiles, defaultLimits.MaxHoldingFiles)
+	fill(&l.MaxArtBatchItems, defaultLimits.MaxArtBatchItems)
+
+	switch {
+	case l.MaxMusicBytes < 0 || l.MaxAlbumArtBytes < 0 || l.MaxMasterArtBytes < 0 || l.MaxRequestBytes < 0 || l.MaxArtBatchBytes < 0:
+		return &limitsError{"byte limits can't be negative"}
+	case l.MaxMusicBytes < l.MaxAlbumArtBytes:
+		return &limitsError{fmt.Sprintf("MaxMusicBytes (%d) is smaller than MaxAlbumArtBytes (%d)", l.MaxMusicBytes, l.MaxAlbumArtBytes)}
+	case l.MaxMasterArtBytes < l.MaxAlbumArtBytes:
+		return &limitsError{fmt.Sprintf("MaxMasterArtBytes (%d) is smaller than MaxAlbumArtBytes (%d)", l.MaxMasterArtBytes, l.MaxAlbumArtBytes)}
+	case l.MaxPageSize < 1 || l.MaxLockBatch < 1 || l.MaxArtBatchItems < 1:
+		return &limitsError{"MaxPageSize, MaxLockBatch and MaxArtBatchItems must be at least 1"}
+	}
+	for name, v := range map[string]int{"UploadTimeout": l.UploadTimeout, "StreamTimeout": l.StreamTimeout, "APITimeout": l.APITimeout, "MaxConcurrentUploads": l.MaxConcurrentUploads, "MaxConcurrentStreams": l.MaxConcurrentStreams} {
+		if v < -1 {
+			return &limitsError{name + " must be positive, or -1 for no limit"}
+		}
+	}
+	uploadSlots = newSemaphore(l.MaxConcurrentUploads)
+	streamSlots = newSemaphore(l.MaxConcurrentStreams)
+	return nil
+}
+
+// Route classes, for timeouts and concurrency
+const (
+	routeUpload = "upload"
+	routeStream = "stream"
+	routeAPI    = "api"
+)
+
+// classifyRequest returns a request's route class and, for PUT and POST, the
+// most its body may hold.
+func classifyRequest(r *http.Request) (string, int64) {
+	params := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if r.Method == "POST" && len(params) == 2 && params[0] == "albumart" && params[1] == "batch" {
+		return routeUpload, config.Limits.MaxArtBatchBytes
+	}
+	if uuidSanityCheck(strings.ToLower(params[0])) != nil || len(params) < 2 {
+		return routeAPI, config.Limits.MaxRequestBytes
+	}
+	switch r.Method {
+	case "PUT":
+		if params[1] == "music" {
+			return routeUpload, config.Limits.MaxMusicBytes
+		} else if params[1] == "albumart" && len(params) >= 3 && params[2] == "master" {
+			return routeUpload, config.Limits.MaxMasterArtBytes
+		} else if params[1] == "albumart" {
+			return routeUpload, config.Limits.MaxAlbumArtBytes
+		}
+	case "GET", "HEAD":
+		switch params[1] {
+		case "music", "albumart", "archive", "playlist.m3u", "clip":
+			return routeStream, 0
+		}
+	}
+	return routeAPI, config.Limits.MaxRequestBytes
+}
+
+type semaphore chan struct{}
+
+// newSemaphore returns nil, which never blocks, for -1.
+func newSemaphore(n int) semaphore {
+	if n < 0 {
+		return nil
+	}
+	return make(semaphore, n)
+}
+
+func (s semaphore) tryAcquire() bool {
+	if s == nil {
+		return true
+	}
+	select {
+	case s <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s semaphore) release() {
+	if s != nil {
+		<-s
+	}
+}
+
+var uploadSlots, streamSlots semaphore
+
+type tooLargeError struct {
+	limit int64
+}
+
+func (e *tooLargeError) Error() string {
+	return fmt.Sprintf("Request body is limited to %d bytes", e.limit)
+}
+
+type TooLargeResponse struct {
+	Error string
+	Code  string
+	Limit int64
+}
+
+// tooLarge answers 413 with a JSON body naming the limit, so upload clients
+// can tell the limit from other failures without parsing the message.
+func tooLarge(w http.ResponseWriter, err *tooLargeError) {
+	js, _ := json.Marshal(TooLargeResponse{err.Error(), "too-large", err.limit})
+	w.Header().Set(errorCodeHeader, "too-large")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	w.Write(js)
+}
+
+// enforceLimits applies the body size, timeout and concurrency limits of
+// each request's route class. The timeout closes the connection, so it also
+// stops uploads and downloads that have stalled.
+func enforceLimits(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		class, maxBytes := classifyRequest(r)
+
+		if r.Method == "PUT" || r.Method == "POST" {
+			if r.ContentLength > maxBytes {
+				tooLarge(w, &tooLargeError{maxBytes})
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+		}
+
+		slots := map[string]semaphore{routeUpload: uploadSlots, routeStream: streamSlots}[class]
+		if !slots.tryAcquire() {
+			w.Header().Set("Retry-After", "10")
+			http.Error(w, "Too many "+class+"s at once, try again later", http.StatusServiceUnavailable)
+			return
+		}
+		defer slots.release()
+
+		timeout := map[string]int{routeUpload: config.Limits.UploadTimeout, routeStream: config.Limits.StreamTimeout, routeAPI: config.Limits.APITimeout}[class]
+		if timeout > 0 {
+			deadline := time.Now().Add(time.Duration(timeout) * time.Second)
+			rc := http.NewResponseController(w)
+			rc.SetReadDeadline(deadline)
+			rc.SetWriteDeadline(deadline)
+			// Keep-alive connections would otherwise carry the deadline
+			// over to the next request
+			defer rc.SetReadDeadline(time.Time{})
+			defer rc.SetWriteDeadline(time.Time{})
+			ctx, cancel := context.WithDeadline(r.Context(), deadline)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// pageLimit parses a ?limit= page size, defaulting to def.
+func pageLimit(r *http.Request, def int) (int, error) {
+	s := r.URL.Query().Get("limit")
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 || n > config.Limits.MaxPageSize {
+		return 0, &limitsError{"limit must be a number from 1 to " + strconv.Itoa(config.Limits.MaxPageSize)}
+	}
+	return n, nil
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Holdings can be locked in two steps: whoever digitized it proposes the lock
+// and a different admin approves it. The proposal is kept in the holding's
+// lock-proposal file and blocks music uploads like a lock does.
+const lockProposalFileName = "lock-proposal"
+
+const defaultLockProposalTTL = 7 * 24 * 60 * 60
+
+type LockProposal struct {
+	ProposedBy string
+	ProposedAt Timestamp
+	ExpiresAt  Timestamp
+	Reason     string `json:",omitempty"`
+
+	// What the holding looked like when proposed; approval checks it still does
+	Manifest []ExportFile
+}
+
+type PendingLock struct {
+	UUID string
+	LockProposal
+}
+
+type lockProposedError struct {
+	uuid string
+	by   string
+}
+
+func (e *lockProposedError) Error() string {
+	return fmt.Sprintf("Lock proposed for %s by %s is awaiting approval", e.uuid, e.by)
+}
+
+type lockApprovalRequiredError struct {
+	uuid  string
+	shard Shard
+}
+
+func (e *lockApprovalRequiredError) Error() string {
+	return fmt.Sprintf("%s is in %s, whose locks must be proposed and approved", e.uuid, describeShard(e.shard))
+}
+
+// readLockProposal returns the holding's unexpired lock proposal, or nil.
+func readLockProposal(dir string) (*LockProposal, error) {
+	data, err := ioutil.ReadFile(path.Join(dir, lockProposalFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	proposal := &LockProposal{}
+	if err := json.Unmarshal(data, proposal); err != nil {
+		return nil, err
+	}
+	if time.Now().After(proposal.ExpiresAt.Time) {
+		return nil, nil
+	}
+	return proposal, nil
+}
+
+// checkLockProposal fails if a lock has been proposed for the holding.
+func checkLockProposal(uuid string, dir string) error {
+	proposal, err := readLockProposal(dir)
+	if err != nil {
+		return err
+	}
+	if proposal != nil {
+		return &lockProposedError{uuid, proposal.ProposedBy}
+	}
+	return nil
+}
+
+// checkDirectLock refuses PUT /UUID4/lock for shards with
+// RequireLockApproval. Admins are exempt, which is also what lets peers
+// replicate locks that were approved elsewhere.
+func checkDirectLock(r *http.Request, uuid string) error {
+	i := shardIndex(uuid)
+	if i < 0 || !config.Shards[i].RequireLockApproval || isAdmin(r) {
+		return nil
+	}
+	return &lockApprovalRequiredError{uuid, config.Shards[i]}
+}
+
+func lockManifest(dir string) ([]ExportFile, error) {
+	files := []ExportFile{}
+	sums, err := localChecksums(dir)
+	if err != nil {
+		return files, err
+	}
+	musicDir := path.Join(dir, "music")
+	err = walkFiles(musicDir, func(rel string) error {
+		stat, err := os.Stat(path.Join(musicDir, rel))
+		if err != nil {
+			return err
+		}
+		files = append(files, ExportFile{rel, stat.Size(), sums.Music[rel]})
+		return nil
+	})
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, err
+}
+
+func sameManifest(a []ExportFile, b []ExportFile) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Path != b[i].Path || a[i].Size != b[i].Size || !sameDigests(a[i].Checksums, b[i].Checksums) {
+			return false
+		}
+	}
+	return true
+}
+
+func lockReviewPreamble(w http.ResponseWriter, uuid string) (string, bool) {
+	if err := uuidSanityCheck(uuid); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+	if err := checkWritable(uuid); err != nil {
+		writeRefused(w, err)
+		return "", false
+	}
+	if err := prepareWrite(uuid); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusConflict)
+		return "", false
+	}
+	dir := uuidToPath(config.LibraryPath, uuid)
+	if !dirExists(dir) {
+		http.Error(w, "holding not found on disk", http.StatusNotFound)
+		return "", false
+	}
+	return dir, true
+}
+
+// proposeLockHandler handles POST /UUID4/lock/propose?reason=...
+func proposeLockHandler(w http.ResponseWriter, r *http.Request, uuid string) {
+	if !checkAuth(w, r) {
+		return
+	}
+	release, ok := guardWrite(w)
+	if !ok {
+		return
+	}
+	defer release()
+	dir, ok := lockReviewPreamble(w, uuid)
+	if !ok {
+		return
+	}
+
+	unlock := lockHolding(uuid)
+	defer unlock()
+
+	if _, err := os.Stat(path.Join(dir, lockFileName)); err == nil {
+		lerr := &lockExistsError{uuid}
+		stats.lockConflicts.add()
+		log.Println(lerr.Error())
+		http.Error(w, lerr.Error(), http.StatusConflict)
+		return
+	}
+	if err := checkLockProposal(uuid, dir); err != nil {
+		if _, ok := err.(*lockProposedError); !ok {
+			storageError(w, err)
+			return
+		}
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	manifest, err := lockManifest(dir)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	user, _, _ := r.BasicAuth()
+	now := time.Now().UTC()
+	proposal := LockProposal{
+		ProposedBy: user,
+		ProposedAt: stamp(now),
+		ExpiresAt:  stamp(now.Add(time.Duration(config.LockProposalTTL) * time.Second)),
+		Reason:     r.URL.Query().Get("reason"),
+		Manifest:   manifest,
+	}
+	js, err := json.Marshal(proposal)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := writeFileAtomic(path.Join(dir, lockProposalFileName), js); err != nil {
+		storageError(w, err)
+		return
+	}
+	emitChange(uuid, "lock-proposed", "")
+	log.Printf("Lock of %s proposed by %s\n", uuid, user)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(js)
+}
+
+// reviewLockHandler handles POST /UUID4/lock/approve and /UUID4/lock/reject.
+// The approver must not be the proposer.
+func reviewLockHandler(w http.ResponseWriter, r *http.Request, uuid string, approve bool) {
+	if !checkAuth(w, r) {
+		return
+	}
+	release, ok := guardWrite(w)
+	if !ok {
+		return
+	}
+	defer release()
+	dir, ok := lockReviewPreamble(w, uuid)
+	if !ok {
+		return
+	}
+
+	unlock := lockHolding(uuid)
+	defer unlock()
+
+	proposal, err := readLockProposal(dir)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	if proposal == nil {
+		http.Error(w, "No lock has been proposed for "+uuid, http.StatusNotFound)
+		return
+	}
+	user, _, _ := r.BasicAuth()
+
+	if !approve {
+		if err := os.Remove(path.Join(dir, lockProposalFileName)); err != nil {
+			storageError(w, err)
+			return
+		}
+		if err := syncDir(dir); err != nil {
+			storageError(w, err)
+			return
+		}
+		emitChange(uuid, "lock-rejected", "")
+		log.Printf("Lock of %s proposed by %s rejected by %s\n", uuid, proposal.ProposedBy, user)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	// A wrong clock can't tell whether the proposal has expired
+	if expirySuspended() {
+		err := checkClockSkew()
+		log.Println(err.Error())
+		w.Header().Set(errorCodeHeader, "clock-skew")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	if user == proposal.ProposedBy {
+		http.Error(w, "A lock can't be approved by the user who proposed it", http.StatusForbidden)
+		return
+	}
+	// Locked directly since it was proposed; don't hash it to find that out
+	if _, err := os.Stat(path.Join(dir, lockFileName)); err == nil {
+		os.Remove(path.Join(dir, lockProposalFileName))
+		stats.lockConflicts.add()
+		http.Error(w, (&lockExistsError{uuid}).Error(), http.StatusConflict)
+		return
+	}
+	manifest, err := lockManifest(dir)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	if !sameManifest(manifest, proposal.Manifest) {
+		http.Error(w, "Holding has changed since the lock was proposed", http.StatusConflict)
+		return
+	}
+
+	info := LockInfo{LockedBy: user, Reason: proposal.Reason, ProposedBy: proposal.ProposedBy}
+	info.ArtSource = lockArtSource(r, uuid)
+	created, err := createLock(uuid, info)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	os.Remove(path.Join(dir, lockProposalFileName))
+	if !created {
+		stats.lockConflicts.add()
+		http.Error(w, (&lockExistsError{uuid}).Error(), http.StatusConflict)
+		return
+	}
+	emitChange(uuid, "lock", "")
+	log.Printf("Lock of %s proposed by %s approved by %s\n", uuid, proposal.ProposedBy, user)
+
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, "Created lock\n")
+}
+
+// pendingLocksHandler handles GET /locks/pending, listing unexpired
+// proposals oldest first.
+func pendingLocksHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	pending := []PendingLock{}
+	err := walkHoldings(config.LibraryPath, func(uuid string, dir string, legacy bool) error {
+		proposal, err := readLockProposal(dir)
+		if err != nil {
+			log.Printf("%s: %s\n", uuid, err.Error())
+		} else if proposal != nil {
+			pending = append(pending, PendingLock{strings.ToLower(uuid), *proposal})
+		}
+		return nil
+	})
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].ProposedAt.Before(pending[j].ProposedAt.Time) })
+
+	js, err := json.Marshal(pending)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Per-UUID mutexes serialize mutations of a single holding. Entries are
+// reference counted so the map only holds UUIDs currently being worked on.
+var holdingMutexes = struct {
+	sync.Mutex
+	m map[string]*holdingMutex
+}{m: map[string]*holdingMutex{}}
+
+type holdingMutex struct {
+	sync.Mutex
+	refs int
+}
+
+func lockHolding(uuid string) func() {
+	holdingMutexes.Lock()
+	hm, ok := holdingMutexes.m[uuid]
+	if !ok {
+		hm = &holdingMutex{}
+		holdingMutexes.m[uuid] = hm
+	}
+	hm.refs++
+	holdingMutexes.Unlock()
+
+	hm.Lock()
+	return func() {
+		hm.Unlock()
+		holdingMutexes.Lock()
+		hm.refs--
+		if hm.refs == 0 {
+			delete(holdingMutexes.m, uuid)
+		}
+		holdingMutexes.Unlock()
+	}
+}
+
+// tryLockHolding is lockHolding for callers that would rather give up than
+// wait for whatever is already working on the holding.
+func tryLockHolding(uuid string) (func(), bool) {
+	holdingMutexes.Lock()
+	hm, ok := holdingMutexes.m[uuid]
+	if !ok {
+		hm = &holdingMutex{}
+		holdingMutexes.m[uuid] = hm
+	}
+	if !hm.TryLock() {
+		holdingMutexes.Unlock()
+		return nil, false
+	}
+	hm.refs++
+	holdingMutexes.Unlock()
+	return func() {
+		hm.Unlock()
+		holdingMutexes.Lock()
+		hm.refs--
+		if hm.refs == 0 {
+			delete(holdingMutexes.m, uuid)
+		}
+		holdingMutexes.Unlock()
+	}, true
+}
+
+type LockInfo struct {
+	LockedAt Timestamp
+	LockedBy string
+	Reason   string `json:",omitempty"`
+
+	// Set when the album art was extracted from the audio files at lock time
+	ArtSource string `json:",omitempty"`
+
+	// Set when the lock was proposed by someone else and approved
+	ProposedBy string `json:",omitempty"`
+
+	// Holding digest of the music as locked
+	Digest string `json:",omitempty"`
+
+	// The music and album art as locked. Locks made before the manifest
+	// existed don't have one.
+	Files []LockedFile `json:",omitempty"`
+}
+
+type LockedFile struct {
+	// music/TRACK or albumart
+	Path   string
+	Size   int64
+	SHA256 string
+	// Unset in locks made before provenance was recorded
+	Provenance *Provenance `json:",omitempty"`
+}
+
+type lockManifestError struct {
+	path string
+	err  error
+}
+
+func (e *lockManifestError) Error() string {
+	return fmt.Sprintf("Cannot hash %s for the lock manifest: %s", e.path, e.err.Error())
+}
+
+// lockedFiles hashes every file under music/ and the album art, and notes
+// where each came from.
+func lockedFiles(dir string) ([]LockedFile, error) {
+	records, err := readProvenance(dir)
+	if err != nil {
+		// Not worth refusing the lock over; the files read as unknown
+		log.Println(err.Error())
+		records = map[string]Provenance{}
+	}
+	files := []LockedFile{}
+	add := func(rel string) error {
+		sums, size, err := digestFile(path.Join(dir, rel), []string{"sha256"})
+		if err != nil {
+			return &lockManifestError{rel, err}
+		}
+		prov := fileProvenance(records, rel)
+		files = append(files, LockedFile{rel, size, sums["sha256"], &prov})
+		return nil
+	}
+	err = walkFiles(path.Join(dir, "music"), func(rel string) error {
+		return add(path.Join("music", rel))
+	})
+	if err != nil {
+		if _, ok := err.(*lockManifestError); !ok {
+			err = &lockManifestError{"music", err}
+		}
+		return nil, err
+	}
+	if _, err := os.Stat(path.Join(dir, "albumart")); err == nil {
+		if err := add("albumart"); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// createLock writes the lock file for a holding, with the manifest of its
+// files, and reports whether it was created; an existing lock is left
+// untouched, and found before the holding is hashed. The caller should hold
+// the holding's mutex, but the lock file is created exclusively regardless so
+// that exactly one of several concurrent lockers wins.
+func createLock(uuid string, info LockInfo) (bool, error) {
+	destPath := path.Join(uuidToPath(config.LibraryPath, uuid), lockFileName)
+
+	if err := ensureSafePath(config.LibraryPath, destPath); err != nil {
+		return false, err
+	}
+	if _, err := os.Stat(destPath); err == nil {
+		return false, nil
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+
+	digest, err := holdingDigest(uuidToPath(config.LibraryPath, uuid))
+	if err != nil {
+		return false, err
+	}
+	info.Digest = digest
+	files, err := lockedFiles(uuidToPath(config.LibraryPath, uuid))
+	if err != nil {
+		return false, err
+	}
+	info.Files = files
+	info.LockedAt = stamp(time.Now())
+	js, err := json.Marshal(info)
+	if err != nil {
+		return false, err
+	}
+
+	f, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	_, err = faultyWriter(destPath, f).Write(js)
+	if err == nil {
+		err = syncFile(f)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = syncDir(path.Dir(destPath))
+	}
+	if err != nil {
+		// Don't leave a truncated lock behind for the next attempt to trip on
+		os.Remove(destPath)
+		return false, err
+	}
+	return true, nil
+}
+
+type BulkLockRequest struct {
+	UUIDs  []string
+	Reason string
+}
+
+type BulkLockResult struct {
+	UUID   string
+	Status string
+	Error  string `json:",omitempty"`
+}
+
+type BulkLockResponse struct {
+	Summary map[string]int
+	Results []BulkLockResult
+}
+
+type batchTooLargeError struct {
+	size  int
+	limit int
+}
+
+func (e *batchTooLargeError) Error() string {
+	return fmt.Sprintf("Batch of %d exceeds the limit of %d", e.size, e.limit)
+}
+
+func bulkLockHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkAuth(w, r) {
+		return
+	}
+	release, ok := guardWrite(w)
+	if !ok {
+		return
+	}
+	defer release()
+	if err := checkReplicationBacklog(); err != nil {
+		replicationBacklogged(w, err)
+		return
+	}
+	user, _, _ := r.BasicAuth()
+
+	body, ok := readUpload(w, r)
+	if !ok {
+		return
+	}
+
+	// Accept either a bare array of UUIDs or an object with a shared reason
+	req := BulkLockRequest{}
+	var err error
+	if strings.HasPrefix(strings.TrimSpace(string(body)), "[") {
+		err = json.Unmarshal(body, &req.UUIDs)
+	} else {
+		err = json.Unmarshal(body, &req)
+	}
+	if err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(req.UUIDs) > config.Limits.MaxLockBatch {
+		berr := &batchTooLargeError{len(req.UUIDs), config.Limits.MaxLockBatch}
+		http.Error(w, berr.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	resp := BulkLockResponse{map[string]int{}, []BulkLockResult{}}
+	for _, uuid := range req.UUIDs {
+		result := bulkLockOne(r, strings.ToLower(uuid), LockInfo{LockedBy: user, Reason: req.Reason})
+		resp.Summary[result.Status]++
+		resp.Results = append(resp.Results, result)
+	}
+	log.Printf("Bulk lock by %s: %v\n", user, resp.Summary)
+
+	js, err := json.Marshal(resp)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusMultiStatus)
+	w.Write(js)
+}
+
+func bulkLockOne(r *http.Request, uuid string, info LockInfo) BulkLockResult {
+	if err := uuidSanityCheck(uuid); err != nil {
+		return BulkLockResult{uuid, "failed", err.Error()}
+	}
+	if err := checkWritable(uuid); err != nil {
+		return BulkLockResult{uuid, "failed", err.Error()}
+	}
+	if err := checkDirectLock(r, uuid); err != nil {
+		return BulkLockResult{uuid, "failed", err.Error()}
+	}
+	if err := prepareWrite(uuid); err != nil {
+		return BulkLockResult{uuid, "failed", err.Error()}
+	}
+
+	unlock := lockHolding(uuid)
+	defer unlock()
+
+	if !dirExists(uuidToPath(config.LibraryPath, uuid)) {
+		return BulkLockResult{uuid, "not-found", ""}
+	}
+	if _, err := os.Stat(path.Join(uuidToPath(config.LibraryPath, uuid), lockFileName)); err == nil {
+		return BulkLockResult{uuid, "already-locked", ""}
+	}
+	if _, err := checkLockCompleteness(r, uuid); err != nil {
+		return BulkLockResult{uuid, "failed", err.Error()}
+	}
+	info.ArtSource = lockArtSource(r, uuid)
+	created, err := createLock(uuid, info)
+	if err != nil {
+		log.Println(err.Error())
+		return BulkLockResult{uuid, "failed", err.Error()}
+	}
+	if !created {
+		return BulkLockResult{uuid, "already-locked", ""}
+	}
+	emitChange(uuid, "lock", "")
+	return BulkLockResult{uuid, "locked", ""}
+}
+
+// lockRemovalHandler handles DELETE /UUID4/lock?confirm=UUID4. The confirm
+// parameter has to repeat the UUID so that a stray DELETE can't unlock a
+// holding by accident.
+func lockRemovalHandler(w http.ResponseWriter, r *http.Request, uuid string) {
+	if err := uuidSanityCheck(uuid); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.ToLower(r.URL.Query().Get("confirm")) != uuid {
+		http.Error(w, "Pass ?confirm="+uuid+" to remove the lock", http.StatusBadRequest)
+		return
+	}
+	if err := checkWritable(uuid); err != nil {
+		writeRefused(w, err)
+		return
+	}
+	if err := prepareWrite(uuid); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	unlock := lockHolding(uuid)
+	defer unlock()
+
+	dir := uuidToPath(config.LibraryPath, uuid)
+	lockPath := path.Join(dir, lockFileName)
+	if err := ensureSafePath(config.LibraryPath, lockPath); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	info, err := readLockInfo(dir)
+	if os.IsNotExist(err) {
+		http.Error(w, uuid+" is not locked", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err.Error())
+	}
+	if err := os.Remove(lockPath); os.IsNotExist(err) {
+		http.Error(w, uuid+" is not locked", http.StatusNotFound)
+		return
+	} else if err != nil {
+		storageError(w, err)
+		return
+	}
+	if err := syncRemoved(lockPath); err != nil {
+		storageError(w, err)
+		return
+	}
+	// The music can change now, so the recorded archive digests can't be
+	// trusted once it is locked again
+	if err := forgetArchiveDigests(uuid, dir); err != nil && !os.IsNotExist(err) {
+		log.Println(err.Error())
+	}
+	emitChange(uuid, "unlock", "")
+
+	user, _, _ := r.BasicAuth()
+	log.Printf("Lock on %s (locked by %s at %s) removed by %s\n", uuid, info.LockedBy, info.LockedAt.Format(time.RFC3339), user)
+	fmt.Fprintf(w, "Removed lock\n")
+}
+
+// lockManifestHandler handles GET /UUID4/lock, which returns the lock with
+// the manifest of the files as they were locked.
+func lockManifestHandler(w http.ResponseWriter, r *http.Request, uuid string) {
+	if err := uuidSanityCheck(uuid); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dir := holdingDir(uuid)
+	if !dirExists(dir) {
+		http.Error(w, "holding not found on disk", http.StatusNotFound)
+		return
+	}
+	info, err := readLockInfo(dir)
+	if os.IsNotExist(err) {
+		http.Error(w, uuid+" is not locked", http.StatusNotFound)
+		return
+	} else if err != nil {
+		storageError(w, err)
+		return
+	}
+	js, err := json.Marshal(info)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/wuvt/moss/mosstest"
+)
+
+// A UUID nothing has been uploaded to can't be locked in advance, and trying
+// doesn't leave a holding behind.
+func TestLockBeforeUpload(t *testing.T) {
+	s := newTestServer(t, mosstest.Spec{})
+	uuid := mosstest.NewUUID()
+
+	resp := s.Do("PUT", "/"+uuid+"/lock", nil)
+	if resp.Status != http.StatusNotFound {
+		t.Fatalf("locking a holding that doesn't exist got %d %s", resp.Status, resp.Body)
+	}
+	if _, err := os.Stat(uuidToPath(config.LibraryPath, uuid)); !os.IsNotExist(err) {
+		t.Errorf("the failed lock made the holding's directory: %v", err)
+	}
+	var uuids []string
+	s.MustDo("GET", "/", nil).JSON(t, &uuids)
+	if len(uuids) != 0 {
+		t.Errorf("the library lists %v", uuids)
+	}
+
+	// Nothing stops it being uploaded to and locked later
+	s.MustDo("PUT", "/"+uuid+"/music/01.flac", mosstest.FLAC(0))
+	if resp := s.Do("PUT", "/"+uuid+"/lock", nil); resp.Status != http.StatusCreated {
+		t.Errorf("locking it after an upload got %d %s", resp.Status, resp.Body)
+	}
+}
+
+func TestLockAfterUpload(t *testing.T) {
+	s := newTestServer(t, mosstest.Spec{Holdings: []mosstest.Holding{{Tracks: []mosstest.Track{{Name: "01.flac"}}}}})
+	resp := s.Do("PUT", s.Path(0, "lock")+"?reason=ripped", nil)
+	if resp.Status != http.StatusCreated {
+		t.Fatalf("lock got %d %s", resp.Status, resp.Body)
+	}
+
+	var holding Holding
+	s.MustDo("GET", s.Path(0), nil).JSON(t, &holding)
+	if !holding.Locked || holding.LockedAt == nil {
+		t.Errorf("the holding is locked %t at %v", holding.Locked, holding.LockedAt)
+	}
+	info, err := readLockInfo(holdingDir(s.Holdings[0].UUID))
+	if err != nil || info.LockedBy != testUser || info.Reason != "ripped" {
+		t.Errorf("the lock is %+v, %v", info, err)
+	}
+	if resp := s.Do("PUT", s.Path(0, "music", "02.flac"), mosstest.FLAC(0)); resp.Status != http.StatusForbidden {
+		t.Errorf("an upload to the locked holding got %d", resp.Status)
+	}
+}
+
+// Locking twice answers 409 with the first lock, which is left as it was.
+func TestDoubleLock(t *testing.T) {
+	s := newTestServer(t, mosstest.Spec{Holdings: []mosstest.Holding{
+		{Tracks: []mosstest.Track{{Name: "01.flac"}}},
+		{Tracks: []mosstest.Track{{Name: "01.flac"}}},
+	}})
+	lockPath := path.Join(holdingDir(s.Holdings[0].UUID), lockFileName)
+	s.MustDo("PUT", s.Path(0, "lock")+"?reason=first", nil)
+	first, err := os.ReadFile(lockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, query := range []string{"?reason=second", "?force=1"} {
+		resp := s.Do("PUT", s.Path(0, "lock")+query, nil)
+		if resp.Status != http.StatusConflict {
+			t.Errorf("locking again with %s got %d %s", query, resp.Status, resp.Body)
+			continue
+		}
+		var info LockInfo
+		resp.JSON(t, &info)
+		if info.Reason != "first" || info.LockedBy != testUser || info.LockedAt.IsZero() {
+			t.Errorf("the 409 gave the lock as %+v", info)
+		}
+	}
+	if now, err := os.ReadFile(lockPath); err != nil || !bytes.Equal(now, first) {
+		t.Errorf("locking again changed the lock: %v", err)
+	}
+
+	// Of many racing to lock, one wins and the rest are told who did
+	const lockers = 8
+	statuses := make(chan int, lockers)
+	var wg sync.WaitGroup
+	for i := 0; i < lockers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp := s.Do("PUT", s.Path(1, "lock"), nil)
+			if resp.Status == http.StatusConflict && json.Unmarshal(resp.Body, &LockInfo{}) != nil {
+				statuses <- 0
+				return
+			}
+			statuses <- resp.Status
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+	won := 0
+	for status := range statuses {
+		switch status {
+		case http.StatusCreated:
+			won++
+		case http.StatusConflict:
+		default:
+			t.Errorf("a racing lock got %d", status)
+		}
+	}
+	if won != 1 {
+		t.Errorf("%d of %d racing locks were created", won, lockers)
+	}
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"crypto/subtle"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -11,10 +10,10 @@ import (
 	"os"
 	"path"
 	"path/filepath"
-	"regexp"
+	"sort"
 	"strconv"
 	"strings"
-	"syscall"
+	"time"
 )
 
 var libpath = flag.String("library-path", "/tmp/library", "Path of library")
@@ -22,23 +21,50 @@ var apiuser = flag.String("apiuser", "admin", "API username")
 var apikey = flag.String("apikey", "hunter2", "API key")
 var port = flag.Int("port", 8080, "Port to listen on")
 var configPath = flag.String("config", "", "Path to JSON config file")
+var legacyLayout = flag.Bool("legacy-layout", false, "Serve holdings found in the legacy flat layout")
+var migrateOnAccess = flag.Bool("migrate-on-access", false, "Move legacy-layout holdings into their shard directory when accessed")
+var autoMigrate = flag.Bool("auto-migrate", false, "Apply pending library format migrations at startup")
+var portableNames = flag.String("portable-names", "", "Reject (\"reject\") or rewrite (\"sanitize\") filenames Windows can't store")
+var strictCaseNames = flag.Bool("strict-case-names", false, "Reject names differing only by case even on case-sensitive filesystems")
+var publicListen = flag.String("public-listen", "", "Address for an anonymous read-only listener serving locked holdings")
+var durable = flag.Bool("durable", false, "fsync uploads and locks before answering")
+var minClientVersion = flag.String("min-client-version", "", "Reject clients reporting an older X-Moss-Client version")
 
 var config Config
 
+// checkAuth requires valid credentials of any role; checkRoles has already
+// made sure the role may make this request.
 func checkAuth(w http.ResponseWriter, r *http.Request) bool {
-	user, pass, ok := r.BasicAuth()
-	if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(config.ApiUser)) != 1 || subtle.ConstantTimeCompare([]byte(pass), []byte(config.ApiKey)) != 1 {
+	user, _, _ := r.BasicAuth()
+	if authenticate(r) == "" {
+		stats.authFailures.add()
 		http.Error(w, "API key is incorrect", http.StatusUnauthorized)
-		log.Println("Authentication failure for " + user)
+		log.Println("Authentication failure for " + user + " from " + clientIP(r))
 		return false
 	}
 	return true
 }
 
+// isAdmin reports whether the request was made with admin credentials.
+func isAdmin(r *http.Request) bool {
+	return authenticate(r) == "admin"
+}
+
 type Shard struct {
 	MinUUID  string
 	MaxUUID  string
 	Writable bool
+	DrainTo  string `json:",omitempty"`
+
+	// For operators: a short unique name for the shard and why it exists
+	Label string `json:",omitempty"`
+	Notes string `json:",omitempty"`
+
+	// Name of the storage the shard's holdings are on, such as "ssd", for
+	// telling tiers apart in headers, logs and metrics
+	Backend string `json:",omitempty"`
+
+	RequireLockApproval bool `json:",omitempty"`
 }
 
 type Config struct {
@@ -47,12 +73,158 @@ type Config struct {
 	ApiKey      string
 	LibraryPath string
 	Shards      []Shard
+	Peers       []Peer
+
+	// Publish change events to a message broker too; see eventbus.go
+	EventBus *EventBus
+
+	// URLs whose Date header the clock is checked against, besides the peers'
+	ClockCheckURLs []string
+	// Seconds the clock may be off before it counts as wrong
+	MaxClockSkew int
+	// Hold off expiring transactions, temp files and lock proposals while
+	// the clock is wrong
+	SuspendExpiryOnClockSkew bool
+
+	LegacyLayout    bool
+	MigrateOnAccess bool
+	AutoMigrate     bool
+	StrictCaseNames bool
+	DiscPattern     string
+	PortableNames   string
+	// For ?autoname=1 uploads, see autoname.go
+	AutonameTemplate string
+	MaxReaderWait    int
+
+	// Older spellings of Limits.MaxLockBatch and Limits.MaxHoldingFiles
+	MaxLockBatch    int
+	MaxHoldingFiles int
+
+	Limits Limits
+
+	// Entries a prefix directory can have before new holdings under it go a
+	// level deeper; 0 never fans out
+	AutoFanoutThreshold int
+
+	// Make fsck fail on zero-byte files rather than warn
+	StrictEmptyFiles bool
+
+	// The largest side in pixels of art derived from a master
+	DerivedArtSize int
+
+	// Dimensions in pixels album art must have, unless SkipArtDimensionChecks
+	// is set; no minimum if unset and at most 10000 on a side
+	MinAlbumArtWidth       int
+	MinAlbumArtHeight      int
+	MaxAlbumArtSide        int
+	SkipArtDimensionChecks bool
+
+	ExtractArtOnLock bool
+	LockProposalTTL  int
+
+	NegativeCacheTTL  int
+	NegativeCacheSize int
+
+	MinClientVersion string
+
+	PublicListen    string
+	PublicRateLimit float64
+	PublicAccessLog string
+
+	Users []User
+
+	RoleUploadQuotas map[string]int64
+
+	RejectionLogSize int
+	RejectionLogTTL  int
+
+	ChecksumAlgorithms   []string
+	ChecksumBackfillRate int64
+	VerifyOnRead         bool
+
+	PeerRetries          int
+	PeerFailureThreshold int
+
+	ArchiveDestinations []ArchiveDestination
+
+	ReplicateTo              []string
+	ReplicationQueueLimit    int
+	ReplicationQueueCritical int
+
+	Catalog *CatalogConfig
+
+	TLSCert string
+	TLSKey  string
+
+	ServerHeader    string
+	NodeName        string
+	Location        string
+	HSTSMaxAge      int
+	ResponseHeaders map[string]string
+	RouteHeaders    []RouteHeaders
+
+	// Seconds that album art and music files of locked holdings may be
+	// cached, and whether locked music is also marked immutable
+	ArtCacheSeconds   int
+	MusicCacheSeconds int
+	LockedImmutable   bool
+
+	// fsync uploads, locks and their directories before answering, at the
+	// cost of write throughput
+	Durable bool
+
+	// Refuse to lock holdings that don't match their expected.json, unless
+	// the lock is forced
+	RequireComplete bool
+
+	// Read PROXY protocol headers on the TCP listeners, and the addresses
+	// of proxies whose X-Forwarded-For and X-Real-IP are believed, going
+	// back at most TrustedProxyHops of them if set
+	ProxyProtocol    bool
+	TrustedProxies   []string
+	TrustedProxyHops int
+
+	// UUID versions holdings may be stored under, 4 if unset
+	AcceptedUUIDVersions []int `json:",omitempty"`
+
+	// Keep export-tree/ as an Artist/Album hardlink tree of the library
+	ExportTree bool
+
+	// Log times in UTC rather than the server's local time
+	LogUTC bool
+
+	// /readyz fails once free space on the library filesystem drops below
+	// this, or reaches 0
+	ReadyMinFreeBytes int64
+	// Free stale temp files, expired transactions and derived files when
+	// space runs short, counting them as free meanwhile
+	ReclaimOnLowSpace bool
+
+	MaxClipLength      float64
+	ClipCacheSize      int
+	ClipTranscoder     []string
+	ClipTranscoderType string
+
+	// Extra or overriding Content-Types for music files by extension, like
+	// {".wv": "audio/x-wavpack"}
+	ContentTypes map[string]string `json:",omitempty"`
+
+	// Independent libraries served by this one server; see tenants.go
+	Tenants []Tenant
 }
 
 type ServerInfo struct {
 	Version   string
+	NodeName  string `json:",omitempty"`
+	Location  string `json:",omitempty"`
 	FreeSpace uint64
-	Shards    []Shard
+	// Used space moss could free on demand
+	Reclaimable Reclaimable
+	Shards      []ShardStatus
+	Features    []string
+	Limits      Limits
+	// Only in builds with fault injection, while a fault is set
+	Faults *Faults `json:",omitempty"`
 }
 
 func versionHandler(w http.ResponseWriter, r *http.Request) {
@@ -61,11 +233,8 @@ func versionHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var stat syscall.Statfs_t
-	syscall.Statfs(config.LibraryPath, &stat)
-	freeSpace := stat.Bavail * uint64(stat.Bsize)
-
-	serverInfo := ServerInfo{"git", freeSpace, config.Shards}
+	freeSpace, _ := libraryFreeSpace()
+	serverInfo := ServerInfo{"git", config.NodeName, config.Location, freeSpace, reclaimable(), shardStatuses(), features, config.Limits, activeFaults()}
 	js, err := json.Marshal(serverInfo)
 	if err != nil {
 		log.Println(err.Error())
@@ -81,32 +250,35 @@ func listAllHandler(w http.ResponseWriter, r *http.Request) {
 	uuidList := []string{}
 	dirEnts, err := ioutil.ReadDir(config.LibraryPath)
 	if err != nil {
-		log.Println(err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 	for _, dirEnt := range dirEnts {
-		if dirEnt.IsDir() {
-			shardPath := path.Join(config.LibraryPath, dirEnt.Name())
-			uuidEnts, err := ioutil.ReadDir(shardPath)
+		if config.LegacyLayout && dirEnt.IsDir() && uuidSanityCheck(dirEnt.Name()) == nil {
+			uuidList = append(uuidList, dirEnt.Name())
+		} else if dirEnt.IsDir() && shardDirPattern.MatchString(dirEnt.Name()) {
+			err := walkPrefix(path.Join(config.LibraryPath, dirEnt.Name()), func(uuid string, dir string) error {
+				uuidList = append(uuidList, uuid)
+				return nil
+			})
 			if err != nil {
-				log.Println(err.Error())
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				writeError(w, err)
 				return
 			}
-			for _, uuidEnt := range uuidEnts {
-				uuidList = append(uuidList, uuidEnt.Name())
-			}
 		}
 	}
+	uuidList, err = filterHoldings(r, uuidList)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	js, err := json.Marshal(uuidList)
 	if err != nil {
 		log.Println(err.Error())
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(js)
+	serveListing(w, r, js, time.Time{})
 }
 
 func mainHandler(w http.ResponseWriter, r *http.Request) {
@@ -123,25 +295,110 @@ func mainHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// At this point we assume that params[0] is a UUID
+	// At this point we assume that params[0] is a UUID. Reads of a holding
+	// the negative cache already knows is missing don't look for files in
+	// its way; writes always do, since they'd run into them.
 	uuid := params[0]
+	reading := r.Method == "GET" || r.Method == "HEAD"
+	if uuidSanityCheck(uuid) == nil && !(reading && cachedMissing(uuid)) {
+		if err := checkHoldingPath(uuid); err != nil {
+			notADirectory(w, err)
+			return
+		}
+	}
 
 	switch r.Method {
 	case "GET":
 		if len(params) == 1 || (len(params) == 2 && params[1] == "") {
 			listUUIDHandler(w, r, params)
 			return
+		} else if params[1] == "attrs" {
+			attrsHandler(w, r, params)
+			return
+		} else if len(params) == 2 && params[1] == "archive" {
+			archiveHandler(w, r, uuid)
+			return
+		} else if params[1] == "clip" {
+			clipHandler(w, r, params)
+			return
+		} else if len(params) == 2 && params[1] == "playlist.m3u" {
+			playlistHandler(w, r, uuid)
+			return
+		} else if len(params) == 2 && params[1] == "repairs" {
+			repairsHandler(w, r, uuid)
+			return
+		} else if len(params) == 2 && params[1] == "provenance" {
+			provenanceHandler(w, r, uuid)
+			return
+		} else if len(params) == 2 && params[1] == "lock" {
+			lockManifestHandler(w, r, uuid)
+			return
+		} else if len(params) == 2 && params[1] == "qc" {
+			holdingQCHandler(w, r, uuid)
+			return
+		} else if len(params) == 2 && params[1] == "expected" {
+			expectationHandler(w, r, uuid)
+			return
+		} else if len(params) == 2 && params[1] == "completeness" {
+			completenessHandler(w, r, uuid)
+			return
 		} else {
 			getHandler(w, r, params)
 			return
 		}
 	case "HEAD":
+		if len(params) == 1 || (len(params) == 2 && params[1] == "") {
+			listUUIDHandler(w, r, params)
+			return
+		} else if len(params) == 2 && params[1] == "archive" {
+			archiveHandler(w, r, uuid)
+			return
+		} else if params[1] == "clip" {
+			clipHandler(w, r, params)
+			return
+		}
 		getHandler(w, r, params)
 		return
+	case "POST":
+		if len(params) == 2 && params[1] == "sizes" {
+			sizesHandler(w, r, uuid)
+			return
+		} else if len(params) == 2 && params[1] == "archive-to" {
+			exportHandler(w, r, uuid, false)
+			return
+		} else if len(params) == 2 && params[1] == "restore-from-archive" {
+			exportHandler(w, r, uuid, true)
+			return
+		} else if len(params) == 2 && params[1] == "relocate" {
+			relocateHandler(w, r, uuid)
+			return
+		} else if len(params) == 2 && params[1] == "verify" {
+			verifyHandler(w, r, uuid)
+			return
+		} else if len(params) == 2 && params[1] == "validate" {
+			validateHandler(w, r, uuid)
+			return
+		} else if params[1] == "txn" {
+			txnHandler(w, r, params)
+			return
+		} else if len(params) == 3 && params[1] == "lock" && params[2] == "propose" {
+			proposeLockHandler(w, r, uuid)
+			return
+		} else if len(params) == 3 && params[1] == "lock" && (params[2] == "approve" || params[2] == "reject") {
+			reviewLockHandler(w, r, uuid, params[2] == "approve")
+			return
+		}
+		http.Error(w, "No request handler for that", http.StatusBadRequest)
+		return
 	case "PUT":
 		if !checkAuth(w, r) {
 			return
 		}
+		release, ok := guardWrite(w)
+		if !ok {
+			return
+		}
+		defer release()
 		if len(params) < 2 {
 			http.Error(w, "Insufficient parameters", http.StatusBadRequest)
 			return
@@ -151,13 +408,61 @@ func mainHandler(w http.ResponseWriter, r *http.Request) {
 		} else if params[1] == "music" {
 			trackUploadHandler(w, r, params)
 			return
+		} else if params[1] == "albumart" && len(params) >= 3 && params[2] == "master" {
+			masterArtUploadHandler(w, r, uuid)
+			return
+		} else if params[1] == "albumart" && len(params) == 3 && params[2] != "" {
+			artworkUploadHandler(w, r, uuid, params[2])
+			return
 		} else if params[1] == "albumart" {
 			albumArtUploadHandler(w, r, uuid)
 			return
+		} else if params[1] == "private" {
+			privacyHandler(w, r, uuid, true)
+			return
+		} else if len(params) == 2 && params[1] == "expected" {
+			expectationHandler(w, r, uuid)
+			return
+		} else if params[1] == "attrs" {
+			attrsHandler(w, r, params)
+			return
 		} else {
 			http.Error(w, "No request handler for that", http.StatusBadRequest)
 			return
 		}
+	case "DELETE":
+		if !checkAuth(w, r) {
+			return
+		}
+		release, ok := guardWrite(w)
+		if !ok {
+			return
+		}
+		defer release()
+		if len(params) == 1 || (len(params) == 2 && params[1] == "") {
+			deleteHoldingHandler(w, r, uuid)
+			return
+		} else if len(params) >= 3 && params[1] == "music" {
+			trackDeleteHandler(w, r, params)
+			return
+		} else if len(params) == 2 && params[1] == "albumart" {
+			albumArtDeleteHandler(w, r, uuid)
+			return
+		} else if len(params) == 3 && params[1] == "albumart" && params[2] != "" {
+			artworkDeleteHandler(w, r, uuid, params[2])
+			return
+		} else if len(params) == 2 && params[1] == "private" {
+			privacyHandler(w, r, uuid, false)
+			return
+		} else if len(params) == 2 && params[1] == "expected" {
+			expectationHandler(w, r, uuid)
+			return
+		} else if len(params) == 2 && params[1] == "lock" {
+			lockRemovalHandler(w, r, uuid)
+			return
+		}
+		http.Error(w, "No request handler for that", http.StatusBadRequest)
+		return
 	default:
 		http.Error(w, "", http.StatusMethodNotAllowed)
 		return
@@ -174,21 +479,76 @@ func (e *uuidError) Error() string {
 	return fmt.Sprintf("%s - %s", e.uuid, e.problem)
 }
 
+// acceptedUUIDVersions returns AcceptedUUIDVersions, or just 4 when it's
+// unset.
+func acceptedUUIDVersions() []int {
+	if len(config.AcceptedUUIDVersions) == 0 {
+		return []int{4}
+	}
+	return config.AcceptedUUIDVersions
+}
+
+type uuidVersionsError struct {
+	version int
+}
+
+func (e *uuidVersionsError) Error() string {
+	return fmt.Sprintf("AcceptedUUIDVersions: there is no UUID version %d, only 1 to 8", e.version)
+}
+
+func validateUUIDVersions() error {
+	for _, v := range config.AcceptedUUIDVersions {
+		if v < 1 || v > 8 {
+			return &uuidVersionsError{v}
+		}
+	}
+	return nil
+}
+
+// uuidSanityCheck accepts a lowercase RFC 4122 UUID of one of the
+// AcceptedUUIDVersions, never the nil or max UUID.
 func uuidSanityCheck(uuid string) error {
 	if len(uuid) != 36 {
 		return &uuidError{uuid, "Invalid length"}
 	}
-	r := regexp.MustCompile("^[a-f0-9]{8}-[a-f0-9]{4}-4[a-f0-9]{3}-[8|9|a|b][a-f0-9]{3}-[a-f0-9]{12}$")
-	if !r.MatchString(uuid) {
-		return &uuidError{uuid, "Invalid uuid4 format"}
+	for i := 0; i < len(uuid); i++ {
+		c := uuid[i]
+		switch {
+		case i == 8 || i == 13 || i == 18 || i == 23:
+			if c != '-' {
+				return &uuidError{uuid, "Invalid UUID format"}
+			}
+		case c >= 'A' && c <= 'F':
+			return &uuidError{uuid, "Uppercase hex digits, use the lowercase form"}
+		case !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f'):
+			return &uuidError{uuid, "Invalid UUID format"}
+		}
 	}
-	return nil
+	switch uuid {
+	case "00000000-0000-0000-0000-000000000000":
+		return &uuidError{uuid, "The nil UUID doesn't identify a holding"}
+	case "ffffffff-ffff-ffff-ffff-ffffffffffff":
+		return &uuidError{uuid, "The max UUID doesn't identify a holding"}
+	}
+	if !strings.ContainsRune("89ab", rune(uuid[19])) {
+		return &uuidError{uuid, "Not an RFC 4122 variant UUID"}
+	}
+	version := int(uuid[14] - '0')
+	if uuid[14] > '9' {
+		version = int(uuid[14]-'a') + 10
+	}
+	for _, v := range acceptedUUIDVersions() {
+		if v == version {
+			return nil
+		}
+	}
+	return &uuidError{uuid, fmt.Sprintf("UUID version %d is not accepted", version)}
 }
 
 func lockCreationHandler(w http.ResponseWriter, r *http.Request, uuid string) {
 	// Handle locking a UUID once all audio files are added. You can still add
-	// album art after the fact. Locks must be removed manually as holdings are
-	// supposed to be immutable once they are added.
+	// album art after the fact. Holdings are supposed to be immutable once
+	// they are locked, so only admins can remove a lock, with DELETE.
 	err := uuidSanityCheck(uuid)
 	if err != nil {
 		log.Println(err.Error())
@@ -196,26 +556,108 @@ func lockCreationHandler(w http.ResponseWriter, r *http.Request, uuid string) {
 		return
 	}
 
-	destPath := path.Join(uuidToPath(config.LibraryPath, uuid), "lock")
+	if err := checkWritable(uuid); err != nil {
+		writeRefused(w, err)
+		return
+	}
+	if err := checkReplicationBacklog(); err != nil {
+		replicationBacklogged(w, err)
+		return
+	}
+	if err := checkDirectLock(r, uuid); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
 
-	if err := ensureSafePath(config.LibraryPath, destPath); err != nil {
+	if err := prepareWrite(uuid); err != nil {
 		log.Println(err.Error())
-		http.Error(w, err.Error(), http.StatusUnauthorized)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	unlock := lockHolding(uuid)
+	defer unlock()
+
+	// Locks are only made for holdings that exist; there's nothing to
+	// reserve a UUID for and an empty directory would list as a holding
+	if !dirExists(uuidToPath(config.LibraryPath, uuid)) {
+		http.Error(w, "holding not found on disk", http.StatusNotFound)
+		return
+	}
+	// A holding that's already locked gets the existing lock back before
+	// anything is said about its completeness or a byte of it is hashed
+	if _, err := os.Stat(path.Join(uuidToPath(config.LibraryPath, uuid), lockFileName)); err == nil {
+		lockConflict(w, uuid)
 		return
 	}
 
-	if _, err := os.OpenFile(destPath, os.O_RDONLY|os.O_CREATE, 0644); err != nil {
+	warning, err := checkLockCompleteness(r, uuid)
+	if ierr, ok := err.(*incompleteError); ok {
+		log.Println(ierr.Error())
+		w.Header().Set(errorCodeHeader, "incomplete")
+		http.Error(w, ierr.Error()+"; pass ?force=1 to lock it anyway", http.StatusConflict)
+		return
+	} else if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	user, _, _ := r.BasicAuth()
+	info := LockInfo{LockedBy: user, Reason: r.URL.Query().Get("reason")}
+	info.ArtSource = lockArtSource(r, uuid)
+	created, err := createLock(uuid, info)
+	if _, ok := err.(*pathTraversalError); ok {
 		log.Println(err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	} else if merr, ok := err.(*lockManifestError); ok {
+		stats.storageErrors.add()
+		log.Println(merr.Error())
+		http.Error(w, merr.Error(), http.StatusInternalServerError)
+		return
+	} else if err != nil {
+		writeError(w, err)
 		return
 	}
+	if !created {
+		lockConflict(w, uuid)
+		return
+	}
+	emitChange(uuid, "lock", "")
 
+	w.WriteHeader(http.StatusCreated)
 	fmt.Fprintf(w, "Created lock\n")
+	if warning != "" {
+		fmt.Fprintf(w, "warning: %s\n", warning)
+	}
+}
+
+// lockConflict answers a lock request for a holding somebody else has
+// already locked with 409 and their lock, telling the loser who and when.
+func lockConflict(w http.ResponseWriter, uuid string) {
+	stats.lockConflicts.add()
+	info, err := readLockInfo(uuidToPath(config.LibraryPath, uuid))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	js, err := json.Marshal(info)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	w.Write(js)
 }
 
 func uuidToPath(basepath string, uuid string) string {
-	shard := uuid[0:2]
-	str := path.Join(basepath, shard, uuid)
+	str := shallowPath(basepath, uuid)
+	if isFannedOut(uuid[0:2]) && !dirExists(str) {
+		str = deepPath(basepath, uuid)
+	}
 	return str
 }
 
@@ -227,31 +669,88 @@ func albumArtUploadHandler(w http.ResponseWriter, r *http.Request, uuid string)
 		return
 	}
 
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		log.Println(err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := checkWritable(uuid); err != nil {
+		writeRefused(w, err)
 		return
 	}
 
-	destPath := path.Join(uuidToPath(config.LibraryPath, uuid), "albumart")
-
-	if err := ensureSafePath(config.LibraryPath, destPath); err != nil {
+	if err := prepareWrite(uuid); err != nil {
 		log.Println(err.Error())
-		http.Error(w, err.Error(), http.StatusUnauthorized)
+		http.Error(w, err.Error(), http.StatusConflict)
 		return
 	}
 
-	if err := ioutil.WriteFile(destPath, body, 0644); err != nil {
-		log.Println(err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	body, ok := readUpload(w, r)
+	if !ok {
 		return
 	}
 
-	fmt.Fprintf(w, "uploaded: %d bytes\n", len(body))
+	if _, err := validateArt(body); err != nil {
+		artRejected(w, err)
+		return
+	}
+	sums, err := verifyUpload(r, body)
+	if err != nil {
+		checksumUploadError(w, err)
+		return
+	}
+	if err := storeAlbumArt(uuid, body, sums, requestProvenance(r, provenanceUpload)); err != nil {
+		if _, ok := err.(*pathTraversalError); ok {
+			log.Println(err.Error())
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		writeError(w, err)
+		return
+	}
+
+	fmt.Fprintf(w, "uploaded: %d bytes\nsha256: %s\n", len(body), sums["sha256"])
 	return
 }
 
+// storeAlbumArt writes a holding's album art, its type, its digests and its
+// provenance under the holding mutex and emits the change.
+func storeAlbumArt(uuid string, body []byte, sums map[string]string, prov Provenance) error {
+	ctype, err := validateArt(body)
+	if err != nil {
+		return err
+	}
+	unlock := lockHolding(uuid)
+	defer unlock()
+
+	dir := uuidToPath(config.LibraryPath, uuid)
+	destPath := path.Join(dir, "albumart")
+	if err := ensureSafePath(config.LibraryPath, destPath); err != nil {
+		return err
+	}
+	// Art may come before any track, as with cover scans
+	if !dirExists(dir) {
+		if err := makeDirs(dir); err != nil {
+			return err
+		}
+		if err := writeHoldingInfo(dir, HoldingInfo{CreatedAt: stamp(time.Now())}); err != nil {
+			return err
+		}
+	}
+	if err := writeFileAtomic(destPath, body); err != nil {
+		return err
+	}
+	if err := recordArtType(dir, ctype); err != nil {
+		return err
+	}
+	if err := recordChecksums(path.Dir(destPath), "", sums); err != nil {
+		return err
+	}
+	if err := recordProvenance(dir, "albumart", &prov); err != nil {
+		return err
+	}
+	if err := forgetArchiveDigests(uuid, dir); err != nil {
+		return err
+	}
+	emitChange(uuid, "albumart", "")
+	return nil
+}
+
 type pathTraversalError struct {
 	basePath   string
 	targetPath string
@@ -261,17 +760,103 @@ func (e *pathTraversalError) Error() string {
 	return fmt.Sprintf("%s is outside of %s", e.targetPath, e.basePath)
 }
 
+// ensureSafePath makes sure targetpath is basepath or somewhere under it,
+// after making both absolute and resolving any "..", and that following the
+// symlinks along the part of it that exists doesn't lead out of basepath.
+// basepath itself may be a symlink.
 func ensureSafePath(basepath string, targetpath string) error {
+	base, err := filepath.Abs(basepath)
+	if err != nil {
+		return err
+	}
 	abs, err := filepath.Abs(targetpath)
 	if err != nil {
 		return err
 	}
-	if !strings.HasPrefix(abs, basepath) {
+	if !isUnder(base, abs) {
+		stats.traversalRejections.add()
+		return &pathTraversalError{basepath, targetpath}
+	}
+	if resolvedBase, err := resolveExisting(base); err == nil {
+		base = resolvedBase
+	}
+	resolved, err := resolveExisting(abs)
+	if os.IsNotExist(err) {
+		// A dangling symlink; where it would lead can't be checked
+		stats.traversalRejections.add()
+		return &pathTraversalError{basepath, targetpath}
+	} else if err != nil {
+		return err
+	}
+	if !isUnder(base, resolved) {
+		stats.traversalRejections.add()
 		return &pathTraversalError{basepath, targetpath}
 	}
 	return nil
 }
 
+// isUnder reports whether the clean absolute path p is base or below it. A
+// bare prefix check would let /tmp/library2 through for /tmp/library.
+func isUnder(base string, p string) bool {
+	rel, err := filepath.Rel(base, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// resolveExisting follows the symlinks in the deepest existing ancestor of
+// the absolute path p, or p itself, and puts the rest of p back on the end.
+func resolveExisting(p string) (string, error) {
+	rest := ""
+	for {
+		if _, err := os.Lstat(p); err == nil {
+			resolved, err := filepath.EvalSymlinks(p)
+			if err != nil {
+				return "", err
+			}
+			return filepath.Join(resolved, rest), nil
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return filepath.Join(p, rest), nil
+		}
+		rest = filepath.Join(filepath.Base(p), rest)
+		p = parent
+	}
+}
+
+type dotSegmentError struct {
+	rel string
+}
+
+func (e *dotSegmentError) Error() string {
+	return fmt.Sprintf("%s has a \".\" or \"..\" path element", e.rel)
+}
+
+// checkDotSegments rejects a path under music/, as given by the client, with
+// a "." or ".." element, however it was encoded on the way in.
+func checkDotSegments(rel string) error {
+	for _, element := range strings.Split(rel, "/") {
+		if element == "." || element == ".." {
+			return &dotSegmentError{rel}
+		}
+	}
+	return nil
+}
+
+// ensureInMusic makes sure destPath is a file under a holding's music
+// directory, not just somewhere in the library, symlinks included.
+func ensureInMusic(musicDir string, destPath string) error {
+	if !strings.HasPrefix(path.Clean(destPath), musicDir+"/") {
+		stats.traversalRejections.add()
+		return &pathTraversalError{musicDir, destPath}
+	}
+	if err := ensureSafePath(config.LibraryPath, destPath); err != nil {
+		return err
+	}
+	return ensureSafePath(musicDir, destPath)
+}
+
 type lockExistsError struct {
 	uuid string
 }
@@ -289,44 +874,175 @@ func trackUploadHandler(w http.ResponseWriter, r *http.Request, params []string)
 		return
 	}
 
-	lockPath := path.Join(uuidToPath(config.LibraryPath, uuid), "lock")
+	if err := checkWritable(uuid); err != nil {
+		writeRefused(w, err)
+		return
+	}
+
+	if err := prepareWrite(uuid); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	unlock := lockHolding(uuid)
+	defer unlock()
+
+	lockPath := path.Join(uuidToPath(config.LibraryPath, uuid), lockFileName)
 	if _, err := os.Stat(lockPath); err == nil {
 		// Lock exists, refuse upload
 		lerr := &lockExistsError{uuid}
+		stats.lockConflicts.add()
 		log.Println(lerr.Error())
 		http.Error(w, lerr.Error(), http.StatusForbidden)
 		return
 	}
+	if err := checkLockProposal(uuid, uuidToPath(config.LibraryPath, uuid)); err != nil {
+		if _, ok := err.(*lockProposedError); !ok {
+			writeError(w, err)
+			return
+		}
+		stats.lockConflicts.add()
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
 
-	body, err := ioutil.ReadAll(r.Body)
+	// Autonamed tracks are named from their tags, so read them first
+	requested := strings.Join(params[2:], "/")
+	var body []byte
+	if r.URL.Query().Get("autoname") == "1" {
+		var ok bool
+		if body, ok = readUpload(w, r); !ok {
+			return
+		}
+		if requested, err = autoname(requested, body); err != nil {
+			log.Println(err.Error())
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := checkDotSegments(requested); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	storedName, err := applyPortableNames(requested)
 	if err != nil {
 		log.Println(err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	musicDir := path.Join(uuidToPath(config.LibraryPath, uuid), "music")
+	destPath := path.Join(musicDir, storedName)
 
-	destPath := path.Join(uuidToPath(config.LibraryPath, uuid), "music", strings.Join(params[2:], "/"))
-
-	if err := ensureSafePath(config.LibraryPath, destPath); err != nil {
+	if err := ensureInMusic(musicDir, destPath); err != nil {
 		log.Println(err.Error())
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
+	if _, err := os.Stat(destPath); os.IsNotExist(err) && config.Limits.MaxHoldingFiles > 0 {
+		count, err := countFiles(musicDir)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if count >= config.Limits.MaxHoldingFiles {
+			terr := &tooManyFilesError{uuid, config.Limits.MaxHoldingFiles}
+			log.Println(terr.Error())
+			http.Error(w, terr.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+	}
+
+	if enforceCaseUniqueness() {
+		err := checkCaseCollision(musicDir, destPath)
+		if _, ok := err.(*caseCollisionError); ok {
+			log.Println(err.Error())
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	if body == nil {
+		var ok bool
+		if body, ok = readUpload(w, r); !ok {
+			return
+		}
+	}
+
+	sums, err := verifyUpload(r, body)
+	if err != nil {
+		checksumUploadError(w, err)
+		return
+	}
+
+	if id := r.Header.Get(txnHeader); id != "" {
+		txn, err := findTxn(uuid, id)
+		if err != nil {
+			txnStatusError(w, err)
+			return
+		}
+		err = stageTxnFile(txn, musicDir, strings.TrimPrefix(destPath, musicDir+"/"), body, sums, trackProvenance(r, provenanceTxn, params, storedName))
+		txn.mu.Unlock()
+		if _, ok := err.(*caseCollisionError); ok {
+			log.Println(err.Error())
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if _, ok := err.(*tooManyFilesError); ok {
+			log.Println(err.Error())
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("X-Moss-Stored-Name", strings.TrimPrefix(destPath, musicDir+"/"))
+		fmt.Fprintf(w, "staged: %d bytes\n", len(body))
+		return
+	}
+
+	newHolding := !dirExists(uuidToPath(config.LibraryPath, uuid))
 	dir, _ := filepath.Split(destPath)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		log.Println(err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := makeDirs(dir); err != nil {
+		writeError(w, err)
 		return
 	}
+	if newHolding {
+		info := HoldingInfo{CreatedAt: stamp(time.Now())}
+		if err := writeHoldingInfo(uuidToPath(config.LibraryPath, uuid), info); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
 
-	if err := ioutil.WriteFile(destPath, body, 0644); err != nil {
-		log.Println(err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := writeFileAtomic(destPath, body); err != nil {
+		writeError(w, err)
 		return
 	}
+	if err := recordChecksums(uuidToPath(config.LibraryPath, uuid), strings.TrimPrefix(destPath, musicDir+"/"), sums); err != nil {
+		writeError(w, err)
+		return
+	}
+	rel := strings.TrimPrefix(destPath, musicDir+"/")
+	if err := recordTags(uuidToPath(config.LibraryPath, uuid), rel, tagsOfUpload(rel, body)); err != nil {
+		writeError(w, err)
+		return
+	}
+	prov := trackProvenance(r, provenanceUpload, params, storedName)
+	if err := recordProvenance(uuidToPath(config.LibraryPath, uuid), path.Join("music", rel), &prov); err != nil {
+		writeError(w, err)
+		return
+	}
+	emitChange(uuid, "music", storedName)
 
-	fmt.Fprintf(w, "uploaded: %d bytes\n", len(body))
+	w.Header().Set("X-Moss-Stored-Name", strings.TrimPrefix(destPath, musicDir+"/"))
+	fmt.Fprintf(w, "uploaded: %d bytes\nsha256: %s\n", len(body), sums["sha256"])
 	return
 
 }
@@ -342,7 +1058,24 @@ func dirExists(path string) bool {
 type Holding struct {
 	FileList   []string
 	HasArtwork bool
-	Locked     bool
+	// Album art slots, front first
+	Artwork      []string
+	HasMasterArt bool `json:",omitempty"`
+	Locked       bool
+	CreatedAt    Timestamp
+	LockedAt     *Timestamp                   `json:",omitempty"`
+	Digest       string                       `json:",omitempty"`
+	Attributes   map[string]map[string]string `json:",omitempty"`
+	Discs        []Disc
+	Backend      string
+	EmptyFiles   []string       `json:",omitempty"`
+	Tags         *TagSummary    `json:",omitempty"`
+	Checksums    *Checksums     `json:",omitempty"`
+	Archive      *ArchiveRecord `json:",omitempty"`
+	ProposedLock *LockProposal  `json:",omitempty"`
+	Usage        *HoldingUsage  `json:",omitempty"`
+	// Of every file, by path in the holding; only shown to admins
+	Provenance map[string]Provenance `json:",omitempty"`
 }
 
 func listUUIDHandler(w http.ResponseWriter, r *http.Request, params []string) {
@@ -353,8 +1086,13 @@ func listUUIDHandler(w http.ResponseWriter, r *http.Request, params []string) {
 		return
 	}
 
-	uuidDir := uuidToPath(config.LibraryPath, params[0])
+	if knownMissing(params[0]) {
+		http.Error(w, "holding not found on disk", http.StatusNotFound)
+		return
+	}
+	uuidDir := holdingDir(params[0])
 	if !dirExists(uuidDir) {
+		rememberMissing(params[0])
 		http.Error(w, "holding not found on disk", http.StatusNotFound)
 		log.Println("Holding not found: " + params[0])
 		return
@@ -362,39 +1100,96 @@ func listUUIDHandler(w http.ResponseWriter, r *http.Request, params []string) {
 
 	searchDir := path.Join(uuidDir, "music")
 	fileList := []string{}
-	err = filepath.Walk(searchDir, func(path string, f os.FileInfo, err error) error {
-		if err != nil || f.IsDir() {
-			return nil
-		}
-		fileList = append(fileList, path[len(searchDir)+1:])
+	err = walkFiles(searchDir, func(rel string) error {
+		fileList = append(fileList, rel)
 		return nil
 	})
 	if err != nil {
-		log.Println(err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
+	sort.Strings(fileList)
 
-	var hasArtwork bool
 	var hasLock bool
 
-	if _, err = os.Stat(path.Join(uuidDir, "albumart")); err != nil {
-		hasArtwork = false
-	} else {
-		hasArtwork = true
-	}
+	// A master alone is served as a derived JPEG, in front
+	artwork := artworkSlots(uuidDir)
+	hasArtwork := len(artwork) > 0
+	_, err = os.Stat(path.Join(uuidDir, masterArtFileName))
+	hasMasterArt := err == nil
 
-	if _, err = os.Stat(path.Join(uuidDir, "lock")); err != nil {
+	if _, err = os.Stat(path.Join(uuidDir, lockFileName)); err != nil {
 		hasLock = false
 	} else {
 		hasLock = true
 	}
 
-	holding := Holding{fileList, hasArtwork, hasLock}
+	holding := Holding{
+		FileList:     fileList,
+		Discs:        detectDiscs(fileList),
+		Backend:      backendFor(params[0]),
+		HasArtwork:   hasArtwork,
+		Artwork:      artwork,
+		HasMasterArt: hasMasterArt,
+		Locked:       hasLock,
+		CreatedAt:    stamp(holdingCreatedAt(uuidDir)),
+	}
+	if hasLock {
+		lockedAt := stamp(holdingLockedAt(uuidDir))
+		holding.LockedAt = &lockedAt
+		if info, err := readLockInfo(uuidDir); err == nil && info.Digest != "" {
+			holding.Digest = info.Digest
+			w.Header().Set(digestHeader, info.Digest)
+		}
+	}
+	if attrs, err := readAttrs(uuidDir); err != nil {
+		log.Println(err.Error())
+	} else if len(attrs) > 0 {
+		holding.Attributes = attrs
+	}
+	if tags, err := readTags(uuidDir); err != nil {
+		log.Println(err.Error())
+	} else {
+		holding.Tags = summarizeTags(holding.Discs, tags)
+	}
+	holding.EmptyFiles = emptyFiles(uuidDir, fileList)
+	if sums, err := readChecksums(uuidDir); err != nil {
+		log.Println(err.Error())
+	} else {
+		for _, rel := range holding.EmptyFiles {
+			if sums.Music[rel] == nil {
+				sums.Music[rel] = emptyChecksums()
+			}
+		}
+		if len(sums.Music) > 0 || sums.AlbumArt != nil || sums.MasterArt != nil || len(sums.Artwork) > 0 {
+			holding.Checksums = &sums
+		}
+	}
+	if info, err := readHoldingInfo(uuidDir); err == nil {
+		holding.Archive = info.Archive
+	}
+	if !hasLock {
+		if proposal, err := readLockProposal(uuidDir); err != nil {
+			log.Println(err.Error())
+		} else {
+			holding.ProposedLock = proposal
+		}
+	}
+	if usage, err := measureHolding(uuidDir); err != nil {
+		log.Println(err.Error())
+	} else {
+		holding.Usage = &usage
+		setHoldingUsage(params[0], usage)
+	}
+	if isAdmin(r) {
+		if records, err := holdingProvenance(uuidDir); err != nil {
+			log.Println(err.Error())
+		} else {
+			holding.Provenance = records
+		}
+	}
 	js, err := json.Marshal(holding)
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(js)
-	return
+	serveListing(w, r, js, newestModTime(uuidDir))
 }
 
 func getHandler(w http.ResponseWriter, r *http.Request, params []string) {
@@ -405,27 +1200,97 @@ func getHandler(w http.ResponseWriter, r *http.Request, params []string) {
 		return
 	}
 
-	uuidDir := uuidToPath(config.LibraryPath, params[0])
+	if knownMissing(params[0]) {
+		http.Error(w, "holding not found on disk", http.StatusNotFound)
+		return
+	}
+	uuidDir := holdingDir(params[0])
 	if !dirExists(uuidDir) {
+		rememberMissing(params[0])
 		http.Error(w, "holding not found on disk", http.StatusNotFound)
 		log.Println("Holding not found: " + params[0])
 		return
 	}
+	if archivedAway(w, params[0], uuidDir) {
+		return
+	}
+	if len(params) < 2 {
+		http.Error(w, "No request handler for that", http.StatusBadRequest)
+		return
+	}
+
+	if params[1] == "albumart" && len(params) >= 3 && params[2] == "master" {
+		serveMasterArt(w, r, params[0], uuidDir)
+		return
 
-	if params[1] == "albumart" {
+	} else if params[1] == "albumart" && len(params) == 3 && params[2] != "" && params[2] != "front" {
+		serveArtwork(w, r, uuidDir, params[2])
+		return
+
+	} else if params[1] == "albumart" {
 		fp := path.Join(uuidDir, "albumart")
 		if err := ensureSafePath(config.LibraryPath, fp); err != nil {
 			log.Println(err.Error())
 			http.Error(w, err.Error(), http.StatusUnauthorized)
 			return
 		}
-		http.ServeFile(w, r, fp)
+		if _, err := os.Stat(fp); os.IsNotExist(err) && serveDerivedArt(w, r, uuidDir) {
+			return
+		}
+		var expected string
+		if sums, err := readChecksums(uuidDir); err == nil {
+			setChecksumHeaders(w, sums.AlbumArt)
+			expected = sums.AlbumArt["sha256"]
+		}
+		var size int64
+		ctype := storedArtType(uuidDir)
+		if stat, err := os.Stat(fp); err == nil {
+			size = stat.Size()
+			setCacheControl(w, uuidDir, config.ArtCacheSeconds, false)
+			setContentDisposition(w, r, artFileName("albumart", ctype, fp))
+		}
+		if ctype != "" {
+			w.Header().Set("Content-Type", ctype)
+		}
+		serveVerified(w, r, params[0], "", fp, size, expected, func(w http.ResponseWriter) {
+			http.ServeFile(w, r, fp)
+		})
 		return
 
 	} else if params[1] == "music" && len(params) >= 3 && len(params[2]) > 0 {
-		fs := http.FileServer(http.Dir(path.Join(uuidDir, "music")))
+		rel := strings.Join(params[2:], "/")
+		stat, statErr := musicFileStat(uuidDir, rel)
+		if strings.HasSuffix(rel, "/") || (statErr == nil && stat.IsDir()) {
+			// Not http.FileServer's HTML index; the holding's listing has
+			// every file
+			http.Error(w, "Directories aren't served; GET /"+params[0]+"/ lists the holding's files", http.StatusNotFound)
+			return
+		}
+		fp := path.Join(uuidDir, "music", path.Clean("/"+rel))
+		var expected string
+		var size int64
+		if statErr == nil {
+			if sums, err := readChecksums(uuidDir); err == nil {
+				setChecksumHeaders(w, sums.Music[checksumKey(rel)])
+				expected = sums.Music[checksumKey(rel)]["sha256"]
+			}
+			setCacheControl(w, uuidDir, config.MusicCacheSeconds, true)
+			setContentDisposition(w, r, stat.Name())
+			if r.Method == "HEAD" {
+				serveVerified(w, r, params[0], checksumKey(rel), fp, stat.Size(), expected, func(w http.ResponseWriter) {
+					headMusicFile(w, r, stat, rel)
+				})
+				return
+			}
+			w.Header().Set("ETag", fileETag(stat))
+			w.Header().Set("Content-Type", contentTypeByName(rel))
+			size = stat.Size()
+		}
+		fs := http.FileServer(filesOnly{http.Dir(path.Join(uuidDir, "music"))})
 		sp := http.StripPrefix("/"+params[0]+"/music", fs)
-		sp.ServeHTTP(w, r)
+		serveVerified(w, r, params[0], checksumKey(rel), fp, size, expected, func(w http.ResponseWriter) {
+			sp.ServeHTTP(w, r)
+		})
 		return
 
 	} else {
@@ -435,6 +1300,108 @@ func getHandler(w http.ResponseWriter, r *http.Request, params []string) {
 	}
 }
 
+// applyDefaults fills in whatever the config left unset.
+func applyDefaults() {
+	if config.MaxClockSkew == 0 {
+		config.MaxClockSkew = defaultMaxClockSkew
+	}
+	if config.RejectionLogSize == 0 {
+		config.RejectionLogSize = defaultRejectionLogSize
+	}
+	if config.RejectionLogTTL == 0 {
+		config.RejectionLogTTL = defaultRejectionLogTTL
+	}
+	if config.LockProposalTTL == 0 {
+		config.LockProposalTTL = defaultLockProposalTTL
+	}
+	if config.MaxReaderWait == 0 {
+		config.MaxReaderWait = defaultMaxReaderWait
+	}
+	if config.DerivedArtSize == 0 {
+		config.DerivedArtSize = defaultDerivedArtSize
+	}
+	if config.MaxAlbumArtSide == 0 {
+		config.MaxAlbumArtSide = defaultMaxAlbumArtSide
+	}
+	if config.NegativeCacheTTL == 0 {
+		config.NegativeCacheTTL = defaultNegativeCacheTTL
+	} else if config.NegativeCacheTTL > maxNegativeCacheTTL {
+		config.NegativeCacheTTL = maxNegativeCacheTTL
+	}
+	if config.NegativeCacheSize == 0 {
+		config.NegativeCacheSize = defaultNegativeCacheSize
+	}
+	if len(config.ChecksumAlgorithms) == 0 {
+		config.ChecksumAlgorithms = defaultChecksumAlgorithms
+	}
+	if config.ChecksumBackfillRate == 0 {
+		config.ChecksumBackfillRate = defaultChecksumBackfillRate
+	}
+
+	if config.PeerRetries == 0 {
+		config.PeerRetries = defaultPeerRetries
+	} else if config.PeerRetries < 0 {
+		config.PeerRetries = 0
+	}
+	if config.PeerFailureThreshold == 0 {
+		config.PeerFailureThreshold = defaultPeerFailureThreshold
+	}
+	if config.ReplicationQueueLimit == 0 {
+		config.ReplicationQueueLimit = defaultReplicationQueueLimit
+	}
+
+	if config.MaxClipLength == 0 {
+		config.MaxClipLength = defaultMaxClipLength
+	}
+	if config.ClipCacheSize == 0 {
+		config.ClipCacheSize = defaultClipCacheSize
+	}
+	if config.ClipTranscoderType == "" {
+		config.ClipTranscoderType = "audio/mpeg"
+	}
+
+	if config.HSTSMaxAge == 0 {
+		config.HSTSMaxAge = defaultHSTSMaxAge
+	} else if config.HSTSMaxAge < 0 {
+		config.HSTSMaxAge = 0
+	}
+	if config.ArtCacheSeconds == 0 {
+		config.ArtCacheSeconds = defaultArtCacheSeconds
+	}
+	if config.MusicCacheSeconds == 0 {
+		config.MusicCacheSeconds = defaultMusicCacheSeconds
+	}
+}
+
+// newHandler routes the API behind its middleware, outermost first.
+func newHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/version", versionHandler)
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/locks", bulkLockHandler)
+	mux.HandleFunc("/locks/pending", pendingLocksHandler)
+	mux.HandleFunc("/changes", changesHandler)
+	mux.HandleFunc("/stats", statsHandler)
+	mux.HandleFunc("/cluster", clusterHandler)
+	mux.HandleFunc("/layout", layoutHandler)
+	mux.HandleFunc("/export-tree", exportTreeHandler)
+	mux.HandleFunc("/uuidinfo/", uuidInfoHandler)
+	mux.HandleFunc("/auth/check", authCheckHandler)
+	mux.HandleFunc("/albumart/batch", artBatchHandler)
+	mux.HandleFunc("/usage/top", topHoldingsHandler)
+	mux.HandleFunc("/admin/", adminHandler)
+	mux.HandleFunc("/diff", diffHandler)
+	mux.HandleFunc("/search", searchHandler)
+	mux.HandleFunc("/lookup", lookupHandler)
+	mux.HandleFunc("/qc/duplicate-names", duplicateNamesHandler)
+	mux.HandleFunc("/me/rejections", myRejectionsHandler)
+	mux.HandleFunc("/me/usage", myUsageHandler)
+	mux.HandleFunc("/", mainHandler)
+	return countOutcomes(measureBackends(recordRejections(setPolicyHeaders(checkClientVersion(checkRoles(enforceLimits(meterUploads(makeRoom(mux)))))))))
+}
+
 func main() {
 	flag.Parse()
 	if *configPath != "" {
@@ -453,14 +1420,162 @@ func main() {
 		config.ApiKey = *apikey
 		config.Port = *port
 		config.LibraryPath = *libpath
+		config.LegacyLayout = *legacyLayout
+		config.MigrateOnAccess = *migrateOnAccess
+		config.StrictCaseNames = *strictCaseNames
+		config.PortableNames = *portableNames
+		config.MinClientVersion = *minClientVersion
+		config.PublicListen = *publicListen
 
 		// Config file is required for configurable shards
-		config.Shards = []Shard{Shard{"00000000-0000-0000-0000-000000000000", "ffffffff-ffff-ffff-ffff-ffffffffffff", true}}
+		config.Shards = []Shard{Shard{"00000000-0000-0000-0000-000000000000", "ffffffff-ffff-ffff-ffff-ffffffffffff", true, "", "", "", "", false}}
 	}
-	log.Println("Server running on port " + strconv.Itoa(config.Port))
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/version", versionHandler)
-	mux.HandleFunc("/", mainHandler)
-	http.ListenAndServe(":"+strconv.Itoa(config.Port), mux)
+	// Given on the command line for one run, so it applies with -config too
+	if *autoMigrate {
+		config.AutoMigrate = true
+	}
+	if *durable {
+		config.Durable = true
+	}
+
+	if config.LogUTC {
+		log.SetFlags(log.Flags() | log.LUTC)
+	}
+
+	if len(config.Tenants) > 0 {
+		if flag.Arg(0) != "" {
+			log.Fatal("Run " + flag.Arg(0) + " with the tenant's own config")
+		}
+		runTenants()
+		return
+	}
+	if *tenantName != "" {
+		log.SetPrefix("[" + *tenantName + "] ")
+	}
+
+	if err := loadFanout(); err != nil {
+		log.Fatal("Cannot load fan-out state: " + err.Error())
+	}
+
+	// Before the subcommands, which tell tracks by their type too
+	if err := initContentTypes(); err != nil {
+		log.Fatal(err.Error())
+	}
+
+	switch flag.Arg(0) {
+	case "fsck":
+		os.Exit(runFsck())
+	case "freeze":
+		os.Exit(runFreeze())
+	case "freeze-hold":
+		os.Exit(holdFreeze())
+	case "thaw":
+		os.Exit(runThaw())
+	case "migrate":
+		os.Exit(runMigrate())
+	case "export-tree":
+		os.Exit(runExportTreeCommand())
+	}
+
+	resetStats()
+	initDrains()
+	if err := initTmpDir(); err != nil {
+		log.Fatal("Cannot set up temp directory: " + err.Error())
+	}
+	applyDefaults()
+	// Before the janitor, which may have to wait for a wrong clock
+	checkClock()
+	go runClockChecks()
+	go runJanitor()
+	if config.ExportTree {
+		go runExportTree()
+	}
+	if config.AutoFanoutThreshold > 0 {
+		go runFanoutChecks()
+	}
+
+	logLibraryScan()
+	go runHoldingCounts()
+	if err := initFormat(); err != nil {
+		log.Fatal("Library format: " + err.Error())
+	}
+
+	if ci, err := probeCaseInsensitive(config.LibraryPath); err != nil {
+		log.Println("Case sensitivity probe failed: " + err.Error())
+	} else if ci {
+		caseInsensitiveFS = true
+		log.Println("Library filesystem is case-insensitive, rejecting case-only name collisions")
+	}
+	if err := validateUUIDVersions(); err != nil {
+		log.Fatal(err.Error())
+	}
+	if err := initTrustedProxies(); err != nil {
+		log.Fatal(err.Error())
+	}
+	if err := initLimits(); err != nil {
+		log.Fatal("Limits: " + err.Error())
+	}
+	if err := validateShards(config); err != nil {
+		for _, p := range err.(*shardConfigError).problems {
+			log.Println("Shards: " + p.String())
+		}
+		os.Exit(1)
+	}
+	if err := validateShardLabels(); err != nil {
+		log.Fatal("Shards: " + err.Error())
+	}
+	if err := validateUsers(); err != nil {
+		log.Fatal("Users: " + err.Error())
+	}
+	if err := initDiscPattern(); err != nil {
+		log.Fatal("DiscPattern: " + err.Error())
+	}
+	if err := validatePortableNames(config.PortableNames); err != nil {
+		log.Fatal("PortableNames: " + err.Error())
+	}
+	if err := validateAutonameTemplate(autonameTemplate()); err != nil {
+		log.Fatal(err.Error())
+	}
+	if config.MinClientVersion != "" {
+		if _, err := parseVersion(config.MinClientVersion); err != nil {
+			log.Fatal("MinClientVersion: " + err.Error())
+		}
+	}
+
+	if err := validateChecksumAlgorithms(config.ChecksumAlgorithms); err != nil {
+		log.Fatal("ChecksumAlgorithms: " + err.Error())
+	}
+	if err := loadUsage(); err != nil {
+		log.Fatal("Cannot load upload usage: " + err.Error())
+	}
+	if err := initReplication(); err != nil {
+		log.Fatal("Cannot start replication: " + err.Error())
+	}
+	if err := initEventBus(); err != nil {
+		log.Fatal(err.Error())
+	}
+	if err := initCatalog(); err != nil {
+		log.Fatal("Catalog: " + err.Error())
+	}
+	if err := loadJobs(); err != nil {
+		log.Fatal("Cannot load jobs: " + err.Error())
+	}
+	if !resumedJob("checksum-backfill") {
+		go runChecksumBackfill(newJob("checksum-backfill", nil))
+	}
+
+	if config.PublicListen != "" {
+		startPublicListener()
+	}
+
+	if *tenantSocket == "" {
+		log.Println("Server running on port " + strconv.Itoa(config.Port))
+	}
+
+	handler := newHandler()
+	if *tenantSocket != "" {
+		log.Fatal(serveTenant(*tenantSocket, handler))
+	}
+	log.Fatal(serveTCP(":"+strconv.Itoa(config.Port), handler, config.TLSCert != ""))
 }
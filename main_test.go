@@ -0,0 +1,393 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/wuvt/moss/mosstest"
+)
+
+const (
+	testUser = "admin"
+	testKey  = "admin"
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// newTestServer starts moss on a fresh library loaded with spec. Each tweak
+// can change the config before moss starts, the way a config file would.
+// moss keeps its state in globals, so tests using it can't run in parallel.
+func newTestServer(t testing.TB, spec mosstest.Spec, tweaks ...func(*Config)) *mosstest.Server {
+	t.Helper()
+	config = Config{
+		ApiUser:     testUser,
+		ApiKey:      testKey,
+		LibraryPath: t.TempDir(),
+		Shards:      []Shard{Shard{"00000000-0000-0000-0000-000000000000", "ffffffff-ffff-ffff-ffff-ffffffffffff", true, "", "", "", "", false}},
+	}
+	for _, tweak := range tweaks {
+		tweak(&config)
+	}
+	startTestLibrary(t)
+	return mosstest.New(t, newHandler(), config.LibraryPath, testUser, testKey, spec)
+}
+
+// startTestLibrary does what main does with the config before serving,
+// short of starting the background jobs.
+func startTestLibrary(t testing.TB) {
+	t.Helper()
+	resetStats()
+	for _, step := range []func() error{loadFanout, initContentTypes, initTmpDir} {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	applyDefaults()
+	for _, step := range []func() error{initFormat, validateUUIDVersions, initTrustedProxies, initLimits, validateUsers, initDiscPattern, loadUsage, initReplication, loadJobs} {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := validatePortableNames(config.PortableNames); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readTestdata returns a file under testdata, such as the album art whose
+// bytes mustn't change with the Go release that encodes images.
+func readTestdata(t testing.TB, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(path.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// writeTestFile puts a file straight into the library, for setting up
+// damage no request could cause.
+func writeTestFile(t testing.TB, p string, data []byte) {
+	t.Helper()
+	if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHoldingListingGolden(t *testing.T) {
+	s := newTestServer(t, mosstest.Spec{Holdings: []mosstest.Holding{{
+		UUID:     "4b1f2c3d-5e6f-4a7b-8c9d-0e1f2a3b4c5d",
+		Tracks:   []mosstest.Track{{Name: "01 Intro.flac"}, {Name: "02 Outro.flac", Size: 4096}},
+		AlbumArt: readTestdata(t, "front.png"),
+	}}})
+	resp := s.MustDo("GET", s.Path(0), nil)
+	// Usage depends on the filesystem's block size
+	mosstest.AssertGolden(t, "holding-listing", resp.Body, "CreatedAt", "At", "Usage")
+}
+
+// BenchmarkUpload times PUT /UUID4/music/NAME of a small track, each into a
+// new holding as when a batch is ripped, with and without Durable.
+func BenchmarkUpload(b *testing.B) {
+	body := mosstest.FLAC(64 << 10)
+	for _, durable := range []bool{false, true} {
+		b.Run(fmt.Sprintf("Durable=%t", durable), func(b *testing.B) {
+			s := newTestServer(b, mosstest.Spec{}, func(c *Config) { c.Durable = durable })
+			b.SetBytes(int64(len(body)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				resp := s.Do("PUT", "/"+mosstest.NewUUID()+"/music/01.flac", body)
+				if resp.Status != http.StatusOK {
+					b.Fatalf("upload: %d %s", resp.Status, resp.Body)
+				}
+			}
+		})
+	}
+}
+
+func TestEnsureSafePath(t *testing.T) {
+	tmp := t.TempDir()
+	base := path.Join(tmp, "library")
+	if err := os.Mkdir(base, 0755); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	relative := func(p string) string {
+		rel, err := filepath.Rel(wd, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rel
+	}
+
+	for _, c := range []struct {
+		target string
+		safe   bool
+	}{
+		{base, true},
+		{base + "/", true},
+		{base + "/4b/4b1f2c3d/music/01.flac", true},
+		{base + "/4b/../4b/x", true},
+		{base + "/..x", true},
+		{base + "2", false},
+		{base + "2/4b/4b1f2c3d", false},
+		{base + "/../library2", false},
+		{base + "/..", false},
+		{base + "/4b/../../etc", false},
+		{tmp, false},
+		{"/", false},
+		{relative(base), true},
+		{relative(base + "/4b/4b1f2c3d"), true},
+		{relative(base + "2/4b"), false},
+		{relative(base) + "/..", false},
+	} {
+		err := ensureSafePath(base, c.target)
+		if c.safe && err != nil {
+			t.Errorf("%s was refused: %s", c.target, err)
+		} else if !c.safe && err == nil {
+			t.Errorf("%s was allowed", c.target)
+		}
+	}
+
+	// A relative base is taken from the working directory too
+	if err := ensureSafePath(relative(base), base+"/4b"); err != nil {
+		t.Error(err)
+	}
+	if err := ensureSafePath(relative(base), base+"2"); err == nil {
+		t.Error("the sibling was allowed under a relative base")
+	}
+}
+
+func TestIsUnder(t *testing.T) {
+	for _, c := range []struct {
+		base, p string
+		under   bool
+	}{
+		{"/srv/library", "/srv/library", true},
+		{"/srv/library", "/srv/library/4b", true},
+		{"/srv/library", "/srv/library/..x", true},
+		{"/srv/library", "/srv/library2", false},
+		{"/srv/library", "/srv/library2/4b", false},
+		{"/srv/library", "/srv", false},
+		{"/srv/library", "/srv/library/..", false},
+		{"/srv/library", "/", false},
+		{"/", "/srv", true},
+	} {
+		if got := isUnder(c.base, c.p); got != c.under {
+			t.Errorf("isUnder(%s, %s) = %t", c.base, c.p, got)
+		}
+	}
+}
+
+func TestEnsureSafePathSymlinks(t *testing.T) {
+	tmp := t.TempDir()
+	real := path.Join(tmp, "real")
+	outside := path.Join(tmp, "outside")
+	for _, dir := range []string{real + "/4b/4b1f2c3d/music", real + "/5c", outside + "/music"} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTestFile(t, outside+"/secret.flac", nil)
+	writeTestFile(t, real+"/4b/4b1f2c3d/music/01.flac", nil)
+	// The library as configured is a symlink to where it really is
+	base := path.Join(tmp, "library")
+	for link, target := range map[string]string{
+		base:                                     real,
+		real + "/6d":                             outside,
+		real + "/7e":                             real + "/5c",
+		real + "/4b/4b1f2c3d/music/leak.flac":    outside + "/secret.flac",
+		real + "/4b/4b1f2c3d/music/same.flac":    real + "/4b/4b1f2c3d/music/01.flac",
+		real + "/4b/4b1f2c3d/music/gone.flac":    real + "/nowhere.flac",
+		real + "/4b/4b1f2c3d/music/relative.mp3": "../../../../outside/secret.flac",
+	} {
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct {
+		target string
+		safe   bool
+	}{
+		// Through the symlinked root, to the real library
+		{base + "/4b/4b1f2c3d/music/01.flac", true},
+		{base + "/4b/4b1f2c3d/music/new.flac", true},
+		// A shard that leads out of the library, existing or not below it
+		{base + "/6d", false},
+		{base + "/6d/music", false},
+		{base + "/6d/6d000000/music/new.flac", false},
+		// A shard that leads elsewhere in it
+		{base + "/7e/7e000000", true},
+		// Files that lead out, elsewhere in, and nowhere
+		{base + "/4b/4b1f2c3d/music/leak.flac", false},
+		{base + "/4b/4b1f2c3d/music/relative.mp3", false},
+		{base + "/4b/4b1f2c3d/music/same.flac", true},
+		{base + "/4b/4b1f2c3d/music/gone.flac", false},
+	} {
+		err := ensureSafePath(base, c.target)
+		if c.safe && err != nil {
+			t.Errorf("%s was refused: %s", c.target, err)
+		} else if !c.safe && err == nil {
+			t.Errorf("%s was allowed", c.target)
+		}
+	}
+
+	resolvedReal, err := filepath.EvalSymlinks(real)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p, want := range map[string]string{
+		base:                          resolvedReal,
+		base + "/4b/new/deeper.flac":  resolvedReal + "/4b/new/deeper.flac",
+		base + "/7e/7e000000/01.flac": resolvedReal + "/5c/7e000000/01.flac",
+	} {
+		if got, err := resolveExisting(p); err != nil || got != want {
+			t.Errorf("resolveExisting(%s) = %s, %v, want %s", p, got, err, want)
+		}
+	}
+}
+
+func TestUUIDSanityCheck(t *testing.T) {
+	const (
+		v1 = "6ba7b810-9dad-11d1-80b4-00c04fd430c8"
+		v4 = "4b1f2c3d-5e6f-4a7b-8c9d-0e1f2a3b4c5d"
+		v7 = "018f4e2a-7c3b-7d2e-9f10-1a2b3c4d5e6f"
+	)
+	for _, c := range []struct {
+		accepted []int
+		uuid     string
+		ok       bool
+	}{
+		// Only version 4 by default
+		{nil, v4, true},
+		{nil, v1, false},
+		{nil, v7, false},
+		{[]int{1, 4}, v1, true},
+		{[]int{1, 4}, v4, true},
+		{[]int{1, 4}, v7, false},
+		{[]int{7}, v7, true},
+		{[]int{7}, v4, false},
+		// Never the nil or max UUID, whatever is accepted
+		{[]int{1, 2, 3, 4, 5, 6, 7, 8}, "00000000-0000-0000-0000-000000000000", false},
+		{[]int{1, 2, 3, 4, 5, 6, 7, 8}, "ffffffff-ffff-ffff-ffff-ffffffffffff", false},
+		// The variant nibble is 8, 9, a or b
+		{nil, "4b1f2c3d-5e6f-4a7b-0c9d-0e1f2a3b4c5d", false},
+		{nil, "4b1f2c3d-5e6f-4a7b-7c9d-0e1f2a3b4c5d", false},
+		{nil, "4b1f2c3d-5e6f-4a7b-cc9d-0e1f2a3b4c5d", false},
+		{nil, "4b1f2c3d-5e6f-4a7b-bc9d-0e1f2a3b4c5d", true},
+		// Lowercase only, so each holding has one directory name
+		{nil, "4B1F2C3D-5E6F-4A7B-8C9D-0E1F2A3B4C5D", false},
+		{nil, "4b1f2c3d-5e6f-4a7b-8c9d-0e1f2a3b4c5D", false},
+		{nil, "4b1f2c3d5e6f4a7b8c9d0e1f2a3b4c5d", false},
+		{nil, "4b1f2c3d_5e6f-4a7b-8c9d-0e1f2a3b4c5d", false},
+		{nil, "4b1f2c3d-5e6f-4a7b-8c9d-0e1f2a3b4c5g", false},
+		{nil, "{4b1f2c3d-5e6f-4a7b-8c9d-0e1f2a3b4c5}", false},
+		{nil, "", false},
+	} {
+		config.AcceptedUUIDVersions = c.accepted
+		err := uuidSanityCheck(c.uuid)
+		if c.ok && err != nil {
+			t.Errorf("%s with versions %v: %s", c.uuid, c.accepted, err)
+		} else if !c.ok && err == nil {
+			t.Errorf("%s with versions %v was accepted", c.uuid, c.accepted)
+		}
+	}
+	config.AcceptedUUIDVersions = nil
+
+	if err := uuidSanityCheck("4B1F2C3D-5E6F-4A7B-8C9D-0E1F2A3B4C5D"); err == nil || !strings.Contains(err.Error(), "lowercase") {
+		t.Errorf("uppercase got %v", err)
+	}
+}
+
+func TestDotSegments(t *testing.T) {
+	for rel, ok := range map[string]bool{
+		"01.flac":           true,
+		"CD1/01.flac":       true,
+		"..flac":            true,
+		"a..b/01.flac":      true,
+		"../01.flac":        false,
+		"CD1/../../01.flac": false,
+		"./01.flac":         false,
+		"CD1/..":            false,
+	} {
+		if err := checkDotSegments(rel); (err == nil) != ok {
+			t.Errorf("checkDotSegments(%s) = %v", rel, err)
+		}
+	}
+
+	musicDir := "/srv/library/4b/4b1f2c3d/music"
+	for dest, ok := range map[string]bool{
+		musicDir + "/01.flac":         true,
+		musicDir + "/CD1/01.flac":     true,
+		musicDir:                      false,
+		musicDir + "/../01.flac":      false,
+		musicDir + "/../music2/x":     false,
+		musicDir + "2/01.flac":        false,
+		musicDir + "/CD1/../../x":     false,
+		"/srv/library/4b/4b1f2c3d/xy": false,
+	} {
+		config.LibraryPath = "/srv/library"
+		if err := ensureInMusic(musicDir, dest); (err == nil) != ok {
+			t.Errorf("ensureInMusic(%s) = %v", dest, err)
+		}
+	}
+
+	// However ".." is encoded, it's decoded before it's checked. Over HTTP
+	// the mux cleans such a path and redirects before moss sees it, so what
+	// reaches checkDotSegments is a name moss made, like an autonamed one.
+	s := newTestServer(t, mosstest.Spec{Holdings: []mosstest.Holding{{Tracks: []mosstest.Track{{Name: "01.flac"}}}}}, func(c *Config) {
+		c.AutonameTemplate = "{album}/{title}"
+	})
+	for _, p := range []string{
+		"%2e%2e/escaped.flac",
+		"%2E%2E/escaped.flac",
+		"CD1/%2e%2e/%2e%2e/escaped.flac",
+		"%2e/escaped.flac",
+		".%2e/escaped.flac",
+		"%2e%2e%2fescaped.flac",
+	} {
+		rel, err := url.PathUnescape(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if checkDotSegments(rel) == nil {
+			t.Errorf("%s was allowed", p)
+		}
+		if resp := s.Do("PUT", s.Path(0, "music", p), mosstest.FLAC(0)); resp.Status/100 == 2 {
+			t.Errorf("%s got %d", p, resp.Status)
+		}
+	}
+	if resp := s.Do("PUT", s.Path(0, "music", "a.flac?autoname=1"), taggedFLAC("ALBUM=..", "TITLE=escaped")); resp.Status != http.StatusBadRequest || !strings.Contains(string(resp.Body), "path element") {
+		t.Errorf("autonamed .. got %d %s", resp.Status, resp.Body)
+	}
+	escaped := 0
+	filepath.Walk(s.Library, func(p string, f os.FileInfo, err error) error {
+		if err == nil && f.Name() == "escaped.flac" {
+			escaped++
+		}
+		return nil
+	})
+	if escaped > 0 {
+		t.Errorf("%d files were written", escaped)
+	}
+}
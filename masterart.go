@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// Besides the album art a holding can keep an archival master, such as a
+// 300MB TIFF scan, in albumart-master. It is only served to authenticated
+// users at /UUID4/albumart/master. A holding with a master but no album art
+// serves a JPEG derived from the master at /UUID4/albumart instead, no more
+// than DerivedArtSize pixels on a side, made on first request and kept in
+// albumart-derived.jpg.
+const masterArtFileName = "albumart-master"
+const derivedArtFileName = "albumart-derived.jpg"
+
+const defaultDerivedArtSize = 1200
+
+// Sent with the 404 for a master that couldn't be turned into a JPEG
+const errorCodeHeader = "X-Moss-Error-Code"
+const artDerivationFailed = "art-derivation-failed"
+
+// Deriving reads the whole master, so only one at a time
+var deriveMu sync.Mutex
+
+// Masters that failed to derive, by path and modification time, so a bad
+// upload isn't decoded again on every request
+var derivationFailures = struct {
+	sync.Mutex
+	m map[string]time.Time
+}{m: map[string]time.Time{}}
+
+type derivationError struct {
+	reason string
+}
+
+func (e *derivationError) Error() string {
+	return "Cannot derive album art from the master: " + e.reason
+}
+
+// spoolUpload streams a request body into tmp/, hashing it on the way. The
+// caller removes the file.
+func spoolUpload(r *http.Request) (string, map[string]string, error) {
+	f, err := ioutil.TempFile(tmpDir(), "upload-")
+	if err != nil {
+		return "", nil, err
+	}
+	expected, err := uploadChecksums(r)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", nil, err
+	}
+	sums, _, err := digestReader(io.TeeReader(r.Body, faultyWriter(f.Name(), f)), uploadAlgorithms(expected))
+	if err == nil {
+		err = syncFile(f)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		for alg, want := range expected {
+			if sums[alg] != want {
+				err = &checksumMismatchError{alg, want, sums[alg]}
+				break
+			}
+		}
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", nil, err
+	}
+	return f.Name(), sums, nil
+}
+
+// masterArtUploadHandler handles PUT /UUID4/albumart/master.
+func masterArtUploadHandler(w http.ResponseWriter, r *http.Request, uuid string) {
+	if err := uuidSanityCheck(uuid); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkWritable(uuid); err != nil {
+		writeRefused(w, err)
+		return
+	}
+	if err := prepareWrite(uuid); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	spooled, sums, err := spoolUpload(r)
+	if qerr, ok := err.(*quotaExceededError); ok {
+		quotaExceeded(w, qerr)
+		return
+	} else if merr, ok := err.(*http.MaxBytesError); ok {
+		tooLarge(w, &tooLargeError{merr.Limit})
+		return
+	} else if _, ok := err.(*checksumMismatchError); ok {
+		checksumUploadError(w, err)
+		return
+	} else if _, ok := err.(*unsupportedChecksumError); ok {
+		checksumUploadError(w, err)
+		return
+	} else if _, ok := err.(*malformedChecksumError); ok {
+		checksumUploadError(w, err)
+		return
+	} else if _, ok := err.(*conflictingChecksumError); ok {
+		checksumUploadError(w, err)
+		return
+	} else if err != nil {
+		storageError(w, err)
+		return
+	}
+	defer os.Remove(spooled)
+
+	unlock := lockHolding(uuid)
+	defer unlock()
+
+	dir := uuidToPath(config.LibraryPath, uuid)
+	destPath := path.Join(dir, masterArtFileName)
+	if err := ensureSafePath(config.LibraryPath, destPath); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err := makeDirs(dir); err != nil {
+		storageError(w, err)
+		return
+	}
+	if err := os.Rename(spooled, destPath); err != nil {
+		storageError(w, err)
+		return
+	}
+	if err := syncDir(dir); err != nil {
+		storageError(w, err)
+		return
+	}
+	if err := os.Remove(path.Join(dir, derivedArtFileName)); err != nil && !os.IsNotExist(err) {
+		log.Println(err.Error())
+	}
+	sumsFile, err := readChecksums(dir)
+	if err == nil {
+		sumsFile.MasterArt = sums
+		err = writeChecksums(dir, sumsFile)
+	}
+	if err == nil {
+		prov := requestProvenance(r, provenanceUpload)
+		err = recordProvenance(dir, masterArtFileName, &prov)
+	}
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	emitChange(uuid, "albumart-master", "")
+
+	stat, _ := os.Stat(destPath)
+	fmt.Fprintf(w, "uploaded: %d bytes\nsha256: %s\n", stat.Size(), sums["sha256"])
+}
+
+// serveMasterArt handles GET and HEAD of /UUID4/albumart/master.
+func serveMasterArt(w http.ResponseWriter, r *http.Request, uuid string, dir string) {
+	if !checkAuth(w, r) {
+		return
+	}
+	fp := path.Join(dir, masterArtFileName)
+	if err := ensureSafePath(config.LibraryPath, fp); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if _, err := os.Stat(fp); err != nil {
+		http.Error(w, "No master album art", http.StatusNotFound)
+		return
+	}
+	if sums, err := readChecksums(dir); err == nil {
+		setChecksumHeaders(w, sums.MasterArt)
+	}
+	http.ServeFile(w, r, fp)
+}
+
+// serveDerivedArt answers GET /UUID4/albumart for a holding that only has a
+// master. It reports whether there was a master to derive from.
+func serveDerivedArt(w http.ResponseWriter, r *http.Request, dir string) bool {
+	master := path.Join(dir, masterArtFileName)
+	stat, err := os.Stat(master)
+	if err != nil {
+		return false
+	}
+	if err := ensureSafePath(config.LibraryPath, master); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return true
+	}
+	derived, err := derivedArt(dir, stat)
+	if derr, ok := err.(*derivationError); ok {
+		w.Header().Set(errorCodeHeader, artDerivationFailed)
+		http.Error(w, derr.Error(), http.StatusNotFound)
+		return true
+	} else if err != nil {
+		writeError(w, err)
+		return true
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	setCacheControl(w, dir, config.ArtCacheSeconds, false)
+	setContentDisposition(w, r, "albumart.jpg")
+	http.ServeFile(w, r, derived)
+	return true
+}
+
+// derivedArt returns the path of the JPEG derived from a holding's master,
+// making it if it's missing or older than the master.
+func derivedArt(dir string, master os.FileInfo) (string, error) {
+	derived := path.Join(dir, derivedArtFileName)
+	if stat, err := os.Stat(derived); err == nil && !stat.ModTime().Before(master.ModTime()) {
+		return derived, nil
+	}
+	masterPath := path.Join(dir, masterArtFileName)
+	derivationFailures.Lock()
+	failedAt, failed := derivationFailures.m[masterPath]
+	derivationFailures.Unlock()
+	if failed && failedAt.Equal(master.ModTime()) {
+		return "", &derivationError{"it failed before and the master hasn't changed"}
+	}
+
+	deriveMu.Lock()
+	defer deriveMu.Unlock()
+	if stat, err := os.Stat(derived); err == nil && !stat.ModTime().Before(master.ModTime()) {
+		return derived, nil
+	}
+	img, err := decodeScaled(masterPath, config.DerivedArtSize)
+	if err != nil {
+		if _, ok := err.(*os.PathError); ok {
+			return "", err
+		}
+		log.Printf("Deriving album art from %s failed: %s\n", masterPath, err.Error())
+		derivationFailures.Lock()
+		derivationFailures.m[masterPath] = master.ModTime()
+		derivationFailures.Unlock()
+		return "", &derivationError{err.Error()}
+	}
+
+	release, err := beginWrite()
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	f, err := ioutil.TempFile(tmpDir(), "derived-")
+	if err != nil {
+		return "", err
+	}
+	err = jpeg.Encode(f, img, &jpeg.Options{Quality: 88})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), derived)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return derived, nil
+}
+
+// boxScaler averages the pixels of an image fed to it row by row into a
+// smaller one.
+type boxScaler struct {
+	factor int
+	out    *image.RGBA
+	sums   []uint64
+	counts []uint64
+}
+
+func newBoxScaler(width int, height int, maxSize int) *boxScaler {
+	factor := 1
+	for (width+factor-1)/factor > maxSize || (height+factor-1)/factor > maxSize {
+		factor++
+	}
+	w := (width + factor - 1) / factor
+	h := (height + factor - 1) / factor
+	return &boxScaler{factor, image.NewRGBA(image.Rect(0, 0, w, h)), make([]uint64, w*h*3), make([]uint64, w*h)}
+}
+
+func (s *boxScaler) addRow(y int, rgb []byte) {
+	w := s.out.Rect.Dx()
+	oy := y / s.factor
+	for x := 0; x*3 < len(rgb); x++ {
+		i := oy*w + x/s.factor
+		s.sums[i*3] += uint64(rgb[x*3])
+		s.sums[i*3+1] += uint64(rgb[x*3+1])
+		s.sums[i*3+2] += uint64(rgb[x*3+2])
+		s.counts[i]++
+	}
+}
+
+func (s *boxScaler) image() *image.RGBA {
+	for i, n := range s.counts {
+		if n == 0 {
+			continue
+		}
+		s.out.Pix[i*4] = uint8(s.sums[i*3] / n)
+		s.out.Pix[i*4+1] = uint8(s.sums[i*3+1] / n)
+		s.out.Pix[i*4+2] = uint8(s.sums[i*3+2] / n)
+		s.out.Pix[i*4+3] = 255
+	}
+	return s.out
+}
+
+// decodeScaled decodes a JPEG, PNG, GIF or baseline TIFF no larger than
+// maxSize on a side. TIFFs are read a row at a time.
+func decodeScaled(p string, maxSize int) (image.Image, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return nil, &unsupportedTIFFError{"too short to be an image"}
+	}
+
+	if isTIFF(magic) {
+		info, err := readTIFFInfo(f)
+		if err != nil {
+			return nil, err
+		}
+		scaler := newBoxScaler(info.width, info.height, maxSize)
+		if err := readTIFFRows(f, info, scaler.addRow); err != nil {
+			return nil, err
+		}
+		return scaler.image(), nil
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(bufio.NewReader(f))
+	if err != nil {
+		return nil, err
+	}
+	bounds := img.Bounds()
+	scaler := newBoxScaler(bounds.Dx(), bounds.Dy(), maxSize)
+	rgb := make([]byte, bounds.Dx()*3)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			i := (x - bounds.Min.X) * 3
+			rgb[i], rgb[i+1], rgb[i+2] = uint8(r>>8), uint8(g>>8), uint8(b>>8)
+		}
+		scaler.addRow(y-bounds.Min.Y, rgb)
+	}
+	return scaler.image(), nil
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// The library root records which on-disk format it is in. Format changes are
+// made by migrations, applied in order, each of which brings every holding up
+// to its version. Applying a migration to a holding must be idempotent, since
+// an interrupted run is resumed by starting over with the holdings that the
+// journal doesn't list as done.
+const formatFileName = ".moss-format"
+const migrationJournalFileName = ".moss-migrate.journal"
+
+type migration struct {
+	version int
+	name    string
+
+	// Required migrations must be run before the server will start; others
+	// are applied automatically at startup
+	required bool
+
+	needed func(uuid string, dir string) (bool, error)
+	apply  func(uuid string, dir string) error
+}
+
+var migrations = []migration{
+	{1, "holding-timestamps", false, needsTimestampBackfill, backfillHoldingTimestamps},
+	{2, "archive-play-order", false, hasArchiveDigests, forgetArchiveDigests},
+	{3, "track-tags", false, needsTrackTags, backfillTrackTags},
+}
+
+// The format this binary writes
+var currentFormatVersion = migrations[len(migrations)-1].version
+
+type LibraryFormat struct {
+	Version int
+}
+
+type formatTooNewError struct {
+	version int
+}
+
+func (e *formatTooNewError) Error() string {
+	return fmt.Sprintf("library is in format %d but this moss only understands up to %d", e.version, currentFormatVersion)
+}
+
+type migrationsPendingError struct {
+	names []string
+}
+
+func (e *migrationsPendingError) Error() string {
+	return fmt.Sprintf("library needs migrating (%s), run \"moss migrate\" or start with -auto-migrate", strings.Join(e.names, ", "))
+}
+
+func formatFile() string {
+	return path.Join(config.LibraryPath, formatFileName)
+}
+
+func journalFile() string {
+	return path.Join(config.LibraryPath, migrationJournalFileName)
+}
+
+// readFormatVersion returns 0 for libraries that predate the format file.
+func readFormatVersion() (int, error) {
+	data, err := ioutil.ReadFile(formatFile())
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	format := LibraryFormat{}
+	if err := json.Unmarshal(data, &format); err != nil {
+		return 0, err
+	}
+	return format.Version, nil
+}
+
+func writeFormatVersion(version int) error {
+	js, err := json.Marshal(LibraryFormat{version})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(formatFile(), js)
+}
+
+func pendingMigrations() ([]migration, error) {
+	version, err := readFormatVersion()
+	if err != nil {
+		return nil, err
+	}
+	if version > currentFormatVersion {
+		return nil, &formatTooNewError{version}
+	}
+	pending := []migration{}
+	for _, m := range migrations {
+		if m.version > version {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// readJournal returns the holdings already done by an interrupted run of
+// migration m.
+func readJournal(m migration) (map[string]bool, error) {
+	done := map[string]bool{}
+	f, err := os.Open(journalFile())
+	if os.IsNotExist(err) {
+		return done, nil
+	} else if err != nil {
+		return done, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() || scanner.Text() != "version "+strconv.Itoa(m.version) {
+		// Left over from another migration, so nothing of this one is done
+		return done, scanner.Err()
+	}
+	for scanner.Scan() {
+		done[scanner.Text()] = true
+	}
+	return done, scanner.Err()
+}
+
+// runMigration applies m to every holding not yet done, journaling each one,
+// and then records the new format version.
+func runMigration(m migration) error {
+	done, err := readJournal(m)
+	if err != nil {
+		return err
+	}
+	if len(done) > 0 {
+		log.Printf("Resuming migration %d (%s), %d holdings already done\n", m.version, m.name, len(done))
+	}
+	journal, err := os.OpenFile(journalFile(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer journal.Close()
+	if len(done) == 0 {
+		if err := journal.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(journal, "version %d\n", m.version); err != nil {
+			return err
+		}
+	}
+
+	count := 0
+	err = walkHoldings(config.LibraryPath, func(uuid string, dir string, legacy bool) error {
+		if done[uuid] {
+			return nil
+		}
+		unlock := lockHolding(strings.ToLower(uuid))
+		defer unlock()
+		needed, err := m.needed(uuid, dir)
+		if err == nil && needed {
+			err = m.apply(uuid, dir)
+			count++
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", uuid, err.Error())
+		}
+		_, err = fmt.Fprintln(journal, uuid)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := writeFormatVersion(m.version); err != nil {
+		return err
+	}
+	log.Printf("Migration %d (%s) done, %d holdings changed\n", m.version, m.name, count)
+	journal.Close()
+	return os.Remove(journalFile())
+}
+
+func runMigrations(pending []migration) error {
+	release, err := beginWrite()
+	if err != nil {
+		return err
+	}
+	defer release()
+	for _, m := range pending {
+		if err := runMigration(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// initFormat is called at startup. It refuses libraries in a newer format,
+// and ones needing required migrations unless AutoMigrate is set; otherwise
+// pending migrations are applied before serving.
+func initFormat() error {
+	pending, err := pendingMigrations()
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	if !config.AutoMigrate {
+		required := []string{}
+		for _, m := range pending {
+			if m.required {
+				required = append(required, m.name)
+			}
+		}
+		if len(required) > 0 {
+			return &migrationsPendingError{required}
+		}
+	}
+	return runMigrations(pending)
+}
+
+// migrationReport counts the holdings each pending migration would change.
+func migrationReport(pending []migration) error {
+	for _, m := range pending {
+		count := 0
+		err := walkHoldings(config.LibraryPath, func(uuid string, dir string, legacy bool) error {
+			needed, err := m.needed(uuid, dir)
+			if err != nil {
+				return fmt.Errorf("%s: %s", uuid, err.Error())
+			}
+			if needed {
+				count++
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		kind := "optional"
+		if m.required {
+			kind = "required"
+		}
+		fmt.Printf("%d %s (%s): %d holdings to change\n", m.version, m.name, kind, count)
+	}
+	return nil
+}
+
+// runMigrate implements "moss migrate [-dry-run]" and returns the process
+// exit status.
+func runMigrate() int {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "Report what would be migrated without changing anything")
+	if err := flags.Parse(flag.Args()[1:]); err != nil {
+		return 2
+	}
+
+	pending, err := pendingMigrations()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "migrate: "+err.Error())
+		return 1
+	}
+	if len(pending) == 0 {
+		fmt.Printf("Library is up to date (format %d)\n", currentFormatVersion)
+		return 0
+	}
+	if *dryRun {
+		if err := migrationReport(pending); err != nil {
+			fmt.Fprintln(os.Stderr, "migrate: "+err.Error())
+			return 1
+		}
+		return 0
+	}
+	if err := initTmpDir(); err != nil {
+		fmt.Fprintln(os.Stderr, "migrate: "+err.Error())
+		return 1
+	}
+	if err := runMigrations(pending); err != nil {
+		fmt.Fprintln(os.Stderr, "migrate: "+err.Error())
+		return 1
+	}
+	fmt.Printf("Library is now in format %d\n", currentFormatVersion)
+	return 0
+}
@@ -0,0 +1,83 @@
+package mosstest
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files with what the tests got")
+
+// Scrubbed replaces the values of volatile fields in golden JSON.
+const Scrubbed = "<scrubbed>"
+
+// AssertGolden compares got, a JSON document, against testdata/NAME.golden,
+// or rewrites that file when the test is run with -update. Both are
+// indented the same way first, and the values of the named fields, such as
+// timestamps, are replaced with Scrubbed wherever they appear.
+func AssertGolden(t testing.TB, name string, got []byte, volatile ...string) {
+	t.Helper()
+	normal, err := NormalizeJSON(got, volatile...)
+	if err != nil {
+		t.Fatalf("%s: %s in %q", name, err, got)
+	}
+	golden := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := os.MkdirAll("testdata", 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(golden, normal, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("%s (run with -update to create it)", err)
+	}
+	if !bytes.Equal(normal, want) {
+		t.Errorf("%s differs from %s:\n got: %s\nwant: %s", name, golden, normal, want)
+	}
+}
+
+// NormalizeJSON indents data with sorted keys, replacing the values of the
+// volatile fields with Scrubbed.
+func NormalizeJSON(data []byte, volatile ...string) ([]byte, error) {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	scrub := map[string]bool{}
+	for _, field := range volatile {
+		scrub[field] = true
+	}
+	var out bytes.Buffer
+	enc := json.NewEncoder(&out)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(scrubJSON(v, scrub)); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func scrubJSON(v interface{}, scrub map[string]bool) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			if scrub[k] {
+				v[k] = Scrubbed
+			} else {
+				v[k] = scrubJSON(item, scrub)
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = scrubJSON(item, scrub)
+		}
+	}
+	return v
+}
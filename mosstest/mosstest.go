@@ -0,0 +1,337 @@
+// Package mosstest starts moss against a throwaway library for tests. A
+// Spec describes the holdings the library should start with, and the
+// server is loaded with them through moss's own API, so the library is laid
+// out exactly as a real one would be.
+//
+// New serves an in-process handler, which is what moss's own tests use, and
+// Start runs a moss binary, for integrations that can't link it in. Either
+// way the Server's Do method makes requests as the admin user, DoAs as any
+// other, and AssertGolden compares JSON responses against golden files.
+package mosstest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Spec is the library a Server starts with.
+type Spec struct {
+	Holdings []Holding
+}
+
+// Holding is one holding of a Spec. An empty UUID gets a random one.
+type Holding struct {
+	UUID   string
+	Tracks []Track
+	// The front album art, and any more images by slot such as "back"
+	AlbumArt []byte
+	Artwork  map[string][]byte
+	// Locked holdings are locked, with force=1, after everything is added
+	Locked bool
+}
+
+// Track is a file under the holding's music directory. Without Contents it
+// is a FLAC of Size bytes; Size 0 makes a small one.
+type Track struct {
+	Name     string
+	Contents []byte
+	Size     int
+}
+
+// Server is a running moss loaded with a Spec.
+type Server struct {
+	URL     string
+	Library string
+	// Admin credentials, used by Do
+	User string
+	Key  string
+	// The holdings of the Spec, with their UUIDs filled in
+	Holdings []Holding
+
+	t      testing.TB
+	client *http.Client
+	cmd    *exec.Cmd
+}
+
+// Response is what a request got back, read in full.
+type Response struct {
+	Status  int
+	Header  http.Header
+	Trailer http.Header
+	Body    []byte
+}
+
+// JSON decodes the body into v, failing the test if it can't.
+func (r *Response) JSON(t testing.TB, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(r.Body, v); err != nil {
+		t.Fatalf("decoding %q: %s", r.Body, err)
+	}
+}
+
+// New serves h on an httptest.Server for the rest of the test and loads spec
+// into it. h must already be configured for library, with user and key as
+// its admin credentials.
+func New(t testing.TB, h http.Handler, library string, user string, key string, spec Spec) *Server {
+	t.Helper()
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+	s := &Server{URL: ts.URL, Library: library, User: user, Key: key, t: t, client: ts.Client()}
+	s.load(spec)
+	return s
+}
+
+// Start runs the moss binary at bin for the rest of the test, with config
+// (the fields of moss's config file) on a fresh library and a free port,
+// and loads spec into it. LibraryPath, Port, ApiUser and ApiKey are filled
+// in unless config sets them.
+func Start(t testing.TB, bin string, config map[string]interface{}, spec Spec) *Server {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := map[string]interface{}{
+		"LibraryPath": filepath.Join(dir, "library"),
+		"ApiUser":     "mosstest",
+		"ApiKey":      "mosstest",
+		"Shards": []map[string]interface{}{{
+			"MinUUID":  "00000000-0000-0000-0000-000000000000",
+			"MaxUUID":  "ffffffff-ffff-ffff-ffff-ffffffffffff",
+			"Writable": true,
+		}},
+	}
+	for k, v := range config {
+		cfg[k] = v
+	}
+	if _, ok := cfg["Port"]; !ok {
+		cfg["Port"] = freePort(t)
+	}
+	library := cfg["LibraryPath"].(string)
+	if err := os.MkdirAll(library, 0755); err != nil {
+		t.Fatal(err)
+	}
+	js, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfgPath := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(cfgPath, js, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	logFile, err := os.Create(filepath.Join(dir, "moss.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(bin, "-config", cfgPath)
+	cmd.Stdout, cmd.Stderr = logFile, logFile
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		logFile.Close()
+		if t.Failed() {
+			if log, err := os.ReadFile(logFile.Name()); err == nil {
+				t.Logf("moss log:\n%s", log)
+			}
+		}
+	})
+
+	s := &Server{
+		URL:     fmt.Sprintf("http://127.0.0.1:%v", cfg["Port"]),
+		Library: library,
+		User:    cfg["ApiUser"].(string),
+		Key:     cfg["ApiKey"].(string),
+		t:       t,
+		client:  &http.Client{Timeout: time.Minute},
+		cmd:     cmd,
+	}
+	s.waitHealthy()
+	s.load(spec)
+	return s
+}
+
+// Kill stops a server from Start the way a crash or kill -9 would, leaving
+// its library as it was at that moment so another Start can pick it up.
+func (s *Server) Kill() {
+	s.t.Helper()
+	if s.cmd == nil {
+		s.t.Fatal("only a server from Start can be killed")
+	}
+	s.cmd.Process.Kill()
+	s.cmd.Wait()
+}
+
+func freePort(t testing.TB) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func (s *Server) waitHealthy() {
+	s.t.Helper()
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		if resp, err := s.client.Get(s.URL + "/healthz"); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	s.t.Fatalf("moss at %s never became healthy", s.URL)
+}
+
+func (s *Server) load(spec Spec) {
+	s.t.Helper()
+	for _, h := range spec.Holdings {
+		if h.UUID == "" {
+			h.UUID = NewUUID()
+		}
+		for _, track := range h.Tracks {
+			body := track.Contents
+			if body == nil {
+				body = FLAC(track.Size)
+			}
+			s.MustDo("PUT", "/"+h.UUID+"/music/"+track.Name, body)
+		}
+		if h.AlbumArt != nil {
+			s.MustDo("PUT", "/"+h.UUID+"/albumart", h.AlbumArt)
+		}
+		for slot, art := range h.Artwork {
+			s.MustDo("PUT", "/"+h.UUID+"/albumart/"+slot, art)
+		}
+		if h.Locked {
+			s.MustDo("PUT", "/"+h.UUID+"/lock?force=1", nil)
+		}
+		s.Holdings = append(s.Holdings, h)
+	}
+}
+
+// Do makes a request as the admin user. Headers are given as name, value
+// pairs.
+func (s *Server) Do(method string, path string, body []byte, header ...string) *Response {
+	s.t.Helper()
+	return s.DoAs(s.User, s.Key, method, path, body, header...)
+}
+
+// DoAs makes a request with the given credentials, or none if user is
+// empty.
+func (s *Server) DoAs(user string, key string, method string, path string, body []byte, header ...string) *Response {
+	s.t.Helper()
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, s.URL+path, r)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	if user != "" {
+		req.SetBasicAuth(user, key)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		s.t.Fatalf("%s %s: %s", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		s.t.Fatalf("%s %s: %s", method, path, err)
+	}
+	return &Response{resp.StatusCode, resp.Header, resp.Trailer, data}
+}
+
+// MustDo is Do that fails the test unless the answer is a 2xx.
+func (s *Server) MustDo(method string, path string, body []byte, header ...string) *Response {
+	s.t.Helper()
+	resp := s.Do(method, path, body, header...)
+	if resp.Status < 200 || resp.Status > 299 {
+		s.t.Fatalf("%s %s: %d %s", method, path, resp.Status, bytes.TrimSpace(resp.Body))
+	}
+	return resp
+}
+
+// NewUUID returns a random version 4 UUID.
+func NewUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// FLAC returns a FLAC stream of size bytes, or a little over 42 for size 0:
+// a STREAMINFO block of 44.1kHz stereo followed by the start of a frame and
+// filler, which is as much as moss looks at.
+func FLAC(size int) []byte {
+	var b bytes.Buffer
+	b.WriteString("fLaC")
+	// Last metadata block, STREAMINFO, 34 bytes long
+	b.Write([]byte{0x80, 0, 0, 34})
+	b.Write(make([]byte, 10))
+	var info [8]byte
+	binary.BigEndian.PutUint64(info[:], 44100<<44|1<<41|15<<36|441000)
+	b.Write(info[:])
+	b.Write(make([]byte, 16))
+	b.Write([]byte{0xff, 0xf8})
+	for b.Len() < size {
+		b.WriteString("audio")
+	}
+	if size > 0 {
+		b.Truncate(size)
+	}
+	return b.Bytes()
+}
+
+// PNG returns a side by side pixel PNG of a single colour, so different
+// shades make different images.
+func PNG(side int, shade uint8) []byte {
+	img := image.NewGray(image.Rect(0, 0, side, side))
+	for i := range img.Pix {
+		img.Pix[i] = shade
+	}
+	img.Set(0, 0, color.Gray{shade ^ 0xff})
+	var b bytes.Buffer
+	if err := png.Encode(&b, img); err != nil {
+		panic(err)
+	}
+	return b.Bytes()
+}
+
+// Path returns a request path for the holding at index i of the Spec, such
+// as Path(0, "music", "01.flac").
+func (s *Server) Path(i int, parts ...string) string {
+	p := "/" + s.Holdings[i].UUID
+	for _, part := range parts {
+		p += "/" + part
+	}
+	if len(parts) == 0 {
+		p += "/"
+	}
+	return p
+}
@@ -0,0 +1,37 @@
+package mosstest
+
+import (
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestStart(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds moss")
+	}
+	bin := filepath.Join(t.TempDir(), "moss")
+	if out, err := exec.Command("go", "build", "-o", bin, "github.com/wuvt/moss").CombinedOutput(); err != nil {
+		t.Fatalf("building moss: %s\n%s", err, out)
+	}
+	s := Start(t, bin, nil, Spec{Holdings: []Holding{{
+		Tracks:   []Track{{Name: "01.flac"}, {Name: "02.flac", Size: 1000}},
+		AlbumArt: PNG(300, 0x80),
+		Locked:   true,
+	}}})
+
+	var holding struct {
+		FileList []string
+		Locked   bool
+	}
+	s.MustDo("GET", s.Path(0), nil).JSON(t, &holding)
+	if len(holding.FileList) != 2 || !holding.Locked {
+		t.Errorf("holding is %+v", holding)
+	}
+	if resp := s.Do("GET", s.Path(0, "music", "02.flac"), nil); len(resp.Body) != 1000 {
+		t.Errorf("02.flac is %d bytes", len(resp.Body))
+	}
+	if resp := s.DoAs("", "", "PUT", s.Path(0, "music", "03.flac"), FLAC(0)); resp.Status != 401 {
+		t.Errorf("unauthenticated upload got %d", resp.Status)
+	}
+}
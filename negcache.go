@@ -0,0 +1,100 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultNegativeCacheTTL = 30
+const defaultNegativeCacheSize = 10000
+
+// Out-of-band holdings (rsync, restores) become visible once the entry
+// expires, so the TTL is capped to keep that delay short.
+const maxNegativeCacheTTL = 300
+
+// negativeCache remembers UUIDs recently found not to exist so repeated
+// lookups for long-gone holdings don't each cost a stat and a log line.
+var negativeCache = struct {
+	sync.Mutex
+	m      map[string]time.Time
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}{m: map[string]time.Time{}}
+
+type NegativeCacheStats struct {
+	Entries int
+	Hits    uint64
+	Misses  uint64
+}
+
+func negativeCacheTTL() time.Duration {
+	return time.Duration(config.NegativeCacheTTL) * time.Second
+}
+
+// knownMissing reports whether uuid is cached as not existing.
+func knownMissing(uuid string) bool {
+	if config.NegativeCacheTTL <= 0 {
+		return false
+	}
+	ok := cachedMissing(uuid)
+	if ok {
+		negativeCache.hits.Add(1)
+	} else {
+		negativeCache.misses.Add(1)
+	}
+	return ok
+}
+
+// cachedMissing is knownMissing without counting a hit or miss, for a
+// look at the cache ahead of the one the handler makes.
+func cachedMissing(uuid string) bool {
+	if config.NegativeCacheTTL <= 0 {
+		return false
+	}
+	negativeCache.Lock()
+	defer negativeCache.Unlock()
+	expires, ok := negativeCache.m[uuid]
+	if ok && time.Now().After(expires) {
+		delete(negativeCache.m, uuid)
+		ok = false
+	}
+	return ok
+}
+
+func rememberMissing(uuid string) {
+	if config.NegativeCacheTTL <= 0 {
+		return
+	}
+	negativeCache.Lock()
+	defer negativeCache.Unlock()
+	now := time.Now()
+	if len(negativeCache.m) >= config.NegativeCacheSize {
+		for key, expires := range negativeCache.m {
+			if now.After(expires) {
+				delete(negativeCache.m, key)
+			}
+		}
+	}
+	// Still full of live entries, so make room with an arbitrary victim
+	for key := range negativeCache.m {
+		if len(negativeCache.m) < config.NegativeCacheSize {
+			break
+		}
+		delete(negativeCache.m, key)
+	}
+	negativeCache.m[uuid] = now.Add(negativeCacheTTL())
+}
+
+func forgetMissing(uuid string) {
+	negativeCache.Lock()
+	delete(negativeCache.m, uuid)
+	negativeCache.Unlock()
+}
+
+func negativeCacheStats() NegativeCacheStats {
+	negativeCache.Lock()
+	entries := len(negativeCache.m)
+	negativeCache.Unlock()
+	return NegativeCacheStats{entries, negativeCache.hits.Load(), negativeCache.misses.Load()}
+}
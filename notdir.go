@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// A botched rsync can leave a regular file where a prefix directory, a
+// holding directory or a holding's music/ should be. Requests that run into
+// one get a 409 with X-Moss-Error-Code: not-a-directory naming the file,
+// rather than a 404 on reads and a raw ENOTDIR on writes, and fsck reports
+// them and can move them into .moss-quarantine/.
+const notADirectoryCode = "not-a-directory"
+const quarantineDirName = ".moss-quarantine"
+
+type notADirectoryError struct {
+	// Relative to the library root
+	path string
+}
+
+func (e *notADirectoryError) Error() string {
+	return fmt.Sprintf("Expected a directory at %s but found a file, which needs to be moved out of the way", e.path)
+}
+
+func libraryRel(p string) string {
+	return strings.TrimPrefix(p, path.Clean(config.LibraryPath)+"/")
+}
+
+// fileInPath returns the first component of p below the library root that
+// exists but isn't a directory, or "" if there is none.
+func fileInPath(p string) string {
+	root := path.Clean(config.LibraryPath)
+	p = path.Clean(p)
+	if !strings.HasPrefix(p, root+"/") {
+		return ""
+	}
+	cur := root
+	for _, part := range strings.Split(strings.TrimPrefix(p, root+"/"), "/") {
+		cur = path.Join(cur, part)
+		stat, err := os.Stat(cur)
+		if err != nil {
+			return ""
+		}
+		if !stat.IsDir() {
+			return cur
+		}
+	}
+	return ""
+}
+
+// checkHoldingPath looks for a file in the way of a holding's directory or
+// its music/, at every place the holding could be.
+func checkHoldingPath(uuid string) *notADirectoryError {
+	candidates := []string{shallowPath(config.LibraryPath, uuid)}
+	if isFannedOut(uuid[0:2]) {
+		candidates = append(candidates, deepPath(config.LibraryPath, uuid))
+	}
+	if config.LegacyLayout {
+		candidates = append(candidates, legacyPath(config.LibraryPath, uuid))
+	}
+	for _, dir := range candidates {
+		if p := fileInPath(path.Join(dir, "music")); p != "" {
+			return &notADirectoryError{libraryRel(p)}
+		}
+	}
+	return nil
+}
+
+// asNotADirectory turns an ENOTDIR from the filesystem, or the EEXIST that
+// os.MkdirAll gives for a file in its way, into a notADirectoryError naming
+// the file.
+func asNotADirectory(err error) (*notADirectoryError, bool) {
+	var perr *os.PathError
+	if errors.As(err, &perr) && perr.Op == "mkdir" && errors.Is(err, syscall.EEXIST) {
+		if p := fileInPath(perr.Path); p != "" {
+			return &notADirectoryError{libraryRel(p)}, true
+		}
+	}
+	if !errors.Is(err, syscall.ENOTDIR) {
+		return nil, false
+	}
+	if errors.As(err, &perr) {
+		if p := fileInPath(perr.Path); p != "" {
+			return &notADirectoryError{libraryRel(p)}, true
+		}
+	}
+	var lerr *os.LinkError
+	if errors.As(err, &lerr) {
+		for _, p := range []string{lerr.New, lerr.Old} {
+			if f := fileInPath(p); f != "" {
+				return &notADirectoryError{libraryRel(f)}, true
+			}
+		}
+	}
+	return nil, false
+}
+
+func notADirectory(w http.ResponseWriter, err *notADirectoryError) {
+	log.Println(err.Error())
+	w.Header().Set(errorCodeHeader, notADirectoryCode)
+	http.Error(w, err.Error(), http.StatusConflict)
+}
+
+// findStrayFiles lists the files, relative to the library root, that sit
+// where the layout expects a directory.
+func findStrayFiles(basepath string) ([]string, error) {
+	stray := []string{}
+	// checkEntry looks at a directory entry named like a holding
+	checkEntry := func(rel string, ent os.DirEntry) {
+		if !ent.IsDir() {
+			stray = append(stray, rel)
+		} else if !isDirOrMissing(path.Join(basepath, rel, "music")) {
+			stray = append(stray, path.Join(rel, "music"))
+		}
+	}
+	dirEnts, err := os.ReadDir(basepath)
+	if err != nil {
+		return nil, err
+	}
+	for _, dirEnt := range dirEnts {
+		name := dirEnt.Name()
+		if uuidSanityCheck(strings.ToLower(name)) == nil {
+			checkEntry(name, dirEnt)
+			continue
+		}
+		if !shardDirPattern.MatchString(name) {
+			continue
+		}
+		if !dirEnt.IsDir() {
+			stray = append(stray, name)
+			continue
+		}
+		prefixEnts, err := os.ReadDir(path.Join(basepath, name))
+		if err != nil {
+			return nil, err
+		}
+		for _, ent := range prefixEnts {
+			rel := path.Join(name, ent.Name())
+			if uuidSanityCheck(strings.ToLower(ent.Name())) == nil {
+				checkEntry(rel, ent)
+				continue
+			}
+			if !isSubPrefix(ent.Name()) {
+				continue
+			}
+			if !ent.IsDir() {
+				stray = append(stray, rel)
+				continue
+			}
+			subEnts, err := os.ReadDir(path.Join(basepath, rel))
+			if err != nil {
+				return nil, err
+			}
+			for _, sub := range subEnts {
+				if uuidSanityCheck(strings.ToLower(sub.Name())) == nil {
+					checkEntry(path.Join(rel, sub.Name()), sub)
+				}
+			}
+		}
+	}
+	return stray, nil
+}
+
+func isDirOrMissing(p string) bool {
+	stat, err := os.Stat(p)
+	return err != nil || stat.IsDir()
+}
+
+// quarantineStrayFiles moves stray files into .moss-quarantine/TIMESTAMP/,
+// keeping their paths, and returns where they went.
+func quarantineStrayFiles(stray []string) (string, error) {
+	dest := path.Join(config.LibraryPath, quarantineDirName, time.Now().UTC().Format("20060102T150405Z"))
+	for _, rel := range stray {
+		target := path.Join(dest, rel)
+		if err := os.MkdirAll(path.Dir(target), 0755); err != nil {
+			return dest, err
+		}
+		if err := os.Rename(path.Join(config.LibraryPath, rel), target); err != nil {
+			return dest, err
+		}
+	}
+	return dest, nil
+}
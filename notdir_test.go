@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/wuvt/moss/mosstest"
+)
+
+// uuidWithPrefix returns a fresh UUID under a two-hex prefix no other UUID of
+// the test uses.
+func uuidWithPrefix(prefix string) string {
+	return prefix + mosstest.NewUUID()[2:]
+}
+
+func TestFileInPlaceOfDirectory(t *testing.T) {
+	s := newTestServer(t, mosstest.Spec{})
+	holdingFile := uuidWithPrefix("a1")
+	prefixFile := uuidWithPrefix("a2")
+	musicFile := uuidWithPrefix("a3")
+	writeTestFile(t, shallowPath(config.LibraryPath, holdingFile), []byte("rsync"))
+	writeTestFile(t, path.Join(config.LibraryPath, "a2"), []byte("rsync"))
+	writeTestFile(t, path.Join(shallowPath(config.LibraryPath, musicFile), "music"), []byte("rsync"))
+
+	for uuid, stray := range map[string]string{
+		holdingFile: path.Join("a1", holdingFile),
+		prefixFile:  "a2",
+		musicFile:   path.Join("a3", musicFile, "music"),
+	} {
+		for _, c := range []struct {
+			method, path string
+			body         []byte
+		}{
+			{"GET", "/" + uuid + "/", nil},
+			{"HEAD", "/" + uuid + "/music/01.flac", nil},
+			{"GET", "/" + uuid + "/archive", nil},
+			{"PUT", "/" + uuid + "/music/01.flac", mosstest.FLAC(0)},
+			{"PUT", "/" + uuid + "/albumart", mosstest.PNG(8, 0)},
+			{"PUT", "/" + uuid + "/lock", nil},
+			{"DELETE", "/" + uuid, nil},
+		} {
+			resp := s.Do(c.method, c.path, c.body)
+			if resp.Status != http.StatusConflict || resp.Header.Get(errorCodeHeader) != notADirectoryCode {
+				t.Errorf("%s %s got %d %s", c.method, c.path, resp.Status, resp.Body)
+			}
+			if c.method != "HEAD" && !strings.Contains(string(resp.Body), stray) {
+				t.Errorf("%s %s didn't name %s: %s", c.method, c.path, stray, resp.Body)
+			}
+		}
+	}
+
+	stray, err := findStrayFiles(config.LibraryPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(stray)
+	want := []string{"a1/" + holdingFile, "a2", "a3/" + musicFile + "/music"}
+	if len(stray) != len(want) || stray[0] != want[0] || stray[1] != want[1] || stray[2] != want[2] {
+		t.Errorf("fsck found %v, want %v", stray, want)
+	}
+	dest, err := quarantineStrayFiles(stray)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rel := range want {
+		if _, err := os.Stat(path.Join(dest, rel)); err != nil {
+			t.Error(err)
+		}
+	}
+	// With them out of the way the holdings are just missing, or empty
+	if resp := s.Do("GET", "/"+holdingFile+"/", nil); resp.Status != http.StatusNotFound {
+		t.Errorf("quarantined holding got %d %s", resp.Status, resp.Body)
+	}
+	s.MustDo("PUT", "/"+prefixFile+"/music/01.flac", mosstest.FLAC(0))
+}
+
+func TestFileInPlaceOfMissingHolding(t *testing.T) {
+	s := newTestServer(t, mosstest.Spec{})
+	uuid := uuidWithPrefix("b1")
+	if resp := s.Do("GET", "/"+uuid+"/", nil); resp.Status != http.StatusNotFound {
+		t.Fatalf("missing holding got %d", resp.Status)
+	}
+
+	// Reads of a holding the negative cache knows is missing are answered
+	// from it, counted once, without looking for what's in its way
+	writeTestFile(t, shallowPath(config.LibraryPath, uuid), []byte("rsync"))
+	before := negativeCacheStats()
+	if resp := s.Do("GET", "/"+uuid+"/", nil); resp.Status != http.StatusNotFound {
+		t.Errorf("cached missing holding got %d %s", resp.Status, resp.Body)
+	}
+	if after := negativeCacheStats(); after.Hits != before.Hits+1 || after.Misses != before.Misses {
+		t.Errorf("one cached read counted %d hits and %d misses", after.Hits-before.Hits, after.Misses-before.Misses)
+	}
+
+	// A write still runs into it
+	resp := s.Do("PUT", "/"+uuid+"/music/01.flac", mosstest.FLAC(0))
+	if resp.Status != http.StatusConflict || resp.Header.Get(errorCodeHeader) != notADirectoryCode {
+		t.Errorf("upload got %d %s", resp.Status, resp.Body)
+	}
+
+	// And once the entry is gone, so do reads
+	forgetMissing(uuid)
+	if resp := s.Do("GET", "/"+uuid+"/", nil); resp.Status != http.StatusConflict {
+		t.Errorf("uncached read got %d %s", resp.Status, resp.Body)
+	}
+}
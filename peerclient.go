@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const defaultPeerRetries = 5
+const defaultPeerFailureThreshold = 5
+
+const peerRetryBase = 500 * time.Millisecond
+const peerRetryCap = 30 * time.Second
+const peerProbeInterval = 30 * time.Second
+const peerMaxRedirects = 5
+
+type peerUnavailableError struct {
+	peer string
+}
+
+func (e *peerUnavailableError) Error() string {
+	return fmt.Sprintf("Peer %s is marked unhealthy, skipping", e.peer)
+}
+
+// PeerHealth tracks consecutive failures per peer. Once a peer reaches
+// PeerFailureThreshold it is skipped until a background probe of its /version
+// succeeds again.
+type PeerHealth struct {
+	Name                string
+	Healthy             bool
+	ConsecutiveFailures int
+	Requests            uint64
+	Retries             uint64
+	Failures            uint64
+	LastError           string     `json:",omitempty"`
+	UnhealthySince      *Timestamp `json:",omitempty"`
+}
+
+var peerStates = struct {
+	sync.Mutex
+	m map[string]*PeerHealth
+}{m: map[string]*PeerHealth{}}
+
+func peerState(name string) *PeerHealth {
+	state, ok := peerStates.m[name]
+	if !ok {
+		state = &PeerHealth{Name: name, Healthy: true}
+		peerStates.m[name] = state
+	}
+	return state
+}
+
+func peerHealthy(name string) bool {
+	peerStates.Lock()
+	defer peerStates.Unlock()
+	return peerState(name).Healthy
+}
+
+func countPeerRetry(name string) {
+	peerStates.Lock()
+	defer peerStates.Unlock()
+	peerState(name).Retries++
+}
+
+func recordPeerResult(peer Peer, err error) {
+	peerStates.Lock()
+	defer peerStates.Unlock()
+	state := peerState(peer.Name)
+	state.Requests++
+	if err == nil {
+		state.ConsecutiveFailures = 0
+		return
+	}
+	state.Failures++
+	state.ConsecutiveFailures++
+	state.LastError = err.Error()
+	if state.Healthy && state.ConsecutiveFailures >= config.PeerFailureThreshold {
+		state.Healthy = false
+		now := stamp(time.Now())
+		state.UnhealthySince = &now
+		log.Printf("ALERT: peer %s marked unhealthy after %d consecutive failures: %s\n", peer.Name, state.ConsecutiveFailures, err.Error())
+		go probePeer(peer)
+	}
+}
+
+// probePeer polls an unhealthy peer until it answers /version again.
+func probePeer(peer Peer) {
+	for {
+		time.Sleep(peerProbeInterval)
+		req, err := http.NewRequest("GET", peerURL(peer, "version"), nil)
+		if err != nil {
+			return
+		}
+		resp, err := peerClient.Do(req)
+		if err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				break
+			}
+		}
+	}
+
+	peerStates.Lock()
+	state := peerState(peer.Name)
+	state.Healthy = true
+	state.ConsecutiveFailures = 0
+	state.UnhealthySince = nil
+	peerStates.Unlock()
+	log.Printf("Peer %s is healthy again\n", peer.Name)
+}
+
+func peerStats() []PeerHealth {
+	peerStates.Lock()
+	defer peerStates.Unlock()
+	list := []PeerHealth{}
+	for _, peer := range config.Peers {
+		list = append(list, *peerState(peer.Name))
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+func idempotentMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "PUT", "DELETE", "OPTIONS":
+		return true
+	}
+	return false
+}
+
+type idempotentKey struct{}
+
+// checkPeerRedirect only follows redirects for requests that are safe to
+// repeat against another URL; anything else gets the redirect back as is.
+func checkPeerRedirect(req *http.Request, via []*http.Request) error {
+	if idempotent, _ := via[0].Context().Value(idempotentKey{}).(bool); !idempotent {
+		return http.ErrUseLastResponse
+	}
+	if len(via) >= peerMaxRedirects {
+		return errors.New("stopped after too many redirects")
+	}
+	return nil
+}
+
+// retryDelay is capped exponential backoff with full jitter.
+func retryDelay(attempt int) time.Duration {
+	d := peerRetryBase << uint(attempt)
+	if d <= 0 || d > peerRetryCap {
+		d = peerRetryCap
+	}
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+// doPeerRequest sends a request built by newReq, retrying connection errors
+// and 5xx responses when the request is idempotent. newReq is called for each
+// attempt so the body can be reopened.
+func doPeerRequest(peer Peer, idempotent bool, newReq func() (*http.Request, error)) (*http.Response, error) {
+	if !peerHealthy(peer.Name) {
+		return nil, &peerUnavailableError{peer.Name}
+	}
+
+	attempts := 1
+	if idempotent {
+		attempts += config.PeerRetries
+	}
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			countPeerRetry(peer.Name)
+			time.Sleep(retryDelay(attempt - 1))
+		}
+		req, err := newReq()
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(context.WithValue(req.Context(), idempotentKey{}, idempotent))
+		resp, err := peerClient.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode >= 500 {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			lastErr = &peerError{peer.Name, fmt.Sprintf("%s %s returned %s", req.Method, req.URL.Path, resp.Status)}
+			continue
+		}
+		recordPeerResult(peer, nil)
+		return resp, nil
+	}
+	recordPeerResult(peer, lastErr)
+	return nil, lastErr
+}
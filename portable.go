@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// PortableNames policies. Names that Windows can't store (and ':' which the
+// macOS Finder shows as '/') are either refused or rewritten at upload time.
+const (
+	portableNamesOff      = ""
+	portableNamesReject   = "reject"
+	portableNamesSanitize = "sanitize"
+)
+
+const nonPortableChars = `<>:"\|?*`
+
+var reservedDeviceNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+type nonPortableNameError struct {
+	name    string
+	problem string
+}
+
+func (e *nonPortableNameError) Error() string {
+	return fmt.Sprintf("%s is not a portable filename: %s", e.name, e.problem)
+}
+
+type portableNamesPolicyError struct {
+	policy string
+}
+
+func (e *portableNamesPolicyError) Error() string {
+	return fmt.Sprintf("unknown policy %q, must be %q or %q", e.policy, portableNamesReject, portableNamesSanitize)
+}
+
+func validatePortableNames(policy string) error {
+	switch policy {
+	case portableNamesOff, portableNamesReject, portableNamesSanitize:
+		return nil
+	}
+	return &portableNamesPolicyError{policy}
+}
+
+// portableProblem describes why a single path element can't be stored on
+// Windows, or returns "" if it can.
+func portableProblem(name string) string {
+	for _, c := range name {
+		if c < 0x20 {
+			return "contains a control character"
+		}
+		if strings.ContainsRune(nonPortableChars, c) {
+			return fmt.Sprintf("contains %q", c)
+		}
+	}
+	if strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+		return "ends with a dot or space"
+	}
+	base := strings.ToUpper(strings.SplitN(name, ".", 2)[0])
+	if reservedDeviceNames[strings.TrimRight(base, " ")] {
+		return "is a reserved device name"
+	}
+	return ""
+}
+
+// sanitizeName applies the documented mapping to one path element:
+// forbidden and control characters become '_', trailing dots and spaces are
+// dropped, and '_' is appended to a reserved device name ("CON.flac" becomes
+// "CON_.flac").
+func sanitizeName(name string) string {
+	var b strings.Builder
+	for _, c := range name {
+		if c < 0x20 || strings.ContainsRune(nonPortableChars, c) {
+			b.WriteRune('_')
+		} else {
+			b.WriteRune(c)
+		}
+	}
+	name = strings.TrimRight(b.String(), ". ")
+	if name == "" {
+		return "_"
+	}
+	parts := strings.SplitN(name, ".", 2)
+	if reservedDeviceNames[strings.ToUpper(strings.TrimRight(parts[0], " "))] {
+		parts[0] = strings.TrimRight(parts[0], " ") + "_"
+	}
+	return strings.Join(parts, ".")
+}
+
+func portablePath(rel string) (string, error) {
+	elements := strings.Split(rel, "/")
+	for i, element := range elements {
+		// Empty elements and dot segments are ensureSafePath's problem
+		if element == "" || element == "." || element == ".." {
+			continue
+		}
+		if problem := portableProblem(element); problem != "" {
+			if config.PortableNames == portableNamesReject {
+				return "", &nonPortableNameError{element, problem}
+			}
+			elements[i] = sanitizeName(element)
+		}
+	}
+	return path.Join(elements...), nil
+}
+
+// applyPortableNames checks a requested path under music/ against the
+// PortableNames policy and returns the name it should be stored under.
+func applyPortableNames(rel string) (string, error) {
+	if config.PortableNames == portableNamesOff {
+		return rel, nil
+	}
+	return portablePath(rel)
+}
+
+// findNonPortableNames maps every non-portable file and directory name
+// under root to its suggested sanitized rename.
+func findNonPortableNames(root string) (map[string]string, error) {
+	found := map[string]string{}
+	err := walkFiles(root, func(rel string) error {
+		elements := strings.Split(rel, "/")
+		suggested := []string{}
+		for i, element := range elements {
+			if portableProblem(element) == "" {
+				suggested = append(suggested, element)
+				continue
+			}
+			suggested = append(suggested, sanitizeName(element))
+			found[strings.Join(elements[:i+1], "/")] = strings.Join(suggested, "/")
+		}
+		return nil
+	})
+	return found, err
+}
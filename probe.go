@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// musicFileStat stats a file under the holding's music directory without
+// opening it, confining rel to that directory the same way http.Dir does.
+func musicFileStat(uuidDir string, rel string) (os.FileInfo, error) {
+	return os.Stat(path.Join(uuidDir, "music", path.Clean("/"+rel)))
+}
+
+// filesOnly is an http.FileSystem that won't open directories, so a file
+// server over it never answers with an index page.
+type filesOnly struct {
+	http.FileSystem
+}
+
+func (fs filesOnly) Open(name string) (http.File, error) {
+	f, err := fs.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if stat, err := f.Stat(); err != nil || stat.IsDir() {
+		f.Close()
+		return nil, os.ErrNotExist
+	}
+	return f, nil
+}
+
+func fileETag(stat os.FileInfo) string {
+	return fmt.Sprintf("\"%x-%x\"", stat.Size(), stat.ModTime().UnixNano())
+}
+
+// etagMatches reports whether an If-None-Match header lists etag.
+func etagMatches(inm string, etag string) bool {
+	for _, candidate := range strings.Split(inm, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// newestModTime returns the latest modification time of dir or anything in
+// it.
+func newestModTime(dir string) time.Time {
+	var newest time.Time
+	filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+		return nil
+	})
+	return newest
+}
+
+// serveListing writes a JSON listing with an ETag hashed from it, so that
+// pollers get a 304 until something in it changes. A non-zero modified also
+// sets Last-Modified, for If-Modified-Since without If-None-Match.
+func serveListing(w http.ResponseWriter, r *http.Request, js []byte, modified time.Time) {
+	etag := fmt.Sprintf("\"%x\"", sha256.Sum256(js))
+	w.Header().Set("ETag", etag)
+	// A client can still revalidate the copy it has, but no cache between
+	// may hand out a stale one
+	w.Header().Set("Cache-Control", "no-store")
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if etagMatches(inm, etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	} else if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modified.IsZero() && !modified.Truncate(time.Second).After(ims) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	// Set here so HEAD gets it however long the listing is
+	w.Header().Set("Content-Length", strconv.Itoa(len(js)))
+	w.Write(js)
+}
+
+// Types for the audio formats stations use, which the system's MIME tables
+// often get wrong or lack. Web players won't stream octet-stream. Config
+// ContentTypes adds to and overrides these.
+var contentTypes = map[string]string{
+	".flac": "audio/flac",
+	".mp3":  "audio/mpeg",
+	".ogg":  "audio/ogg",
+	".opus": "audio/opus",
+	".m4a":  "audio/mp4",
+	".wav":  "audio/wav",
+	".aif":  "audio/aiff",
+	".aiff": "audio/aiff",
+}
+
+type contentTypeError struct {
+	ext   string
+	ctype string
+}
+
+func (e *contentTypeError) Error() string {
+	return fmt.Sprintf("ContentTypes: %q => %q needs an extension starting with . and a valid media type", e.ext, e.ctype)
+}
+
+// initContentTypes merges ContentTypes into the table.
+func initContentTypes() error {
+	for ext, ctype := range config.ContentTypes {
+		if _, _, err := mime.ParseMediaType(ctype); err != nil || !strings.HasPrefix(ext, ".") || len(ext) < 2 {
+			return &contentTypeError{ext, ctype}
+		}
+		contentTypes[strings.ToLower(ext)] = ctype
+	}
+	return nil
+}
+
+func contentTypeByName(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	if ctype, ok := contentTypes[ext]; ok {
+		return ctype
+	}
+	if ctype := mime.TypeByExtension(ext); ctype != "" {
+		return ctype
+	}
+	return "application/octet-stream"
+}
+
+// parseSingleRange understands a single "bytes=start-end" range, which is all
+// a size probe needs. Anything else is answered as if no range was sent.
+func parseSingleRange(header string, size int64) (int64, int64, bool) {
+	if !strings.HasPrefix(header, "bytes=") || strings.Contains(header, ",") {
+		return 0, 0, false
+	}
+	spec := strings.SplitN(strings.TrimPrefix(header, "bytes="), "-", 2)
+	if len(spec) != 2 {
+		return 0, 0, false
+	}
+	if spec[0] == "" {
+		n, err := strconv.ParseInt(spec[1], 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, true
+	}
+	start, err := strconv.ParseInt(spec[0], 10, 64)
+	if err != nil || start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if spec[1] != "" {
+		end, err = strconv.ParseInt(spec[1], 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end, true
+}
+
+// headMusicFile answers HEAD from the file's metadata alone, so probing a file
+// never has to open it.
+func headMusicFile(w http.ResponseWriter, r *http.Request, stat os.FileInfo, name string) {
+	etag := fileETag(stat)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", stat.ModTime().UTC().Format(http.TimeFormat))
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Type", contentTypeByName(name))
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" && (inm == etag || inm == "*") {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !stat.ModTime().Truncate(time.Second).After(ims) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if start, end, ok := parseSingleRange(r.Header.Get("Range"), stat.Size()); ok {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, stat.Size()))
+		w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+		w.WriteHeader(http.StatusPartialContent)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(stat.Size(), 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+type FileSize struct {
+	Path    string
+	Size    int64
+	ModTime Timestamp
+	ETag    string
+	Missing bool `json:",omitempty"`
+
+	// Bytes allocated on disk, which is less than Size for sparse files
+	PhysicalSize int64
+	Sparse       bool `json:",omitempty"`
+
+	Checksums map[string]string `json:",omitempty"`
+}
+
+func sizesHandler(w http.ResponseWriter, r *http.Request, uuid string) {
+	err := uuidSanityCheck(uuid)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	uuidDir := holdingDir(uuid)
+	if !dirExists(uuidDir) {
+		http.Error(w, "holding not found on disk", http.StatusNotFound)
+		log.Println("Holding not found: " + uuid)
+		return
+	}
+
+	body, ok := readUpload(w, r)
+	if !ok {
+		return
+	}
+	paths := []string{}
+	if err := json.Unmarshal(body, &paths); err != nil {
+		http.Error(w, "Expected a JSON array of paths: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(paths) > config.Limits.MaxHoldingFiles {
+		berr := &batchTooLargeError{len(paths), config.Limits.MaxHoldingFiles}
+		http.Error(w, berr.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	stored, err := readChecksums(uuidDir)
+	if err != nil {
+		log.Println(err.Error())
+	}
+	sizes := []FileSize{}
+	for _, p := range paths {
+		stat, err := musicFileStat(uuidDir, p)
+		if err != nil || stat.IsDir() {
+			sizes = append(sizes, FileSize{Path: p, Missing: true})
+			continue
+		}
+		sums := stored.Music[checksumKey(p)]
+		if sums == nil && stat.Size() == 0 {
+			sums = emptyChecksums()
+		}
+		sizes = append(sizes, FileSize{p, stat.Size(), stamp(stat.ModTime()), fileETag(stat), false, physicalSize(stat), isSparse(stat), sums})
+	}
+
+	js, err := json.Marshal(sizes)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/wuvt/moss/mosstest"
+)
+
+func TestEtagMatches(t *testing.T) {
+	for _, c := range []struct {
+		inm  string
+		want bool
+	}{
+		{`"abc"`, true},
+		{`W/"abc"`, true},
+		{`"xyz", "abc"`, true},
+		{`*`, true},
+		{`"xyz"`, false},
+		{`abc`, false},
+		{`"abcd"`, false},
+	} {
+		if got := etagMatches(c.inm, `"abc"`); got != c.want {
+			t.Errorf("etagMatches(%q) = %t", c.inm, got)
+		}
+	}
+}
+
+// A poller sending back the ETag it got is answered 304 until an upload
+// changes the listing, and then gets the new listing and a new ETag.
+func TestListingNotModified(t *testing.T) {
+	s := newTestServer(t, mosstest.Spec{Holdings: []mosstest.Holding{{Tracks: []mosstest.Track{{Name: "01.flac"}}}}})
+	for _, c := range []struct {
+		name   string
+		path   string
+		upload string
+	}{
+		{"library", "/", "/" + mosstest.NewUUID() + "/music/01.flac"},
+		{"holding", s.Path(0), s.Path(0, "music", "02.flac")},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			first := s.MustDo("GET", c.path, nil)
+			etag := first.Header.Get("ETag")
+			if etag == "" {
+				t.Fatalf("GET %s sent no ETag", c.path)
+			}
+
+			resp := s.Do("GET", c.path, nil, "If-None-Match", etag)
+			if resp.Status != http.StatusNotModified || len(resp.Body) > 0 {
+				t.Errorf("the same ETag got %d %q", resp.Status, resp.Body)
+			}
+			if resp.Header.Get("ETag") != etag {
+				t.Errorf("the 304 has ETag %s, not %s", resp.Header.Get("ETag"), etag)
+			}
+			if resp := s.Do("GET", c.path, nil, "If-None-Match", `"something-else"`); resp.Status != http.StatusOK || string(resp.Body) != string(first.Body) {
+				t.Errorf("another ETag got %d", resp.Status)
+			}
+
+			s.MustDo("PUT", c.upload, mosstest.FLAC(0))
+			resp = s.Do("GET", c.path, nil, "If-None-Match", etag)
+			if resp.Status != http.StatusOK || string(resp.Body) == string(first.Body) {
+				t.Fatalf("after an upload the old ETag got %d %s", resp.Status, resp.Body)
+			}
+			if changed := resp.Header.Get("ETag"); changed == "" || changed == etag {
+				t.Errorf("after an upload the ETag is %s", changed)
+			}
+			if resp := s.Do("GET", c.path, nil, "If-None-Match", resp.Header.Get("ETag")); resp.Status != http.StatusNotModified {
+				t.Errorf("the new ETag got %d", resp.Status)
+			}
+		})
+	}
+
+	// The holding also goes by its newest mtime when there's no ETag to go by
+	resp := s.MustDo("GET", s.Path(0), nil)
+	modified := resp.Header.Get("Last-Modified")
+	if modified == "" {
+		t.Fatal("GET /UUID4/ sent no Last-Modified")
+	}
+	if resp := s.Do("GET", s.Path(0), nil, "If-Modified-Since", modified); resp.Status != http.StatusNotModified {
+		t.Errorf("If-Modified-Since its Last-Modified got %d", resp.Status)
+	}
+	if resp := s.Do("GET", s.Path(0), nil, "If-Modified-Since", "Mon, 02 Jan 2006 15:04:05 GMT"); resp.Status != http.StatusOK {
+		t.Errorf("If-Modified-Since long ago got %d", resp.Status)
+	}
+	if resp := s.Do("GET", s.Path(0), nil, "If-None-Match", `"something-else"`, "If-Modified-Since", modified); resp.Status != http.StatusOK {
+		t.Errorf("If-None-Match that doesn't match got %d despite If-Modified-Since", resp.Status)
+	}
+}
+
+// Multi-disc holdings keep each disc in its own directory, which is served
+// file by file, with ranges, and never as an index page.
+func TestDiscDirectories(t *testing.T) {
+	s := newTestServer(t, mosstest.Spec{Holdings: []mosstest.Holding{{Tracks: []mosstest.Track{
+		{Name: "CD1/01 One.flac", Size: 1000},
+		{Name: "CD1/02 Two.flac"},
+		{Name: "CD2/01 Three.flac", Contents: taggedFLAC("TITLE=Three")},
+		{Name: "CD2/Bonus/01 Four.flac"},
+	}}}})
+
+	var holding Holding
+	s.MustDo("GET", s.Path(0), nil).JSON(t, &holding)
+	want := []string{"CD1/01 One.flac", "CD1/02 Two.flac", "CD2/01 Three.flac", "CD2/Bonus/01 Four.flac"}
+	if strings.Join(holding.FileList, "|") != strings.Join(want, "|") {
+		t.Errorf("the holding lists %q", holding.FileList)
+	}
+
+	resp := s.MustDo("GET", s.Path(0, "music", "CD2", "01%20Three.flac"), nil)
+	if string(resp.Body) != string(taggedFLAC("TITLE=Three")) {
+		t.Errorf("CD2/01 Three.flac came back as %d other bytes", len(resp.Body))
+	}
+	resp = s.Do("GET", s.Path(0, "music", "CD1", "01%20One.flac"), nil, "Range", "bytes=100-199")
+	if resp.Status != http.StatusPartialContent || len(resp.Body) != 100 || resp.Header.Get("Content-Range") != "bytes 100-199/1000" {
+		t.Errorf("a range of CD1/01 One.flac got %d %s with %d bytes", resp.Status, resp.Header.Get("Content-Range"), len(resp.Body))
+	}
+	s.MustDo("HEAD", s.Path(0, "music", "CD2", "Bonus", "01%20Four.flac"), nil)
+
+	for _, p := range []string{
+		"CD1", "CD1/", "CD2/", "CD2/Bonus", "CD2/Bonus/",
+		"CD1/index.html", "CD1/01%20One.flac/", "CD3/", "CD3/01.flac",
+	} {
+		for _, method := range []string{"GET", "HEAD"} {
+			resp := s.Do(method, s.Path(0, "music")+"/"+p, nil)
+			if resp.Status != http.StatusNotFound {
+				t.Errorf("%s music/%s got %d %s", method, p, resp.Status, resp.Body)
+			}
+			if strings.Contains(string(resp.Body), "<a href") || strings.Contains(resp.Header.Get("Content-Type"), "html") {
+				t.Errorf("%s music/%s got an index page: %s", method, p, resp.Body)
+			}
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Every file in a holding has a provenance record in provenance.json, keyed
+// by its path in the holding as in the lock manifest: music/TRACK, albumart,
+// albumart-master and artwork/SLOT. It says how the file got there, when,
+// and who sent it from which address with what client. Replicas, restores
+// and repairs also keep the record of the first copy as Origin, so a file
+// can be traced back to whoever ripped it however many times it was copied.
+// Locks copy each file's record into the manifest. Files written before
+// provenance was recorded read as unknown rather than failing.
+const (
+	provenanceUpload      = "upload"
+	provenanceTxn         = "transaction"
+	provenanceBatchArt    = "batch-art"
+	provenanceExtracted   = "extracted"
+	provenanceReplicated  = "replicated"
+	provenanceRestored    = "restored"
+	provenanceRepaired    = "repaired"
+	provenanceUnknown     = "unknown"
+	provenanceUnknownNote = "pre-provenance"
+)
+
+// Sent by replication with the record of the file being pushed
+const provenanceHeader = "X-Moss-Provenance"
+
+type Provenance struct {
+	// upload, transaction, batch-art, extracted, replicated, restored,
+	// repaired, or unknown for files from before provenance was recorded
+	Source string
+	// When the file was received; unset when unknown
+	At     *Timestamp `json:",omitempty"`
+	User   string     `json:",omitempty"`
+	IP     string     `json:",omitempty"`
+	Client string     `json:",omitempty"`
+	// The name it was sent under, when it's stored as another: a track
+	// renamed by portable names, or the entry of an album art batch
+	RequestedName string `json:",omitempty"`
+	// The peer it was replicated or repaired from, the archive it was
+	// restored from, or the track its art was extracted from
+	From string `json:",omitempty"`
+	// For copies, the record of the first copy, where known
+	Origin *Provenance `json:",omitempty"`
+	Note   string      `json:",omitempty"`
+}
+
+func unknownProvenance() Provenance {
+	return Provenance{Source: provenanceUnknown, Note: provenanceUnknownNote}
+}
+
+// requestProvenance makes the record of a file sent in r. Files pushed by
+// a peer's replication are recorded as replicated, with the record the peer
+// sent along as their origin.
+func requestProvenance(r *http.Request, source string) Provenance {
+	user, _, _ := r.BasicAuth()
+	now := stamp(time.Now())
+	p := Provenance{Source: source, At: &now, User: user, IP: clientIP(r), Client: r.Header.Get("X-Moss-Client")}
+	if p.Client == "" {
+		p.Client = r.UserAgent()
+	}
+	if from := r.Header.Get(replicationHeader); from != "" && isAdmin(r) {
+		p.Source = provenanceReplicated
+		if from != "1" {
+			p.From = from
+		}
+		var sent Provenance
+		if err := json.Unmarshal([]byte(r.Header.Get(provenanceHeader)), &sent); err == nil && sent.Source != "" {
+			p.Origin = originOf(sent)
+		}
+	}
+	return p
+}
+
+// copyProvenance makes the record of a copy of a file whose own record was
+// p, such as a restore or a repair.
+func copyProvenance(source string, from string, p Provenance) Provenance {
+	now := stamp(time.Now())
+	return Provenance{Source: source, At: &now, From: from, Origin: originOf(p)}
+}
+
+// originOf returns the record of the first copy of a file whose record is
+// p, or nil when that isn't known.
+func originOf(p Provenance) *Provenance {
+	if p.Origin != nil {
+		return p.Origin
+	} else if p.Source == provenanceUnknown || p.Source == "" {
+		return nil
+	}
+	return &p
+}
+
+func readProvenance(dir string) (map[string]Provenance, error) {
+	records := map[string]Provenance{}
+	data, err := ioutil.ReadFile(path.Join(dir, provenanceFileName))
+	if os.IsNotExist(err) {
+		return records, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &records)
+	return records, err
+}
+
+func writeProvenance(dir string, records map[string]Provenance) error {
+	js, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path.Join(dir, provenanceFileName), js)
+}
+
+// recordProvenance keeps or, for nil p, forgets the record of the file at
+// rel in the holding. The caller must hold the holding's mutex.
+func recordProvenance(dir string, rel string, p *Provenance) error {
+	records, err := readProvenance(dir)
+	if err != nil {
+		return err
+	}
+	if p == nil {
+		if _, ok := records[rel]; !ok {
+			return nil
+		}
+		delete(records, rel)
+	} else {
+		records[rel] = *p
+	}
+	return writeProvenance(dir, records)
+}
+
+// fileProvenance looks up the record of rel, which reads as unknown for
+// files from before provenance was recorded.
+func fileProvenance(records map[string]Provenance, rel string) Provenance {
+	if p, ok := records[rel]; ok {
+		return p
+	}
+	return unknownProvenance()
+}
+
+// holdingProvenance returns the record of every file the holding has.
+func holdingProvenance(dir string) (map[string]Provenance, error) {
+	records, err := readProvenance(dir)
+	if err != nil {
+		return nil, err
+	}
+	all := map[string]Provenance{}
+	err = walkFiles(path.Join(dir, "music"), func(rel string) error {
+		all[path.Join("music", rel)] = fileProvenance(records, path.Join("music", rel))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, rel := range []string{"albumart", masterArtFileName} {
+		if _, err := os.Stat(path.Join(dir, rel)); err == nil {
+			all[rel] = fileProvenance(records, rel)
+		}
+	}
+	for _, slot := range artworkSlots(dir) {
+		rel := path.Join(artworkDirName, slot)
+		if _, err := os.Stat(path.Join(dir, rel)); err == nil {
+			all[rel] = fileProvenance(records, rel)
+		}
+	}
+	return all, nil
+}
+
+// provenanceHandler handles GET /UUID4/provenance, which is only for admins
+// as it names users and their addresses.
+func provenanceHandler(w http.ResponseWriter, r *http.Request, uuid string) {
+	if err := uuidSanityCheck(uuid); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !isAdmin(r) {
+		http.Error(w, "Provenance is only shown to admins", http.StatusForbidden)
+		return
+	}
+	dir := holdingDir(uuid)
+	if !dirExists(dir) {
+		http.Error(w, "holding not found on disk", http.StatusNotFound)
+		return
+	}
+	records, err := holdingProvenance(dir)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	js, err := json.Marshal(records)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// trackProvenance makes the record of a track sent to /UUID4/music/NAME and
+// stored as storedName.
+func trackProvenance(r *http.Request, source string, params []string, storedName string) Provenance {
+	p := requestProvenance(r, source)
+	if requested := strings.Join(params[2:], "/"); requested != storedName {
+		p.RequestedName = requested
+	}
+	return p
+}
+
+// restoredProvenance records that the holding's music and album art were
+// restored from location, keeping what's known of where each first came
+// from. The caller must hold the holding's mutex.
+func restoredProvenance(dir string, location string) error {
+	records, err := readProvenance(dir)
+	if err != nil {
+		return err
+	}
+	present, err := holdingProvenance(dir)
+	if err != nil {
+		return err
+	}
+	for rel, p := range present {
+		if rel == "albumart" || strings.HasPrefix(rel, "music/") {
+			records[rel] = copyProvenance(provenanceRestored, location, p)
+		}
+	}
+	return writeProvenance(dir, records)
+}
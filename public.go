@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultPublicRateLimit = 10
+
+var publicLog *log.Logger
+
+// limiter is a per-client token bucket refilled at rate tokens per second.
+type limiter struct {
+	sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(rate float64) *limiter {
+	return &limiter{rate: rate, burst: rate * 2, buckets: map[string]*bucket{}}
+}
+
+func (l *limiter) allow(key string) bool {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{l.burst, now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune forgets clients whose buckets have refilled completely.
+func (l *limiter) prune() {
+	l.Lock()
+	defer l.Unlock()
+	for key, b := range l.buckets {
+		if time.Since(b.last).Seconds()*l.rate+b.tokens >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// isPublic reports whether a holding may be served on the public listener:
+// it must be locked and not marked private.
+func isPublic(uuid string) bool {
+	dir, _ := lookupHoldingDir(uuid)
+	if _, err := os.Stat(path.Join(dir, lockFileName)); err != nil {
+		return false
+	}
+	info, err := readHoldingInfo(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return false
+	}
+	return !info.Private
+}
+
+func publicHandler(limit *limiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{w, 0}
+		start := time.Now()
+		defer func() {
+			publicLog.Printf("%s \"%s %s %s\" %d %s backend=%s\n", clientIP(r), r.Method, r.URL.RequestURI(), r.Proto, rec.status, time.Since(start), backendOrNone(rec.Header().Get(backendHeader)))
+		}()
+
+		if !limit.allow(clientIP(r)) {
+			http.Error(rec, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(rec, "Only GET is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.URL.Path == "/version" {
+			versionHandler(rec, r)
+			return
+		}
+
+		params := strings.Split(r.URL.Path[len("/"):], "/")
+		uuid := strings.ToLower(params[0])
+		if uuidSanityCheck(uuid) != nil || !isPublic(uuid) {
+			// Don't tell guessed UUIDs apart from missing ones
+			http.Error(rec, "holding not found", http.StatusNotFound)
+			return
+		}
+		mainHandler(rec, r)
+	})
+}
+
+func startPublicListener() {
+	out := os.Stderr
+	if config.PublicAccessLog != "" {
+		f, err := os.OpenFile(config.PublicAccessLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			log.Fatal("Cannot open public access log: " + err.Error())
+		}
+		out = f
+	}
+	publicLog = log.New(out, "public: ", log.LstdFlags)
+
+	rate := config.PublicRateLimit
+	if rate == 0 {
+		rate = defaultPublicRateLimit
+	}
+	limit := newLimiter(rate)
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			limit.prune()
+		}
+	}()
+
+	log.Println("Public read-only listener on " + config.PublicListen)
+	go func() {
+		err := serveTCP(config.PublicListen, countOutcomes(measureBackends(setPolicyHeaders(enforceLimits(publicHandler(limit))))), false)
+		log.Fatal(fmt.Sprintf("Public listener on %s failed: %s", config.PublicListen, err))
+	}()
+}
+
+func privacyHandler(w http.ResponseWriter, r *http.Request, uuid string, private bool) {
+	err := uuidSanityCheck(uuid)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	unlock := lockHolding(uuid)
+	defer unlock()
+
+	dir, _ := lookupHoldingDir(uuid)
+	if !dirExists(dir) {
+		http.Error(w, "holding not found on disk", http.StatusNotFound)
+		log.Println("Holding not found: " + uuid)
+		return
+	}
+	info, err := readHoldingInfo(dir)
+	if os.IsNotExist(err) {
+		info = HoldingInfo{CreatedAt: stamp(inferCreatedAt(dir))}
+	} else if err != nil {
+		storageError(w, err)
+		return
+	}
+	info.Private = private
+	if err := writeHoldingInfo(dir, info); err != nil {
+		storageError(w, err)
+		return
+	}
+
+	if private {
+		fmt.Fprintf(w, "Holding is private\n")
+	} else {
+		fmt.Fprintf(w, "Holding is public\n")
+	}
+}
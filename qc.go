@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Quality control reports for catalogers. Within one holding, files are
+// flagged when their names differ only by case, a " (N)" copy suffix or, for
+// tracks, the extension, and when they have identical content. Zero-byte
+// placeholders all have the same (empty) content and aren't reported for it.
+const defaultQCPageSize = 100
+
+var copySuffix = regexp.MustCompile(`\s*\(\d+\)$`)
+
+type QCFile struct {
+	Path   string
+	Size   int64
+	SHA256 string `json:",omitempty"`
+}
+
+type QCFinding struct {
+	// "similar-names" or "identical-content"
+	Kind  string
+	Files []QCFile
+}
+
+type HoldingQC struct {
+	UUID     string
+	Findings []QCFinding
+}
+
+type QCReport struct {
+	Holdings []HoldingQC
+	// Pass as ?after= for the next page; absent on the last one
+	Next string `json:",omitempty"`
+}
+
+// nameKey reduces a path to what a duplicate would share with the original.
+// Tracks in different formats count as the same name, other files only if
+// they have the same extension.
+func nameKey(rel string) string {
+	dir, name := path.Split(rel)
+	ext := path.Ext(name)
+	stem := copySuffix.ReplaceAllString(strings.TrimSuffix(name, ext), "")
+	kind := strings.ToLower(ext)
+	if isTrack(rel) {
+		kind = "track"
+	}
+	return strings.ToLower(dir+stem) + "\x00" + kind
+}
+
+// checkHolding runs the checks on one holding. Without hashMissing, files
+// with no stored SHA-256 are left out of the content check.
+func checkHolding(uuid string, dir string, hashMissing bool) (HoldingQC, error) {
+	result := HoldingQC{strings.ToLower(uuid), []QCFinding{}}
+	musicDir := path.Join(dir, "music")
+	sums, err := readChecksums(dir)
+	if err != nil {
+		return result, err
+	}
+
+	files := []QCFile{}
+	err = walkFiles(musicDir, func(rel string) error {
+		stat, err := os.Stat(path.Join(musicDir, rel))
+		if err != nil {
+			return err
+		}
+		file := QCFile{rel, stat.Size(), sums.Music[rel]["sha256"]}
+		if file.SHA256 == "" && hashMissing && file.Size > 0 {
+			if file.SHA256, err = hashFile(path.Join(musicDir, rel)); err != nil {
+				return err
+			}
+		}
+		files = append(files, file)
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+
+	group := func(kind string, key func(QCFile) string) {
+		groups := map[string][]QCFile{}
+		keys := []string{}
+		for _, file := range files {
+			k := key(file)
+			if k == "" {
+				continue
+			}
+			if _, ok := groups[k]; !ok {
+				keys = append(keys, k)
+			}
+			groups[k] = append(groups[k], file)
+		}
+		for _, k := range keys {
+			if len(groups[k]) > 1 {
+				result.Findings = append(result.Findings, QCFinding{kind, groups[k]})
+			}
+		}
+	}
+	group("similar-names", func(f QCFile) string { return nameKey(f.Path) })
+	group("identical-content", func(f QCFile) string {
+		if f.Size == 0 {
+			return ""
+		}
+		return f.SHA256
+	})
+	return result, nil
+}
+
+func writeQC(w http.ResponseWriter, v interface{}) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// holdingQCHandler handles GET /UUID4/qc, checking one holding and hashing
+// any file whose checksum isn't stored.
+func holdingQCHandler(w http.ResponseWriter, r *http.Request, uuid string) {
+	// Hashing can be slow, so not for anonymous readers
+	if !checkAuth(w, r) {
+		return
+	}
+	if err := uuidSanityCheck(uuid); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dir := holdingDir(uuid)
+	if !dirExists(dir) {
+		http.Error(w, "holding not found on disk", http.StatusNotFound)
+		return
+	}
+	result, err := checkHolding(uuid, dir, true)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	writeQC(w, result)
+}
+
+// duplicateNamesHandler handles GET /qc/duplicate-names?limit=N&after=UUID4,
+// a page of the holdings with findings from stored checksums, in UUID order.
+// limit counts holdings examined, so a page can have fewer results, or none,
+// and still be followed by another.
+func duplicateNamesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkAuth(w, r) {
+		return
+	}
+	limit, err := pageLimit(r, defaultQCPageSize)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	after := strings.ToLower(r.URL.Query().Get("after"))
+
+	type holding struct {
+		uuid string
+		dir  string
+	}
+	holdings := []holding{}
+	err = walkHoldings(config.LibraryPath, func(uuid string, dir string, legacy bool) error {
+		if strings.ToLower(uuid) > after {
+			holdings = append(holdings, holding{strings.ToLower(uuid), dir})
+		}
+		return nil
+	})
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	sort.Slice(holdings, func(i, j int) bool { return holdings[i].uuid < holdings[j].uuid })
+
+	report := QCReport{Holdings: []HoldingQC{}}
+	if len(holdings) > limit {
+		holdings = holdings[:limit]
+		report.Next = holdings[limit-1].uuid
+	}
+	for _, h := range holdings {
+		result, err := checkHolding(h.uuid, h.dir, false)
+		if err != nil {
+			log.Println("QC: " + h.uuid + ": " + err.Error())
+			continue
+		}
+		if len(result.Findings) > 0 {
+			report.Holdings = append(report.Holdings, result)
+		}
+	}
+	writeQC(w, report)
+}
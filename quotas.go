@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Bytes uploaded by each user are counted in hourly buckets over a rolling
+// 24 hours and kept in .moss-usage.json in the library root, so a restart
+// doesn't hand out a fresh allowance. A user's UploadQuota, or failing that
+// RoleUploadQuotas for their role, caps the total; 0 means no limit and -1
+// exempts a user from their role's quota.
+const usageFileName = ".moss-usage.json"
+
+const quotaWindow = 24 * time.Hour
+
+// Sent by peers pushing holdings, which never count against a quota. Only
+// honoured for admin credentials, which replication needs anyway.
+const replicationHeader = "X-Moss-Replication"
+
+type UploadUsage struct {
+	User     string
+	Used     int64
+	Quota    int64      `json:",omitempty"`
+	ResetsAt *Timestamp `json:",omitempty"`
+}
+
+// Bytes per user by the Unix hour they were uploaded in
+var uploadUsage = struct {
+	sync.Mutex
+	users map[string]map[int64]int64
+	dirty bool
+}{users: map[string]map[int64]int64{}}
+
+type quotaExceededError struct {
+	user     string
+	quota    int64
+	resetsAt time.Time
+}
+
+func (e *quotaExceededError) Error() string {
+	return fmt.Sprintf("Upload quota of %d bytes per 24 hours exceeded for %s, more can be uploaded from %s", e.quota, e.user, e.resetsAt.Format(time.RFC3339))
+}
+
+func usageFile() string {
+	return path.Join(config.LibraryPath, usageFileName)
+}
+
+func quotaFor(user string, role string) int64 {
+	for _, u := range config.Users {
+		if u.Name == user && u.UploadQuota != 0 {
+			if u.UploadQuota < 0 {
+				return 0
+			}
+			return u.UploadQuota
+		}
+	}
+	return config.RoleUploadQuotas[role]
+}
+
+func currentHour(now time.Time) int64 {
+	return now.Unix() / 3600
+}
+
+// pruneUsage drops buckets that have left the window. The caller holds the
+// uploadUsage mutex.
+func pruneUsage(hours map[int64]int64, now time.Time) {
+	oldest := currentHour(now) - int64(quotaWindow/time.Hour) + 1
+	for hour := range hours {
+		if hour < oldest {
+			delete(hours, hour)
+		}
+	}
+}
+
+// usageOf returns what user has uploaded in the window and when the oldest
+// of it stops counting, or the zero time for nothing. With need > 0 it's
+// when enough will have stopped counting to fit need more bytes under quota.
+func usageOf(user string, quota int64, need int64, now time.Time) (int64, time.Time) {
+	uploadUsage.Lock()
+	defer uploadUsage.Unlock()
+	hours := uploadUsage.users[user]
+	pruneUsage(hours, now)
+	var used int64
+	order := []int64{}
+	for hour, n := range hours {
+		used += n
+		order = append(order, hour)
+	}
+	if len(order) == 0 {
+		return 0, time.Time{}
+	}
+	sort.Slice(order, func(i, j int) bool { return order[i] < order[j] })
+
+	expires := func(hour int64) time.Time {
+		return time.Unix(hour*3600, 0).Add(quotaWindow).UTC()
+	}
+	if quota <= 0 || need <= 0 {
+		return used, expires(order[0])
+	}
+	left := used
+	for _, hour := range order {
+		left -= hours[hour]
+		if left+need <= quota {
+			return used, expires(hour)
+		}
+	}
+	return used, expires(order[len(order)-1])
+}
+
+func chargeUpload(user string, n int64) {
+	if n <= 0 {
+		return
+	}
+	now := time.Now()
+	uploadUsage.Lock()
+	defer uploadUsage.Unlock()
+	hours, ok := uploadUsage.users[user]
+	if !ok {
+		hours = map[int64]int64{}
+		uploadUsage.users[user] = hours
+	}
+	hours[currentHour(now)] += n
+	uploadUsage.dirty = true
+}
+
+func saveUsage() {
+	release, err := beginWrite()
+	if err != nil {
+		// Frozen; stays dirty for the next save
+		return
+	}
+	defer release()
+	uploadUsage.Lock()
+	defer uploadUsage.Unlock()
+	if !uploadUsage.dirty {
+		return
+	}
+	now := time.Now()
+	persisted := map[string]map[int64]int64{}
+	for user, hours := range uploadUsage.users {
+		pruneUsage(hours, now)
+		if len(hours) > 0 {
+			persisted[user] = hours
+		}
+	}
+	js, err := json.Marshal(persisted)
+	if err == nil {
+		err = writeFileAtomic(usageFile(), js)
+	}
+	if err != nil {
+		log.Println("Cannot save upload usage: " + err.Error())
+		return
+	}
+	uploadUsage.dirty = false
+}
+
+// loadUsage reads back the upload usage. A file that can't be parsed is
+// set aside and usage starts again from nothing, since being unable to serve
+// the library would be worse than letting some uploads past their quotas.
+func loadUsage() error {
+	data, err := ioutil.ReadFile(usageFile())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	users := map[string]map[int64]int64{}
+	if err := json.Unmarshal(data, &users); err != nil {
+		log.Printf("WARNING: %s is corrupt (%s), moving it to %s.corrupt and starting upload quotas afresh\n", usageFile(), err.Error(), usageFile())
+		return os.Rename(usageFile(), usageFile()+".corrupt")
+	}
+	uploadUsage.Lock()
+	defer uploadUsage.Unlock()
+	uploadUsage.users = users
+	return nil
+}
+
+// meteredBody counts what is read from an upload against the user and stops
+// with a quotaExceededError once the quota is used up.
+type meteredBody struct {
+	io.ReadCloser
+	user  string
+	quota int64
+	left  int64
+	read  int64
+	saved bool
+}
+
+func (b *meteredBody) Read(p []byte) (int, error) {
+	if b.quota > 0 && int64(len(p)) > b.left+1 {
+		p = p[:b.left+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	chargeUpload(b.user, int64(n))
+	if b.quota > 0 {
+		b.left -= int64(n)
+		if b.left < 0 {
+			_, resetsAt := usageOf(b.user, b.quota, 1, time.Now())
+			err = &quotaExceededError{b.user, b.quota, resetsAt}
+		}
+	}
+	if err != nil && !b.saved {
+		b.saved = true
+		saveUsage()
+	}
+	return n, err
+}
+
+func quotaExceeded(w http.ResponseWriter, err *quotaExceededError) {
+	log.Println(err.Error())
+	w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(err.resetsAt).Seconds())+1))
+	w.Header().Set("X-Moss-Quota-Reset", err.resetsAt.Format(time.RFC3339))
+	http.Error(w, err.Error(), http.StatusTooManyRequests)
+}
+
+// readUpload reads a request body, answering 429 itself if that runs over
+// the user's quota, 413 if it runs over a MaxBytesReader limit and 500 for
+// other failures. JSON request bodies are read with it too.
+func readUpload(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := ioutil.ReadAll(r.Body)
+	if qerr, ok := err.(*quotaExceededError); ok {
+		quotaExceeded(w, qerr)
+		return nil, false
+	} else if merr, ok := err.(*http.MaxBytesError); ok {
+		tooLarge(w, &tooLargeError{merr.Limit})
+		return nil, false
+	} else if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	return body, true
+}
+
+// meterUploads counts the bodies of PUT and POST requests against the
+// authenticated user, refusing them up front if the quota is already used
+// up or the declared length wouldn't fit.
+func meterUploads(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (r.Method != "PUT" && r.Method != "POST") || r.Body == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		role := authenticate(r)
+		if role == "" || (role == "admin" && r.Header.Get(replicationHeader) != "") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		user, _, _ := r.BasicAuth()
+		quota := quotaFor(user, role)
+		body := &meteredBody{ReadCloser: r.Body, user: user, quota: quota}
+		if quota > 0 {
+			need := r.ContentLength
+			if need < 1 {
+				need = 1
+			}
+			if need > quota {
+				http.Error(w, fmt.Sprintf("Upload of %d bytes is larger than the quota of %d bytes per 24 hours", need, quota), http.StatusRequestEntityTooLarge)
+				return
+			}
+			used, resetsAt := usageOf(user, quota, need, time.Now())
+			if used+need > quota {
+				quotaExceeded(w, &quotaExceededError{user, quota, resetsAt})
+				return
+			}
+			body.left = quota - used
+		}
+		r.Body = body
+		next.ServeHTTP(w, r)
+		if !body.saved && body.read > 0 {
+			saveUsage()
+		}
+	})
+}
+
+func usageFor(user string, role string) UploadUsage {
+	quota := quotaFor(user, role)
+	used, resetsAt := usageOf(user, quota, 0, time.Now())
+	usage := UploadUsage{User: user, Used: used, Quota: quota}
+	if !resetsAt.IsZero() {
+		stamped := stamp(resetsAt)
+		usage.ResetsAt = &stamped
+	}
+	return usage
+}
+
+// uploadStats reports every user's usage in the window, for /stats.
+func uploadStats() []UploadUsage {
+	roles := map[string]string{config.ApiUser: "admin"}
+	for _, u := range config.Users {
+		roles[u.Name] = u.Role
+	}
+	uploadUsage.Lock()
+	users := []string{}
+	for user := range uploadUsage.users {
+		users = append(users, user)
+	}
+	uploadUsage.Unlock()
+	sort.Strings(users)
+
+	result := []UploadUsage{}
+	for _, user := range users {
+		if usage := usageFor(user, roles[user]); usage.Used > 0 {
+			result = append(result, usage)
+		}
+	}
+	return result
+}
+
+// myUsageHandler handles GET /me/usage.
+func myUsageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkAuth(w, r) {
+		return
+	}
+	user, _, _ := r.BasicAuth()
+	js, err := json.Marshal(usageFor(user, authenticate(r)))
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
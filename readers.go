@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Streaming a whole holding (archives, playlists, pushes to peers and
+// archive exports) takes a read reference on it for the duration, and
+// anything that removes or moves a holding's files waits for the readers to
+// finish, up to MaxReaderWait seconds, before giving up with
+// holdingBusyError. New readers queue behind a waiting remover so it can't be
+// starved. Readers don't take the holding mutex, so uploads aren't held up.
+const defaultMaxReaderWait = 30
+
+type readerState struct {
+	readers  int
+	removers int
+}
+
+var holdingReaders = struct {
+	sync.Mutex
+	cond *sync.Cond
+	m    map[string]*readerState
+}{m: map[string]*readerState{}}
+
+func init() {
+	holdingReaders.cond = sync.NewCond(&holdingReaders.Mutex)
+}
+
+type holdingBusyError struct {
+	uuid    string
+	readers int
+}
+
+func (e *holdingBusyError) Error() string {
+	return fmt.Sprintf("%s is being read by %d streaming request(s), try again later", e.uuid, e.readers)
+}
+
+// readerStateFor returns the state for uuid, creating it. The caller holds
+// the holdingReaders mutex.
+func readerStateFor(uuid string) *readerState {
+	st, ok := holdingReaders.m[uuid]
+	if !ok {
+		st = &readerState{}
+		holdingReaders.m[uuid] = st
+	}
+	return st
+}
+
+// dropIdle forgets uuid once nothing holds or wants it. The caller holds the
+// holdingReaders mutex.
+func dropIdle(uuid string, st *readerState) {
+	if st.readers == 0 && st.removers == 0 {
+		delete(holdingReaders.m, uuid)
+	}
+}
+
+// readHolding takes a read reference on a holding and returns the function
+// that releases it.
+func readHolding(uuid string) func() {
+	holdingReaders.Lock()
+	st := readerStateFor(uuid)
+	for st.removers > 0 {
+		holdingReaders.cond.Wait()
+	}
+	st.readers++
+	holdingReaders.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			holdingReaders.Lock()
+			st.readers--
+			dropIdle(uuid, st)
+			holdingReaders.cond.Broadcast()
+			holdingReaders.Unlock()
+		})
+	}
+}
+
+func maxReaderWait() time.Duration {
+	if config.MaxReaderWait < 0 {
+		return 0
+	}
+	return time.Duration(config.MaxReaderWait) * time.Second
+}
+
+// excludeReaders waits for a holding's readers to finish and keeps new ones
+// out until the returned function is called. It gives up after MaxReaderWait.
+func excludeReaders(uuid string) (func(), error) {
+	deadline := time.Now().Add(maxReaderWait())
+	timer := time.AfterFunc(maxReaderWait(), func() {
+		holdingReaders.Lock()
+		holdingReaders.cond.Broadcast()
+		holdingReaders.Unlock()
+	})
+	defer timer.Stop()
+
+	holdingReaders.Lock()
+	defer holdingReaders.Unlock()
+	st := readerStateFor(uuid)
+	st.removers++
+	for st.readers > 0 {
+		if !time.Now().Before(deadline) {
+			st.removers--
+			readers := st.readers
+			holdingReaders.cond.Broadcast()
+			stats.readerConflicts.add()
+			return nil, &holdingBusyError{uuid, readers}
+		}
+		holdingReaders.cond.Wait()
+	}
+	return func() {
+		holdingReaders.Lock()
+		st.removers--
+		dropIdle(uuid, st)
+		holdingReaders.cond.Broadcast()
+		holdingReaders.Unlock()
+	}, nil
+}
+
+// writeReaderMetrics writes the moss_holding_readers gauge for /metrics,
+// one series per holding currently being streamed.
+func writeReaderMetrics(w io.Writer) {
+	holdingReaders.Lock()
+	counts := map[string]int{}
+	for uuid, st := range holdingReaders.m {
+		if st.readers > 0 {
+			counts[uuid] = st.readers
+		}
+	}
+	holdingReaders.Unlock()
+
+	fmt.Fprintln(w, "# HELP moss_holding_readers Streaming requests currently reading a holding.")
+	fmt.Fprintln(w, "# TYPE moss_holding_readers gauge")
+	uuids := []string{}
+	for uuid := range counts {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+	for _, uuid := range uuids {
+		fmt.Fprintf(w, "moss_holding_readers{uuid=%q} %d\n", uuid, counts[uuid])
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Not all of the space moss uses has to stay used: temp files older than
+// staleTempAge belong to requests that died, transactions idle for
+// staleTxnAge are due to be expired, and cached clips and art derived from
+// masters are made again on demand. Reclaimable reports how much each comes
+// to, next to FreeSpace in /version and /stats. The derived figure comes from
+// the usage figures measured along with the holding count.
+//
+// With ReclaimOnLowSpace set, moss frees that space itself when it runs
+// short: before an upload that wouldn't leave ReadyMinFreeBytes free, and
+// when /readyz finds free space low, which then also counts reclaimable space
+// as free. Temp files and transactions younger than those ages may still be
+// in use and are never touched, nor are derived files made within
+// reclaimMinAge. moss keeps no trash or snapshots, so nothing else is ever
+// removed.
+const reclaimMinAge = time.Hour
+
+type Reclaimable struct {
+	// Temp files old enough for the janitor
+	StaleTemp int64
+	// Files staged in transactions idle for long enough to be expired
+	ExpiredTransactions int64
+	// Cached clips and art derived from masters
+	Derived int64
+	Total   int64
+	// When Derived was measured; unset before the first measurement
+	DerivedMeasuredAt *Timestamp `json:",omitempty"`
+}
+
+// Only one reclaim runs at a time; writes that find one running wait for it
+var reclaiming sync.Mutex
+
+// treeSize returns the physical size of a file, or of a directory and
+// everything in it.
+func treeSize(p string) int64 {
+	var size int64
+	filepath.Walk(p, func(_ string, info os.FileInfo, err error) error {
+		if err == nil {
+			size += physicalSize(info)
+		}
+		return nil
+	})
+	return size
+}
+
+func expiredTxns() []*Txn {
+	txns.Lock()
+	open := []*Txn{}
+	for _, txn := range txns.m {
+		open = append(open, txn)
+	}
+	txns.Unlock()
+
+	expired := []*Txn{}
+	for _, txn := range open {
+		txn.mu.Lock()
+		if txn.files != nil && time.Since(txn.LastUsed.Time) >= staleTxnAge {
+			expired = append(expired, txn)
+		}
+		txn.mu.Unlock()
+	}
+	return expired
+}
+
+// staleTempFiles lists the temp files old enough for the janitor, leaving
+// out the directories of expired transactions, which are counted apart.
+func staleTempFiles(expired []*Txn) []string {
+	txnDirs := map[string]bool{}
+	for _, txn := range expired {
+		txnDirs[txn.dir] = true
+	}
+	dirEnts, err := ioutil.ReadDir(tmpDir())
+	if err != nil {
+		return nil
+	}
+	stale := []string{}
+	for _, dirEnt := range dirEnts {
+		p := path.Join(tmpDir(), dirEnt.Name())
+		if time.Since(dirEnt.ModTime()) >= staleTempAge && !txnDirs[p] {
+			stale = append(stale, p)
+		}
+	}
+	return stale
+}
+
+func reclaimable() Reclaimable {
+	r := Reclaimable{}
+	expired := expiredTxns()
+	for _, txn := range expired {
+		r.ExpiredTransactions += treeSize(txn.dir)
+	}
+	for _, p := range staleTempFiles(expired) {
+		r.StaleTemp += treeSize(p)
+	}
+	if totals := usageTotals(); totals != nil {
+		r.Derived = totals.Derived.Physical
+		r.DerivedMeasuredAt = &totals.MeasuredAt
+	}
+	r.Total = r.StaleTemp + r.ExpiredTransactions + r.Derived
+	return r
+}
+
+// holdingsWithDerived lists the holdings the usage figures say have derived
+// files.
+func holdingsWithDerived() []string {
+	usageCache.Lock()
+	defer usageCache.Unlock()
+	uuids := []string{}
+	for uuid, usage := range usageCache.holdings {
+		if usage.Derived.Files > 0 {
+			uuids = append(uuids, uuid)
+		}
+	}
+	return uuids
+}
+
+// removeDerived removes a holding's cached clips and derived art made more
+// than reclaimMinAge ago, logging each, and returns the bytes freed.
+func removeDerived(uuid string) int64 {
+	unlock := lockHolding(uuid)
+	defer unlock()
+
+	dir, _ := lookupHoldingDir(uuid)
+	var freed int64
+	remove := func(p string, info os.FileInfo) {
+		if time.Since(info.ModTime()) < reclaimMinAge {
+			return
+		}
+		if err := os.Remove(p); err != nil {
+			log.Println("Reclaim: " + err.Error())
+			return
+		}
+		log.Printf("Reclaim: removed %s (%d bytes)\n", libraryRel(p), physicalSize(info))
+		freed += physicalSize(info)
+	}
+	if info, err := os.Stat(path.Join(dir, derivedArtFileName)); err == nil {
+		remove(path.Join(dir, derivedArtFileName), info)
+	}
+	clips, _ := ioutil.ReadDir(path.Join(dir, clipDirName))
+	for _, info := range clips {
+		remove(path.Join(dir, clipDirName, info.Name()), info)
+	}
+	if freed > 0 {
+		if usage, err := measureHolding(dir); err == nil {
+			setHoldingUsage(uuid, usage)
+		}
+	}
+	return freed
+}
+
+// reclaimSpace frees what it can, logging everything it removes and the
+// total.
+func reclaimSpace(reason string) {
+	reclaiming.Lock()
+	defer reclaiming.Unlock()
+
+	log.Println("Reclaim: starting, " + reason)
+	var freed int64
+	// Going by a wrong clock could remove temp files still in use
+	if !expirySuspended() {
+		expired := expiredTxns()
+		for _, txn := range expired {
+			txn.mu.Lock()
+			if txn.files != nil && time.Since(txn.LastUsed.Time) >= staleTxnAge {
+				size := treeSize(txn.dir)
+				forgetTxn(txn)
+				log.Printf("Reclaim: expired transaction %s for %s (%d bytes)\n", txn.ID, txn.UUID, size)
+				freed += size
+			}
+			txn.mu.Unlock()
+		}
+		for _, p := range staleTempFiles(expired) {
+			size := treeSize(p)
+			if err := os.RemoveAll(p); err != nil {
+				log.Println("Reclaim: " + err.Error())
+				continue
+			}
+			log.Printf("Reclaim: removed stale temp file %s (%d bytes)\n", p, size)
+			freed += size
+		}
+	}
+	for _, uuid := range holdingsWithDerived() {
+		freed += removeDerived(uuid)
+	}
+	log.Printf("Reclaim: freed %d bytes\n", freed)
+}
+
+// needsRoom reports whether writing need more bytes would leave less than
+// ReadyMinFreeBytes free.
+func needsRoom(need int64) bool {
+	free, err := libraryFreeSpace()
+	if err != nil {
+		return false
+	}
+	return free < uint64(need)+uint64(config.ReadyMinFreeBytes)
+}
+
+// makeRoom reclaims space before an upload that wouldn't otherwise fit. The
+// upload goes ahead either way, and fails with 507 if it still doesn't fit.
+func makeRoom(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if config.ReclaimOnLowSpace && (r.Method == "PUT" || r.Method == "POST") && r.ContentLength > 0 && needsRoom(r.ContentLength) {
+			reclaimSpace("an upload to " + r.URL.Path + " needs room")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
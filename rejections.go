@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Refused writes are remembered per user so volunteers can see why an upload
+// failed without digging through the server log. Each user keeps their last
+// RejectionLogSize refusals for up to RejectionLogTTL seconds.
+const defaultRejectionLogSize = 50
+const defaultRejectionLogTTL = 24 * 60 * 60
+
+const requestIDHeader = "X-Request-Id"
+
+// Only this much of the error body is kept
+const maxRejectionDetail = 512
+
+// Query parameters whose values never make it into the log
+var sensitiveParams = []string{"key", "token", "secret", "password", "signature", "credential"}
+
+type Rejection struct {
+	Time      Timestamp
+	User      string
+	ClientIP  string
+	Method    string
+	Path      string
+	Status    int
+	Error     string
+	RequestID string
+	Backend   string `json:",omitempty"`
+}
+
+var rejections = struct {
+	sync.Mutex
+	m map[string][]Rejection
+}{m: map[string][]Rejection{}}
+
+type rejectionRecorder struct {
+	http.ResponseWriter
+	status int
+	detail []byte
+}
+
+func (r *rejectionRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *rejectionRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	if r.status >= 400 && len(r.detail) < maxRejectionDetail {
+		n := maxRejectionDetail - len(r.detail)
+		if n > len(b) {
+			n = len(b)
+		}
+		r.detail = append(r.detail, b[:n]...)
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *rejectionRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (r *rejectionRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestID uses the client's X-Request-Id if it looks sane, so a client can
+// match its own logs to the rejection.
+func requestID(r *http.Request) string {
+	id := r.Header.Get(requestIDHeader)
+	if id == "" || len(id) > 64 {
+		return newRequestID()
+	}
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return newRequestID()
+		}
+	}
+	return id
+}
+
+// redactedPath returns the request path with the values of sensitive query
+// parameters replaced.
+func redactedPath(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.Path
+	}
+	query := u.Query()
+	for name := range query {
+		lower := strings.ToLower(name)
+		for _, sensitive := range sensitiveParams {
+			if strings.Contains(lower, sensitive) {
+				query[name] = []string{"REDACTED"}
+				break
+			}
+		}
+	}
+	return u.Path + "?" + query.Encode()
+}
+
+// firstLine keeps the first line of an error body, which is where the
+// handlers put the reason.
+func firstLine(detail string) string {
+	return strings.TrimSpace(strings.SplitN(detail, "\n", 2)[0])
+}
+
+func recordRejection(rejection Rejection) {
+	rejections.Lock()
+	defer rejections.Unlock()
+	ring := append(pruneRejections(rejections.m[rejection.User], rejection.Time.Time), rejection)
+	if len(ring) > config.RejectionLogSize {
+		ring = ring[len(ring)-config.RejectionLogSize:]
+	}
+	rejections.m[rejection.User] = ring
+}
+
+// pruneRejections drops entries older than RejectionLogTTL. The caller holds
+// the rejections mutex.
+func pruneRejections(ring []Rejection, now time.Time) []Rejection {
+	cutoff := now.Add(-time.Duration(config.RejectionLogTTL) * time.Second)
+	i := 0
+	for i < len(ring) && ring[i].Time.Before(cutoff) {
+		i++
+	}
+	return ring[i:]
+}
+
+// recordRejections wraps a handler to remember refused mutating requests by
+// authenticated users. Every mutating request gets an X-Request-Id.
+func recordRejections(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		id := requestID(r)
+		w.Header().Set(requestIDHeader, id)
+		rec := &rejectionRecorder{w, 0, nil}
+		next.ServeHTTP(rec, r)
+		if rec.status < 400 {
+			return
+		}
+		// Unauthenticated failures can't be attributed to anyone
+		if authenticate(r) == "" {
+			return
+		}
+		// Credentials are only ever taken from the Authorization header,
+		// which isn't kept
+		user, _, _ := r.BasicAuth()
+		recordRejection(Rejection{
+			Time:      stamp(time.Now()),
+			User:      user,
+			ClientIP:  clientIP(r),
+			Method:    r.Method,
+			Path:      redactedPath(r.URL),
+			Status:    rec.status,
+			Error:     firstLine(string(rec.detail)),
+			RequestID: id,
+			Backend:   w.Header().Get(backendHeader),
+		})
+	})
+}
+
+func userRejections(user string) []Rejection {
+	rejections.Lock()
+	defer rejections.Unlock()
+	now := time.Now()
+	result := []Rejection{}
+	for name, ring := range rejections.m {
+		if user != "" && name != user {
+			continue
+		}
+		ring = pruneRejections(ring, now)
+		if len(ring) == 0 {
+			delete(rejections.m, name)
+			continue
+		}
+		rejections.m[name] = ring
+		result = append(result, ring...)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Time.After(result[j].Time.Time) })
+	return result
+}
+
+func writeRejections(w http.ResponseWriter, list []Rejection) {
+	js, err := json.Marshal(list)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// myRejectionsHandler handles GET /me/rejections, the caller's own recent
+// refused requests, newest first.
+func myRejectionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkAuth(w, r) {
+		return
+	}
+	user, _, _ := r.BasicAuth()
+	if user == "" {
+		// An empty filter would mean everyone
+		writeRejections(w, []Rejection{})
+		return
+	}
+	writeRejections(w, userRejections(user))
+}
+
+// rejectionsHandler handles GET /admin/rejections?user=..., everyone's recent
+// refused requests unless narrowed to one user.
+func rejectionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeRejections(w, userRejections(r.URL.Query().Get("user")))
+}
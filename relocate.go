@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Holdings sometimes end up under the wrong two-hex prefix directory, e.g.
+// after an rsync into the wrong place. POST /UUID4/relocate moves one back to
+// where uuidToPath says it belongs.
+
+type RelocateResult struct {
+	UUID    string
+	OldPath string
+	NewPath string
+	Moved   bool
+	// Set when the move had to copy across filesystems
+	Copied bool `json:",omitempty"`
+}
+
+type misplacedConflictError struct {
+	uuid  string
+	paths []string
+}
+
+func (e *misplacedConflictError) Error() string {
+	return fmt.Sprintf("%s is stored in more than one place (%s), resolve it by hand", e.uuid, strings.Join(e.paths, ", "))
+}
+
+type relocateVerifyError struct {
+	file    string
+	problem string
+}
+
+func (e *relocateVerifyError) Error() string {
+	return fmt.Sprintf("Copy of %s does not match the original - %s", e.file, e.problem)
+}
+
+// findHoldingCopies returns every directory, relative to the library root,
+// that holds uuid: its own shard directory, any other prefix directory, and
+// the legacy flat location.
+func findHoldingCopies(uuid string) ([]string, error) {
+	dirEnts, err := ioutil.ReadDir(config.LibraryPath)
+	if err != nil {
+		return nil, err
+	}
+	found := []string{}
+	for _, dirEnt := range dirEnts {
+		if !dirEnt.IsDir() || !shardDirPattern.MatchString(dirEnt.Name()) {
+			continue
+		}
+		for _, rel := range []string{path.Join(dirEnt.Name(), uuid), path.Join(dirEnt.Name(), uuid[2:4], uuid)} {
+			if dirExists(path.Join(config.LibraryPath, rel)) {
+				found = append(found, rel)
+			}
+		}
+	}
+	if dirExists(legacyPath(config.LibraryPath, uuid)) {
+		found = append(found, uuid)
+	}
+	return found, nil
+}
+
+// isMisplaced reports whether a holding found by walkHoldings lives under a
+// prefix directory other than its own, at either depth.
+func isMisplaced(uuid string, dir string, legacy bool) bool {
+	if legacy || len(uuid) < 4 {
+		return false
+	}
+	uuid = strings.ToLower(uuid)
+	parent := path.Dir(dir)
+	if path.Base(parent) == uuid[2:4] && path.Base(path.Dir(parent)) == uuid[0:2] {
+		return false
+	}
+	return path.Base(parent) != uuid[0:2]
+}
+
+// moveHolding renames src to dest, falling back to a verified copy and delete
+// when they are on different filesystems. It reports whether it copied.
+func moveHolding(src string, dest string) (bool, error) {
+	if err := os.MkdirAll(path.Dir(dest), 0755); err != nil {
+		return false, err
+	}
+	err := os.Rename(src, dest)
+	if err == nil {
+		return false, nil
+	}
+	if !errors.Is(err, syscall.EXDEV) {
+		return false, err
+	}
+
+	// Stage the copy beside its destination so the final step is a rename
+	staging, err := ioutil.TempDir(path.Dir(dest), ".relocate-")
+	if err != nil {
+		return true, err
+	}
+	staged := path.Join(staging, path.Base(dest))
+	if err := copyTree(src, staged); err != nil {
+		os.RemoveAll(staging)
+		return true, err
+	}
+	if err := verifyTreeCopy(src, staged); err != nil {
+		os.RemoveAll(staging)
+		return true, err
+	}
+	if err := os.Rename(staged, dest); err != nil {
+		os.RemoveAll(staging)
+		return true, err
+	}
+	os.Remove(staging)
+	return true, os.RemoveAll(src)
+}
+
+func copyTree(src string, dest string) error {
+	return filepath.Walk(src, func(p string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		target := path.Join(dest, p[len(src):])
+		if f.IsDir() {
+			return os.MkdirAll(target, f.Mode().Perm()|0700)
+		}
+		if !f.Mode().IsRegular() {
+			return &relocateVerifyError{p[len(src):], "not a regular file"}
+		}
+		return copyFile(p, target, f.Mode().Perm())
+	})
+}
+
+func copyFile(src string, dest string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// verifyTreeCopy compares the sizes and SHA-256 of every file in two trees.
+func verifyTreeCopy(src string, dest string) error {
+	before, err := treeSizes(src)
+	if err != nil {
+		return err
+	}
+	after, err := treeSizes(dest)
+	if err != nil {
+		return err
+	}
+	if len(before) != len(after) {
+		return &relocateVerifyError{src, fmt.Sprintf("expected %d files, found %d", len(before), len(after))}
+	}
+	for name, size := range before {
+		if after[name] != size {
+			return &relocateVerifyError{name, "size mismatch"}
+		}
+		a, err := hashFile(src + name)
+		if err != nil {
+			return err
+		}
+		b, err := hashFile(dest + name)
+		if err != nil {
+			return err
+		}
+		if a != b {
+			return &relocateVerifyError{name, "checksum mismatch"}
+		}
+	}
+	return nil
+}
+
+// relocateHandler handles POST /UUID4/relocate. It waits up to MaxReaderWait
+// for downloads of the holding to finish, and refuses with 409 rather than
+// wait if an upload or lock is working on it.
+func relocateHandler(w http.ResponseWriter, r *http.Request, uuid string) {
+	if !checkAuth(w, r) {
+		return
+	}
+	release, ok := guardWrite(w)
+	if !ok {
+		return
+	}
+	defer release()
+	if err := uuidSanityCheck(uuid); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	admit, err := excludeReaders(uuid)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	defer admit()
+	unlock, ok := tryLockHolding(uuid)
+	if !ok {
+		http.Error(w, uuid+" is busy with an upload or lock, try again later", http.StatusConflict)
+		return
+	}
+	defer unlock()
+
+	copies, err := findHoldingCopies(uuid)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	want := strings.TrimPrefix(uuidToPath(config.LibraryPath, uuid), path.Clean(config.LibraryPath)+"/")
+	result := RelocateResult{UUID: uuid, NewPath: want}
+	switch {
+	case len(copies) == 0:
+		http.Error(w, "holding not found on disk", http.StatusNotFound)
+		return
+	case len(copies) > 1:
+		cerr := &misplacedConflictError{uuid, copies}
+		log.Println(cerr.Error())
+		http.Error(w, cerr.Error(), http.StatusConflict)
+		return
+	}
+	result.OldPath = copies[0]
+
+	if result.OldPath != want {
+		src := path.Join(config.LibraryPath, result.OldPath)
+		dest := uuidToPath(config.LibraryPath, uuid)
+		if err := ensureSafePath(config.LibraryPath, dest); err != nil {
+			log.Println(err.Error())
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		copied, err := moveHolding(src, dest)
+		if _, ok := err.(*relocateVerifyError); ok {
+			log.Println(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if err != nil {
+			storageError(w, err)
+			return
+		}
+		result.Moved = true
+		result.Copied = copied
+		forgetMissing(uuid)
+		emitChange(uuid, "relocate", want)
+		user, _, _ := r.BasicAuth()
+		log.Printf("Relocated %s from %s to %s for %s\n", uuid, result.OldPath, want, user)
+	}
+
+	js, err := json.Marshal(result)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With VerifyOnRead, full GETs of files that have a stored SHA-256 are hashed
+// as they stream out. A file that no longer matches is repaired in the
+// background from a peer whose copy has the stored checksum.
+const verifiedTrailer = "X-Moss-Verified"
+
+// A client can also ask for the digest of what it was sent with X-Verify:
+// sha256, which comes back in an X-Verify-SHA256 trailer, or as a header on
+// HEAD for clients that can't take trailers.
+const verifyRequestHeader = "X-Verify"
+const verifyDigestHeader = "X-Verify-SHA256"
+
+const repairHistoryFileName = "repairs.json"
+const maxRepairHistory = 100
+
+type RepairRecord struct {
+	Path     string
+	Time     Timestamp
+	Expected string
+	Found    string
+	Outcome  string
+	Peer     string `json:",omitempty"`
+	Error    string `json:",omitempty"`
+}
+
+// Files being repaired, keyed by uuid and path, so a popular corrupt file is
+// only fetched once
+var repairs = struct {
+	sync.Mutex
+	m map[string]bool
+}{m: map[string]bool{}}
+
+type verifyingWriter struct {
+	http.ResponseWriter
+	h        hash.Hash
+	trailers []string
+	status   int
+	n        int64
+}
+
+func (w *verifyingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+		if status == http.StatusOK && len(w.trailers) > 0 {
+			// Trailers need a chunked response
+			w.Header().Del("Content-Length")
+			w.Header().Set("Trailer", strings.Join(w.trailers, ", "))
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *verifyingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(b)
+	if w.status == http.StatusOK {
+		w.h.Write(b[:n])
+		w.n += int64(n)
+	}
+	return n, err
+}
+
+func (w *verifyingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *verifyingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+type unsupportedVerifyError struct {
+	alg string
+}
+
+func (e *unsupportedVerifyError) Error() string {
+	return fmt.Sprintf("%s: %s is not supported, only sha256", verifyRequestHeader, e.alg)
+}
+
+// wantsVerify reports whether the client sent X-Verify: sha256.
+func wantsVerify(r *http.Request) (bool, error) {
+	alg := strings.ToLower(strings.TrimSpace(r.Header.Get(verifyRequestHeader)))
+	if alg == "" {
+		return false, nil
+	} else if alg != "sha256" {
+		return false, &unsupportedVerifyError{alg}
+	}
+	return true, nil
+}
+
+// checkServedDigest compares what was read back with the stored SHA-256 and
+// counts and logs a mismatch, scheduling a repair with VerifyOnRead.
+func checkServedDigest(uuid string, rel string, expected string, found string) bool {
+	if expected == "" || found == expected {
+		return true
+	}
+	stats.verifyMismatches.add()
+	log.Printf("Checksum mismatch serving %s/%s: stored %s, read %s\n", uuid, repairName(rel), expected, found)
+	if config.VerifyOnRead {
+		scheduleRepair(uuid, rel, expected, found)
+	}
+	return false
+}
+
+// serveVerified serves a file through serve, hashing what goes out when
+// VerifyOnRead or X-Verify calls for it, and schedules a repair if the whole
+// file went out and didn't match expected. rel is the path under music/ or ""
+// for the album art, at fp. HEAD with X-Verify hashes the file on disk.
+func serveVerified(w http.ResponseWriter, r *http.Request, uuid string, rel string, fp string, size int64, expected string, serve func(http.ResponseWriter)) {
+	if err := ensureSafePath(config.LibraryPath, fp); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	faultRead(fp)
+	want, err := wantsVerify(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if want && r.Method == "HEAD" && r.Header.Get("Range") == "" {
+		if sums, _, err := digestFile(fp, []string{"sha256"}); err == nil {
+			w.Header().Set(verifyDigestHeader, sums["sha256"])
+			checkServedDigest(uuid, rel, expected, sums["sha256"])
+		}
+		serve(w)
+		return
+	}
+	check := config.VerifyOnRead && expected != ""
+	if (!want && !check) || r.Method != "GET" || r.Header.Get("Range") != "" {
+		serve(w)
+		return
+	}
+	vw := &verifyingWriter{ResponseWriter: w, h: sha256.New()}
+	// HTTP/1.0 responses can't carry trailers
+	if r.ProtoAtLeast(1, 1) {
+		if expected != "" {
+			vw.trailers = append(vw.trailers, verifiedTrailer)
+		}
+		if want {
+			vw.trailers = append(vw.trailers, verifyDigestHeader)
+		}
+	}
+	serve(vw)
+	if vw.status != http.StatusOK || vw.n != size {
+		return
+	}
+	found := hex.EncodeToString(vw.h.Sum(nil))
+	if want {
+		w.Header().Set(verifyDigestHeader, found)
+	}
+	if expected == "" {
+		return
+	}
+	if checkServedDigest(uuid, rel, expected, found) {
+		w.Header().Set(verifiedTrailer, "ok")
+	} else {
+		w.Header().Set(verifiedTrailer, "mismatch")
+	}
+}
+
+func repairName(rel string) string {
+	if rel == "" {
+		return "albumart"
+	}
+	return "music/" + rel
+}
+
+func readRepairHistory(dir string) ([]RepairRecord, error) {
+	history := []RepairRecord{}
+	data, err := ioutil.ReadFile(path.Join(dir, repairHistoryFileName))
+	if os.IsNotExist(err) {
+		return history, nil
+	} else if err != nil {
+		return history, err
+	}
+	err = json.Unmarshal(data, &history)
+	return history, err
+}
+
+// recordRepair appends to the holding's repair history. The caller holds the
+// holding mutex.
+func recordRepair(dir string, record RepairRecord) {
+	history, err := readRepairHistory(dir)
+	if err != nil {
+		log.Println(err.Error())
+	}
+	history = append(history, record)
+	if len(history) > maxRepairHistory {
+		history = history[len(history)-maxRepairHistory:]
+	}
+	js, err := json.Marshal(history)
+	if err == nil {
+		err = writeFileAtomic(path.Join(dir, repairHistoryFileName), js)
+	}
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+func scheduleRepair(uuid string, rel string, expected string, found string) {
+	key := uuid + "/" + repairName(rel)
+	repairs.Lock()
+	if repairs.m[key] {
+		repairs.Unlock()
+		return
+	}
+	repairs.m[key] = true
+	repairs.Unlock()
+
+	go func() {
+		defer func() {
+			repairs.Lock()
+			delete(repairs.m, key)
+			repairs.Unlock()
+		}()
+		record := RepairRecord{Path: repairName(rel), Time: stamp(time.Now()), Expected: expected, Found: found}
+		peer, err := repairFile(uuid, rel, expected)
+		if err != nil {
+			stats.repairFailures.add()
+			record.Outcome = "failed"
+			record.Error = err.Error()
+			log.Printf("Repair of %s failed: %s\n", key, err.Error())
+		} else {
+			stats.repairs.add()
+			record.Outcome = "repaired"
+			record.Peer = peer
+			log.Printf("Repaired %s from %s\n", key, peer)
+		}
+
+		release, err := beginWrite()
+		if err != nil {
+			return
+		}
+		defer release()
+		unlock := lockHolding(uuid)
+		defer unlock()
+		recordRepair(holdingDir(uuid), record)
+		if record.Outcome == "repaired" {
+			emitChange(uuid, "repair", rel)
+		}
+	}()
+}
+
+type repairError struct {
+	problem string
+}
+
+func (e *repairError) Error() string {
+	return e.problem
+}
+
+// fetchGoodCopy downloads a peer's copy of the file into tmp/ and returns its
+// path if it has the expected SHA-256.
+func fetchGoodCopy(peer Peer, uuid string, rel string, expected string) (string, error) {
+	remote, err := peerHolding(peer, uuid)
+	if err != nil {
+		return "", err
+	}
+	if remote == nil || remote.Checksums == nil {
+		return "", &peerError{peer.Name, "has no checksums for " + uuid}
+	}
+	remoteSums := remote.Checksums.AlbumArt
+	target := peerURL(peer, uuid, "albumart")
+	if rel != "" {
+		remoteSums = remote.Checksums.Music[rel]
+		target = peerURL(peer, uuid, "music", rel)
+	}
+	if remoteSums["sha256"] != expected {
+		return "", &peerError{peer.Name, "copy of " + repairName(rel) + " doesn't have the stored checksum"}
+	}
+
+	resp, err := peerRequest(peer, "GET", target, nil, 0)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", &peerError{peer.Name, fmt.Sprintf("GET %s returned %s", target, resp.Status)}
+	}
+	f, err := ioutil.TempFile(tmpDir(), "repair-")
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), resp.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && hex.EncodeToString(h.Sum(nil)) != expected {
+		err = &peerError{peer.Name, "sent a copy of " + repairName(rel) + " that doesn't match its checksum"}
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// repairFile replaces a corrupt local file with the first good peer copy and
+// returns the peer's name.
+func repairFile(uuid string, rel string, expected string) (string, error) {
+	if len(config.Peers) == 0 {
+		return "", &repairError{"no peers are configured"}
+	}
+	var lastErr error = &repairError{"no healthy peer has a good copy"}
+	for _, peer := range config.Peers {
+		if !peerHealthy(peer.Name) {
+			continue
+		}
+		tmp, err := fetchGoodCopy(peer, uuid, rel, expected)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		err = replaceCorruptFile(uuid, rel, expected, tmp, peer.Name)
+		os.Remove(tmp)
+		if err != nil {
+			return "", err
+		}
+		return peer.Name, nil
+	}
+	return "", lastErr
+}
+
+func replaceCorruptFile(uuid string, rel string, expected string, tmp string, peer string) error {
+	release, err := beginWrite()
+	if err != nil {
+		return err
+	}
+	defer release()
+	unlock := lockHolding(uuid)
+	defer unlock()
+
+	dir := holdingDir(uuid)
+	dest := path.Join(dir, "albumart")
+	if rel != "" {
+		dest = path.Join(dir, "music", rel)
+	}
+	if err := ensureSafePath(config.LibraryPath, dest); err != nil {
+		return err
+	}
+	// Don't clobber a legitimate re-upload that happened meanwhile
+	sums, err := readChecksums(dir)
+	if err != nil {
+		return err
+	}
+	stored := sums.AlbumArt
+	if rel != "" {
+		stored = sums.Music[rel]
+	}
+	if stored["sha256"] != expected {
+		return &repairError{repairName(rel) + " was replaced while the repair was under way"}
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		return err
+	}
+	key := "albumart"
+	if rel != "" {
+		key = path.Join("music", rel)
+	}
+	records, err := readProvenance(dir)
+	if err != nil {
+		return err
+	}
+	prov := copyProvenance(provenanceRepaired, peer, fileProvenance(records, key))
+	return recordProvenance(dir, key, &prov)
+}
+
+// repairsHandler handles GET /UUID4/repairs.
+func repairsHandler(w http.ResponseWriter, r *http.Request, uuid string) {
+	if err := uuidSanityCheck(uuid); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dir := holdingDir(uuid)
+	if !dirExists(dir) {
+		http.Error(w, "holding not found on disk", http.StatusNotFound)
+		return
+	}
+	history, err := readRepairHistory(dir)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	js, err := json.Marshal(history)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
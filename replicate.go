@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+type Peer struct {
+	Name    string
+	URL     string
+	ApiUser string
+	ApiKey  string
+}
+
+var peerClient = &http.Client{Timeout: 30 * time.Minute, CheckRedirect: checkPeerRedirect}
+
+// bodyFunc opens a fresh copy of a request body so it can be sent again on a
+// retry or a redirect.
+type bodyFunc func() (io.ReadCloser, error)
+
+func bytesBody(data []byte) bodyFunc {
+	return func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+}
+
+func fileBody(p string) bodyFunc {
+	return func() (io.ReadCloser, error) {
+		return os.Open(p)
+	}
+}
+
+type peerError struct {
+	peer    string
+	problem string
+}
+
+func (e *peerError) Error() string {
+	return fmt.Sprintf("Peer %s: %s", e.peer, e.problem)
+}
+
+func findPeer(name string) (Peer, bool) {
+	for _, peer := range config.Peers {
+		if peer.Name == name {
+			return peer, true
+		}
+	}
+	return Peer{}, false
+}
+
+func peerURL(peer Peer, parts ...string) string {
+	escaped := []string{}
+	for _, part := range parts {
+		for _, segment := range strings.Split(part, "/") {
+			escaped = append(escaped, url.PathEscape(segment))
+		}
+	}
+	return strings.TrimSuffix(peer.URL, "/") + "/" + strings.Join(escaped, "/")
+}
+
+func newPeerRequest(peer Peer, method string, target string, body bodyFunc, size int64) (*http.Request, error) {
+	req, err := http.NewRequest(method, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		if req.Body, err = body(); err != nil {
+			return nil, err
+		}
+		req.GetBody = body
+		req.ContentLength = size
+	}
+	req.SetBasicAuth(peer.ApiUser, peer.ApiKey)
+	// Names us in the provenance of what we send
+	from := config.NodeName
+	if from == "" {
+		from = "1"
+	}
+	req.Header.Set(replicationHeader, from)
+	return req, nil
+}
+
+// peerRequest sends a request to a peer, retrying it if the method is
+// idempotent.
+func peerRequest(peer Peer, method string, target string, body bodyFunc, size int64) (*http.Response, error) {
+	return doPeerRequest(peer, idempotentMethod(method), func() (*http.Request, error) {
+		return newPeerRequest(peer, method, target, body, size)
+	})
+}
+
+// peerQuery is peerRequest for POSTs that only read, which are safe to retry.
+func peerQuery(peer Peer, target string, body []byte) (*http.Response, error) {
+	return doPeerRequest(peer, true, func() (*http.Request, error) {
+		return newPeerRequest(peer, "POST", target, bytesBody(body), int64(len(body)))
+	})
+}
+
+func peerHolding(peer Peer, uuid string) (*Holding, error) {
+	resp, err := peerRequest(peer, "GET", peerURL(peer, uuid), nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, &peerError{peer.Name, fmt.Sprintf("GET %s returned %s", uuid, resp.Status)}
+	}
+	holding := &Holding{}
+	err = json.NewDecoder(resp.Body).Decode(holding)
+	return holding, err
+}
+
+// pushFile uploads a file with its digests, so the peer refuses a copy that
+// was damaged on the way, and with its provenance.
+func pushFile(peer Peer, target string, src string, sums map[string]string, prov Provenance) error {
+	stat, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	resp, err := doPeerRequest(peer, true, func() (*http.Request, error) {
+		req, err := newPeerRequest(peer, "PUT", target, fileBody(src), stat.Size())
+		if err != nil {
+			return nil, err
+		}
+		for alg, sum := range sums {
+			req.Header.Set(checksumHeaderPrefix+alg, sum)
+		}
+		js, _ := json.Marshal(prov)
+		req.Header.Set(provenanceHeader, string(js))
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &peerError{peer.Name, fmt.Sprintf("PUT %s returned %s", target, resp.Status)}
+	}
+	return nil
+}
+
+// pushHolding copies a holding to a peer through the peer's own API: files
+// first, then album art, then the lock if the holding is locked here. A
+// holding that is already locked on the peer is left alone for verification
+// to judge. progress is called with the size of each file once it is sent.
+func pushHolding(peer Peer, uuid string, dir string, progress func(int64)) error {
+	remote, err := peerHolding(peer, uuid)
+	if err != nil {
+		return err
+	}
+	if remote != nil && remote.Locked {
+		return nil
+	}
+
+	sums, err := localChecksums(dir)
+	if err != nil {
+		return err
+	}
+	records, err := readProvenance(dir)
+	if err != nil {
+		return err
+	}
+
+	done := readHolding(uuid)
+	defer done()
+	musicDir := path.Join(dir, "music")
+	err = walkFiles(musicDir, func(rel string) error {
+		src := path.Join(musicDir, rel)
+		if err := pushFile(peer, peerURL(peer, uuid, "music", rel), src, sums.Music[rel], fileProvenance(records, path.Join("music", rel))); err != nil {
+			return err
+		}
+		if stat, err := os.Stat(src); err == nil {
+			progress(stat.Size())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(path.Join(dir, "albumart")); err == nil {
+		if err := pushFile(peer, peerURL(peer, uuid, "albumart"), path.Join(dir, "albumart"), sums.AlbumArt, fileProvenance(records, "albumart")); err != nil {
+			return err
+		}
+	}
+	if _, err := os.Stat(path.Join(dir, masterArtFileName)); err == nil {
+		if err := pushFile(peer, peerURL(peer, uuid, "albumart", "master"), path.Join(dir, masterArtFileName), sums.MasterArt, fileProvenance(records, masterArtFileName)); err != nil {
+			return err
+		}
+	}
+	for _, slot := range artworkSlots(dir) {
+		p := path.Join(dir, artworkDirName, slot)
+		if _, err := os.Stat(p); err != nil {
+			continue
+		}
+		if err := pushFile(peer, peerURL(peer, uuid, "albumart", slot), p, sums.Artwork[slot], fileProvenance(records, path.Join(artworkDirName, slot))); err != nil {
+			return err
+		}
+	}
+
+	if _, err := os.Stat(path.Join(dir, lockFileName)); err == nil {
+		resp, err := peerRequest(peer, "PUT", peerURL(peer, uuid, "lock"), nil, 0)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusConflict {
+			return &peerError{peer.Name, fmt.Sprintf("PUT %s/lock returned %s", uuid, resp.Status)}
+		}
+	}
+	return nil
+}
+
+// localChecksums returns the stored digests of a holding, computing SHA-256
+// for any file that doesn't have one yet.
+func localChecksums(dir string) (Checksums, error) {
+	sums, err := readChecksums(dir)
+	if err != nil {
+		return sums, err
+	}
+	musicDir := path.Join(dir, "music")
+	err = walkFiles(musicDir, func(rel string) error {
+		if len(sums.Music[rel]) > 0 {
+			return nil
+		}
+		sum, err := hashFile(path.Join(musicDir, rel))
+		if err != nil {
+			return err
+		}
+		sums.Music[rel] = map[string]string{"sha256": sum}
+		return nil
+	})
+	if err != nil {
+		return sums, err
+	}
+	if len(sums.AlbumArt) == 0 {
+		if sum, err := hashFile(path.Join(dir, "albumart")); err == nil {
+			sums.AlbumArt = map[string]string{"sha256": sum}
+		}
+	}
+	if len(sums.MasterArt) == 0 {
+		if sum, err := hashFile(path.Join(dir, masterArtFileName)); err == nil {
+			sums.MasterArt = map[string]string{"sha256": sum}
+		}
+	}
+	return sums, nil
+}
+
+// checksumsAgree compares every algorithm both sides know. A peer that
+// reports no digests at all is too old to have stored them and only gets the
+// size check.
+func checksumsAgree(local map[string]string, remote map[string]string) bool {
+	if len(remote) == 0 {
+		return true
+	}
+	for alg, sum := range remote {
+		if localSum, ok := local[alg]; ok && localSum != sum {
+			return false
+		}
+	}
+	return true
+}
+
+// verifyHolding checks that a peer holds every file of the local copy with
+// the same size and checksums, the same album art in every slot and the same
+// master, each with the same checksums, and agrees about the lock.
+func verifyHolding(peer Peer, uuid string, dir string) error {
+	remote, err := peerHolding(peer, uuid)
+	if err != nil {
+		return err
+	}
+	if remote == nil {
+		return &peerError{peer.Name, uuid + " is missing"}
+	}
+
+	_, lockErr := os.Stat(path.Join(dir, lockFileName))
+	slots := artworkSlots(dir)
+	if remote.Artwork == nil {
+		// A peer from before slots only says whether it has any art
+		if remote.HasArtwork != (len(slots) > 0) {
+			return &peerError{peer.Name, uuid + " album art differs"}
+		}
+	} else if strings.Join(remote.Artwork, ",") != strings.Join(slots, ",") {
+		return &peerError{peer.Name, fmt.Sprintf("%s has album art in %v, expected %v", uuid, remote.Artwork, slots)}
+	}
+	_, artErr := os.Stat(path.Join(dir, "albumart"))
+	_, masterErr := os.Stat(path.Join(dir, masterArtFileName))
+	if remote.HasMasterArt != (masterErr == nil) {
+		return &peerError{peer.Name, uuid + " master album art differs"}
+	}
+	// A master alone is listed as the front too, so only the digests can
+	// tell whether the peer also has albumart itself
+	if masterErr == nil && remote.Checksums != nil && (remote.Checksums.AlbumArt != nil) != (artErr == nil) {
+		return &peerError{peer.Name, uuid + " album art differs"}
+	}
+	if remote.Locked != (lockErr == nil) {
+		return &peerError{peer.Name, uuid + " lock state differs"}
+	}
+
+	musicDir := path.Join(dir, "music")
+	local := map[string]int64{}
+	paths := []string{}
+	err = walkFiles(musicDir, func(rel string) error {
+		stat, err := os.Stat(path.Join(musicDir, rel))
+		if err != nil {
+			return err
+		}
+		local[rel] = stat.Size()
+		paths = append(paths, rel)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(remote.FileList) != len(paths) {
+		return &peerError{peer.Name, fmt.Sprintf("%s has %d files, expected %d", uuid, len(remote.FileList), len(paths))}
+	}
+
+	js, err := json.Marshal(paths)
+	if err != nil {
+		return err
+	}
+	resp, err := peerQuery(peer, peerURL(peer, uuid, "sizes"), js)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &peerError{peer.Name, fmt.Sprintf("POST %s/sizes returned %s", uuid, resp.Status)}
+	}
+	sizes := []FileSize{}
+	if err := json.NewDecoder(resp.Body).Decode(&sizes); err != nil {
+		return err
+	}
+	sums, err := localChecksums(dir)
+	if err != nil {
+		return err
+	}
+	for _, size := range sizes {
+		if size.Missing || size.Size != local[size.Path] {
+			return &peerError{peer.Name, fmt.Sprintf("%s/%s does not match", uuid, size.Path)}
+		}
+		if !checksumsAgree(sums.Music[size.Path], size.Checksums) {
+			return &peerError{peer.Name, fmt.Sprintf("%s/%s checksum does not match", uuid, size.Path)}
+		}
+	}
+	if artErr == nil && remote.Checksums != nil && !checksumsAgree(sums.AlbumArt, remote.Checksums.AlbumArt) {
+		return &peerError{peer.Name, uuid + " album art checksum does not match"}
+	}
+	if masterErr == nil && remote.Checksums != nil && !checksumsAgree(sums.MasterArt, remote.Checksums.MasterArt) {
+		return &peerError{peer.Name, uuid + " master album art checksum does not match"}
+	}
+	if remote.Checksums != nil {
+		for _, slot := range slots {
+			if slot != "front" && !checksumsAgree(sums.Artwork[slot], remote.Checksums.Artwork[slot]) {
+				return &peerError{peer.Name, fmt.Sprintf("%s album art in %s checksum does not match", uuid, slot)}
+			}
+		}
+	}
+	return nil
+}
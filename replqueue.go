@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Every change to a holding queues it for the peers in ReplicateTo. Each
+// peer's queue is kept in .moss-replication/PEER.json under the library root,
+// so pending work survives a restart, and is worked through by one worker per
+// peer that pushes and verifies the holding.
+const replicationDirName = ".moss-replication"
+
+const defaultReplicationQueueLimit = 10000
+
+// Failed pushes are retried with backoff up to this long apart
+const replicationRetryCap = 10 * time.Minute
+
+// Idle workers look for due retries and unsaved queues this often
+const replicationIdleInterval = 5 * time.Second
+
+type ReplicationItem struct {
+	UUID     string
+	Enqueued Timestamp
+	Updated  Timestamp
+
+	Attempts    int        `json:",omitempty"`
+	LastError   string     `json:",omitempty"`
+	NextAttempt *Timestamp `json:",omitempty"`
+}
+
+type replicationQueue struct {
+	mu    sync.Mutex
+	peer  Peer
+	items map[string]*ReplicationItem
+	wake  chan struct{}
+
+	// Set when the queue changed but couldn't be saved, e.g. while frozen
+	dirty  bool
+	warned bool
+
+	holdings rollingCounter
+	bytes    rollingCounter
+}
+
+// Set up at startup and only read afterwards
+var replicationQueues = map[string]*replicationQueue{}
+
+type ReplicationThroughput struct {
+	Holdings uint64
+	Bytes    uint64
+}
+
+type ReplicationStats struct {
+	Peer          string
+	Depth         int
+	OverLimit     bool
+	OldestPending *Timestamp `json:",omitempty"`
+	OldestAge     float64    `json:",omitempty"`
+	Throughput    map[string]ReplicationThroughput
+}
+
+type replicationBackloggedError struct {
+	peer  string
+	depth int
+}
+
+func (e *replicationBackloggedError) Error() string {
+	return fmt.Sprintf("Replication queue for %s is critically full (%d holdings), try again later", e.peer, e.depth)
+}
+
+func replicationDir() string {
+	return path.Join(config.LibraryPath, replicationDirName)
+}
+
+func (q *replicationQueue) file() string {
+	return path.Join(replicationDir(), url.PathEscape(q.peer.Name)+".json")
+}
+
+// save writes the queue out. The caller holds q.mu.
+func (q *replicationQueue) save() {
+	release, err := beginWrite()
+	if err != nil {
+		q.dirty = true
+		return
+	}
+	defer release()
+
+	items := []*ReplicationItem{}
+	for _, item := range q.items {
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Enqueued.Before(items[j].Enqueued.Time) })
+	js, err := json.Marshal(items)
+	if err == nil {
+		err = writeFileAtomic(q.file(), js)
+	}
+	if err != nil {
+		log.Printf("Cannot save replication queue for %s: %s\n", q.peer.Name, err.Error())
+		q.dirty = true
+		return
+	}
+	q.dirty = false
+}
+
+func (q *replicationQueue) load() error {
+	data, err := ioutil.ReadFile(q.file())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	items := []*ReplicationItem{}
+	if err := json.Unmarshal(data, &items); err != nil {
+		return err
+	}
+	for _, item := range items {
+		q.items[item.UUID] = item
+	}
+	return nil
+}
+
+// checkDepth logs once when the queue grows past ReplicationQueueLimit and
+// again once it has drained back below it. The caller holds q.mu.
+func (q *replicationQueue) checkDepth() {
+	over := len(q.items) >= config.ReplicationQueueLimit
+	if over && !q.warned {
+		log.Printf("WARNING: replication queue for %s is %d holdings deep (limit %d)\n", q.peer.Name, len(q.items), config.ReplicationQueueLimit)
+	} else if !over && q.warned {
+		log.Printf("Replication queue for %s is back under its limit (%d holdings)\n", q.peer.Name, len(q.items))
+	}
+	q.warned = over
+}
+
+func (q *replicationQueue) enqueue(uuid string) {
+	q.mu.Lock()
+	now := time.Now().UTC()
+	if item, ok := q.items[uuid]; ok {
+		// Already pending; the next push will pick up this change too
+		item.Updated = stamp(now)
+		item.NextAttempt = nil
+	} else {
+		q.items[uuid] = &ReplicationItem{UUID: uuid, Enqueued: stamp(now), Updated: stamp(now)}
+	}
+	q.checkDepth()
+	q.save()
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next returns a copy of the oldest item that is due, or nil.
+func (q *replicationQueue) next() *ReplicationItem {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.dirty {
+		q.save()
+	}
+	now := time.Now()
+	var oldest *ReplicationItem
+	for _, item := range q.items {
+		if item.NextAttempt != nil && item.NextAttempt.After(now) {
+			continue
+		}
+		if oldest == nil || item.Enqueued.Before(oldest.Enqueued.Time) {
+			oldest = item
+		}
+	}
+	if oldest == nil {
+		return nil
+	}
+	item := *oldest
+	return &item
+}
+
+// done records the outcome of pushing item. If the holding changed again
+// while it was being pushed it stays queued.
+func (q *replicationQueue) done(item *ReplicationItem, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	current, ok := q.items[item.UUID]
+	if !ok {
+		return
+	}
+	if err == nil {
+		if current.Updated.Equal(item.Updated.Time) {
+			delete(q.items, item.UUID)
+		} else {
+			current.Enqueued = current.Updated
+			current.Attempts = 0
+			current.LastError = ""
+		}
+		q.holdings.add()
+	} else if current.Updated.Equal(item.Updated.Time) {
+		current.Attempts++
+		current.LastError = err.Error()
+		delay := peerRetryCap << uint(current.Attempts-1)
+		if delay <= 0 || delay > replicationRetryCap {
+			delay = replicationRetryCap
+		}
+		if _, ok := err.(*peerUnavailableError); ok {
+			// Not the holding's fault; wait for the peer to come back
+			current.Attempts--
+			delay = peerProbeInterval
+		}
+		next := stamp(time.Now().Add(delay))
+		current.NextAttempt = &next
+	}
+	q.checkDepth()
+	q.save()
+}
+
+func (q *replicationQueue) push(item *ReplicationItem) error {
+	dir := holdingDir(item.UUID)
+	if !dirExists(dir) {
+		// Removed since it was queued; deletes aren't replicated
+		return nil
+	}
+	err := pushHolding(q.peer, item.UUID, dir, func(n int64) {
+		q.bytes.addN(uint64(n))
+	})
+	if err == nil {
+		err = verifyHolding(q.peer, item.UUID, dir)
+	}
+	return err
+}
+
+func (q *replicationQueue) run() {
+	for {
+		item := q.next()
+		if item == nil {
+			select {
+			case <-q.wake:
+			case <-time.After(replicationIdleInterval):
+			}
+			continue
+		}
+		err := q.push(item)
+		if err != nil {
+			log.Printf("Replicating %s to %s: %s\n", item.UUID, q.peer.Name, err.Error())
+		}
+		q.done(item, err)
+	}
+}
+
+// initReplication loads the queues of the peers in ReplicateTo and starts
+// their workers.
+func initReplication() error {
+	if len(config.ReplicateTo) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(replicationDir(), 0755); err != nil {
+		return err
+	}
+	for _, name := range config.ReplicateTo {
+		peer, ok := findPeer(name)
+		if !ok {
+			return &peerError{name, "is in ReplicateTo but not in Peers"}
+		}
+		q := &replicationQueue{peer: peer, items: map[string]*ReplicationItem{}, wake: make(chan struct{}, 1)}
+		if err := q.load(); err != nil {
+			return err
+		}
+		if len(q.items) > 0 {
+			log.Printf("Resuming replication to %s with %d holdings pending\n", peer.Name, len(q.items))
+		}
+		q.checkDepth()
+		replicationQueues[peer.Name] = q
+		go q.run()
+	}
+	return nil
+}
+
+func enqueueReplication(uuid string) {
+	for _, q := range replicationQueues {
+		q.enqueue(uuid)
+	}
+}
+
+// checkReplicationBacklog refuses new locks while any queue is at
+// ReplicationQueueCritical, since locked holdings are what peers most need.
+func checkReplicationBacklog() error {
+	if config.ReplicationQueueCritical <= 0 {
+		return nil
+	}
+	for _, q := range replicationQueues {
+		q.mu.Lock()
+		depth := len(q.items)
+		q.mu.Unlock()
+		if depth >= config.ReplicationQueueCritical {
+			return &replicationBackloggedError{q.peer.Name, depth}
+		}
+	}
+	return nil
+}
+
+func replicationBacklogged(w http.ResponseWriter, err error) {
+	log.Println(err.Error())
+	w.Header().Set("Retry-After", "60")
+	http.Error(w, err.Error(), http.StatusServiceUnavailable)
+}
+
+func replicationStats(now time.Time) []ReplicationStats {
+	names := []string{}
+	for name := range replicationQueues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := []ReplicationStats{}
+	for _, name := range names {
+		q := replicationQueues[name]
+		q.mu.Lock()
+		s := ReplicationStats{Peer: name, Depth: len(q.items), OverLimit: q.warned, Throughput: map[string]ReplicationThroughput{}}
+		for _, item := range q.items {
+			if s.OldestPending == nil || item.Enqueued.Before(s.OldestPending.Time) {
+				enqueued := item.Enqueued
+				s.OldestPending = &enqueued
+			}
+		}
+		q.mu.Unlock()
+		if s.OldestPending != nil {
+			s.OldestAge = now.Sub(s.OldestPending.Time).Seconds()
+		}
+		for _, window := range statsWindows {
+			s.Throughput[window.name] = ReplicationThroughput{q.holdings.sum(now, window.duration), q.bytes.sum(now, window.duration)}
+		}
+		result = append(result, s)
+	}
+	return result
+}
+
+func resetReplicationStats() {
+	for _, q := range replicationQueues {
+		q.holdings.reset()
+		q.bytes.reset()
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// User is an extra set of API credentials with a role. The ApiUser/ApiKey
+// pair from the config is always an admin.
+type User struct {
+	Name string
+	Key  string
+	Role string
+
+	// Bytes per 24 hours, overriding RoleUploadQuotas; -1 for no limit
+	UploadQuota int64 `json:",omitempty"`
+}
+
+// routeRule grants access to a path, or with a trailing "/..." to everything
+// under it, for the listed methods (all methods if empty). A {uuid} path
+// element matches any holding UUID.
+type routeRule struct {
+	methods []string
+	path    string
+}
+
+var readMethods = []string{"GET", "HEAD"}
+
+// roleRoutes says which requests each role's credentials may be used for.
+// Requests made with credentials outside their role's rules are refused with
+// 403 before they reach a handler.
+var roleRoutes = map[string][]routeRule{
+	"admin": {
+		{nil, "/..."},
+	},
+	"write": {
+		{readMethods, "/"},
+		{readMethods, "/{uuid}"},
+		{readMethods, "/{uuid}/..."},
+		{readMethods, "/version"},
+		{readMethods, "/changes"},
+		{readMethods, "/diff"},
+		{readMethods, "/search"},
+		{readMethods, "/lookup"},
+		{readMethods, "/healthz"},
+		{readMethods, "/readyz"},
+		{readMethods, "/stats"},
+		{readMethods, "/cluster"},
+		{readMethods, "/usage/top"},
+		{readMethods, "/layout"},
+		{readMethods, "/export-tree"},
+		{readMethods, "/uuidinfo/..."},
+		{readMethods, "/auth/check"},
+		{readMethods, "/metrics"},
+		{readMethods, "/locks/pending"},
+		{readMethods, "/me/rejections"},
+		{readMethods, "/me/usage"},
+		{[]string{"POST"}, "/locks"},
+		{[]string{"POST"}, "/albumart/batch"},
+		{[]string{"PUT", "DELETE"}, "/{uuid}/music/..."},
+		{[]string{"PUT", "DELETE"}, "/{uuid}/albumart"},
+		{[]string{"PUT", "DELETE"}, "/{uuid}/albumart/..."},
+		{[]string{"PUT"}, "/{uuid}/attrs/..."},
+		{[]string{"PUT", "DELETE"}, "/{uuid}/private"},
+		{[]string{"PUT", "DELETE"}, "/{uuid}/expected"},
+		{[]string{"PUT"}, "/{uuid}/lock"},
+		{[]string{"POST"}, "/{uuid}/lock/propose"},
+		{[]string{"POST"}, "/{uuid}/sizes"},
+		{[]string{"POST"}, "/{uuid}/verify"},
+		{[]string{"POST"}, "/{uuid}/validate"},
+		{[]string{"POST"}, "/{uuid}/txn"},
+		{[]string{"POST"}, "/{uuid}/txn/..."},
+	},
+	"monitor": {
+		{readMethods, "/version"},
+		{readMethods, "/healthz"},
+		{readMethods, "/readyz"},
+		{readMethods, "/stats"},
+		{readMethods, "/metrics"},
+	},
+}
+
+func (rule routeRule) allows(method string, p string) bool {
+	prefix := strings.HasSuffix(rule.path, "/...")
+	ruleElements := strings.Split(strings.TrimSuffix(rule.path, "/..."), "/")
+	elements := strings.Split(p, "/")
+	if prefix {
+		if len(elements) <= len(ruleElements) {
+			return false
+		}
+	} else if len(elements) != len(ruleElements) {
+		return false
+	}
+	for i, want := range ruleElements {
+		if want == "{uuid}" {
+			if uuidSanityCheck(strings.ToLower(elements[i])) != nil {
+				return false
+			}
+		} else if elements[i] != want {
+			return false
+		}
+	}
+	if len(rule.methods) == 0 {
+		return true
+	}
+	for _, m := range rule.methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+func roleAllows(role string, method string, p string) bool {
+	for _, rule := range roleRoutes[role] {
+		if rule.allows(method, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func credentialsMatch(user string, key string, wantUser string, wantKey string) bool {
+	return wantUser != "" && subtle.ConstantTimeCompare([]byte(user), []byte(wantUser)) == 1 && subtle.ConstantTimeCompare([]byte(key), []byte(wantKey)) == 1
+}
+
+// authenticate returns the role of the request's credentials, or "" if it
+// has none or they are wrong.
+func authenticate(r *http.Request) string {
+	user, key, ok := r.BasicAuth()
+	if !ok {
+		return ""
+	}
+	if credentialsMatch(user, key, config.ApiUser, config.ApiKey) {
+		return "admin"
+	}
+	for _, u := range config.Users {
+		if credentialsMatch(user, key, u.Name, u.Key) {
+			return u.Role
+		}
+	}
+	return ""
+}
+
+// checkRoles keeps role-restricted credentials to their routes. Anonymous
+// requests and unknown credentials go through untouched; handlers that need
+// authentication still reject them.
+func checkRoles(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		role := authenticate(r)
+		if role != "" && !roleAllows(role, r.Method, r.URL.Path) {
+			user, _, _ := r.BasicAuth()
+			log.Printf("Refused %s %s for %s from %s (role %s)\n", r.Method, r.URL.Path, user, clientIP(r), role)
+			http.Error(w, "Your credentials don't allow this request", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AuthCheck is what GET /auth/check tells a client about its credentials.
+type AuthCheck struct {
+	User string
+	Role string
+	// Whether the role may upload, lock and otherwise change holdings
+	CanWrite bool
+	// The ranges this server takes writes for; every UUID without shards
+	WritableRanges       []ShardRange
+	AcceptedUUIDVersions []int
+	Usage                UploadUsage
+	Limits               Limits
+	MinClientVersion     string `json:",omitempty"`
+}
+
+// authCheckHandler handles GET /auth/check, for clients to try their
+// credentials before starting on anything long.
+func authCheckHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkAuth(w, r) {
+		return
+	}
+	user, _, _ := r.BasicAuth()
+	role := authenticate(r)
+	check := AuthCheck{
+		User:                 user,
+		Role:                 role,
+		CanWrite:             role == "admin" || role == "write",
+		WritableRanges:       writableRanges(),
+		AcceptedUUIDVersions: acceptedUUIDVersions(),
+		Usage:                usageFor(user, role),
+		Limits:               config.Limits,
+		MinClientVersion:     config.MinClientVersion,
+	}
+	if len(config.Shards) == 0 {
+		check.WritableRanges = []ShardRange{{MinUUID: "00000000-0000-0000-0000-000000000000", MaxUUID: "ffffffff-ffff-ffff-ffff-ffffffffffff"}}
+	}
+	if !check.CanWrite {
+		check.WritableRanges = []ShardRange{}
+	}
+	js, err := json.Marshal(check)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+type unknownRoleError struct {
+	user string
+	role string
+}
+
+func (e *unknownRoleError) Error() string {
+	return fmt.Sprintf("Unknown role %q for user %s", e.role, e.user)
+}
+
+func validateUsers() error {
+	for _, u := range config.Users {
+		if _, ok := roleRoutes[u.Role]; !ok {
+			return &unknownRoleError{u.Name, u.Role}
+		}
+	}
+	return nil
+}
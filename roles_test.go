@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/wuvt/moss/mosstest"
+)
+
+func TestRoleRoutes(t *testing.T) {
+	s := newTestServer(t, mosstest.Spec{Holdings: []mosstest.Holding{{Tracks: []mosstest.Track{{Name: "01.flac"}}}}}, func(c *Config) {
+		c.Users = []User{
+			{Name: "writer", Key: "writer", Role: "write"},
+			{Name: "monitor", Key: "monitor", Role: "monitor"},
+		}
+	})
+	uuid := s.Holdings[0].UUID
+	roles := []string{"admin", "write", "monitor"}
+	for _, c := range []struct {
+		method, path string
+		// Whether admin, write and monitor may make the request
+		allowed [3]bool
+	}{
+		{"GET", "/version", [3]bool{true, true, true}},
+		{"GET", "/healthz", [3]bool{true, true, true}},
+		{"HEAD", "/readyz", [3]bool{true, true, true}},
+		{"GET", "/stats", [3]bool{true, true, true}},
+		{"GET", "/metrics", [3]bool{true, true, true}},
+		{"DELETE", "/stats", [3]bool{true, false, false}},
+		{"GET", "/auth/check", [3]bool{true, true, false}},
+		{"GET", "/cluster", [3]bool{true, true, false}},
+		{"GET", "/usage/top", [3]bool{true, true, false}},
+		{"GET", "/me/rejections", [3]bool{true, true, false}},
+		{"GET", "/me/usage", [3]bool{true, true, false}},
+		{"GET", "/changes", [3]bool{true, true, false}},
+		{"GET", "/search?q=x", [3]bool{true, true, false}},
+		{"GET", "/", [3]bool{true, true, false}},
+		{"GET", "/" + uuid + "/", [3]bool{true, true, false}},
+		{"GET", "/" + uuid + "/music/01.flac", [3]bool{true, true, false}},
+		{"PUT", "/" + uuid + "/music/02.flac", [3]bool{true, true, false}},
+		{"DELETE", "/" + uuid + "/music/02.flac", [3]bool{true, true, false}},
+		{"PUT", "/" + uuid + "/lock", [3]bool{true, true, false}},
+		{"DELETE", "/" + uuid + "/lock", [3]bool{true, false, false}},
+		{"DELETE", "/" + mosstest.NewUUID(), [3]bool{true, false, false}},
+		{"GET", "/admin/jobs", [3]bool{true, false, false}},
+		{"POST", "/albumart/batch", [3]bool{true, true, false}},
+	} {
+		p := c.path
+		if i := strings.IndexByte(p, '?'); i >= 0 {
+			p = p[:i]
+		}
+		for i, role := range roles {
+			if got := roleAllows(role, c.method, p); got != c.allowed[i] {
+				t.Errorf("%s %s for %s: roleAllows says %t", c.method, c.path, role, got)
+			}
+			user, key := role, role
+			if role == "admin" {
+				user, key = testUser, testKey
+			} else if role == "write" {
+				user, key = "writer", "writer"
+			}
+			var body []byte
+			if c.method == "PUT" || c.method == "POST" {
+				body = mosstest.FLAC(0)
+			}
+			resp := s.DoAs(user, key, c.method, c.path, body)
+			if refused := resp.Status == http.StatusForbidden && strings.Contains(string(resp.Body), "credentials don't allow"); refused == c.allowed[i] {
+				t.Errorf("%s %s for %s: got %d %s", c.method, c.path, role, resp.Status, resp.Body)
+			}
+		}
+	}
+}
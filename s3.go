@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ArchiveDestination is an S3-compatible bucket that locked holdings can be
+// exported to for cold storage.
+type ArchiveDestination struct {
+	Name         string
+	Endpoint     string
+	Region       string
+	Bucket       string
+	Prefix       string `json:",omitempty"`
+	StorageClass string `json:",omitempty"`
+	AccessKey    string
+	SecretKey    string
+}
+
+// Requests are signed with the payload hash, so empty bodies use this one
+const emptyPayloadSHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+var s3Client = &http.Client{Timeout: 6 * time.Hour}
+
+type s3Error struct {
+	destination string
+	problem     string
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("Archive destination %s: %s", e.destination, e.problem)
+}
+
+func findDestination(name string) (ArchiveDestination, bool) {
+	for _, dest := range config.ArchiveDestinations {
+		if dest.Name == name {
+			return dest, true
+		}
+	}
+	return ArchiveDestination{}, false
+}
+
+func (d ArchiveDestination) objectKey(name string) string {
+	return strings.TrimPrefix(strings.TrimSuffix(d.Prefix, "/")+"/"+name, "/")
+}
+
+func (d ArchiveDestination) location(key string) string {
+	return "s3://" + d.Bucket + "/" + key
+}
+
+// objectURL uses path-style addressing, which every S3-compatible store
+// supports.
+func (d ArchiveDestination) objectURL(key string) string {
+	escaped := []string{}
+	for _, segment := range strings.Split(key, "/") {
+		escaped = append(escaped, url.PathEscape(segment))
+	}
+	return strings.TrimSuffix(d.Endpoint, "/") + "/" + url.PathEscape(d.Bucket) + "/" + strings.Join(escaped, "/")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// signS3 adds an AWS Signature Version 4 Authorization header to req.
+func signS3(req *http.Request, dest ArchiveDestination, payloadHash string) {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "content-type" || strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := []string{}
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + dest.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+dest.SecretKey), day)
+	key = hmacSHA256(key, dest.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		dest.AccessKey, scope, signedHeaders, signature))
+}
+
+func s3Check(dest ArchiveDestination, resp *http.Response, what string) error {
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return &s3Error{dest.Name, fmt.Sprintf("%s returned %s: %s", what, resp.Status, strings.TrimSpace(string(detail)))}
+}
+
+// s3PutFile uploads a local file whose SHA-256 is already known.
+func s3PutFile(dest ArchiveDestination, key string, p string, sum string, contentType string, storageClass string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("PUT", dest.objectURL(key), f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = stat.Size()
+	req.Header.Set("Content-Type", contentType)
+	if storageClass != "" {
+		req.Header.Set("X-Amz-Storage-Class", storageClass)
+	}
+	signS3(req, dest, sum)
+	resp, err := s3Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return s3Check(dest, resp, "PUT "+key)
+}
+
+// s3Get opens an object for reading. Objects in Glacier-class storage must
+// have been restored in the bucket first; until then S3 refuses the GET.
+func s3Get(dest ArchiveDestination, key string) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", dest.objectURL(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	signS3(req, dest, emptyPayloadSHA256)
+	resp, err := s3Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := s3Check(dest, resp, "GET "+key); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp.Body, nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const maxPlanTargets = 256
+
+const minUUIDString = "00000000-0000-0000-0000-000000000000"
+const maxUUIDString = "ffffffff-ffff-ffff-ffff-ffffffffffff"
+
+type PlannedShard struct {
+	Shard    Shard
+	Holdings int
+	Bytes    int64
+}
+
+type ShardPlan struct {
+	Targets    int
+	Exclude    string `json:",omitempty"`
+	Holdings   int
+	Bytes      int64
+	Current    []PlannedShard
+	Partitions []PlannedShard
+}
+
+type plannedHolding struct {
+	uuid  string
+	bytes int64
+}
+
+func uuidToInt(uuid string) *big.Int {
+	n, _ := new(big.Int).SetString(strings.Replace(uuid, "-", "", -1), 16)
+	return n
+}
+
+func intToUUID(n *big.Int) string {
+	s := fmt.Sprintf("%032x", n)
+	return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:32]
+}
+
+// splitPoint picks the boundary between two neighbouring holdings halfway
+// between their UUIDs, so new holdings on either side land where expected.
+// It returns the MaxUUID of the lower partition and the MinUUID of the next.
+func splitPoint(lower string, upper string) (string, string) {
+	mid := new(big.Int).Add(uuidToInt(lower), uuidToInt(upper))
+	mid.Rsh(mid, 1)
+	return intToUUID(mid), intToUUID(new(big.Int).Add(mid, big.NewInt(1)))
+}
+
+// evenSplit divides the whole UUID space into n ranges, for libraries with
+// nothing in them to balance.
+func evenSplit(n int) []PlannedShard {
+	space := new(big.Int).Lsh(big.NewInt(1), 128)
+	step := new(big.Int).Div(space, big.NewInt(int64(n)))
+	partitions := []PlannedShard{}
+	for i := 0; i < n; i++ {
+		min := new(big.Int).Mul(step, big.NewInt(int64(i)))
+		max := new(big.Int).Sub(new(big.Int).Add(min, step), big.NewInt(1))
+		if i == n-1 {
+			max = new(big.Int).Sub(space, big.NewInt(1))
+		}
+		partitions = append(partitions, PlannedShard{Shard: Shard{MinUUID: intToUUID(min), MaxUUID: intToUUID(max), Writable: true}})
+	}
+	return partitions
+}
+
+// planPartitions cuts the UUID-ordered holdings into at most n contiguous
+// runs of roughly equal bytes.
+func planPartitions(holdings []plannedHolding, total int64, n int) []PlannedShard {
+	if len(holdings) == 0 {
+		return evenSplit(n)
+	}
+	if n > len(holdings) {
+		n = len(holdings)
+	}
+
+	partitions := []PlannedShard{}
+	current := PlannedShard{Shard: Shard{MinUUID: minUUIDString, Writable: true}}
+	// Each partition aims for an equal share of what's left, so one huge
+	// holding doesn't starve the partitions after it
+	bytesLeft := total
+	quota := float64(bytesLeft) / float64(n)
+	for i, h := range holdings {
+		current.Holdings++
+		current.Bytes += h.bytes
+
+		k := len(partitions) + 1
+		remaining := len(holdings) - i - 1
+		if k < n && remaining > 0 && (float64(current.Bytes) >= quota || remaining == n-k) {
+			max, nextMin := splitPoint(h.uuid, holdings[i+1].uuid)
+			current.Shard.MaxUUID = max
+			partitions = append(partitions, current)
+			bytesLeft -= current.Bytes
+			quota = float64(bytesLeft) / float64(n-k)
+			current = PlannedShard{Shard: Shard{MinUUID: nextMin, Writable: true}}
+		}
+	}
+	current.Shard.MaxUUID = maxUUIDString
+	return append(partitions, current)
+}
+
+// shardPlanHandler handles GET /admin/shard-plan?targets=N, proposing shard
+// ranges that split the library into N partitions of roughly equal size. It
+// only reads the library; nothing is changed.
+func shardPlanHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	targets, err := strconv.Atoi(r.URL.Query().Get("targets"))
+	if err != nil || targets < 1 || targets > maxPlanTargets {
+		http.Error(w, fmt.Sprintf("targets must be a number from 1 to %d", maxPlanTargets), http.StatusBadRequest)
+		return
+	}
+	exclude := r.URL.Query().Get("exclude")
+	if exclude != "" && exclude != "locked" && exclude != "unlocked" {
+		http.Error(w, "exclude must be locked or unlocked", http.StatusBadRequest)
+		return
+	}
+
+	plan := ShardPlan{Targets: targets, Exclude: exclude, Current: []PlannedShard{}}
+	for _, shard := range config.Shards {
+		plan.Current = append(plan.Current, PlannedShard{Shard: shard})
+	}
+	holdings := []plannedHolding{}
+	err = walkHoldings(config.LibraryPath, func(uuid string, dir string, legacy bool) error {
+		uuid = strings.ToLower(uuid)
+		if uuidSanityCheck(uuid) != nil {
+			return nil
+		}
+		_, err := os.Stat(path.Join(dir, lockFileName))
+		locked := err == nil
+		if (exclude == "locked" && locked) || (exclude == "unlocked" && !locked) {
+			return nil
+		}
+		h := plannedHolding{uuid, holdingBytes(dir)}
+		holdings = append(holdings, h)
+		plan.Holdings++
+		plan.Bytes += h.bytes
+		if i := shardIndex(uuid); i >= 0 {
+			plan.Current[i].Holdings++
+			plan.Current[i].Bytes += h.bytes
+		}
+		return nil
+	})
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	sort.Slice(holdings, func(i, j int) bool { return holdings[i].uuid < holdings[j].uuid })
+	plan.Partitions = planPartitions(holdings, plan.Bytes, targets)
+
+	js, err := json.Marshal(plan)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
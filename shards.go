@@ -0,0 +1,541 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// shardIndex returns the index of the configured shard covering uuid, or -1.
+// UUIDs are compared as lowercase strings, which orders them numerically.
+func shardIndex(uuid string) int {
+	for i, shard := range config.Shards {
+		if uuid >= strings.ToLower(shard.MinUUID) && uuid <= strings.ToLower(shard.MaxUUID) {
+			return i
+		}
+	}
+	return -1
+}
+
+func inShard(shard Shard, uuid string) bool {
+	return uuid >= strings.ToLower(shard.MinUUID) && uuid <= strings.ToLower(shard.MaxUUID)
+}
+
+type drainState struct {
+	peer Peer
+	job  *Job
+}
+
+// Shards being drained, keyed by lowercase MinUUID.
+var drains = struct {
+	sync.Mutex
+	m map[string]*drainState
+}{m: map[string]*drainState{}}
+
+type drainingError struct {
+	uuid  string
+	shard Shard
+	owner string
+}
+
+func (e *drainingError) Error() string {
+	return fmt.Sprintf("%s is in %s which is being drained, write to %s instead", e.uuid, describeShard(e.shard), e.owner)
+}
+
+// describeShard names a shard for error messages, by its label if it has one,
+// and the node it lives on.
+func describeShard(shard Shard) string {
+	name := fmt.Sprintf("shard %s-%s", shard.MinUUID, shard.MaxUUID)
+	if shard.Label != "" {
+		name = fmt.Sprintf("shard '%s'", shard.Label)
+	}
+	if config.NodeName != "" {
+		name += fmt.Sprintf(" on node '%s'", config.NodeName)
+	}
+	return name
+}
+
+type duplicateLabelError struct {
+	label string
+}
+
+func (e *duplicateLabelError) Error() string {
+	return fmt.Sprintf("label %q is used by more than one shard", e.label)
+}
+
+func validateShardLabels() error {
+	seen := map[string]bool{}
+	for _, shard := range config.Shards {
+		if shard.Label == "" {
+			continue
+		}
+		if seen[shard.Label] {
+			return &duplicateLabelError{shard.Label}
+		}
+		seen[shard.Label] = true
+	}
+	return nil
+}
+
+var uuidShape = regexp.MustCompile("^[a-f0-9]{8}-[a-f0-9]{4}-[a-f0-9]{4}-[a-f0-9]{4}-[a-f0-9]{12}$")
+
+type shardProblem struct {
+	index   int
+	problem string
+}
+
+// shardConfigError lists every problem found in Shards.
+type shardConfigError struct {
+	problems []shardProblem
+}
+
+func (p shardProblem) String() string {
+	if p.index < 0 {
+		return p.problem
+	}
+	return fmt.Sprintf("shard %d: %s", p.index, p.problem)
+}
+
+func (e *shardConfigError) Error() string {
+	lines := []string{}
+	for _, p := range e.problems {
+		lines = append(lines, p.String())
+	}
+	return strings.Join(lines, "; ")
+}
+
+// validateShards checks that every shard's range is made of UUIDs and runs
+// upwards, that the shards are sorted by range without overlapping, and that
+// at least one is Writable. A config without shards takes writes for every
+// UUID and passes. It only looks at cfg, so config checks can use it too.
+func validateShards(cfg Config) error {
+	if len(cfg.Shards) == 0 {
+		return nil
+	}
+	problems := []shardProblem{}
+	writable := false
+	for i, shard := range cfg.Shards {
+		min, max := strings.ToLower(shard.MinUUID), strings.ToLower(shard.MaxUUID)
+		wellFormed := true
+		if !uuidShape.MatchString(min) {
+			problems = append(problems, shardProblem{i, fmt.Sprintf("MinUUID %q is not a UUID", shard.MinUUID)})
+			wellFormed = false
+		}
+		if !uuidShape.MatchString(max) {
+			problems = append(problems, shardProblem{i, fmt.Sprintf("MaxUUID %q is not a UUID", shard.MaxUUID)})
+			wellFormed = false
+		}
+		if wellFormed && min > max {
+			problems = append(problems, shardProblem{i, fmt.Sprintf("MinUUID %s is greater than MaxUUID %s", min, max)})
+		}
+		prev := Shard{}
+		if i > 0 {
+			prev = cfg.Shards[i-1]
+		}
+		prevMin, prevMax := strings.ToLower(prev.MinUUID), strings.ToLower(prev.MaxUUID)
+		if wellFormed && i > 0 && uuidShape.MatchString(prevMin) && uuidShape.MatchString(prevMax) {
+			if min <= prevMax && max >= prevMin {
+				problems = append(problems, shardProblem{i, fmt.Sprintf("range overlaps shard %d (%s-%s)", i-1, prevMin, prevMax)})
+			} else if min < prevMin {
+				problems = append(problems, shardProblem{i, fmt.Sprintf("comes before shard %d; list shards in order of MinUUID", i-1)})
+			}
+		}
+		writable = writable || shard.Writable
+	}
+	if !writable {
+		problems = append(problems, shardProblem{-1, "no shard is Writable"})
+	}
+	if len(problems) > 0 {
+		return &shardConfigError{problems}
+	}
+	return nil
+}
+
+// shardForUUID returns the configured shard a UUID falls in. Both ends of a
+// shard's range are part of it.
+func shardForUUID(uuid string) (Shard, bool) {
+	i := shardIndex(strings.ToLower(uuid))
+	if i < 0 {
+		return Shard{}, false
+	}
+	return config.Shards[i], true
+}
+
+type ShardRange struct {
+	MinUUID string
+	MaxUUID string
+	Label   string `json:",omitempty"`
+}
+
+// notOwnedError is a write to a UUID outside every shard of this server, or
+// in one that isn't Writable.
+type notOwnedError struct {
+	uuid  string
+	shard *Shard
+}
+
+func (e *notOwnedError) Error() string {
+	if e.shard != nil {
+		return fmt.Sprintf("%s is in %s which is not writable", e.uuid, describeShard(*e.shard))
+	}
+	return fmt.Sprintf("%s is outside the shards of this server", e.uuid)
+}
+
+type NotOwnedResponse struct {
+	Error string
+	UUID  string
+	// The shard the UUID is in, when it is read-only here
+	Shard *ShardRange `json:",omitempty"`
+	// The ranges this server takes writes for
+	WritableRanges []ShardRange
+}
+
+// checkWritable refuses writes to holdings outside this server's writable
+// shards, and in shards that are being drained. Without any shards
+// configured every UUID is writable.
+func checkWritable(uuid string) error {
+	if len(config.Shards) == 0 {
+		return nil
+	}
+	shard, ok := shardForUUID(uuid)
+	if !ok {
+		return &notOwnedError{uuid, nil}
+	} else if !shard.Writable {
+		return &notOwnedError{uuid, &shard}
+	}
+	drains.Lock()
+	drain, ok := drains.m[strings.ToLower(shard.MinUUID)]
+	drains.Unlock()
+	if ok {
+		return &drainingError{uuid, shard, drain.peer.URL}
+	}
+	return nil
+}
+
+func writeRefused(w http.ResponseWriter, err error) {
+	log.Println(err.Error())
+	if oerr, ok := err.(*notOwnedError); ok {
+		resp := NotOwnedResponse{Error: oerr.Error(), UUID: oerr.uuid}
+		if oerr.shard != nil {
+			resp.Shard = &ShardRange{oerr.shard.MinUUID, oerr.shard.MaxUUID, oerr.shard.Label}
+		}
+		resp.WritableRanges = writableRanges()
+		js, _ := json.Marshal(resp)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write(js)
+		return
+	}
+	if derr, ok := err.(*drainingError); ok {
+		w.Header().Set("X-Moss-Owner", derr.owner)
+	}
+	http.Error(w, err.Error(), http.StatusMisdirectedRequest)
+}
+
+// writableRanges lists the shards this server takes writes for, drained or
+// not.
+func writableRanges() []ShardRange {
+	ranges := []ShardRange{}
+	for _, shard := range config.Shards {
+		if shard.Writable {
+			ranges = append(ranges, ShardRange{shard.MinUUID, shard.MaxUUID, shard.Label})
+		}
+	}
+	return ranges
+}
+
+// initDrains marks shards configured with DrainTo as draining so writes are
+// refused from startup. Replication still has to be started over the API.
+func initDrains() {
+	for _, shard := range config.Shards {
+		if shard.DrainTo == "" {
+			continue
+		}
+		peer, ok := findPeer(shard.DrainTo)
+		if !ok {
+			log.Fatal("Shard " + shard.MinUUID + " drains to unknown peer " + shard.DrainTo)
+		}
+		drains.m[strings.ToLower(shard.MinUUID)] = &drainState{peer, nil}
+	}
+}
+
+type ShardStatus struct {
+	Shard
+	Drain *Job `json:",omitempty"`
+}
+
+func shardStatuses() []ShardStatus {
+	drains.Lock()
+	defer drains.Unlock()
+	statuses := []ShardStatus{}
+	for _, shard := range config.Shards {
+		status := ShardStatus{shard, nil}
+		if drain, ok := drains.m[strings.ToLower(shard.MinUUID)]; ok {
+			status.DrainTo = drain.peer.Name
+			if drain.job != nil {
+				status.Drain = drain.job.snapshot()
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// DrainJobParams are saved with drain jobs.
+type DrainJobParams struct {
+	MinUUID     string
+	Peer        string
+	DeleteLocal bool
+}
+
+func init() {
+	// A drain can delete local copies, so a restart leaves it for an admin.
+	// Until then the shard keeps refusing writes.
+	jobRunners["drain"] = jobRunner{
+		run: func(job *Job) {
+			shard, peer, params, err := drainOfJob(job)
+			if err != nil {
+				job.fail(err.Error())
+				job.finish()
+				return
+			}
+			runDrain(job, shard, peer, params.DeleteLocal)
+		},
+		interrupted: func(job *Job) {
+			if _, _, _, err := drainOfJob(job); err != nil {
+				log.Printf("Job %s: %s\n", job.ID, err.Error())
+			}
+		},
+		abort: func(job *Job) {
+			params := DrainJobParams{}
+			if err := job.decodeParams(&params); err != nil {
+				return
+			}
+			minUUID := strings.ToLower(params.MinUUID)
+			drains.Lock()
+			defer drains.Unlock()
+			if drain, ok := drains.m[minUUID]; ok && drain.job == job {
+				drain.job = nil
+				if i := shardIndex(strings.ToLower(params.MinUUID)); i < 0 || config.Shards[i].DrainTo == "" {
+					delete(drains.m, minUUID)
+				}
+			}
+		},
+	}
+}
+
+// drainOfJob finds the shard and peer of a saved drain job and marks the
+// shard as draining again.
+func drainOfJob(job *Job) (Shard, Peer, DrainJobParams, error) {
+	params := DrainJobParams{}
+	if err := job.decodeParams(&params); err != nil {
+		return Shard{}, Peer{}, params, err
+	}
+	i := shardIndex(strings.ToLower(params.MinUUID))
+	if i < 0 || strings.ToLower(config.Shards[i].MinUUID) != strings.ToLower(params.MinUUID) {
+		return Shard{}, Peer{}, params, &drainResumeError{"no shard starts at " + params.MinUUID}
+	}
+	peer, ok := findPeer(params.Peer)
+	if !ok {
+		return Shard{}, Peer{}, params, &drainResumeError{"unknown peer " + params.Peer}
+	}
+	drains.Lock()
+	drains.m[strings.ToLower(params.MinUUID)] = &drainState{peer, job}
+	drains.Unlock()
+	return config.Shards[i], peer, params, nil
+}
+
+type drainResumeError struct {
+	problem string
+}
+
+func (e *drainResumeError) Error() string {
+	return "Cannot resume drain: " + e.problem
+}
+
+type DrainRequest struct {
+	Peer        string
+	DeleteLocal bool
+}
+
+func drainHandler(w http.ResponseWriter, r *http.Request, minUUID string) {
+	i := -1
+	for j, shard := range config.Shards {
+		if strings.ToLower(shard.MinUUID) == minUUID {
+			i = j
+		}
+	}
+	if i < 0 {
+		http.Error(w, "No shard starts at "+minUUID, http.StatusNotFound)
+		return
+	}
+	shard := config.Shards[i]
+
+	switch r.Method {
+	case "GET", "HEAD":
+		drains.Lock()
+		drain, ok := drains.m[minUUID]
+		drains.Unlock()
+		if !ok || drain.job == nil {
+			http.Error(w, "Shard is not being drained", http.StatusNotFound)
+			return
+		}
+		writeJob(w, drain.job, http.StatusOK)
+		return
+	case "POST":
+	default:
+		http.Error(w, "Only GET and POST are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := DrainRequest{Peer: shard.DrainTo}
+	body, ok := readUpload(w, r)
+	if !ok {
+		return
+	}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	peer, ok := findPeer(req.Peer)
+	if !ok {
+		http.Error(w, "Unknown peer "+req.Peer, http.StatusBadRequest)
+		return
+	}
+
+	drains.Lock()
+	if drain, ok := drains.m[minUUID]; ok && drain.job != nil && drain.job.active() {
+		drains.Unlock()
+		writeJob(w, drain.job, http.StatusConflict)
+		return
+	}
+	job := newJob("drain", DrainJobParams{shard.MinUUID, peer.Name, req.DeleteLocal})
+	drains.m[minUUID] = &drainState{peer, job}
+	drains.Unlock()
+
+	user, _, _ := r.BasicAuth()
+	log.Printf("Drain of shard %s to %s started by %s (job %s)\n", shard.MinUUID, peer.Name, user, job.ID)
+	go runDrain(job, shard, peer, req.DeleteLocal)
+
+	writeJob(w, job, http.StatusAccepted)
+}
+
+func writeJob(w http.ResponseWriter, job *Job, status int) {
+	js, err := json.Marshal(job.snapshot())
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(js)
+}
+
+func holdingBytes(dir string) int64 {
+	musicDir := path.Join(dir, "music")
+	var total int64
+	walkFiles(musicDir, func(rel string) error {
+		if stat, err := os.Stat(path.Join(musicDir, rel)); err == nil {
+			total += stat.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+// runDrain replicates every holding in the shard to peer, verifies each copy
+// and, if asked to, removes the local copy once the peer's is confirmed.
+func runDrain(job *Job, shard Shard, peer Peer, deleteLocal bool) {
+	type pending struct {
+		uuid string
+		dir  string
+		size int64
+	}
+	holdings := []pending{}
+	err := walkHoldings(config.LibraryPath, func(uuid string, dir string, legacy bool) error {
+		if inShard(shard, uuid) {
+			holdings = append(holdings, pending{uuid, dir, holdingBytes(dir)})
+		}
+		return nil
+	})
+	if err != nil {
+		job.fail(err.Error())
+		job.finish()
+		return
+	}
+
+	job.update(func(j *Job) {
+		j.HoldingsTotal = len(holdings)
+		j.HoldingsRemaining = len(holdings)
+		for _, h := range holdings {
+			j.BytesTotal += h.size
+		}
+		j.BytesRemaining = j.BytesTotal
+	})
+
+	for _, h := range holdings {
+		var sent int64
+		err := pushHolding(peer, h.uuid, h.dir, func(n int64) {
+			sent += n
+			job.update(func(j *Job) { j.BytesRemaining -= n })
+		})
+		if err == nil {
+			err = verifyHolding(peer, h.uuid, h.dir)
+		}
+		if err != nil {
+			// The holding still has to be moved, all of it
+			job.fail(err.Error())
+			job.update(func(j *Job) { j.BytesRemaining += sent })
+			continue
+		}
+		// Holdings already locked on the peer aren't re-sent
+		job.update(func(j *Job) {
+			j.BytesRemaining -= h.size - sent
+			j.HoldingsRemaining--
+		})
+
+		if deleteLocal {
+			release, err := beginWrite()
+			if err != nil {
+				job.fail(h.uuid + ": " + err.Error())
+				continue
+			}
+			if err := removeHolding(h.uuid, h.dir); err != nil {
+				job.fail(err.Error())
+			}
+			release()
+		}
+	}
+	job.finish()
+}
+
+func removeHolding(uuid string, dir string) error {
+	admit, err := excludeReaders(uuid)
+	if err != nil {
+		return err
+	}
+	defer admit()
+	unlock := lockHolding(uuid)
+	defer unlock()
+	if err := ensureSafePath(config.LibraryPath, dir); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := syncRemoved(dir); err != nil {
+		return err
+	}
+	log.Printf("Removed local copy of %s\n", uuid)
+	emitChange(uuid, "delete", "")
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"testing"
+
+	"github.com/wuvt/moss/mosstest"
+)
+
+func TestShardRangeBoundaries(t *testing.T) {
+	const (
+		writableMin = "40000000-0000-4000-8000-000000000000"
+		writableMax = "4fffffff-ffff-4fff-bfff-ffffffffffff"
+		readOnlyMin = "80000000-0000-4000-8000-000000000000"
+		readOnlyMax = "8fffffff-ffff-4fff-bfff-ffffffffffff"
+	)
+	s := newTestServer(t, mosstest.Spec{}, func(c *Config) {
+		c.Shards = []Shard{
+			{MinUUID: writableMin, MaxUUID: writableMax, Writable: true, Label: "a"},
+			{MinUUID: readOnlyMin, MaxUUID: readOnlyMax, Label: "b"},
+		}
+	})
+
+	for _, c := range []struct {
+		uuid  string
+		owned bool
+		shard string
+	}{
+		{writableMin, true, ""},
+		{writableMax, true, ""},
+		{"4fffffff-ffff-4fff-bfff-fffffffffffe", true, ""},
+		{"3fffffff-ffff-4fff-bfff-ffffffffffff", false, ""},
+		{"50000000-0000-4000-8000-000000000000", false, ""},
+		{readOnlyMin, false, "b"},
+		{readOnlyMax, false, "b"},
+		{"7fffffff-ffff-4fff-bfff-ffffffffffff", false, ""},
+		{"90000000-0000-4000-8000-000000000000", false, ""},
+	} {
+		for _, p := range []string{"/music/01.flac", "/albumart", "/lock"} {
+			body := mosstest.FLAC(0)
+			if p == "/albumart" {
+				body = mosstest.PNG(8, 0)
+			} else if p == "/lock" {
+				body = nil
+			}
+			resp := s.Do("PUT", "/"+c.uuid+p, body)
+			if c.owned {
+				if resp.Status/100 != 2 {
+					t.Errorf("PUT %s%s got %d %s", c.uuid, p, resp.Status, resp.Body)
+				}
+				continue
+			}
+			if resp.Status != http.StatusForbidden {
+				t.Errorf("PUT %s%s got %d, want 403", c.uuid, p, resp.Status)
+				continue
+			}
+			var refused NotOwnedResponse
+			resp.JSON(t, &refused)
+			if refused.UUID != c.uuid || len(refused.WritableRanges) != 1 || refused.WritableRanges[0].MinUUID != writableMin || refused.WritableRanges[0].MaxUUID != writableMax {
+				t.Errorf("PUT %s%s was refused with %+v", c.uuid, p, refused)
+			}
+			if c.shard == "" && refused.Shard != nil || c.shard != "" && (refused.Shard == nil || refused.Shard.Label != c.shard) {
+				t.Errorf("PUT %s%s named shard %+v, want %q", c.uuid, p, refused.Shard, c.shard)
+			}
+		}
+	}
+
+	// Reads are served from whatever is on disk, owned or not
+	for _, uuid := range []string{readOnlyMin, readOnlyMax, "3fffffff-ffff-4fff-bfff-ffffffffffff"} {
+		writeTestFile(t, path.Join(uuidToPath(config.LibraryPath, uuid), "music", "01.flac"), mosstest.FLAC(0))
+		if resp := s.Do("GET", "/"+uuid+"/music/01.flac", nil); resp.Status != http.StatusOK {
+			t.Errorf("GET %s got %d", uuid, resp.Status)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Counters keep one bucket per minute for the longest window. Buckets are
+// recycled lazily when a new minute first touches them, so recording an
+// event is a couple of atomic operations and never takes a lock.
+const statsBuckets = 24 * 60
+
+// A bucket is a single word: how many times round the buckets its minute is
+// in the top bits, the count below. Recycling a bucket and counting in it
+// are then one compare-and-swap, so no event is lost to a recycle racing it.
+const (
+	statsCountBits = 44
+	statsCountMask = 1<<statsCountBits - 1
+)
+
+type statsBucket struct {
+	word atomic.Uint64
+}
+
+type rollingCounter struct {
+	buckets [statsBuckets]statsBucket
+
+	// Never reset, so /metrics counters only go up
+	total atomic.Uint64
+}
+
+func (c *rollingCounter) add() {
+	c.addN(1)
+}
+
+func (c *rollingCounter) addN(n uint64) {
+	minute := uint64(time.Now().Unix() / 60)
+	b := &c.buckets[minute%statsBuckets]
+	lap := minute / statsBuckets
+	for {
+		old := b.word.Load()
+		next := lap<<statsCountBits | n
+		if old>>statsCountBits == lap {
+			next = old + n
+		}
+		if b.word.CompareAndSwap(old, next) {
+			break
+		}
+	}
+	c.total.Add(n)
+}
+
+func (c *rollingCounter) sum(now time.Time, window time.Duration) uint64 {
+	minute := now.Unix() / 60
+	oldest := minute - int64(window/time.Minute) + 1
+	var total uint64
+	for i := range c.buckets {
+		word := c.buckets[i].word.Load()
+		if m := int64(word>>statsCountBits)*statsBuckets + int64(i); m >= oldest && m <= minute {
+			total += word & statsCountMask
+		}
+	}
+	return total
+}
+
+func (c *rollingCounter) reset() {
+	for i := range c.buckets {
+		c.buckets[i].word.Store(0)
+	}
+}
+
+var stats struct {
+	status2xx           rollingCounter
+	status3xx           rollingCounter
+	status4xx           rollingCounter
+	status5xx           rollingCounter
+	authFailures        rollingCounter
+	lockConflicts       rollingCounter
+	traversalRejections rollingCounter
+	storageErrors       rollingCounter
+	repairs             rollingCounter
+	repairFailures      rollingCounter
+	readerConflicts     rollingCounter
+	verifyMismatches    rollingCounter
+	resetAt             atomic.Int64
+}
+
+var statsWindows = []struct {
+	name     string
+	duration time.Duration
+}{
+	{"5m", 5 * time.Minute},
+	{"1h", time.Hour},
+	{"24h", 24 * time.Hour},
+}
+
+type StatsWindow struct {
+	Name                string
+	Start               Timestamp
+	End                 Timestamp
+	Requests            map[string]uint64
+	AuthFailures        uint64
+	LockConflicts       uint64
+	TraversalRejections uint64
+	StorageErrors       uint64
+	Repairs             uint64
+	RepairFailures      uint64
+	ReaderConflicts     uint64
+	VerifyMismatches    uint64
+}
+
+type Stats struct {
+	NodeName string `json:",omitempty"`
+	Location string `json:",omitempty"`
+	Shards   []ShardStatus
+
+	Since   Timestamp
+	Windows []StatsWindow
+	Temp    TempUsage
+
+	FreeSpace   uint64
+	Reclaimable Reclaimable
+
+	NegativeCache NegativeCacheStats
+	Peers         []PeerHealth
+	Replication   []ReplicationStats
+	Uploads       []UploadUsage
+	Fanout        []FanoutPrefix
+	Catalog       *CatalogStats  `json:",omitempty"`
+	Holdings      *HoldingCount  `json:",omitempty"`
+	Usage         *UsageTotals   `json:",omitempty"`
+	Clock         *ClockStatus   `json:",omitempty"`
+	EventBus      *EventBusStats `json:",omitempty"`
+}
+
+func resetStats() {
+	for _, c := range []*rollingCounter{&stats.status2xx, &stats.status3xx, &stats.status4xx, &stats.status5xx,
+		&stats.authFailures, &stats.lockConflicts, &stats.traversalRejections, &stats.storageErrors, &stats.repairs, &stats.repairFailures, &stats.readerConflicts, &stats.verifyMismatches} {
+		c.reset()
+	}
+	resetReplicationStats()
+	stats.resetAt.Store(time.Now().Unix())
+}
+
+func currentStats() Stats {
+	now := time.Now()
+	freeSpace, _ := libraryFreeSpace()
+	s := Stats{config.NodeName, config.Location, shardStatuses(), stamp(time.Unix(stats.resetAt.Load(), 0)), []StatsWindow{}, tempUsage(), freeSpace, reclaimable(), negativeCacheStats(), peerStats(), replicationStats(now), uploadStats(), fanoutPrefixes(), catalogStats(), currentHoldingCount(), usageTotals(), currentClockStatus(), eventBusStats()}
+	for _, window := range statsWindows {
+		// Buckets are whole minutes, so the window starts at a minute boundary
+		start := now.Truncate(time.Minute).Add(-window.duration + time.Minute)
+		s.Windows = append(s.Windows, StatsWindow{
+			Name:  window.name,
+			Start: stamp(start),
+			End:   stamp(now),
+			Requests: map[string]uint64{
+				"2xx": stats.status2xx.sum(now, window.duration),
+				"3xx": stats.status3xx.sum(now, window.duration),
+				"4xx": stats.status4xx.sum(now, window.duration),
+				"5xx": stats.status5xx.sum(now, window.duration),
+			},
+			AuthFailures:        stats.authFailures.sum(now, window.duration),
+			LockConflicts:       stats.lockConflicts.sum(now, window.duration),
+			TraversalRejections: stats.traversalRejections.sum(now, window.duration),
+			StorageErrors:       stats.storageErrors.sum(now, window.duration),
+			Repairs:             stats.repairs.sum(now, window.duration),
+			RepairFailures:      stats.repairFailures.sum(now, window.duration),
+			ReaderConflicts:     stats.readerConflicts.sum(now, window.duration),
+			VerifyMismatches:    stats.verifyMismatches.sum(now, window.duration),
+		})
+	}
+	return s
+}
+
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+	case "DELETE":
+		if !checkAuth(w, r) {
+			return
+		}
+		resetStats()
+		user, _, _ := r.BasicAuth()
+		log.Println("Stats reset by " + user)
+	default:
+		http.Error(w, "Only GET and DELETE are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	js, err := json.Marshal(currentStats())
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// storageError reports a failed filesystem operation to the client.
+func storageError(w http.ResponseWriter, err error) {
+	stats.storageErrors.add()
+	if nerr, ok := asNotADirectory(err); ok {
+		notADirectory(w, nerr)
+		return
+	} else if isNoSpace(err) {
+		noSpace(w, err)
+		return
+	}
+	log.Println(err.Error())
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// writeError is storageError for errors the client may have caused: a file
+// or directory that doesn't exist is a 404 and one moss may not touch is a
+// 403, neither counted as storage errors. Paths are given relative to the
+// library.
+func writeError(w http.ResponseWriter, err error) {
+	name := "file"
+	var perr *os.PathError
+	if errors.As(err, &perr) {
+		name = libraryRel(perr.Path)
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, name+" not found", http.StatusNotFound)
+		return
+	} else if errors.Is(err, fs.ErrPermission) {
+		log.Println(err.Error())
+		http.Error(w, "Permission denied on "+name, http.StatusForbidden)
+		return
+	}
+	storageError(w, err)
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func countOutcomes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{w, 0}
+		next.ServeHTTP(rec, r)
+		switch {
+		case rec.status == 0 || rec.status < 300:
+			stats.status2xx.add()
+		case rec.status < 400:
+			stats.status3xx.add()
+		case rec.status < 500:
+			stats.status4xx.add()
+		default:
+			stats.status5xx.add()
+		}
+	})
+}
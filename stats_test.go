@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/wuvt/moss/mosstest"
+)
+
+func TestWriteError(t *testing.T) {
+	newTestServer(t, mosstest.Spec{})
+	p := path.Join(config.LibraryPath, "ab", "missing")
+	for _, c := range []struct {
+		name     string
+		err      error
+		status   int
+		mentions string
+		storage  bool
+	}{
+		{"not found", &os.PathError{Op: "open", Path: p, Err: syscall.ENOENT}, http.StatusNotFound, "ab/missing not found", false},
+		{"wrapped not found", fmt.Errorf("reading: %w", &os.PathError{Op: "open", Path: p, Err: syscall.ENOENT}), http.StatusNotFound, "ab/missing", false},
+		{"bare not found", fs.ErrNotExist, http.StatusNotFound, "file not found", false},
+		{"permission", &os.PathError{Op: "open", Path: p, Err: syscall.EACCES}, http.StatusForbidden, "Permission denied on ab/missing", false},
+		{"i/o error", &os.PathError{Op: "read", Path: p, Err: syscall.EIO}, http.StatusInternalServerError, "input/output error", true},
+		{"anything else", errors.New("something broke"), http.StatusInternalServerError, "something broke", true},
+	} {
+		before := stats.storageErrors.total.Load()
+		w := httptest.NewRecorder()
+		writeError(w, c.err)
+		if w.Code != c.status || !strings.Contains(w.Body.String(), c.mentions) {
+			t.Errorf("%s got %d %q", c.name, w.Code, w.Body.String())
+		}
+		if counted := stats.storageErrors.total.Load() > before; counted != c.storage {
+			t.Errorf("%s counted as a storage error: %t", c.name, counted)
+		}
+		// Paths the client gave are named relative to the library
+		if !c.storage && strings.Contains(w.Body.String(), config.LibraryPath) {
+			t.Errorf("%s named the library: %q", c.name, w.Body.String())
+		}
+	}
+}
+
+// What a client asked for that isn't there is a 404, not a fault.
+func TestNotFoundStatuses(t *testing.T) {
+	s := newTestServer(t, mosstest.Spec{Holdings: []mosstest.Holding{
+		{Tracks: []mosstest.Track{{Name: "01.flac"}}},
+		// Album art first, so there's no music/ yet
+		{AlbumArt: mosstest.PNG(8, 0)},
+	}})
+	missing := mosstest.NewUUID()
+	before := stats.storageErrors.total.Load()
+
+	for _, c := range []struct {
+		method, path string
+		status       int
+	}{
+		{"GET", "/" + missing + "/", http.StatusNotFound},
+		{"HEAD", "/" + missing + "/", http.StatusNotFound},
+		{"GET", "/" + missing + "/music/01.flac", http.StatusNotFound},
+		{"GET", "/" + missing + "/albumart", http.StatusNotFound},
+		{"PUT", "/" + missing + "/lock", http.StatusNotFound},
+		{"GET", s.Path(0, "music", "02.flac"), http.StatusNotFound},
+		{"GET", s.Path(0, "music", "CD1", "01.flac"), http.StatusNotFound},
+		{"GET", s.Path(0, "albumart"), http.StatusNotFound},
+		{"GET", s.Path(0, "music", "01.flac"), http.StatusOK},
+		{"GET", s.Path(1), http.StatusOK},
+		{"GET", s.Path(1, "music", "01.flac"), http.StatusNotFound},
+		{"GET", s.Path(1, "albumart"), http.StatusOK},
+	} {
+		if resp := s.Do(c.method, c.path, nil); resp.Status != c.status {
+			t.Errorf("%s %s got %d %s", c.method, c.path, resp.Status, resp.Body)
+		}
+	}
+	if after := stats.storageErrors.total.Load(); after != before {
+		t.Errorf("%d storage errors were counted", after-before)
+	}
+
+	// A holding without music/ lists no files, rather than failing
+	resp := s.MustDo("GET", s.Path(1), nil)
+	if !strings.Contains(string(resp.Body), `"FileList":[]`) {
+		t.Errorf("the art-only holding lists %s", resp.Body)
+	}
+
+	if os.Geteuid() == 0 {
+		t.Log("running as root, which can read anything, so skipping unreadable files")
+		return
+	}
+	track := path.Join(holdingDir(s.Holdings[0].UUID), "music", "01.flac")
+	if err := os.Chmod(track, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(track, 0644)
+	if resp := s.Do("GET", s.Path(0, "music", "01.flac"), nil); resp.Status != http.StatusForbidden {
+		t.Errorf("an unreadable track got %d %s", resp.Status, resp.Body)
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"unicode/utf16"
+)
+
+// The artist and album tags of each track are read when it is uploaded and
+// kept in tags.json in the holding, keyed by path under music/ like
+// checksums.json, so listings and searches needn't open every file.
+// Compilations have an album artist (usually "Various Artists") that differs
+// from the artists of the tracks, so both are kept.
+
+// Vorbis comment blocks larger than this are skipped rather than read into
+// memory.
+const maxVorbisComments = 1 << 20
+
+type TrackTags struct {
+	Title       string `json:",omitempty"`
+	Artist      string `json:",omitempty"`
+	AlbumArtist string `json:",omitempty"`
+	Album       string `json:",omitempty"`
+	Compilation bool   `json:",omitempty"`
+	// Without any total, so "3" for "3/12"
+	TrackNumber string `json:",omitempty"`
+	DiscNumber  string `json:",omitempty"`
+}
+
+// TagSummary describes a holding as a whole from its tracks' tags.
+type TagSummary struct {
+	Album       string `json:",omitempty"`
+	AlbumArtist string `json:",omitempty"`
+	// The distinct track artists, in play order
+	Artists     []string
+	Compilation bool
+	Tracks      map[string]TrackTags
+}
+
+func (t TrackTags) empty() bool {
+	return t == TrackTags{}
+}
+
+// readTrackTags reads the tags of a FLAC file's Vorbis comments or an MP3's
+// ID3v2 text frames.
+func readTrackTags(r io.Reader) (TrackTags, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil {
+		return TrackTags{}, errNoMetadata
+	}
+	if string(magic) == "fLaC" {
+		br.Discard(4)
+		return flacTags(br)
+	} else if string(magic[:3]) == "ID3" {
+		return id3Tags(br)
+	}
+	return TrackTags{}, errNoMetadata
+}
+
+func flacTags(r *bufio.Reader) (TrackTags, error) {
+	tags := TrackTags{}
+	err := flacBlocks(r, func(blockType byte, length int, block io.Reader) error {
+		if blockType != 4 || length > maxVorbisComments {
+			return nil
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(block, data); err != nil {
+			return err
+		}
+		for _, comment := range parseVorbisComments(data) {
+			kv := strings.SplitN(comment, "=", 2)
+			if len(kv) == 2 {
+				tags.set(strings.ToUpper(kv[0]), kv[1])
+			}
+		}
+		return nil
+	})
+	return tags, err
+}
+
+// parseVorbisComments returns the "NAME=value" strings of a comment block,
+// which unlike the rest of FLAC is little-endian.
+func parseVorbisComments(b []byte) []string {
+	field := func() (string, bool) {
+		if len(b) < 4 {
+			return "", false
+		}
+		n := binary.LittleEndian.Uint32(b)
+		if uint32(len(b)-4) < n {
+			return "", false
+		}
+		v := string(b[4 : 4+n])
+		b = b[4+n:]
+		return v, true
+	}
+	if _, ok := field(); !ok { // vendor
+		return nil
+	}
+	if len(b) < 4 {
+		return nil
+	}
+	count := binary.LittleEndian.Uint32(b)
+	b = b[4:]
+	comments := []string{}
+	for i := uint32(0); i < count; i++ {
+		comment, ok := field()
+		if !ok {
+			break
+		}
+		comments = append(comments, comment)
+	}
+	return comments
+}
+
+// set takes the first value given for a Vorbis comment name.
+func (t *TrackTags) set(name string, value string) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return
+	}
+	switch name {
+	case "TITLE":
+		if t.Title == "" {
+			t.Title = value
+		}
+	case "ARTIST":
+		if t.Artist == "" {
+			t.Artist = value
+		}
+	case "ALBUMARTIST", "ALBUM ARTIST", "ALBUM_ARTIST":
+		if t.AlbumArtist == "" {
+			t.AlbumArtist = value
+		}
+	case "ALBUM":
+		if t.Album == "" {
+			t.Album = value
+		}
+	case "COMPILATION":
+		t.Compilation = value == "1" || strings.EqualFold(value, "true")
+	case "TRACKNUMBER":
+		if t.TrackNumber == "" {
+			t.TrackNumber = strings.TrimSpace(strings.SplitN(value, "/", 2)[0])
+		}
+	case "DISCNUMBER":
+		if t.DiscNumber == "" {
+			t.DiscNumber = strings.TrimSpace(strings.SplitN(value, "/", 2)[0])
+		}
+	}
+}
+
+// ID3v2 text frames and the Vorbis comment names they correspond to. TCMP is
+// the iTunes compilation flag; TRCK and TPOS are the track and disc numbers.
+var id3TextFrames = map[string]string{
+	"TIT2": "TITLE",
+	"TPE1": "ARTIST",
+	"TPE2": "ALBUMARTIST",
+	"TALB": "ALBUM",
+	"TCMP": "COMPILATION",
+	"TRCK": "TRACKNUMBER",
+	"TPOS": "DISCNUMBER",
+}
+
+func id3Tags(r *bufio.Reader) (TrackTags, error) {
+	tags := TrackTags{}
+	err := id3Frames(r, func(id string, frame []byte) {
+		if name, ok := id3TextFrames[id]; ok {
+			tags.set(name, decodeID3Text(frame))
+		}
+	})
+	return tags, err
+}
+
+// decodeID3Text returns the first string of a text frame. ID3v2.4 separates
+// multiple values with NULs.
+func decodeID3Text(b []byte) string {
+	if len(b) < 1 {
+		return ""
+	}
+	encoding := b[0]
+	b = b[1:]
+	var s string
+	switch encoding {
+	case 0:
+		runes := make([]rune, len(b))
+		for i, c := range b {
+			runes[i] = rune(c)
+		}
+		s = string(runes)
+	case 1, 2:
+		bigEndian := encoding == 2
+		if len(b) >= 2 && b[0] == 0xfe && b[1] == 0xff {
+			bigEndian = true
+			b = b[2:]
+		} else if len(b) >= 2 && b[0] == 0xff && b[1] == 0xfe {
+			bigEndian = false
+			b = b[2:]
+		}
+		units := make([]uint16, 0, len(b)/2)
+		for i := 0; i+1 < len(b); i += 2 {
+			if bigEndian {
+				units = append(units, binary.BigEndian.Uint16(b[i:]))
+			} else {
+				units = append(units, binary.LittleEndian.Uint16(b[i:]))
+			}
+		}
+		s = string(utf16.Decode(units))
+	case 3:
+		s = string(b)
+	default:
+		return ""
+	}
+	return strings.SplitN(s, "\x00", 2)[0]
+}
+
+func readTags(dir string) (map[string]TrackTags, error) {
+	tags := map[string]TrackTags{}
+	data, err := ioutil.ReadFile(path.Join(dir, tagsFileName))
+	if os.IsNotExist(err) {
+		return tags, nil
+	} else if err != nil {
+		return tags, err
+	}
+	err = json.Unmarshal(data, &tags)
+	return tags, err
+}
+
+func writeTags(dir string, tags map[string]TrackTags) error {
+	if len(tags) == 0 {
+		if err := os.Remove(path.Join(dir, tagsFileName)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	js, err := json.Marshal(tags)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path.Join(dir, tagsFileName), js)
+}
+
+// recordTags replaces the stored tags for the track at rel under music/.
+// Files without any tags we understand are simply left out. The caller holds
+// the holding mutex.
+func recordTags(dir string, rel string, trackTags TrackTags) error {
+	tags, err := readTags(dir)
+	if err != nil {
+		return err
+	}
+	if trackTags.empty() {
+		if _, ok := tags[rel]; !ok {
+			return nil
+		}
+		delete(tags, rel)
+	} else {
+		tags[rel] = trackTags
+	}
+	return writeTags(dir, tags)
+}
+
+// tagsOfUpload reads the tags of an uploaded track's body, if it's a track.
+func tagsOfUpload(rel string, body []byte) TrackTags {
+	if !isTrack(rel) {
+		return TrackTags{}
+	}
+	tags, _ := readTrackTags(bytes.NewReader(body))
+	return tags
+}
+
+// summarizeTags builds a holding's tag summary from its tracks in play order,
+// or returns nil if none of them are tagged.
+func summarizeTags(discs []Disc, tags map[string]TrackTags) *TagSummary {
+	summary := &TagSummary{Artists: []string{}, Tracks: map[string]TrackTags{}}
+	seen := map[string]bool{}
+	for _, disc := range discs {
+		for _, rel := range disc.Tracks {
+			t, ok := tags[rel]
+			if !ok {
+				continue
+			}
+			summary.Tracks[rel] = t
+			if summary.Album == "" {
+				summary.Album = t.Album
+			}
+			if summary.AlbumArtist == "" {
+				summary.AlbumArtist = t.AlbumArtist
+			}
+			if t.Compilation {
+				summary.Compilation = true
+			}
+			if t.Artist != "" && !seen[strings.ToLower(t.Artist)] {
+				seen[strings.ToLower(t.Artist)] = true
+				summary.Artists = append(summary.Artists, t.Artist)
+			}
+		}
+	}
+	if len(summary.Tracks) == 0 {
+		return nil
+	}
+	return summary
+}
+
+// matchesArtist reports whether a track is by artist, either as the track
+// artist or as the album artist of the release it's on.
+func (t TrackTags) matchesArtist(artist string) bool {
+	return strings.EqualFold(t.Artist, artist) || strings.EqualFold(t.AlbumArtist, artist)
+}
+
+// needsTrackTags reports whether a holding has tracks but no tags.json.
+func needsTrackTags(uuid string, dir string) (bool, error) {
+	if _, err := os.Stat(path.Join(dir, tagsFileName)); err == nil {
+		return false, nil
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+	found := false
+	err := walkFiles(path.Join(dir, "music"), func(rel string) error {
+		if isTrack(rel) {
+			found = true
+		}
+		return nil
+	})
+	return found, err
+}
+
+// backfillTrackTags reads the tags of every track in a holding that predates
+// tags.json. Tracks whose tags can't be parsed are left out.
+func backfillTrackTags(uuid string, dir string) error {
+	musicDir := path.Join(dir, "music")
+	tags := map[string]TrackTags{}
+	err := walkFiles(musicDir, func(rel string) error {
+		if !isTrack(rel) {
+			return nil
+		}
+		f, err := os.Open(path.Join(musicDir, rel))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if t, err := readTrackTags(f); err == nil && !t.empty() {
+			tags[rel] = t
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return writeTags(dir, tags)
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// With Tenants configured, one moss serves several independent libraries.
+// Each tenant is an ordinary moss config file, run by its own child process
+// listening on a Unix socket, so its credentials, shards, indexes, stats and
+// jobs can't mix with another tenant's. The parent only listens on Port and
+// hands each request to the tenant whose Host or path Prefix it matches.
+type Tenant struct {
+	Name string
+
+	// Requests for this Host, or under this path Prefix, which is removed
+	// before the tenant sees them
+	Host   string `json:",omitempty"`
+	Prefix string `json:",omitempty"`
+
+	// Path of the tenant's moss config file
+	Config string
+}
+
+var tenantName = flag.String("tenant-name", "", "Name to log as when run as a tenant (set by the parent)")
+var tenantSocket = flag.String("tenant-socket", "", "Unix socket to serve on when run as a tenant (set by the parent)")
+
+const tenantRestartDelay = 5 * time.Second
+
+type tenantConfigError struct {
+	tenant  string
+	problem string
+}
+
+func (e *tenantConfigError) Error() string {
+	return fmt.Sprintf("tenant %q: %s", e.tenant, e.problem)
+}
+
+// tenantRoute is a running tenant with the config it was loaded from, used
+// to tell which tenants a caller's credentials belong to.
+type tenantRoute struct {
+	Tenant
+	config Config
+	proxy  *httputil.ReverseProxy
+}
+
+func loadTenantConfig(t Tenant) (Config, error) {
+	c := Config{}
+	data, err := os.ReadFile(t.Config)
+	if err != nil {
+		return c, &tenantConfigError{t.Name, err.Error()}
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, &tenantConfigError{t.Name, "invalid config file " + t.Config}
+	}
+	return c, nil
+}
+
+// loadTenants checks the tenants can't overlap, in routing or in storage,
+// and loads their configs.
+func loadTenants() ([]*tenantRoute, error) {
+	routes := []*tenantRoute{}
+	seen := map[string]string{}
+	claim := func(kind string, value string, name string) error {
+		if other, ok := seen[kind+" "+value]; ok {
+			return &tenantConfigError{name, fmt.Sprintf("%s %s is also used by %q", kind, value, other)}
+		}
+		seen[kind+" "+value] = name
+		return nil
+	}
+	for _, t := range config.Tenants {
+		switch {
+		case t.Name == "" || strings.ContainsAny(t.Name, "/ "):
+			return nil, &tenantConfigError{t.Name, "needs a Name without slashes or spaces"}
+		case t.Host == "" && t.Prefix == "":
+			return nil, &tenantConfigError{t.Name, "needs a Host or a Prefix"}
+		case t.Prefix != "" && (!strings.HasPrefix(t.Prefix, "/") || strings.HasSuffix(t.Prefix, "/") || path.Clean(t.Prefix) != t.Prefix):
+			return nil, &tenantConfigError{t.Name, "Prefix must look like /name"}
+		case t.Config == "":
+			return nil, &tenantConfigError{t.Name, "needs a Config file"}
+		}
+		if err := claim("name", t.Name, t.Name); err != nil {
+			return nil, err
+		}
+		if t.Host != "" {
+			if err := claim("Host", strings.ToLower(t.Host), t.Name); err != nil {
+				return nil, err
+			}
+		}
+		if t.Prefix != "" {
+			if err := claim("Prefix", t.Prefix, t.Name); err != nil {
+				return nil, err
+			}
+		}
+
+		c, err := loadTenantConfig(t)
+		if err != nil {
+			return nil, err
+		}
+		if len(c.Tenants) > 0 {
+			return nil, &tenantConfigError{t.Name, "a tenant can't have tenants of its own"}
+		}
+		if c.LibraryPath == "" {
+			return nil, &tenantConfigError{t.Name, "needs a LibraryPath"}
+		}
+		root, err := filepath.Abs(c.LibraryPath)
+		if err != nil {
+			return nil, &tenantConfigError{t.Name, err.Error()}
+		}
+		for _, other := range routes {
+			otherRoot, _ := filepath.Abs(other.config.LibraryPath)
+			if root == otherRoot || strings.HasPrefix(root, otherRoot+"/") || strings.HasPrefix(otherRoot, root+"/") {
+				return nil, &tenantConfigError{t.Name, "LibraryPath overlaps tenant " + strconv.Quote(other.Name)}
+			}
+		}
+		routes = append(routes, &tenantRoute{Tenant: t, config: c})
+	}
+	return routes, nil
+}
+
+func tenantSocketPath(name string) string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("moss-%d-%s.sock", os.Getpid(), name))
+}
+
+// superviseTenant runs a tenant's process, starting it again whenever it
+// exits.
+func superviseTenant(t Tenant, socket string) {
+	// Pdeathsig fires when the thread that started the child exits, so
+	// keep this goroutine on one thread for good
+	runtime.LockOSThread()
+	for {
+		cmd := exec.Command(os.Args[0], "-config", t.Config, "-tenant-name", t.Name, "-tenant-socket", socket)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		// Don't outlive the parent
+		cmd.SysProcAttr = &syscall.SysProcAttr{Pdeathsig: syscall.SIGTERM}
+		err := cmd.Run()
+		if err == nil {
+			err = fmt.Errorf("exited")
+		}
+		log.Printf("Tenant %s: %s, restarting in %s\n", t.Name, err.Error(), tenantRestartDelay)
+		time.Sleep(tenantRestartDelay)
+	}
+}
+
+func newTenantProxy(t Tenant, socket string) *httputil.ReverseProxy {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}
+	return &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme = "http"
+			r.URL.Host = "tenant"
+			// The tenant trusts whatever we say, so say it once
+			r.Header.Set("X-Real-IP", clientIP(r))
+			r.Header["X-Forwarded-For"] = nil
+			if t.Prefix != "" && !strings.EqualFold(hostOnly(r.Host), t.Host) {
+				r.URL.Path = strings.TrimPrefix(r.URL.Path, t.Prefix)
+				if r.URL.Path == "" {
+					r.URL.Path = "/"
+				}
+				r.URL.RawPath = ""
+				r.Header.Set("X-Forwarded-Prefix", t.Prefix)
+			}
+		},
+		Transport: transport,
+		// Stream downloads and archives as they come
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("Tenant %s: %s\n", t.Name, err.Error())
+			http.Error(w, "Tenant "+t.Name+" is unavailable", http.StatusBadGateway)
+		},
+	}
+}
+
+func hostOnly(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// routeTenant picks the tenant for a request, by Host first and then by the
+// longest matching Prefix.
+func routeTenant(routes []*tenantRoute, r *http.Request) *tenantRoute {
+	host := hostOnly(r.Host)
+	for _, t := range routes {
+		if t.Host != "" && strings.EqualFold(host, t.Host) {
+			return t
+		}
+	}
+	var best *tenantRoute
+	for _, t := range routes {
+		if t.Prefix == "" {
+			continue
+		}
+		if r.URL.Path == t.Prefix || strings.HasPrefix(r.URL.Path, t.Prefix+"/") {
+			if best == nil || len(t.Prefix) > len(best.Prefix) {
+				best = t
+			}
+		}
+	}
+	return best
+}
+
+// tenantAuthenticate is authenticate against a tenant's own credentials.
+func tenantAuthenticate(c Config, r *http.Request) bool {
+	user, key, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	if credentialsMatch(user, key, c.ApiUser, c.ApiKey) {
+		return true
+	}
+	for _, u := range c.Users {
+		if credentialsMatch(user, key, u.Name, u.Key) {
+			return true
+		}
+	}
+	return false
+}
+
+type TenantInfo struct {
+	Name   string
+	Host   string `json:",omitempty"`
+	Prefix string `json:",omitempty"`
+}
+
+type TenantsServerInfo struct {
+	Version string
+	Tenants []TenantInfo
+}
+
+// tenantVersionHandler answers /version on the parent with the tenants the
+// caller has credentials for.
+func tenantVersionHandler(w http.ResponseWriter, r *http.Request, routes []*tenantRoute) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	info := TenantsServerInfo{"git", []TenantInfo{}}
+	for _, t := range routes {
+		if tenantAuthenticate(t.config, r) {
+			info.Tenants = append(info.Tenants, TenantInfo{t.Name, t.Host, t.Prefix})
+		}
+	}
+	js, err := json.Marshal(info)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// runTenants is main for a server with Tenants: it starts each tenant and
+// proxies to them.
+func runTenants() {
+	routes, err := loadTenants()
+	if err != nil {
+		log.Fatal("Tenants: " + err.Error())
+	}
+	for _, t := range routes {
+		socket := tenantSocketPath(t.Name)
+		t.proxy = newTenantProxy(t.Tenant, socket)
+		go superviseTenant(t.Tenant, socket)
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := routeTenant(routes, r)
+		if t == nil {
+			if r.URL.Path == "/version" {
+				tenantVersionHandler(w, r, routes)
+				return
+			}
+			http.Error(w, "No tenant for that", http.StatusNotFound)
+			return
+		}
+		t.proxy.ServeHTTP(w, r)
+	})
+
+	log.Printf("Server running on port %d for %d tenants\n", config.Port, len(routes))
+	log.Fatal(serveTCP(":"+strconv.Itoa(config.Port), handler, config.TLSCert != ""))
+}
+
+// serveTenant serves a tenant's requests on the socket its parent proxies
+// to.
+func serveTenant(socket string, handler http.Handler) error {
+	servingTenant = true
+	os.Remove(socket)
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(socket, 0600); err != nil {
+		return err
+	}
+	return http.Serve(l, handler)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Just enough TIFF to derive a preview from a scanner's archival master:
+// baseline, uncompressed, chunky 8- or 16-bit greyscale or RGB(A) in strips.
+// Rows are handed to a callback as they are read, so a 300MB scan never has
+// to be held in memory.
+
+type unsupportedTIFFError struct {
+	problem string
+}
+
+func (e *unsupportedTIFFError) Error() string {
+	return "unsupported TIFF: " + e.problem
+}
+
+var errNotTIFF = errors.New("not a TIFF file")
+
+type tiffInfo struct {
+	width, height   int
+	bitsPerSample   int
+	samplesPerPixel int
+	photometric     int
+	stripOffsets    []int64
+	stripByteCounts []int64
+	rowsPerStrip    int
+	order           binary.ByteOrder
+}
+
+const (
+	tiffImageWidth      = 256
+	tiffImageLength     = 257
+	tiffBitsPerSample   = 258
+	tiffCompression     = 259
+	tiffPhotometric     = 262
+	tiffStripOffsets    = 273
+	tiffSamplesPerPixel = 277
+	tiffRowsPerStrip    = 278
+	tiffStripByteCounts = 279
+	tiffPlanarConfig    = 284
+)
+
+func isTIFF(magic []byte) bool {
+	return len(magic) >= 4 && (string(magic[:4]) == "II*\x00" || string(magic[:4]) == "MM\x00*")
+}
+
+// readTIFFInfo parses the first IFD.
+func readTIFFInfo(r io.ReaderAt) (*tiffInfo, error) {
+	header := make([]byte, 8)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, errNotTIFF
+	}
+	if !isTIFF(header) {
+		return nil, errNotTIFF
+	}
+	info := &tiffInfo{order: binary.LittleEndian, bitsPerSample: 1, samplesPerPixel: 1, rowsPerStrip: 1 << 30}
+	if header[0] == 'M' {
+		info.order = binary.BigEndian
+	}
+	ifd := int64(info.order.Uint32(header[4:]))
+	countBytes := make([]byte, 2)
+	if _, err := r.ReadAt(countBytes, ifd); err != nil {
+		return nil, err
+	}
+	count := int(info.order.Uint16(countBytes))
+	entries := make([]byte, count*12)
+	if _, err := r.ReadAt(entries, ifd+2); err != nil {
+		return nil, err
+	}
+
+	compression, planar := 1, 1
+	for i := 0; i < count; i++ {
+		e := entries[i*12 : i*12+12]
+		tag := info.order.Uint16(e[0:])
+		values, err := tiffValues(r, info.order, info.order.Uint16(e[2:]), int(info.order.Uint32(e[4:])), e[8:12])
+		if err != nil {
+			return nil, err
+		}
+		if len(values) == 0 {
+			continue
+		}
+		switch tag {
+		case tiffImageWidth:
+			info.width = int(values[0])
+		case tiffImageLength:
+			info.height = int(values[0])
+		case tiffBitsPerSample:
+			info.bitsPerSample = int(values[0])
+			for _, v := range values {
+				if int(v) != info.bitsPerSample {
+					return nil, &unsupportedTIFFError{"mixed bits per sample"}
+				}
+			}
+		case tiffCompression:
+			compression = int(values[0])
+		case tiffPhotometric:
+			info.photometric = int(values[0])
+		case tiffStripOffsets:
+			info.stripOffsets = values
+		case tiffSamplesPerPixel:
+			info.samplesPerPixel = int(values[0])
+		case tiffRowsPerStrip:
+			info.rowsPerStrip = int(values[0])
+		case tiffStripByteCounts:
+			info.stripByteCounts = values
+		case tiffPlanarConfig:
+			planar = int(values[0])
+		}
+	}
+
+	switch {
+	case compression != 1:
+		return nil, &unsupportedTIFFError{fmt.Sprintf("compression %d", compression)}
+	case planar != 1:
+		return nil, &unsupportedTIFFError{"planar sample layout"}
+	case info.bitsPerSample != 8 && info.bitsPerSample != 16:
+		return nil, &unsupportedTIFFError{fmt.Sprintf("%d bits per sample", info.bitsPerSample)}
+	case info.photometric == 2 && info.samplesPerPixel < 3:
+		return nil, &unsupportedTIFFError{"RGB with fewer than 3 samples"}
+	case info.photometric != 0 && info.photometric != 1 && info.photometric != 2:
+		return nil, &unsupportedTIFFError{fmt.Sprintf("photometric interpretation %d", info.photometric)}
+	case info.width <= 0 || info.height <= 0:
+		return nil, &unsupportedTIFFError{"missing dimensions"}
+	case len(info.stripOffsets) == 0 || len(info.stripOffsets) != len(info.stripByteCounts):
+		return nil, &unsupportedTIFFError{"missing strips"}
+	}
+	return info, nil
+}
+
+// tiffValues reads the SHORT or LONG values of an IFD entry, which are stored
+// in the entry itself when they fit in four bytes.
+func tiffValues(r io.ReaderAt, order binary.ByteOrder, typ uint16, count int, inline []byte) ([]int64, error) {
+	var size int
+	switch typ {
+	case 3:
+		size = 2
+	case 4:
+		size = 4
+	default:
+		return nil, nil
+	}
+	if count < 0 || count > 1<<24 {
+		return nil, &unsupportedTIFFError{"implausible entry count"}
+	}
+	data := inline
+	if count*size > 4 {
+		data = make([]byte, count*size)
+		if _, err := r.ReadAt(data, int64(order.Uint32(inline))); err != nil {
+			return nil, err
+		}
+	}
+	values := make([]int64, count)
+	for i := range values {
+		if size == 2 {
+			values[i] = int64(order.Uint16(data[i*2:]))
+		} else {
+			values[i] = int64(order.Uint32(data[i*4:]))
+		}
+	}
+	return values, nil
+}
+
+// readTIFFRows calls fn with each row of the image as 8-bit RGB.
+func readTIFFRows(r io.ReaderAt, info *tiffInfo, fn func(y int, rgb []byte)) error {
+	bytesPerSample := info.bitsPerSample / 8
+	rowBytes := info.width * info.samplesPerPixel * bytesPerSample
+	row := make([]byte, rowBytes)
+	rgb := make([]byte, info.width*3)
+	y := 0
+	for i, offset := range info.stripOffsets {
+		rows := info.rowsPerStrip
+		if int64(rows*rowBytes) > info.stripByteCounts[i] {
+			rows = int(info.stripByteCounts[i]) / rowBytes
+		}
+		for j := 0; j < rows && y < info.height; j++ {
+			if _, err := r.ReadAt(row, offset+int64(j*rowBytes)); err != nil {
+				return err
+			}
+			for x := 0; x < info.width; x++ {
+				for c := 0; c < 3; c++ {
+					s := c
+					if info.photometric != 2 {
+						s = 0
+					}
+					k := (x*info.samplesPerPixel + s) * bytesPerSample
+					v := row[k]
+					if bytesPerSample == 2 && info.order == binary.LittleEndian {
+						v = row[k+1] // the high byte
+					}
+					if info.photometric == 0 {
+						v = 255 - v
+					}
+					rgb[x*3+c] = v
+				}
+			}
+			fn(y, rgb)
+			y++
+		}
+	}
+	if y < info.height {
+		return &unsupportedTIFFError{"strips cover fewer rows than the image"}
+	}
+	return nil
+}
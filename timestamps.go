@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Timestamp is how every time in the API and in moss's own JSON files is
+// written: RFC 3339 in UTC, whatever TZ the server runs in. It reads RFC 3339
+// with any offset, and Unix seconds.
+type Timestamp struct {
+	time.Time
+}
+
+func stamp(t time.Time) Timestamp {
+	return Timestamp{t.UTC()}
+}
+
+func (t Timestamp) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.UTC().Format(time.RFC3339Nano))
+}
+
+func (t *Timestamp) UnmarshalJSON(data []byte) error {
+	var seconds int64
+	if err := json.Unmarshal(data, &seconds); err == nil {
+		*t = stamp(time.Unix(seconds, 0))
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return err
+	}
+	*t = stamp(parsed)
+	return nil
+}
+
+// parseTimeParam reads a query parameter given as RFC 3339 or Unix seconds.
+func parseTimeParam(param string, v string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(seconds, 0).UTC(), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return t, &timeFilterError{param, v}
+	}
+	return t.UTC(), nil
+}
+
+// HoldingInfo is kept in holding.json next to music/ and records facts about
+// the holding that the filesystem can't be trusted to remember.
+type HoldingInfo struct {
+	CreatedAt Timestamp
+	Private   bool `json:",omitempty"`
+
+	// Detected when the album art was stored; see arttype.go
+	AlbumArtType string `json:",omitempty"`
+	// And of the art in other slots; see artwork.go
+	ArtworkTypes map[string]string `json:",omitempty"`
+
+	// Digest of the archive of a locked holding, by format
+	ArchiveSHA256 map[string]string `json:",omitempty"`
+
+	// Set once the holding has been exported to cold storage
+	Archive *ArchiveRecord `json:",omitempty"`
+}
+
+func readHoldingInfo(dir string) (HoldingInfo, error) {
+	info := HoldingInfo{}
+	data, err := ioutil.ReadFile(path.Join(dir, holdingInfoFileName))
+	if err != nil {
+		return info, err
+	}
+	err = json.Unmarshal(data, &info)
+	return info, err
+}
+
+func writeHoldingInfo(dir string, info HoldingInfo) error {
+	js, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path.Join(dir, holdingInfoFileName), js)
+}
+
+func readLockInfo(dir string) (LockInfo, error) {
+	info := LockInfo{}
+	data, err := ioutil.ReadFile(path.Join(dir, lockFileName))
+	if err != nil || len(data) == 0 {
+		// Locks created before lock metadata existed are empty files
+		return info, err
+	}
+	err = json.Unmarshal(data, &info)
+	return info, err
+}
+
+// Holdings without holding.json are dated by their oldest file.
+func inferCreatedAt(dir string) time.Time {
+	created := time.Time{}
+	if stat, err := os.Stat(dir); err == nil {
+		created = stat.ModTime()
+	}
+	musicDir := path.Join(dir, "music")
+	walkFiles(musicDir, func(rel string) error {
+		if stat, err := os.Stat(path.Join(musicDir, rel)); err == nil && stat.ModTime().Before(created) {
+			created = stat.ModTime()
+		}
+		return nil
+	})
+	return created.UTC()
+}
+
+func holdingCreatedAt(dir string) time.Time {
+	if info, err := readHoldingInfo(dir); err == nil && !info.CreatedAt.IsZero() {
+		return info.CreatedAt.Time
+	}
+	return inferCreatedAt(dir)
+}
+
+// holdingLockedAt returns the zero time for holdings that are not locked.
+func holdingLockedAt(dir string) time.Time {
+	stat, err := os.Stat(path.Join(dir, lockFileName))
+	if err != nil {
+		return time.Time{}
+	}
+	if info, err := readLockInfo(dir); err == nil && !info.LockedAt.IsZero() {
+		return info.LockedAt.Time
+	}
+	return stat.ModTime().UTC()
+}
+
+// needsTimestampBackfill reports whether a holding predates holding.json or
+// lock metadata with LockedAt.
+func needsTimestampBackfill(uuid string, dir string) (bool, error) {
+	if _, err := readHoldingInfo(dir); os.IsNotExist(err) {
+		return true, nil
+	}
+	if _, err := os.Stat(path.Join(dir, lockFileName)); err != nil {
+		return false, nil
+	}
+	info, err := readLockInfo(dir)
+	return err == nil && info.LockedAt.IsZero(), nil
+}
+
+// backfillHoldingTimestamps records CreatedAt and LockedAt for a holding that
+// predates them, using the filesystem times as the best available guess.
+func backfillHoldingTimestamps(uuid string, dir string) error {
+	if _, err := readHoldingInfo(dir); os.IsNotExist(err) {
+		if err := writeHoldingInfo(dir, HoldingInfo{CreatedAt: stamp(inferCreatedAt(dir))}); err != nil {
+			return err
+		}
+	}
+
+	lockPath := path.Join(dir, lockFileName)
+	stat, err := os.Stat(lockPath)
+	if err != nil {
+		return nil
+	}
+	info, err := readLockInfo(dir)
+	if err != nil || !info.LockedAt.IsZero() {
+		return nil
+	}
+	info.LockedAt = stamp(stat.ModTime())
+	js, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(lockPath, js); err != nil {
+		return err
+	}
+	return os.Chtimes(lockPath, stat.ModTime(), stat.ModTime())
+}
+
+type timeFilterError struct {
+	param string
+	value string
+}
+
+func (e *timeFilterError) Error() string {
+	return fmt.Sprintf("%s must be an RFC 3339 timestamp or Unix seconds, got %q", e.param, e.value)
+}
+
+type holdingTimes struct {
+	uuid    string
+	created time.Time
+	locked  time.Time
+}
+
+// filterHoldings applies the ?createdBefore=, ?createdAfter=, ?lockedBefore=,
+// ?lockedAfter= and ?sort= parameters of the listing endpoint. Filtering on
+// lock time excludes unlocked holdings.
+func filterHoldings(r *http.Request, uuidList []string) ([]string, error) {
+	q := r.URL.Query()
+	params := []string{"createdBefore", "createdAfter", "lockedBefore", "lockedAfter"}
+	bounds := map[string]time.Time{}
+	for _, param := range params {
+		if v := q.Get(param); v != "" {
+			t, err := parseTimeParam(param, v)
+			if err != nil {
+				return nil, err
+			}
+			bounds[param] = t
+		}
+	}
+	sortBy := q.Get("sort")
+	// Holdings without an expectation are neither complete nor incomplete
+	complete := q.Get("complete")
+	if complete != "" && complete != "true" && complete != "false" {
+		return nil, fmt.Errorf("complete must be true or false")
+	}
+	if len(bounds) == 0 && sortBy == "" && complete == "" {
+		return uuidList, nil
+	}
+
+	holdings := []holdingTimes{}
+	for _, uuid := range uuidList {
+		dir, _ := lookupHoldingDir(uuid)
+		h := holdingTimes{uuid, holdingCreatedAt(dir), holdingLockedAt(dir)}
+		if t, ok := bounds["createdBefore"]; ok && !h.created.Before(t) {
+			continue
+		}
+		if t, ok := bounds["createdAfter"]; ok && !h.created.After(t) {
+			continue
+		}
+		if t, ok := bounds["lockedBefore"]; ok && (h.locked.IsZero() || !h.locked.Before(t)) {
+			continue
+		}
+		if t, ok := bounds["lockedAfter"]; ok && (h.locked.IsZero() || !h.locked.After(t)) {
+			continue
+		}
+		if complete != "" {
+			if c, err := checkCompleteness(uuid, dir); err != nil || !c.Declared || c.Complete != (complete == "true") {
+				continue
+			}
+		}
+		holdings = append(holdings, h)
+	}
+
+	switch sortBy {
+	case "":
+	case "created", "-created", "locked", "-locked":
+		sort.SliceStable(holdings, func(i, j int) bool {
+			a, b := holdings[i], holdings[j]
+			if sortBy[0] == '-' {
+				a, b = b, a
+			}
+			if sortBy == "created" || sortBy == "-created" {
+				return a.created.Before(b.created)
+			}
+			return a.locked.Before(b.locked)
+		})
+	default:
+		return nil, fmt.Errorf("sort must be one of created, -created, locked, -locked")
+	}
+
+	result := []string{}
+	for _, h := range holdings {
+		result = append(result, h.uuid)
+	}
+	return result, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wuvt/moss/mosstest"
+)
+
+// inZone runs the rest of the test as if the server's TZ were loc.
+func inZone(t *testing.T, loc *time.Location) {
+	t.Helper()
+	local := time.Local
+	time.Local = loc
+	t.Cleanup(func() { time.Local = local })
+}
+
+func TestTimestampUTC(t *testing.T) {
+	inZone(t, time.FixedZone("EDT", -4*60*60))
+	local := time.Date(2026, 10, 14, 6, 30, 0, 0, time.Local)
+
+	js, err := json.Marshal(stamp(local))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(js) != `"2026-10-14T10:30:00Z"` {
+		t.Errorf("a local time was written as %s", js)
+	}
+	// Even one not made by stamp
+	if js, _ := json.Marshal(Timestamp{local}); string(js) != `"2026-10-14T10:30:00Z"` {
+		t.Errorf("an unstamped local time was written as %s", js)
+	}
+
+	for _, in := range []string{`"2026-10-14T06:30:00-04:00"`, `"2026-10-14T19:30:00+09:00"`, `"2026-10-14T10:30:00Z"`, `1791973800`} {
+		var ts Timestamp
+		if err := json.Unmarshal([]byte(in), &ts); err != nil {
+			t.Errorf("%s: %s", in, err)
+			continue
+		}
+		if !ts.Equal(local) || ts.Location() != time.UTC {
+			t.Errorf("%s was read as %s", in, ts)
+		}
+	}
+	for _, bad := range []string{`"2026-10-14 10:30:00"`, `"yesterday"`, `true`} {
+		var ts Timestamp
+		if err := json.Unmarshal([]byte(bad), &ts); err == nil {
+			t.Errorf("%s was read as %s", bad, ts)
+		}
+	}
+
+	for _, v := range []string{"2026-10-14T06:30:00-04:00", "1791973800"} {
+		got, err := parseTimeParam("since", v)
+		if err != nil || !got.Equal(local) || got.Location() != time.UTC {
+			t.Errorf("parseTimeParam(%q) = %s, %v", v, got, err)
+		}
+	}
+	if _, err := parseTimeParam("since", "14/10/2026"); err == nil {
+		t.Error("parseTimeParam took a date it can't read")
+	}
+}
+
+// Away from UTC, what the API shows and filters by is still UTC.
+func TestAPITimestampsUTC(t *testing.T) {
+	inZone(t, time.FixedZone("JST", 9*60*60))
+	before := time.Now()
+	s := newTestServer(t, mosstest.Spec{Holdings: []mosstest.Holding{{Tracks: []mosstest.Track{{Name: "01.flac"}}, Locked: true}}})
+
+	var holding struct {
+		CreatedAt string
+		LockedAt  string
+	}
+	s.MustDo("GET", s.Path(0), nil).JSON(t, &holding)
+	for name, v := range map[string]string{"CreatedAt": holding.CreatedAt, "LockedAt": holding.LockedAt} {
+		parsed, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil || !strings.HasSuffix(v, "Z") {
+			t.Errorf("%s is %q", name, v)
+		} else if parsed.Before(before.Add(-time.Second)) || parsed.After(time.Now().Add(time.Second)) {
+			t.Errorf("%s is %s, which isn't now", name, v)
+		}
+	}
+
+	// The same instant with an offset, in Unix seconds or in UTC finds it
+	since := before.Add(-time.Minute)
+	for _, v := range []string{since.Format(time.RFC3339), since.UTC().Format(time.RFC3339), since.In(time.FixedZone("", -7*60*60)).Format(time.RFC3339)} {
+		var uuids []string
+		s.MustDo("GET", "/?createdAfter="+url.QueryEscape(v), nil).JSON(t, &uuids)
+		if len(uuids) != 1 {
+			t.Errorf("createdAfter=%s found %v", v, uuids)
+		}
+		s.MustDo("GET", "/?createdBefore="+url.QueryEscape(v), nil).JSON(t, &uuids)
+		if len(uuids) != 0 {
+			t.Errorf("createdBefore=%s found %v", v, uuids)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"syscall"
+	"time"
+)
+
+// Temporary files live in tmp/ under the library root so that renaming them
+// into place is always a cheap same-filesystem rename.
+const tmpDirName = "tmp"
+
+const janitorInterval = time.Hour
+const staleTempAge = 24 * time.Hour
+
+func tmpDir() string {
+	return path.Join(config.LibraryPath, tmpDirName)
+}
+
+type crossDeviceError struct {
+	root string
+	tmp  string
+}
+
+func (e *crossDeviceError) Error() string {
+	return fmt.Sprintf("%s is not on the same filesystem as %s", e.tmp, e.root)
+}
+
+func deviceID(p string) (uint64, error) {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(p, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Dev), nil
+}
+
+// initTmpDir creates the library's tmp/ directory and makes sure it shares a
+// device with the library root.
+func initTmpDir() error {
+	if err := os.MkdirAll(tmpDir(), 0755); err != nil {
+		return err
+	}
+	rootDev, err := deviceID(config.LibraryPath)
+	if err != nil {
+		return err
+	}
+	tmpDev, err := deviceID(tmpDir())
+	if err != nil {
+		return err
+	}
+	if rootDev != tmpDev {
+		return &crossDeviceError{config.LibraryPath, tmpDir()}
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temp file and renames it over dest, so
+// readers never see a partially written file.
+func writeFileAtomic(dest string, data []byte) error {
+	f, err := ioutil.TempFile(tmpDir(), "upload-")
+	if err != nil {
+		return err
+	}
+	_, err = faultyWriter(dest, f).Write(data)
+	if err == nil {
+		err = syncFile(f)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), dest)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return syncDir(path.Dir(dest))
+}
+
+type TempUsage struct {
+	Files int
+	Bytes int64
+}
+
+func tempUsage() TempUsage {
+	usage := TempUsage{}
+	dirEnts, err := ioutil.ReadDir(tmpDir())
+	if err != nil {
+		return usage
+	}
+	for _, dirEnt := range dirEnts {
+		usage.Files++
+		usage.Bytes += dirEnt.Size()
+	}
+	return usage
+}
+
+// cleanTmpDir removes temp files old enough that their request must have
+// died without cleaning up after itself.
+func cleanTmpDir() {
+	dirEnts, err := ioutil.ReadDir(tmpDir())
+	if err != nil {
+		log.Println("Janitor: " + err.Error())
+		return
+	}
+	for _, dirEnt := range dirEnts {
+		if time.Since(dirEnt.ModTime()) < staleTempAge {
+			continue
+		}
+		p := path.Join(tmpDir(), dirEnt.Name())
+		if err := os.RemoveAll(p); err != nil {
+			log.Println("Janitor: " + err.Error())
+			continue
+		}
+		log.Printf("Janitor: removed stale temp file %s (%d bytes)\n", p, dirEnt.Size())
+	}
+}
+
+func runJanitor() {
+	for {
+		if !expirySuspended() {
+			cleanTmpDir()
+			expireTxns()
+		}
+		// Picks up usage that couldn't be saved while frozen
+		saveUsage()
+		time.Sleep(janitorInterval)
+	}
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Transactions let an importer upload a whole holding all-or-nothing. PUTs
+// carrying X-Moss-Txn are staged in tmp/ and only moved into the holding,
+// together, when the transaction is committed.
+const txnHeader = "X-Moss-Txn"
+
+// Transactions untouched for this long are discarded by the janitor
+const staleTxnAge = time.Hour
+
+type Txn struct {
+	mu sync.Mutex
+
+	ID       string
+	UUID     string
+	Created  Timestamp
+	LastUsed Timestamp
+	dir      string
+	files    map[string]map[string]string
+	// Of each staged file, as it was staged
+	provenance map[string]Provenance
+}
+
+var txns = struct {
+	sync.Mutex
+	m map[string]*Txn
+}{m: map[string]*Txn{}}
+
+type txnError struct {
+	id      string
+	problem string
+}
+
+func (e *txnError) Error() string {
+	return fmt.Sprintf("Transaction %s %s", e.id, e.problem)
+}
+
+// findTxn returns the open transaction id for uuid, with its mutex held.
+func findTxn(uuid string, id string) (*Txn, error) {
+	txns.Lock()
+	txn, ok := txns.m[id]
+	txns.Unlock()
+	if !ok {
+		return nil, &txnError{id, "does not exist or has expired"}
+	}
+	txn.mu.Lock()
+	if txn.UUID != uuid {
+		txn.mu.Unlock()
+		return nil, &txnError{id, "belongs to " + txn.UUID}
+	}
+	if txn.files == nil {
+		// Committed or aborted while we waited
+		txn.mu.Unlock()
+		return nil, &txnError{id, "does not exist or has expired"}
+	}
+	txn.LastUsed = stamp(time.Now())
+	return txn, nil
+}
+
+// forgetTxn removes a transaction and its staging directory. The caller holds
+// its mutex.
+func forgetTxn(txn *Txn) {
+	txns.Lock()
+	delete(txns.m, txn.ID)
+	txns.Unlock()
+	txn.files = nil
+	os.RemoveAll(txn.dir)
+}
+
+func txnStatusError(w http.ResponseWriter, err error) {
+	log.Println(err.Error())
+	http.Error(w, err.Error(), http.StatusNotFound)
+}
+
+func writeTxn(w http.ResponseWriter, status int, txn *Txn) {
+	js, err := json.Marshal(txn)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(js)
+}
+
+// txnHandler handles POST /UUID4/txn, POST /UUID4/txn/ID/commit and
+// POST /UUID4/txn/ID/abort.
+func txnHandler(w http.ResponseWriter, r *http.Request, params []string) {
+	uuid := params[0]
+	if err := uuidSanityCheck(uuid); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !checkAuth(w, r) {
+		return
+	}
+	release, ok := guardWrite(w)
+	if !ok {
+		return
+	}
+	defer release()
+
+	switch {
+	case len(params) == 2:
+		openTxn(w, uuid)
+	case len(params) == 4 && params[3] == "commit":
+		commitTxn(w, uuid, params[2])
+	case len(params) == 4 && params[3] == "abort":
+		txn, err := findTxn(uuid, params[2])
+		if err != nil {
+			txnStatusError(w, err)
+			return
+		}
+		forgetTxn(txn)
+		txn.mu.Unlock()
+		log.Printf("Aborted transaction %s for %s\n", txn.ID, uuid)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "No request handler for that", http.StatusBadRequest)
+	}
+}
+
+func openTxn(w http.ResponseWriter, uuid string) {
+	if err := checkWritable(uuid); err != nil {
+		writeRefused(w, err)
+		return
+	}
+	if _, err := os.Stat(path.Join(uuidToPath(config.LibraryPath, uuid), lockFileName)); err == nil {
+		lerr := &lockExistsError{uuid}
+		stats.lockConflicts.add()
+		log.Println(lerr.Error())
+		http.Error(w, lerr.Error(), http.StatusForbidden)
+		return
+	}
+
+	b := make([]byte, 8)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	dir, err := ioutil.TempDir(tmpDir(), "txn-"+id+"-")
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	now := time.Now().UTC()
+	txn := &Txn{
+		ID:         id,
+		UUID:       uuid,
+		Created:    stamp(now),
+		LastUsed:   stamp(now),
+		dir:        dir,
+		files:      map[string]map[string]string{},
+		provenance: map[string]Provenance{},
+	}
+	txns.Lock()
+	txns.m[id] = txn
+	txns.Unlock()
+	log.Printf("Opened transaction %s for %s\n", id, uuid)
+	writeTxn(w, http.StatusCreated, txn)
+}
+
+// stageTxnFile writes an upload into the transaction instead of the holding.
+// rel has already been checked against the holding's music directory.
+func stageTxnFile(txn *Txn, musicDir string, rel string, body []byte, sums map[string]string, prov Provenance) error {
+	stagedMusic := path.Join(txn.dir, "music")
+	dest := path.Join(stagedMusic, rel)
+	if enforceCaseUniqueness() {
+		if err := checkCaseCollision(stagedMusic, dest); err != nil {
+			return err
+		}
+	}
+	if config.Limits.MaxHoldingFiles > 0 {
+		if _, staged := txn.files[rel]; !staged {
+			count, err := countFiles(musicDir)
+			if err != nil {
+				return err
+			}
+			for staged := range txn.files {
+				if _, err := os.Stat(path.Join(musicDir, staged)); os.IsNotExist(err) {
+					count++
+				}
+			}
+			if _, err := os.Stat(path.Join(musicDir, rel)); os.IsNotExist(err) && count >= config.Limits.MaxHoldingFiles {
+				return &tooManyFilesError{txn.UUID, config.Limits.MaxHoldingFiles}
+			}
+		}
+	}
+	dir, _ := filepath.Split(dest)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(dest, body); err != nil {
+		return err
+	}
+	txn.files[rel] = sums
+	txn.provenance[rel] = prov
+	return nil
+}
+
+// commitTxn moves every staged file into the holding under its mutex. Files
+// it replaces are set aside first so a failure part way through can put the
+// holding back the way it was.
+// txnSidecars are the files of a holding that committing a transaction
+// rewrites.
+var txnSidecars = []string{checksumsFileName, tagsFileName, provenanceFileName}
+
+// snapshotSidecars reads the txnSidecars of the holding in dir as they are,
+// nil for any that don't exist, so a failed commit can put them back.
+func snapshotSidecars(dir string) (map[string][]byte, error) {
+	snapshot := map[string][]byte{}
+	for _, name := range txnSidecars {
+		data, err := ioutil.ReadFile(path.Join(dir, name))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		snapshot[name] = data
+	}
+	return snapshot, nil
+}
+
+// restoreSidecars puts back the txnSidecars from a snapshot, removing those
+// that didn't exist when it was taken.
+func restoreSidecars(dir string, snapshot map[string][]byte) error {
+	var firstErr error
+	for name, data := range snapshot {
+		var err error
+		if data == nil {
+			if err = os.Remove(path.Join(dir, name)); os.IsNotExist(err) {
+				err = nil
+			}
+		} else {
+			err = writeFileAtomic(path.Join(dir, name), data)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func commitTxn(w http.ResponseWriter, uuid string, id string) {
+	if err := checkWritable(uuid); err != nil {
+		writeRefused(w, err)
+		return
+	}
+	if err := prepareWrite(uuid); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	unlock := lockHolding(uuid)
+	defer unlock()
+
+	txn, err := findTxn(uuid, id)
+	if err != nil {
+		txnStatusError(w, err)
+		return
+	}
+	defer txn.mu.Unlock()
+
+	holdingPath := uuidToPath(config.LibraryPath, uuid)
+	if _, err := os.Stat(path.Join(holdingPath, lockFileName)); err == nil {
+		lerr := &lockExistsError{uuid}
+		stats.lockConflicts.add()
+		log.Println(lerr.Error())
+		http.Error(w, lerr.Error(), http.StatusForbidden)
+		forgetTxn(txn)
+		return
+	}
+	if err := checkLockProposal(uuid, holdingPath); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	rels := []string{}
+	for rel := range txn.files {
+		rels = append(rels, rel)
+	}
+	sort.Strings(rels)
+
+	newHolding := !dirExists(holdingPath)
+	sums, err := readChecksums(holdingPath)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	tags, err := readTags(holdingPath)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	records, err := readProvenance(holdingPath)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+
+	sidecars, err := snapshotSidecars(holdingPath)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+
+	musicDir := path.Join(holdingPath, "music")
+	backupDir := path.Join(txn.dir, "replaced")
+	done := []string{}
+	rollback := func() {
+		if !newHolding {
+			if err := restoreSidecars(holdingPath, sidecars); err != nil {
+				log.Printf("Rolling back transaction %s for %s: %s\n", txn.ID, uuid, err.Error())
+			}
+		}
+		for _, rel := range done {
+			dest := path.Join(musicDir, rel)
+			if err := os.Rename(path.Join(backupDir, rel), dest); os.IsNotExist(err) {
+				os.Remove(dest)
+			}
+		}
+		if newHolding {
+			os.RemoveAll(holdingPath)
+		}
+		// Files already moved in were removed again, so it can't be retried
+		forgetTxn(txn)
+	}
+	for _, rel := range rels {
+		dest := path.Join(musicDir, rel)
+		dir, _ := filepath.Split(dest)
+		backup := path.Join(backupDir, rel)
+		backupParent, _ := filepath.Split(backup)
+		err := makeDirs(dir)
+		if err == nil {
+			err = os.MkdirAll(backupParent, 0755)
+		}
+		if err == nil {
+			if err = os.Rename(dest, backup); os.IsNotExist(err) {
+				err = nil
+			}
+		}
+		if err == nil {
+			err = os.Rename(path.Join(txn.dir, "music", rel), dest)
+		}
+		if err == nil {
+			err = syncDir(dir)
+		}
+		if err != nil {
+			os.Rename(backup, dest)
+			rollback()
+			storageError(w, err)
+			return
+		}
+		done = append(done, rel)
+		sums.Music[rel] = txn.files[rel]
+		records[path.Join("music", rel)] = txn.provenance[rel]
+		delete(tags, rel)
+		if isTrack(rel) {
+			if f, err := os.Open(dest); err == nil {
+				if t, err := readTrackTags(f); err == nil && !t.empty() {
+					tags[rel] = t
+				}
+				f.Close()
+			}
+		}
+	}
+
+	if newHolding {
+		info := HoldingInfo{CreatedAt: stamp(time.Now())}
+		if err := writeHoldingInfo(holdingPath, info); err != nil {
+			rollback()
+			storageError(w, err)
+			return
+		}
+	}
+	if err := writeChecksums(holdingPath, sums); err != nil {
+		rollback()
+		storageError(w, err)
+		return
+	}
+	if err := writeTags(holdingPath, tags); err != nil {
+		rollback()
+		storageError(w, err)
+		return
+	}
+	if err := writeProvenance(holdingPath, records); err != nil {
+		rollback()
+		storageError(w, err)
+		return
+	}
+
+	forgetTxn(txn)
+	emitChange(uuid, "txn", txn.ID)
+	log.Printf("Committed transaction %s for %s (%d files)\n", txn.ID, uuid, len(rels))
+
+	js, err := json.Marshal(map[string]interface{}{"ID": txn.ID, "UUID": uuid, "Files": rels})
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// expireTxns discards transactions nobody has touched for staleTxnAge.
+func expireTxns() {
+	txns.Lock()
+	open := []*Txn{}
+	for _, txn := range txns.m {
+		open = append(open, txn)
+	}
+	txns.Unlock()
+
+	for _, txn := range open {
+		txn.mu.Lock()
+		if txn.files != nil && time.Since(txn.LastUsed.Time) >= staleTxnAge {
+			log.Printf("Janitor: expired transaction %s for %s (%d files)\n", txn.ID, txn.UUID, len(txn.files))
+			forgetTxn(txn)
+		}
+		txn.mu.Unlock()
+	}
+}
@@ -0,0 +1,60 @@
+//go:build faults
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/wuvt/moss/mosstest"
+)
+
+// A commit that fails rewriting any of the sidecars leaves the holding as it
+// was, sidecars included.
+func TestTxnRollbackRestoresSidecars(t *testing.T) {
+	old := taggedFLAC("TITLE=Old")
+	for _, failing := range txnSidecars {
+		t.Run(failing, func(t *testing.T) {
+			s := newTestServer(t, mosstest.Spec{Holdings: []mosstest.Holding{{
+				Tracks: []mosstest.Track{{Name: "01.flac", Contents: old}},
+			}}})
+			dir := uuidToPath(config.LibraryPath, s.Holdings[0].UUID)
+			before, err := snapshotSidecars(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var txn Txn
+			s.MustDo("POST", s.Path(0, "txn"), nil).JSON(t, &txn)
+			s.MustDo("PUT", s.Path(0, "music", "01.flac"), taggedFLAC("TITLE=New"), txnHeader, txn.ID)
+			s.MustDo("PUT", s.Path(0, "music", "02.flac"), taggedFLAC("TITLE=Added"), txnHeader, txn.ID)
+
+			faults, _ := json.Marshal(Faults{FailWrites: 1, WritePrefix: libraryRel(path.Join(dir, failing))})
+			s.MustDo("PUT", "/admin/faults", faults)
+			defer s.MustDo("DELETE", "/admin/faults", nil)
+			if resp := s.Do("POST", s.Path(0, "txn", txn.ID, "commit"), nil); resp.Status != http.StatusInsufficientStorage {
+				t.Fatalf("commit got %d %s", resp.Status, resp.Body)
+			}
+
+			after, err := snapshotSidecars(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range txnSidecars {
+				if !bytes.Equal(before[name], after[name]) || (before[name] == nil) != (after[name] == nil) {
+					t.Errorf("%s was %q and is now %q", name, before[name], after[name])
+				}
+			}
+			if data, err := os.ReadFile(path.Join(dir, "music", "01.flac")); err != nil || !bytes.Equal(data, old) {
+				t.Errorf("01.flac wasn't put back: %v", err)
+			}
+			if _, err := os.Stat(path.Join(dir, "music", "02.flac")); !os.IsNotExist(err) {
+				t.Errorf("02.flac is still there: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Summing file sizes undercounts what a holding costs: sidecars, cached clips
+// and derived art take space too, and every file is rounded up to whole
+// filesystem blocks. Each holding's usage is measured both ways and split
+// into content (music/ and uploaded art), derived data (clips/ and art made
+// from a master) and metadata (the JSON sidecars and the lock). Holdings are
+// measured along with the holding count and kept in memory; GET /UUID4/
+// measures its holding afresh.
+const defaultTopHoldings = 20
+
+type UsageFigures struct {
+	Files int
+	// Sum of file sizes
+	Logical int64
+	// Sum of allocated blocks, or of sizes where the filesystem can't say
+	Physical int64
+}
+
+func (u *UsageFigures) add(o UsageFigures) {
+	u.Files += o.Files
+	u.Logical += o.Logical
+	u.Physical += o.Physical
+}
+
+type HoldingUsage struct {
+	Content  UsageFigures
+	Derived  UsageFigures
+	Metadata UsageFigures
+	Logical  int64
+	Physical int64
+}
+
+type HoldingUsageEntry struct {
+	UUID string
+	HoldingUsage
+}
+
+type UsageTotals struct {
+	Holdings int
+	HoldingUsage
+	MeasuredAt Timestamp
+}
+
+type TopHoldings struct {
+	By         string
+	MeasuredAt *Timestamp `json:",omitempty"`
+	Holdings   []HoldingUsageEntry
+}
+
+var usageCache = struct {
+	sync.Mutex
+	holdings   map[string]HoldingUsage
+	measuredAt time.Time
+}{holdings: map[string]HoldingUsage{}}
+
+type usageOrderError struct {
+	by string
+}
+
+func (e *usageOrderError) Error() string {
+	return "by must be logical or physical, got " + e.by
+}
+
+// usageCategory sorts a path relative to the holding directory into content,
+// derived or metadata by its first component.
+func usageCategory(usage *HoldingUsage, rel string) *UsageFigures {
+	switch strings.SplitN(rel, "/", 2)[0] {
+	case "music", "albumart", artworkDirName, masterArtFileName:
+		return &usage.Content
+	case clipDirName, derivedArtFileName:
+		return &usage.Derived
+	}
+	return &usage.Metadata
+}
+
+// measureHolding walks a holding directory and adds up what it uses.
+// Directories count toward physical usage only.
+func measureHolding(dir string) (HoldingUsage, error) {
+	usage := HoldingUsage{}
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		figures := usageCategory(&usage, filepath.ToSlash(rel))
+		physical := physicalSize(info)
+		figures.Physical += physical
+		usage.Physical += physical
+		if info.Mode().IsRegular() {
+			figures.Files++
+			figures.Logical += info.Size()
+			usage.Logical += info.Size()
+		}
+		return nil
+	})
+	return usage, err
+}
+
+// refreshUsage measures every holding and replaces the cached figures.
+func refreshUsage() error {
+	measured := map[string]HoldingUsage{}
+	err := walkHoldings(config.LibraryPath, func(uuid string, dir string, legacy bool) error {
+		usage, err := measureHolding(dir)
+		if os.IsNotExist(err) {
+			// Deleted while we were walking
+			return nil
+		} else if err != nil {
+			return err
+		}
+		measured[strings.ToLower(uuid)] = usage
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	usageCache.Lock()
+	defer usageCache.Unlock()
+	usageCache.holdings = measured
+	usageCache.measuredAt = time.Now()
+	return nil
+}
+
+func setHoldingUsage(uuid string, usage HoldingUsage) {
+	usageCache.Lock()
+	defer usageCache.Unlock()
+	usageCache.holdings[strings.ToLower(uuid)] = usage
+}
+
+func forgetHoldingUsage(uuid string) {
+	usageCache.Lock()
+	defer usageCache.Unlock()
+	delete(usageCache.holdings, strings.ToLower(uuid))
+}
+
+// usageTotals sums the cached figures, or returns nil before the first
+// measurement has finished.
+func usageTotals() *UsageTotals {
+	usageCache.Lock()
+	defer usageCache.Unlock()
+	if usageCache.measuredAt.IsZero() {
+		return nil
+	}
+	totals := UsageTotals{Holdings: len(usageCache.holdings), MeasuredAt: stamp(usageCache.measuredAt)}
+	for _, usage := range usageCache.holdings {
+		totals.Content.add(usage.Content)
+		totals.Derived.add(usage.Derived)
+		totals.Metadata.add(usage.Metadata)
+		totals.Logical += usage.Logical
+		totals.Physical += usage.Physical
+	}
+	return &totals
+}
+
+func topHoldings(by string, limit int) TopHoldings {
+	usageCache.Lock()
+	defer usageCache.Unlock()
+	top := TopHoldings{By: by, Holdings: []HoldingUsageEntry{}}
+	if !usageCache.measuredAt.IsZero() {
+		measuredAt := stamp(usageCache.measuredAt)
+		top.MeasuredAt = &measuredAt
+	}
+	for uuid, usage := range usageCache.holdings {
+		top.Holdings = append(top.Holdings, HoldingUsageEntry{uuid, usage})
+	}
+	size := func(e HoldingUsageEntry) int64 {
+		if by == "physical" {
+			return e.Physical
+		}
+		return e.Logical
+	}
+	sort.Slice(top.Holdings, func(i, j int) bool {
+		a, b := top.Holdings[i], top.Holdings[j]
+		if size(a) != size(b) {
+			return size(a) > size(b)
+		}
+		return a.UUID < b.UUID
+	})
+	if len(top.Holdings) > limit {
+		top.Holdings = top.Holdings[:limit]
+	}
+	return top
+}
+
+// topHoldingsHandler handles GET /usage/top?by=logical|physical&limit=N.
+func topHoldingsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	by := r.URL.Query().Get("by")
+	if by == "" {
+		by = "logical"
+	} else if by != "logical" && by != "physical" {
+		http.Error(w, (&usageOrderError{by}).Error(), http.StatusBadRequest)
+		return
+	}
+	limit, err := pageLimit(r, defaultTopHoldings)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	js, err := json.Marshal(topHoldings(by, limit))
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// GET /uuidinfo/UUID tells a client what this node makes of a UUID before it
+// does anything with it: whether it's valid and why not, its canonical form,
+// the shard covering it and whether that shard takes writes. Everything but
+// Exists comes from the config; Exists is answered from the negative cache
+// when it can be and otherwise costs one stat of the holding directory.
+
+type UUIDInfo struct {
+	UUID      string
+	Canonical string
+	Valid     bool
+	Problem   string `json:",omitempty"`
+	// AcceptedUUIDVersions, in effect
+	AcceptedVersions []int
+	Node             string `json:",omitempty"`
+
+	// Unset for a valid UUID outside every shard of this node
+	Shard    *ShardRange `json:",omitempty"`
+	Backend  string      `json:",omitempty"`
+	Writable bool
+	// Why a write would be refused
+	WriteRefusal string `json:",omitempty"`
+	Exists       bool
+}
+
+func lookupUUIDInfo(uuid string) UUIDInfo {
+	info := UUIDInfo{UUID: uuid, Canonical: strings.ToLower(uuid), AcceptedVersions: acceptedUUIDVersions(), Node: config.NodeName}
+	if err := uuidSanityCheck(info.Canonical); err != nil {
+		info.Problem = err.Error()
+		if uerr, ok := err.(*uuidError); ok {
+			info.Problem = uerr.problem
+		}
+		return info
+	}
+	info.Valid = true
+	if shard, ok := shardForUUID(info.Canonical); ok {
+		info.Shard = &ShardRange{shard.MinUUID, shard.MaxUUID, shard.Label}
+		info.Backend = shard.Backend
+	}
+	if err := checkWritable(info.Canonical); err != nil {
+		info.WriteRefusal = err.Error()
+	} else {
+		info.Writable = true
+	}
+	if !knownMissing(info.Canonical) {
+		dir, _ := lookupHoldingDir(info.Canonical)
+		if info.Exists = dirExists(dir); !info.Exists {
+			rememberMissing(info.Canonical)
+		}
+	}
+	return info
+}
+
+// uuidInfoHandler handles GET /uuidinfo/UUID. It answers 200 for invalid
+// UUIDs too, with Valid unset and the Problem.
+func uuidInfoHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkAuth(w, r) {
+		return
+	}
+	uuid := strings.TrimPrefix(r.URL.Path, "/uuidinfo/")
+	if uuid == "" || strings.Contains(uuid, "/") {
+		http.Error(w, "Give one UUID: /uuidinfo/UUID", http.StatusNotFound)
+		return
+	}
+	js, err := json.Marshal(lookupUUIDInfo(uuid))
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
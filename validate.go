@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// POST /UUID4/validate runs the checks a set of track uploads would meet,
+// without the bytes and without writing anything, so an importer on a slow
+// link can fix or skip files before sending them. Each file gets a verdict,
+// ok, would-dedup (the holding already has that content) or rejected with a
+// code, and so does each check of the holding as a whole.
+const (
+	planOK         = "ok"
+	planWouldDedup = "would-dedup"
+	planRejected   = "rejected"
+)
+
+type PlannedFile struct {
+	// Under music/
+	Path      string
+	Size      int64
+	Checksums map[string]string `json:",omitempty"`
+}
+
+type UploadPlan struct {
+	Files []PlannedFile
+}
+
+type PlanFileVerdict struct {
+	Path string
+	// Set when it would be stored under another name
+	StoredName string `json:",omitempty"`
+	Verdict    string
+	Code       string `json:",omitempty"`
+	Message    string `json:",omitempty"`
+	// The file already in the holding with the same content
+	Existing string `json:",omitempty"`
+}
+
+type PlanHoldingVerdict struct {
+	Check   string
+	Verdict string
+	Code    string `json:",omitempty"`
+	Message string `json:",omitempty"`
+}
+
+type PlanReport struct {
+	UUID    string
+	OK      bool
+	Holding []PlanHoldingVerdict
+	Files   []PlanFileVerdict
+}
+
+func (report *PlanReport) holdingCheck(check string, code string, err error) {
+	if err == nil {
+		report.Holding = append(report.Holding, PlanHoldingVerdict{Check: check, Verdict: planOK})
+		return
+	}
+	report.OK = false
+	report.Holding = append(report.Holding, PlanHoldingVerdict{check, planRejected, code, err.Error()})
+}
+
+type insufficientSpaceError struct {
+	need int64
+	free uint64
+}
+
+func (e *insufficientSpaceError) Error() string {
+	return fmt.Sprintf("The uploads need %d bytes but only %d are free", e.need, e.free)
+}
+
+type planError struct {
+	problem string
+}
+
+func (e *planError) Error() string {
+	return e.problem
+}
+
+// validChecksum reports whether sum looks like a hex digest of alg.
+func validChecksum(alg string, sum string) bool {
+	want := len(digestBytes(nil, []string{alg})[alg])
+	return len(sum) == want && strings.Trim(strings.ToLower(sum), "0123456789abcdef") == ""
+}
+
+// validatePlannedFile is the per-file part of trackUploadHandler's checks.
+// stored maps the stored names claimed so far by other files in the plan.
+func validatePlannedFile(f PlannedFile, musicDir string, existing Checksums, stored map[string]string) PlanFileVerdict {
+	verdict := PlanFileVerdict{Path: f.Path, Verdict: planRejected}
+	reject := func(code string, err error) PlanFileVerdict {
+		verdict.Code = code
+		verdict.Message = err.Error()
+		return verdict
+	}
+
+	if f.Path == "" || strings.HasSuffix(f.Path, "/") {
+		return reject("bad-path", &planError{"A file needs a name"})
+	}
+	if err := checkDotSegments(f.Path); err != nil {
+		return reject("bad-path", err)
+	}
+	storedName, err := applyPortableNames(f.Path)
+	if err != nil {
+		return reject("non-portable-name", err)
+	}
+	if storedName != f.Path {
+		verdict.StoredName = storedName
+	}
+	destPath := path.Join(musicDir, storedName)
+	if err := ensureInMusic(musicDir, destPath); err != nil {
+		return reject("unsafe-path", err)
+	}
+	rel := strings.TrimPrefix(destPath, musicDir+"/")
+	if other, ok := stored[strings.ToLower(rel)]; ok {
+		if other == rel || enforceCaseUniqueness() {
+			return reject("duplicate-in-plan", &planError{fmt.Sprintf("%s is also planned as %s", rel, other)})
+		}
+	}
+	stored[strings.ToLower(rel)] = rel
+
+	if f.Size < 0 {
+		return reject("bad-size", &planError{"Size can't be negative"})
+	} else if f.Size > config.Limits.MaxMusicBytes {
+		return reject("too-large", &tooLargeError{config.Limits.MaxMusicBytes})
+	}
+	for alg, sum := range f.Checksums {
+		alg = strings.ToLower(alg)
+		if _, ok := checksumAlgorithms[alg]; !ok {
+			return reject("unsupported-checksum", &unsupportedChecksumError{alg})
+		}
+		if !validChecksum(alg, sum) {
+			return reject("bad-checksum", &planError{"The " + alg + " checksum is not a hex digest"})
+		}
+	}
+
+	if enforceCaseUniqueness() {
+		err := checkCaseCollision(musicDir, destPath)
+		if _, ok := err.(*caseCollisionError); ok {
+			return reject("case-collision", err)
+		} else if err != nil {
+			return reject("storage-error", err)
+		}
+	}
+	if nerr, ok := asNotADirectory(statErr(destPath)); ok {
+		return reject(notADirectoryCode, nerr)
+	}
+
+	verdict.Verdict = planOK
+	if want := strings.ToLower(f.Checksums["sha256"]); want != "" {
+		if existing.Music[rel]["sha256"] == want {
+			verdict.Verdict = planWouldDedup
+			verdict.Existing = rel
+		} else {
+			names := []string{}
+			for name, sums := range existing.Music {
+				if sums["sha256"] == want {
+					names = append(names, name)
+				}
+			}
+			if len(names) > 0 {
+				sort.Strings(names)
+				verdict.Verdict = planWouldDedup
+				verdict.Existing = names[0]
+			}
+		}
+	}
+	return verdict
+}
+
+func statErr(p string) error {
+	_, err := os.Stat(p)
+	return err
+}
+
+func validatePlan(r *http.Request, uuid string, plan UploadPlan) (PlanReport, error) {
+	report := PlanReport{UUID: uuid, OK: true, Holding: []PlanHoldingVerdict{}, Files: []PlanFileVerdict{}}
+
+	werr := checkWritable(uuid)
+	code := "not-writable"
+	if _, ok := werr.(*notOwnedError); ok {
+		code = "not-owned"
+	}
+	report.holdingCheck("writable", code, werr)
+
+	dir := uuidToPath(config.LibraryPath, uuid)
+	if _, err := os.Stat(path.Join(dir, lockFileName)); err == nil {
+		report.holdingCheck("lock", "locked", &lockExistsError{uuid})
+	} else if err := checkLockProposal(uuid, dir); err != nil {
+		if _, ok := err.(*lockProposedError); !ok {
+			return report, err
+		}
+		report.holdingCheck("lock", "lock-proposed", err)
+	} else {
+		report.holdingCheck("lock", "", nil)
+	}
+
+	musicDir := path.Join(dir, "music")
+	existing, err := readChecksums(dir)
+	if err != nil {
+		return report, err
+	}
+	stored := map[string]string{}
+	newFiles := 0
+	var need int64
+	for _, f := range plan.Files {
+		verdict := validatePlannedFile(f, musicDir, existing, stored)
+		if verdict.Verdict == planRejected {
+			report.OK = false
+		} else if verdict.Verdict == planOK {
+			need += f.Size
+			name := verdict.StoredName
+			if name == "" {
+				name = f.Path
+			}
+			if _, err := os.Stat(path.Join(musicDir, name)); os.IsNotExist(err) {
+				newFiles++
+			}
+		}
+		report.Files = append(report.Files, verdict)
+	}
+
+	count, err := countFiles(musicDir)
+	if err != nil {
+		return report, err
+	}
+	var ferr error
+	if count+newFiles > config.Limits.MaxHoldingFiles {
+		ferr = &tooManyFilesError{uuid, config.Limits.MaxHoldingFiles}
+	}
+	report.holdingCheck("file-count", "too-many-files", ferr)
+
+	var serr error
+	free, err := libraryFreeSpace()
+	if err != nil {
+		return report, err
+	}
+	if config.ReclaimOnLowSpace {
+		free += uint64(reclaimable().Total)
+	}
+	if uint64(need) > free {
+		serr = &insufficientSpaceError{need, free}
+	}
+	report.holdingCheck("free-space", "insufficient-space", serr)
+
+	var qerr error
+	role := authenticate(r)
+	user, _, _ := r.BasicAuth()
+	if quota := quotaFor(user, role); quota > 0 && r.Header.Get(replicationHeader) == "" {
+		now := time.Now()
+		if used, resetsAt := usageOf(user, quota, need, now); used+need > quota {
+			qerr = &quotaExceededError{user, quota, resetsAt}
+		}
+	}
+	report.holdingCheck("quota", "quota-exceeded", qerr)
+	return report, nil
+}
+
+// validateHandler handles POST /UUID4/validate.
+func validateHandler(w http.ResponseWriter, r *http.Request, uuid string) {
+	if !checkAuth(w, r) {
+		return
+	}
+	if err := uuidSanityCheck(uuid); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	body, ok := readUpload(w, r)
+	if !ok {
+		return
+	}
+	plan := UploadPlan{}
+	if err := json.Unmarshal(body, &plan); err != nil {
+		http.Error(w, `Expected {"Files": [{"Path": ..., "Size": ..., "Checksums": {...}}]}: `+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(plan.Files) > config.Limits.MaxHoldingFiles {
+		berr := &batchTooLargeError{len(plan.Files), config.Limits.MaxHoldingFiles}
+		http.Error(w, berr.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	report, err := validatePlan(r, uuid, plan)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	js, err := json.Marshal(report)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+)
+
+// POST /UUID4/verify re-hashes a locked holding's files and compares them
+// with the manifest recorded when it was locked, or with checksums.json for
+// locks made before manifests existed. Files are streamed through the hash,
+// and the check stops when the client goes away.
+type VerifyFile struct {
+	Path string
+	// ok, mismatched, missing or extra
+	Status   string
+	Size     int64  `json:",omitempty"`
+	Expected string `json:",omitempty"`
+	Found    string `json:",omitempty"`
+}
+
+type VerifyReport struct {
+	UUID string
+	// manifest, or checksums for locks without one
+	Against    string
+	Intact     bool
+	OK         int
+	Mismatched int
+	Missing    int
+	Extra      int
+	Files      []VerifyFile
+}
+
+type notLockedError struct {
+	uuid string
+}
+
+func (e *notLockedError) Error() string {
+	return e.uuid + " has never been locked, so there is no manifest to verify it against"
+}
+
+// contextReader stops a read once its request has been cancelled.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+func hashFileContext(ctx context.Context, p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, &contextReader{ctx, f}); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// expectedFiles returns the SHA-256 each file should have, keyed by
+// music/TRACK or albumart, and what they came from.
+func expectedFiles(dir string, lock LockInfo) (map[string]string, string, error) {
+	expected := map[string]string{}
+	if len(lock.Files) > 0 {
+		for _, f := range lock.Files {
+			expected[f.Path] = f.SHA256
+		}
+		return expected, "manifest", nil
+	}
+	sums, err := readChecksums(dir)
+	if err != nil {
+		return nil, "", err
+	}
+	for rel, digests := range sums.Music {
+		expected[path.Join("music", rel)] = digests["sha256"]
+	}
+	if len(sums.AlbumArt) > 0 {
+		expected["albumart"] = sums.AlbumArt["sha256"]
+	}
+	return expected, "checksums", nil
+}
+
+// checkHoldingIntact compares a locked holding's files with what was recorded
+// when it was locked.
+func checkHoldingIntact(ctx context.Context, uuid string, dir string) (VerifyReport, error) {
+	report := VerifyReport{UUID: uuid, Files: []VerifyFile{}}
+	lock, err := readLockInfo(dir)
+	if os.IsNotExist(err) {
+		return report, &notLockedError{uuid}
+	} else if err != nil {
+		return report, err
+	}
+	expected, against, err := expectedFiles(dir, lock)
+	if err != nil {
+		return report, err
+	}
+	report.Against = against
+
+	present := []string{}
+	err = walkFiles(path.Join(dir, "music"), func(rel string) error {
+		present = append(present, path.Join("music", rel))
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	if _, err := os.Stat(path.Join(dir, "albumart")); err == nil {
+		present = append(present, "albumart")
+	}
+
+	seen := map[string]bool{}
+	for _, rel := range present {
+		seen[rel] = true
+		file := VerifyFile{Path: rel, Expected: expected[rel]}
+		if stat, err := os.Stat(path.Join(dir, rel)); err == nil {
+			file.Size = stat.Size()
+		}
+		want, known := expected[rel]
+		if !known {
+			file.Status = "extra"
+			report.Extra++
+			report.Files = append(report.Files, file)
+			continue
+		}
+		found, err := hashFileContext(ctx, path.Join(dir, rel))
+		if err != nil {
+			return report, err
+		}
+		file.Found = found
+		if found == want {
+			file.Status = "ok"
+			report.OK++
+		} else {
+			file.Status = "mismatched"
+			report.Mismatched++
+		}
+		report.Files = append(report.Files, file)
+	}
+	for rel, want := range expected {
+		if !seen[rel] {
+			report.Files = append(report.Files, VerifyFile{Path: rel, Status: "missing", Expected: want})
+			report.Missing++
+		}
+	}
+	sort.Slice(report.Files, func(i, j int) bool { return report.Files[i].Path < report.Files[j].Path })
+	report.Intact = report.Mismatched == 0 && report.Missing == 0 && report.Extra == 0
+	return report, nil
+}
+
+// verifyHandler handles POST /UUID4/verify.
+func verifyHandler(w http.ResponseWriter, r *http.Request, uuid string) {
+	if !checkAuth(w, r) {
+		return
+	}
+	if err := uuidSanityCheck(uuid); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dir := holdingDir(uuid)
+	if !dirExists(dir) {
+		http.Error(w, "holding not found on disk", http.StatusNotFound)
+		return
+	}
+	report, err := checkHoldingIntact(r.Context(), uuid, dir)
+	if _, ok := err.(*notLockedError); ok {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if r.Context().Err() != nil {
+		log.Printf("Verify of %s given up, the client went away\n", uuid)
+		return
+	} else if err != nil {
+		storageError(w, err)
+		return
+	}
+	if !report.Intact {
+		log.Printf("Verify of %s: %d mismatched, %d missing, %d extra\n", uuid, report.Mismatched, report.Missing, report.Extra)
+	}
+	js, err := json.Marshal(report)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+)
+
+// Directory entries are read this many at a time so a holding with tens of
+// thousands of files never has to be held in memory as os.FileInfo values.
+const readdirBatch = 256
+
+type tooManyFilesError struct {
+	uuid  string
+	limit int
+}
+
+func (e *tooManyFilesError) Error() string {
+	return fmt.Sprintf("%s already holds the maximum of %d files", e.uuid, e.limit)
+}
+
+// walkFiles calls fn with the slash-separated path, relative to root, of every
+// non-directory entry below root. A missing root is treated as empty; any
+// other error, including a file or directory below it going missing partway
+// through or one returned by fn, is passed on.
+func walkFiles(root string, fn func(rel string) error) error {
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return walkFilesRel(root, "", fn)
+}
+
+func walkFilesRel(root string, rel string, fn func(rel string) error) error {
+	dir, err := os.Open(path.Join(root, rel))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	for {
+		dirEnts, err := dir.ReadDir(readdirBatch)
+		for _, dirEnt := range dirEnts {
+			name := path.Join(rel, dirEnt.Name())
+			if dirEnt.IsDir() {
+				if err := walkFilesRel(root, name, fn); err != nil {
+					return err
+				}
+			} else if err := fn(name); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func countFiles(root string) (int, error) {
+	count := 0
+	err := walkFiles(root, func(rel string) error {
+		count++
+		return nil
+	})
+	return count, err
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"runtime"
+	"syscall"
+	"testing"
+
+	"github.com/wuvt/moss/mosstest"
+)
+
+// makeManyFiles creates n empty files under dir: most of them side by side,
+// the rest one to a directory down a chain depth deep.
+func makeManyFiles(t testing.TB, dir string, n int, depth int) {
+	t.Helper()
+	nested := dir
+	for i := 0; i < depth; i++ {
+		nested = path.Join(nested, fmt.Sprintf("d%02d", i))
+		writeTestFile(t, path.Join(nested, "deep.flac"), nil)
+	}
+	for i := 0; i < n-depth; i++ {
+		f, err := os.Create(path.Join(dir, fmt.Sprintf("%05d.flac", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+}
+
+func openFiles(t testing.TB) int {
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("no /proc/self/fd to count open files with")
+	}
+	return len(fds)
+}
+
+func liveHeap() uint64 {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc
+}
+
+// walkFiles reads a directory of 40,000 files a batch at a time, holding
+// one descriptor per directory it's in and none for the files.
+func TestWalkFilesBounded(t *testing.T) {
+	const (
+		files = 40000
+		depth = 16
+	)
+	root := t.TempDir()
+	makeManyFiles(t, root, files, depth)
+
+	fdsBefore := openFiles(t)
+	heapBefore := liveHeap()
+	maxFds, maxHeap := 0, uint64(0)
+	seen := 0
+	err := walkFiles(root, func(rel string) error {
+		seen++
+		if seen%500 == 0 || path.Base(rel) == "deep.flac" {
+			if fds := openFiles(t); fds > maxFds {
+				maxFds = fds
+			}
+		}
+		if seen%4000 == 0 {
+			if heap := liveHeap(); heap > maxHeap {
+				maxHeap = heap
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seen != files {
+		t.Errorf("walked %d files of %d", seen, files)
+	}
+	// One for each directory down to the deepest, and one for reading
+	// /proc/self/fd
+	if extra := maxFds - fdsBefore; extra > depth+2 {
+		t.Errorf("walking held %d more files open, for a tree %d deep", extra, depth)
+	}
+	// A listing of every entry at once would be several megabytes
+	if maxHeap > heapBefore && maxHeap-heapBefore > 1<<20 {
+		t.Errorf("walking grew the live heap by %d bytes", maxHeap-heapBefore)
+	}
+}
+
+// A holding of thousands of files can be listed and archived with far fewer
+// descriptors to spare, since the archive opens its files one at a time.
+func TestManyFileHoldingFdLimit(t *testing.T) {
+	const files = 3000
+	s := newTestServer(t, mosstest.Spec{Holdings: []mosstest.Holding{{Tracks: []mosstest.Track{{Name: "upload.flac"}}}}})
+	makeManyFiles(t, path.Join(holdingDir(s.Holdings[0].UUID), "music"), files, 4)
+
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		t.Fatal(err)
+	}
+	lowered := limit
+	lowered.Cur = uint64(openFiles(t) + 64)
+	if lowered.Cur >= limit.Cur {
+		t.Skip("the open file limit is already low")
+	}
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &lowered); err != nil {
+		t.Skip("can't lower the open file limit: " + err.Error())
+	}
+	defer syscall.Setrlimit(syscall.RLIMIT_NOFILE, &limit)
+
+	s.MustDo("GET", s.Path(0), nil)
+	resp := s.MustDo("GET", s.Path(0, "archive")+"?format=tar", nil)
+	entries := 0
+	tr := tar.NewReader(bytes.NewReader(resp.Body))
+	for {
+		if _, err := tr.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		entries++
+	}
+	if entries != files+1 {
+		t.Errorf("the archive has %d entries, want %d", entries, files+1)
+	}
+}